@@ -26,6 +26,14 @@ func init() {
 func main() {
 	printInfo()
 
+	// Metrics of file storage and database are copied by `server copy` without starting server
+	if len(os.Args) > 1 && os.Args[1] == "copy" {
+		if err := server.RunCopy(os.Args[2:]); err != nil {
+			log.Fatal().Err(err).Msg("copy failed")
+		}
+		return
+	}
+
 	server.Run()
 }
 
@@ -20,6 +20,7 @@ const (
 	DefaultCryptoKey      = ""
 	DefaultConfigPath     = ""
 	DefaultTransport      = "rest"
+	DefaultAPIKey         = ""
 )
 
 // ClientConfig structure define
@@ -32,6 +33,7 @@ type ClientConfig struct {
 	CryptoKey      string `json:"crypto_key" env:"CRYPTO_KEY"`           // Path to file with public crypto key
 	ConfigPath     string `env:"CONFIG"`                                 // Path to JSON file with configuration
 	Transport      string `env:"TRANSPORT"`                              // Chose transport "grpc" or "rest"
+	APIKey         string `json:"api_key" env:"API_KEY"`                 // API key of tenant, which owns reported metrics
 }
 
 // GetClientConfig allow to get ClientConfig
@@ -46,6 +48,7 @@ func GetClientConfig() (ClientConfig, error) {
 	flag.StringVar(&cfg.CryptoKey, "crypto-key", DefaultCryptoKey, "Path to public crypto key")
 	flag.StringVar(&cfg.ConfigPath, "c", DefaultConfigPath, "Path to config file")
 	flag.StringVar(&cfg.Transport, "t", DefaultTransport, "Transport to use (`grpc` or `rest`)")
+	flag.StringVar(&cfg.APIKey, "api-key", DefaultAPIKey, "API key of tenant")
 	flag.Parse()
 
 	envConfigPath := os.Getenv("CONFIG")
@@ -101,6 +104,10 @@ func GetClientConfig() (ClientConfig, error) {
 		cfg.Transport = envTransport
 	}
 
+	if envAPIKey := os.Getenv("API_KEY"); envAPIKey != "" {
+		cfg.APIKey = envAPIKey
+	}
+
 	// Validations
 	if cfg.PollInterval <= 0 || cfg.PollInterval > 100 {
 		return ClientConfig{}, fmt.Errorf("wrong value PollInterval: %d. Must be: 0 < PollInterval <= 100", cfg.PollInterval)
@@ -169,4 +176,7 @@ func mergeConfig(cfg *ClientConfig, fileCfg ClientConfig) {
 	if cfg.Transport == DefaultTransport && fileCfg.Transport != "" {
 		cfg.Transport = fileCfg.Transport
 	}
+	if cfg.APIKey == DefaultAPIKey && fileCfg.APIKey != "" {
+		cfg.APIKey = fileCfg.APIKey
+	}
 }
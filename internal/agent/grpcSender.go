@@ -7,6 +7,7 @@ import (
 	pb "github.com/melkomukovki/go-musthave-metrics/internal/proto"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
 	"time"
 )
 
@@ -45,6 +46,9 @@ func (g *GRPCMetricSender) SendMetrics(metrics []entities.Metric) error {
 	}
 
 	req := &pb.AddMetricsRequest{Metrics: protoMetrics}
+	if g.config.APIKey != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, "x-api-key", g.config.APIKey)
+	}
 
 	_, err := g.client.AddMetrics(ctx, req)
 	if err != nil {
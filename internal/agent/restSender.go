@@ -64,6 +64,9 @@ func (r *RestMetricSender) SendMetrics(metrics []entities.Metric) error {
 	if r.ipAddress != "" {
 		headers["X-Real-IP"] = r.ipAddress
 	}
+	if r.config.APIKey != "" {
+		headers["X-API-Key"] = r.config.APIKey
+	}
 
 	mMarshaled, err := json.Marshal(metrics)
 	if err != nil {
@@ -10,34 +10,79 @@ import (
 	"os"
 	"strconv"
 	"strings"
+
+	"github.com/melkomukovki/go-musthave-metrics/internal/entities"
+	"github.com/melkomukovki/go-musthave-metrics/internal/influx"
 )
 
 // Default server config settings
 const (
-	DefaultAddress         = "localhost:8080" // Server address
-	DefaultGrpcAddress     = ""               // Grpc server address
-	DefaultStoreInterval   = 300              // Store interval in seconds
-	DefaultFileStoragePath = "metrics.json"   // Path to storage file
-	DefaultRestore         = true             // Restore metrics from file
-	DefaultDSN             = ""               // DSN connection string
-	DefaultHashKey         = ""               // Secret string for hashing messages
-	DefaultCryptoKey       = ""               // Path to file with private key
-	DefaultConfigPath      = ""               // Path to json config file
-	DefaultTrustedSubnet   = ""               // Trusted subnet, block request from different subnets
+	DefaultAddress            = "localhost:8080" // Server address
+	DefaultGrpcAddress        = ""               // Grpc server address
+	DefaultMetricsAddress     = ""               // Address of Prometheus exposition endpoint, served on server address if empty
+	DefaultStatsdAddress      = ""               // UDP and TCP address of StatsD listener, listener is disabled if empty
+	DefaultStatsdFlush        = 10               // Interval between writes of aggregated StatsD metrics in seconds
+	DefaultGraphiteAddress    = ""               // TCP address of Graphite plaintext listener, listener is disabled if empty
+	DefaultGraphiteRules      = ""               // Type rules of Graphite paths, all paths are gauges if empty
+	DefaultInfluxIntegerRules = ""               // Type rules of InfluxDB integer fields, all integers are gauges if empty
+	DefaultInfluxTags         = "labels"         // Conversion of InfluxDB tags: labels or suffix of metric name
+	DefaultStoreInterval      = 300              // Store interval in seconds
+	DefaultFileStoragePath    = "metrics.json"   // Path to storage file
+	DefaultStoreGenerations   = 3                // Number of kept storage file generations
+	DefaultRestore            = true             // Restore metrics from file
+	DefaultDSN                = ""               // DSN connection string
+	DefaultHashKey            = ""               // Secret string for hashing messages
+	DefaultCryptoKey          = ""               // Path to file with private key
+	DefaultConfigPath         = ""               // Path to json config file
+	DefaultTrustedSubnet      = ""               // Trusted subnet, block request from different subnets
+	DefaultMigrateOnly        = false            // Apply database migrations and exit
+	DefaultMigrateDown        = 0                // Number of database migrations to revert before exit
+	DefaultAPIKeys            = ""               // Comma separated `key:tenant` pairs, tenants are disabled if empty
+	DefaultRetentionRules     = ""               // Retention rules, metrics are kept forever if empty
+	DefaultRetentionInterval  = 60               // Interval between retention runs in seconds
+	DefaultCacheFlushInterval = 0                // Interval between flushes of write-behind cache in seconds, cache is disabled if zero
+	DefaultCacheMaxDirty      = 10000            // Number of pending changes of write-behind cache, after which writers flush them
+	DefaultJournalPath        = ""               // Path to journal of writes made while database is unavailable, journal is disabled if empty
+	DefaultJournalMaxSize     = 64               // Maximum size of journal in megabytes
+	DefaultDualWrite          = ""               // Primary storage of dual-write mode, dual-write is disabled if empty
+)
+
+// Primary storages of dual-write mode, the other storage receives copies of changes
+const (
+	DualWriteFile     = "file"     // Metrics are served from file storage, changes are mirrored to database
+	DualWriteDatabase = "database" // Metrics are served from database, changes are mirrored to file storage
 )
 
 // ServerConfig server config structure
 type ServerConfig struct {
-	Address         string `json:"address" env:"ADDRESS"`
-	GrpcAddress     string `json:"grpc_address" env:"GRPC_ADDRESS"`
-	StoreInterval   int    `json:"store_interval" env:"STORE_INTERVAL"`
-	FileStoragePath string `json:"file_storage_path" env:"FILE_STORAGE_PATH"`
-	Restore         bool   `json:"restore" env:"RESTORE"`
-	DataSourceName  string `json:"database_dsn" env:"DATABASE_DSN"`
-	HashKey         string `json:"key" env:"KEY"`
-	CryptoKey       string `json:"crypto_key" env:"CRYPTO_KEY"`
-	ConfigPath      string `env:"CONFIG"`
-	TrustedSubnet   string `json:"trusted_subnet" env:"TRUSTED_SUBNETS"`
+	Address            string `json:"address" env:"ADDRESS"`
+	GrpcAddress        string `json:"grpc_address" env:"GRPC_ADDRESS"`
+	MetricsAddress     string `json:"metrics_address" env:"METRICS_ADDRESS"`
+	StatsdAddress      string `json:"statsd_address" env:"STATSD_ADDRESS"`
+	StatsdFlush        int    `json:"statsd_flush_interval" env:"STATSD_FLUSH_INTERVAL"`
+	GraphiteAddress    string `json:"graphite_address" env:"GRAPHITE_ADDRESS"`
+	GraphiteRules      string `json:"graphite_rules" env:"GRAPHITE_RULES"`
+	InfluxIntegerRules string `json:"influx_integer_rules" env:"INFLUX_INTEGER_RULES"`
+	InfluxTags         string `json:"influx_tags" env:"INFLUX_TAGS"`
+	StoreInterval      int    `json:"store_interval" env:"STORE_INTERVAL"`
+	FileStoragePath    string `json:"file_storage_path" env:"FILE_STORAGE_PATH"`
+	StoreGenerations   int    `json:"store_generations" env:"STORE_GENERATIONS"`
+	Restore            bool   `json:"restore" env:"RESTORE"`
+	DataSourceName     string `json:"database_dsn" env:"DATABASE_DSN"`
+	HashKey            string `json:"key" env:"KEY"`
+	CryptoKey          string `json:"crypto_key" env:"CRYPTO_KEY"`
+	ConfigPath         string `env:"CONFIG"`
+	TrustedSubnet      string `json:"trusted_subnet" env:"TRUSTED_SUBNETS"`
+	MigrateOnly        bool   `env:"MIGRATE_ONLY"`
+	MigrateDown        int    `env:"MIGRATE_DOWN"`
+	APIKeys            string `json:"api_keys" env:"API_KEYS"`
+	RetentionRules     string `json:"retention_rules" env:"RETENTION_RULES"`
+	RetentionInterval  int    `json:"retention_interval" env:"RETENTION_INTERVAL"`
+	CacheFlushInterval int    `json:"cache_flush_interval" env:"CACHE_FLUSH_INTERVAL"`
+	CacheMaxDirty      int    `json:"cache_max_dirty" env:"CACHE_MAX_DIRTY"`
+	JournalPath        string `json:"journal_path" env:"JOURNAL_PATH"`
+	JournalMaxSize     int    `json:"journal_max_size" env:"JOURNAL_MAX_SIZE"`
+	DualWrite          string `json:"dual_write" env:"DUAL_WRITE"`
 }
 
 // GetServerConfig allows to get instance of ServerConfig
@@ -46,14 +91,32 @@ func GetServerConfig() (ServerConfig, error) {
 
 	flag.StringVar(&cfg.Address, "a", DefaultAddress, "Server address and port")
 	flag.StringVar(&cfg.GrpcAddress, "g", DefaultGrpcAddress, "gRPC server address")
+	flag.StringVar(&cfg.MetricsAddress, "metrics-address", DefaultMetricsAddress, "Separate address of Prometheus `/metrics` endpoint")
+	flag.StringVar(&cfg.StatsdAddress, "statsd-address", DefaultStatsdAddress, "UDP and TCP address of StatsD listener")
+	flag.IntVar(&cfg.StatsdFlush, "statsd-flush-interval", DefaultStatsdFlush, "Interval between writes of aggregated StatsD metrics (sec)")
+	flag.StringVar(&cfg.GraphiteAddress, "graphite-address", DefaultGraphiteAddress, "TCP address of Graphite plaintext listener")
+	flag.StringVar(&cfg.GraphiteRules, "graphite-rules", DefaultGraphiteRules, "Type rules of Graphite paths, e.g. `path=*.interface-*.if_octets.*,type=counter`")
+	flag.StringVar(&cfg.InfluxIntegerRules, "influx-integer-rules", DefaultInfluxIntegerRules, "Type rules of InfluxDB integer fields, e.g. `name=net_bytes_*,type=counter`")
+	flag.StringVar(&cfg.InfluxTags, "influx-tags", DefaultInfluxTags, "Convert InfluxDB tags to `labels` or `suffix` of metric name")
 	flag.IntVar(&cfg.StoreInterval, "i", DefaultStoreInterval, "Store interval")
 	flag.StringVar(&cfg.FileStoragePath, "f", DefaultFileStoragePath, "File with metrics")
+	flag.IntVar(&cfg.StoreGenerations, "store-generations", DefaultStoreGenerations, "Number of kept storage file generations")
 	flag.BoolVar(&cfg.Restore, "r", DefaultRestore, "Restore from file (bool)")
 	flag.StringVar(&cfg.DataSourceName, "d", DefaultDSN, "Database DSN")
 	flag.StringVar(&cfg.HashKey, "k", DefaultHashKey, "Hash key for calculation HashSHA256 header")
 	flag.StringVar(&cfg.CryptoKey, "crypto-key", DefaultCryptoKey, "Path to private crypto key")
 	flag.StringVar(&cfg.ConfigPath, "c", DefaultConfigPath, "Configuration file path")
 	flag.StringVar(&cfg.TrustedSubnet, "t", DefaultTrustedSubnet, "Trusted subnet")
+	flag.BoolVar(&cfg.MigrateOnly, "migrate-only", DefaultMigrateOnly, "Apply database migrations and exit")
+	flag.IntVar(&cfg.MigrateDown, "migrate-down", DefaultMigrateDown, "Revert given number of database migrations and exit")
+	flag.StringVar(&cfg.APIKeys, "api-keys", DefaultAPIKeys, "Comma separated `key:tenant` pairs of API keys")
+	flag.StringVar(&cfg.RetentionRules, "retention-rules", DefaultRetentionRules, "Retention rules, e.g. `type=gauge,ttl=24h;name=Poll*,history=7d`")
+	flag.IntVar(&cfg.RetentionInterval, "retention-interval", DefaultRetentionInterval, "Interval between retention runs (sec)")
+	flag.IntVar(&cfg.CacheFlushInterval, "cache-flush-interval", DefaultCacheFlushInterval, "Flush interval of write-behind cache in front of database (sec), 0 disables cache")
+	flag.IntVar(&cfg.CacheMaxDirty, "cache-max-dirty", DefaultCacheMaxDirty, "Number of pending changes of write-behind cache, after which writers flush them")
+	flag.StringVar(&cfg.JournalPath, "journal-path", DefaultJournalPath, "Journal of writes made while database is unavailable, empty disables journal")
+	flag.IntVar(&cfg.JournalMaxSize, "journal-max-size", DefaultJournalMaxSize, "Maximum size of journal (MB)")
+	flag.StringVar(&cfg.DualWrite, "dual-write", DefaultDualWrite, "Write to both file storage and database, serving metrics from `file` or `database`")
 	flag.Parse()
 
 	envConfigPath := os.Getenv("CONFIG")
@@ -82,6 +145,13 @@ func GetServerConfig() (ServerConfig, error) {
 	if envFileStorePath := os.Getenv("FILE_STORAGE_PATH"); envFileStorePath != "" {
 		cfg.FileStoragePath = envFileStorePath
 	}
+	if envStoreGenerations := os.Getenv("STORE_GENERATIONS"); envStoreGenerations != "" {
+		iStoreGenerations, err := strconv.Atoi(envStoreGenerations)
+		if err != nil || iStoreGenerations < 1 {
+			return ServerConfig{}, fmt.Errorf("invalid value for env variable `STORE_GENERATIONS`")
+		}
+		cfg.StoreGenerations = iStoreGenerations
+	}
 	if envRestore := os.Getenv("RESTORE"); envRestore != "" {
 		if strings.ToLower(envRestore) == "true" {
 			cfg.Restore = true
@@ -111,6 +181,109 @@ func GetServerConfig() (ServerConfig, error) {
 		cfg.GrpcAddress = envGrpcAddress
 	}
 
+	if envMetricsAddress := os.Getenv("METRICS_ADDRESS"); envMetricsAddress != "" {
+		cfg.MetricsAddress = envMetricsAddress
+	}
+
+	if envStatsdAddress := os.Getenv("STATSD_ADDRESS"); envStatsdAddress != "" {
+		cfg.StatsdAddress = envStatsdAddress
+	}
+
+	if envStatsdFlush := os.Getenv("STATSD_FLUSH_INTERVAL"); envStatsdFlush != "" {
+		iStatsdFlush, err := strconv.Atoi(envStatsdFlush)
+		if err != nil || iStatsdFlush < 1 {
+			return ServerConfig{}, fmt.Errorf("invalid value for env variable `STATSD_FLUSH_INTERVAL`")
+		}
+		cfg.StatsdFlush = iStatsdFlush
+	}
+
+	if envGraphiteAddress := os.Getenv("GRAPHITE_ADDRESS"); envGraphiteAddress != "" {
+		cfg.GraphiteAddress = envGraphiteAddress
+	}
+
+	if envGraphiteRules := os.Getenv("GRAPHITE_RULES"); envGraphiteRules != "" {
+		cfg.GraphiteRules = envGraphiteRules
+	}
+
+	if envInfluxIntegerRules := os.Getenv("INFLUX_INTEGER_RULES"); envInfluxIntegerRules != "" {
+		cfg.InfluxIntegerRules = envInfluxIntegerRules
+	}
+
+	if envInfluxTags := os.Getenv("INFLUX_TAGS"); envInfluxTags != "" {
+		cfg.InfluxTags = envInfluxTags
+	}
+
+	if envMigrateOnly := os.Getenv("MIGRATE_ONLY"); envMigrateOnly != "" {
+		if strings.ToLower(envMigrateOnly) == "true" {
+			cfg.MigrateOnly = true
+		} else if strings.ToLower(envMigrateOnly) == "false" {
+			cfg.MigrateOnly = false
+		} else {
+			return ServerConfig{}, fmt.Errorf("invalid value for env variable `MIGRATE_ONLY`")
+		}
+	}
+
+	if envMigrateDown := os.Getenv("MIGRATE_DOWN"); envMigrateDown != "" {
+		iMigrateDown, err := strconv.Atoi(envMigrateDown)
+		if err != nil {
+			return ServerConfig{}, fmt.Errorf("invalid value for env variable `MIGRATE_DOWN`")
+		}
+		cfg.MigrateDown = iMigrateDown
+	}
+
+	if envAPIKeys := os.Getenv("API_KEYS"); envAPIKeys != "" {
+		cfg.APIKeys = envAPIKeys
+	}
+
+	if envRetentionRules := os.Getenv("RETENTION_RULES"); envRetentionRules != "" {
+		cfg.RetentionRules = envRetentionRules
+	}
+
+	if envRetentionInterval := os.Getenv("RETENTION_INTERVAL"); envRetentionInterval != "" {
+		iRetentionInterval, err := strconv.Atoi(envRetentionInterval)
+		if err != nil || iRetentionInterval < 1 {
+			return ServerConfig{}, fmt.Errorf("invalid value for env variable `RETENTION_INTERVAL`")
+		}
+		cfg.RetentionInterval = iRetentionInterval
+	}
+
+	if envCacheFlushInterval := os.Getenv("CACHE_FLUSH_INTERVAL"); envCacheFlushInterval != "" {
+		iCacheFlushInterval, err := strconv.Atoi(envCacheFlushInterval)
+		if err != nil || iCacheFlushInterval < 0 {
+			return ServerConfig{}, fmt.Errorf("invalid value for env variable `CACHE_FLUSH_INTERVAL`")
+		}
+		cfg.CacheFlushInterval = iCacheFlushInterval
+	}
+
+	if envCacheMaxDirty := os.Getenv("CACHE_MAX_DIRTY"); envCacheMaxDirty != "" {
+		iCacheMaxDirty, err := strconv.Atoi(envCacheMaxDirty)
+		if err != nil || iCacheMaxDirty < 1 {
+			return ServerConfig{}, fmt.Errorf("invalid value for env variable `CACHE_MAX_DIRTY`")
+		}
+		cfg.CacheMaxDirty = iCacheMaxDirty
+	}
+
+	if envJournalPath, ok := os.LookupEnv("JOURNAL_PATH"); ok {
+		cfg.JournalPath = envJournalPath
+	}
+
+	if envJournalMaxSize := os.Getenv("JOURNAL_MAX_SIZE"); envJournalMaxSize != "" {
+		iJournalMaxSize, err := strconv.Atoi(envJournalMaxSize)
+		if err != nil || iJournalMaxSize < 1 {
+			return ServerConfig{}, fmt.Errorf("invalid value for env variable `JOURNAL_MAX_SIZE`")
+		}
+		cfg.JournalMaxSize = iJournalMaxSize
+	}
+
+	if envDualWrite := os.Getenv("DUAL_WRITE"); envDualWrite != "" {
+		cfg.DualWrite = envDualWrite
+	}
+
+	// Migration modes work only with database
+	if (cfg.MigrateOnly || cfg.MigrateDown > 0) && cfg.DataSourceName == "" {
+		return ServerConfig{}, fmt.Errorf("database DSN is required to run migrations")
+	}
+
 	// Validate file path and create if not exists
 	if cfg.DataSourceName != "" {
 		_, err := os.Stat(cfg.FileStoragePath)
@@ -136,6 +309,58 @@ func GetServerConfig() (ServerConfig, error) {
 		}
 	}
 
+	// Validate API keys
+	if _, err := entities.ParseAPIKeys(cfg.APIKeys); err != nil {
+		return ServerConfig{}, err
+	}
+
+	// Validate retention rules
+	if _, err := entities.ParseRetentionRules(cfg.RetentionRules); err != nil {
+		return ServerConfig{}, err
+	}
+	if cfg.RetentionInterval < 1 {
+		return ServerConfig{}, fmt.Errorf("retention interval must be positive")
+	}
+
+	// Validate write-behind cache settings
+	if cfg.CacheFlushInterval < 0 || cfg.CacheMaxDirty < 1 {
+		return ServerConfig{}, fmt.Errorf("cache flush interval must not be negative and max dirty must be positive")
+	}
+
+	// Validate journal settings
+	if cfg.JournalMaxSize < 1 {
+		return ServerConfig{}, fmt.Errorf("journal max size must be positive")
+	}
+
+	// Validate dual-write mode
+	switch cfg.DualWrite {
+	case DefaultDualWrite:
+	case DualWriteFile, DualWriteDatabase:
+		if cfg.DataSourceName == "" || cfg.FileStoragePath == "" {
+			return ServerConfig{}, fmt.Errorf("dual-write requires both database DSN and file storage path")
+		}
+	default:
+		return ServerConfig{}, fmt.Errorf("invalid dual-write primary storage: %s", cfg.DualWrite)
+	}
+
+	// Validate StatsD listener settings
+	if cfg.StatsdFlush < 1 {
+		return ServerConfig{}, fmt.Errorf("StatsD flush interval must be positive")
+	}
+
+	// Validate Graphite rules
+	if _, err := entities.ParseGraphiteRules(cfg.GraphiteRules); err != nil {
+		return ServerConfig{}, err
+	}
+
+	// Validate InfluxDB conversion settings
+	if _, err := entities.ParseInfluxIntegerRules(cfg.InfluxIntegerRules); err != nil {
+		return ServerConfig{}, err
+	}
+	if cfg.InfluxTags != influx.TagsAsLabels && cfg.InfluxTags != influx.TagsAsSuffix {
+		return ServerConfig{}, fmt.Errorf("invalid conversion of InfluxDB tags: %s", cfg.InfluxTags)
+	}
+
 	// Validate trusted subnet
 	if cfg.TrustedSubnet != "" {
 		_, _, err := net.ParseCIDR(cfg.TrustedSubnet)
@@ -175,12 +400,36 @@ func mergeConfig(cfg *ServerConfig, fileCfg ServerConfig) {
 	if cfg.GrpcAddress == DefaultGrpcAddress && fileCfg.GrpcAddress != "" {
 		cfg.GrpcAddress = fileCfg.GrpcAddress
 	}
+	if cfg.MetricsAddress == DefaultMetricsAddress && fileCfg.MetricsAddress != "" {
+		cfg.MetricsAddress = fileCfg.MetricsAddress
+	}
+	if cfg.StatsdAddress == DefaultStatsdAddress && fileCfg.StatsdAddress != "" {
+		cfg.StatsdAddress = fileCfg.StatsdAddress
+	}
+	if cfg.StatsdFlush == DefaultStatsdFlush && fileCfg.StatsdFlush != 0 {
+		cfg.StatsdFlush = fileCfg.StatsdFlush
+	}
+	if cfg.GraphiteAddress == DefaultGraphiteAddress && fileCfg.GraphiteAddress != "" {
+		cfg.GraphiteAddress = fileCfg.GraphiteAddress
+	}
+	if cfg.GraphiteRules == DefaultGraphiteRules && fileCfg.GraphiteRules != "" {
+		cfg.GraphiteRules = fileCfg.GraphiteRules
+	}
+	if cfg.InfluxIntegerRules == DefaultInfluxIntegerRules && fileCfg.InfluxIntegerRules != "" {
+		cfg.InfluxIntegerRules = fileCfg.InfluxIntegerRules
+	}
+	if cfg.InfluxTags == DefaultInfluxTags && fileCfg.InfluxTags != "" {
+		cfg.InfluxTags = fileCfg.InfluxTags
+	}
 	if cfg.StoreInterval == DefaultStoreInterval && fileCfg.StoreInterval != 0 {
 		cfg.StoreInterval = fileCfg.StoreInterval
 	}
 	if cfg.FileStoragePath == DefaultFileStoragePath && fileCfg.FileStoragePath != "" {
 		cfg.FileStoragePath = fileCfg.FileStoragePath
 	}
+	if cfg.StoreGenerations == DefaultStoreGenerations && fileCfg.StoreGenerations != 0 {
+		cfg.StoreGenerations = fileCfg.StoreGenerations
+	}
 	if cfg.DataSourceName == DefaultDSN && fileCfg.DataSourceName != "" {
 		cfg.DataSourceName = fileCfg.DataSourceName
 	}
@@ -193,4 +442,28 @@ func mergeConfig(cfg *ServerConfig, fileCfg ServerConfig) {
 	if cfg.TrustedSubnet == DefaultTrustedSubnet && fileCfg.TrustedSubnet != "" {
 		cfg.TrustedSubnet = fileCfg.TrustedSubnet
 	}
+	if cfg.APIKeys == DefaultAPIKeys && fileCfg.APIKeys != "" {
+		cfg.APIKeys = fileCfg.APIKeys
+	}
+	if cfg.RetentionRules == DefaultRetentionRules && fileCfg.RetentionRules != "" {
+		cfg.RetentionRules = fileCfg.RetentionRules
+	}
+	if cfg.RetentionInterval == DefaultRetentionInterval && fileCfg.RetentionInterval != 0 {
+		cfg.RetentionInterval = fileCfg.RetentionInterval
+	}
+	if cfg.CacheFlushInterval == DefaultCacheFlushInterval && fileCfg.CacheFlushInterval != 0 {
+		cfg.CacheFlushInterval = fileCfg.CacheFlushInterval
+	}
+	if cfg.CacheMaxDirty == DefaultCacheMaxDirty && fileCfg.CacheMaxDirty != 0 {
+		cfg.CacheMaxDirty = fileCfg.CacheMaxDirty
+	}
+	if cfg.JournalPath == DefaultJournalPath && fileCfg.JournalPath != "" {
+		cfg.JournalPath = fileCfg.JournalPath
+	}
+	if cfg.JournalMaxSize == DefaultJournalMaxSize && fileCfg.JournalMaxSize != 0 {
+		cfg.JournalMaxSize = fileCfg.JournalMaxSize
+	}
+	if cfg.DualWrite == DefaultDualWrite && fileCfg.DualWrite != "" {
+		cfg.DualWrite = fileCfg.DualWrite
+	}
 }
@@ -2,10 +2,15 @@ package controllers
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"github.com/melkomukovki/go-musthave-metrics/internal/entities"
 	pb "github.com/melkomukovki/go-musthave-metrics/internal/proto"
 	"github.com/melkomukovki/go-musthave-metrics/internal/services"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"time"
 )
 
 type MetricsServer struct {
@@ -18,99 +23,337 @@ func NewMetricsServer(service *services.Service) *MetricsServer {
 }
 
 func (s *MetricsServer) AddMetric(ctx context.Context, req *pb.AddMetricRequest) (*pb.AddMetricResponse, error) {
-	metric := entities.Metric{
-		ID:    req.Metric.Id,
-		MType: req.Metric.MetricType,
+	metric, err := metricFromPb(req.Metric)
+	if err != nil {
+		return nil, err
 	}
-	switch req.Metric.MetricType {
-	case entities.Gauge:
-		metric.Value = &req.Metric.Value
-	case entities.Counter:
-		metric.Delta = &req.Metric.Delta
-	default:
-		return nil, fmt.Errorf("unknown metric type: %s", req.Metric.MetricType)
+
+	var cond entities.GaugeCondition
+	if req.ExpectedVersion != nil {
+		cond.Version = &req.ExpectedVersion.Value
+	}
+	if req.ExpectedValue != nil {
+		cond.Value = &req.ExpectedValue.Value
+	}
+	if req.Timestamp != nil {
+		cond.Timestamp = req.Timestamp.AsTime()
+	}
+	if cond.IsZero() {
+		if err = s.service.AddMetric(ctx, metric); err != nil {
+			return nil, metadataStatus(err)
+		}
+		return &pb.AddMetricResponse{Message: "Success"}, nil
 	}
 
-	err := s.service.AddMetric(ctx, metric)
+	version, err := s.service.UpdateGauge(ctx, metric, cond)
+	if errors.Is(err, entities.ErrConditionFailed) {
+		return nil, status.Error(codes.Aborted, err.Error())
+	}
 	if err != nil {
-		return nil, err
+		return nil, metadataStatus(err)
 	}
-
-	return &pb.AddMetricResponse{Message: "Success"}, nil
+	return &pb.AddMetricResponse{Message: "Success", Version: version}, nil
 }
 
 func (s *MetricsServer) AddMetrics(ctx context.Context, req *pb.AddMetricsRequest) (*pb.AddMetricsResponse, error) {
 	var metrics []entities.Metric
 	for _, m := range req.Metrics {
-		metric := entities.Metric{
-			ID:    m.Id,
-			MType: m.MetricType,
-		}
-		switch m.MetricType {
-		case entities.Gauge:
-			metric.Value = &m.Value
-		case entities.Counter:
-			metric.Delta = &m.Delta
-		default:
-			return nil, fmt.Errorf("unknown metric type: %s", m.MetricType)
+		metric, err := metricFromPb(m)
+		if err != nil {
+			return nil, err
 		}
 		metrics = append(metrics, metric)
 	}
 
 	err := s.service.AddMultipleMetrics(ctx, metrics)
 	if err != nil {
-		return nil, err
+		return nil, metadataStatus(err)
 	}
 
 	return &pb.AddMetricsResponse{Message: "Success"}, nil
 }
 
 func (s *MetricsServer) GetMetric(ctx context.Context, req *pb.GetMetricRequest) (*pb.GetMetricResponse, error) {
-	metric, err := s.service.GetMetric(ctx, req.MetricType, req.Id)
+	metric, err := s.service.GetMetric(ctx, req.MetricType, req.Id, req.Labels)
 	if err != nil {
 		return nil, err
 	}
 
-	respMetric := pb.Metric{
-		Id:         metric.ID,
-		MetricType: metric.MType,
-	}
-	if metric.MType == entities.Gauge {
-		respMetric.Value = *metric.Value
-	} else if metric.MType == entities.Counter {
-		respMetric.Delta = *metric.Delta
-	}
-
-	return &pb.GetMetricResponse{Metric: &respMetric}, nil
+	return &pb.GetMetricResponse{Metric: metricToPb(metric), Version: metric.Version}, nil
 }
 
 func (s *MetricsServer) ListMetrics(ctx context.Context, req *pb.ListMetricsRequest) (*pb.ListMetricsResponse, error) {
-	metrics, err := s.service.GetAllMetrics(ctx)
+	matchers := make([]entities.LabelMatcher, 0, len(req.Matchers))
+	for _, m := range req.Matchers {
+		matcher, err := entities.NewLabelMatcher(entities.MatchType(m.Type), m.Name, m.Value)
+		if err != nil {
+			return nil, err
+		}
+		matchers = append(matchers, matcher)
+	}
+
+	metrics, err := s.service.GetAllMetrics(ctx, matchers)
 	if err != nil {
 		return nil, err
 	}
 
 	var pbMetrics []*pb.Metric
 	for _, m := range metrics {
-		pbMetric := &pb.Metric{
-			Id:         m.ID,
-			MetricType: m.MType,
-		}
-		if m.MType == entities.Gauge {
-			pbMetric.Value = *m.Value
-		} else if m.MType == entities.Counter {
-			pbMetric.Delta = *m.Delta
-		}
-		pbMetrics = append(pbMetrics, pbMetric)
+		pbMetrics = append(pbMetrics, metricToPb(m))
 	}
 
 	return &pb.ListMetricsResponse{Metrics: pbMetrics}, nil
 }
 
+func (s *MetricsServer) GetMetricHistory(ctx context.Context, req *pb.GetMetricHistoryRequest) (*pb.GetMetricHistoryResponse, error) {
+	to := time.Now()
+	if req.To != nil {
+		to = req.To.AsTime()
+	}
+	from := to.Add(-time.Hour)
+	if req.From != nil {
+		from = req.From.AsTime()
+	}
+	var step time.Duration
+	if req.Step != nil {
+		step = req.Step.AsDuration()
+	}
+
+	history, err := s.service.GetMetricHistory(ctx, req.MetricType, req.Id, req.Labels, from, to, step)
+	if err != nil {
+		return nil, err
+	}
+
+	pbPoints := make([]*pb.MetricPoint, 0, len(history.Points))
+	for _, p := range history.Points {
+		pbPoint := &pb.MetricPoint{Timestamp: timestamppb.New(p.Timestamp)}
+		if history.MType == entities.Gauge {
+			pbPoint.Value = *p.Value
+		} else if history.MType == entities.Counter {
+			pbPoint.Delta = *p.Delta
+		}
+		pbPoints = append(pbPoints, pbPoint)
+	}
+
+	return &pb.GetMetricHistoryResponse{Points: pbPoints}, nil
+}
+
+func (s *MetricsServer) GetGaugeRollups(ctx context.Context, req *pb.GetGaugeRollupsRequest) (*pb.GetGaugeRollupsResponse, error) {
+	resolution := req.Resolution
+	if resolution == "" {
+		resolution = entities.DefaultRollupResolution
+	}
+	to := time.Now()
+	if req.To != nil {
+		to = req.To.AsTime()
+	}
+	from := to.Add(-24 * time.Hour)
+	if req.From != nil {
+		from = req.From.AsTime()
+	}
+
+	rollups, err := s.service.GetGaugeRollups(ctx, req.Id, req.Labels, resolution, from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	pbPoints := make([]*pb.RollupPoint, 0, len(rollups.Points))
+	for _, p := range rollups.Points {
+		pbPoints = append(pbPoints, &pb.RollupPoint{
+			Timestamp: timestamppb.New(p.Timestamp),
+			Min:       p.Min,
+			Max:       p.Max,
+			Avg:       p.Avg,
+			Sum:       p.Sum,
+			Count:     p.Count,
+		})
+	}
+
+	return &pb.GetGaugeRollupsResponse{Resolution: rollups.Resolution, Points: pbPoints}, nil
+}
+
+func (s *MetricsServer) DeleteMetric(ctx context.Context, req *pb.DeleteMetricRequest) (*pb.DeleteMetricResponse, error) {
+	err := s.service.DeleteMetric(ctx, req.MetricType, req.Id, req.Labels)
+	if err != nil {
+		return nil, err
+	}
+	return &pb.DeleteMetricResponse{Message: "Success"}, nil
+}
+
+func (s *MetricsServer) ResetCounter(ctx context.Context, req *pb.ResetCounterRequest) (*pb.ResetCounterResponse, error) {
+	err := s.service.ResetCounter(ctx, req.Id, req.Labels)
+	if err != nil {
+		return nil, err
+	}
+	return &pb.ResetCounterResponse{Message: "Success"}, nil
+}
+
+func (s *MetricsServer) SetMetadata(ctx context.Context, req *pb.SetMetadataRequest) (*pb.SetMetadataResponse, error) {
+	if req.Metadata == nil {
+		return nil, status.Error(codes.InvalidArgument, entities.ErrMissingField.Error())
+	}
+	err := s.service.SetMetadata(ctx, metadataFromPb(req.Metadata))
+	if err != nil {
+		return nil, metadataStatus(err)
+	}
+	return &pb.SetMetadataResponse{Message: "Success"}, nil
+}
+
+func (s *MetricsServer) GetMetadata(ctx context.Context, req *pb.GetMetadataRequest) (*pb.GetMetadataResponse, error) {
+	meta, err := s.service.GetMetadata(ctx, req.Name)
+	if err != nil {
+		return nil, metadataStatus(err)
+	}
+	return &pb.GetMetadataResponse{Metadata: metadataToPb(meta)}, nil
+}
+
+func (s *MetricsServer) ListMetadata(ctx context.Context, req *pb.ListMetadataRequest) (*pb.ListMetadataResponse, error) {
+	metadata, err := s.service.GetAllMetadata(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	pbMetadata := make([]*pb.MetricMetadata, 0, len(metadata))
+	for _, meta := range metadata {
+		pbMetadata = append(pbMetadata, metadataToPb(meta))
+	}
+	return &pb.ListMetadataResponse{Metadata: pbMetadata}, nil
+}
+
+func (s *MetricsServer) DeleteMetadata(ctx context.Context, req *pb.DeleteMetadataRequest) (*pb.DeleteMetadataResponse, error) {
+	err := s.service.DeleteMetadata(ctx, req.Name)
+	if err != nil {
+		return nil, metadataStatus(err)
+	}
+	return &pb.DeleteMetadataResponse{Message: "Success"}, nil
+}
+
 func (s *MetricsServer) Ping(ctx context.Context, req *pb.PingRequest) (*pb.PingResponse, error) {
 	err := s.service.Ping(ctx)
+	if errors.Is(err, entities.ErrStorageDegraded) {
+		stats, _ := s.service.JournalStats()
+		return &pb.PingResponse{Message: fmt.Sprintf("Degraded: %d writes (%d bytes) journaled", stats.Records, stats.Bytes)}, nil
+	}
 	if err != nil {
 		return nil, fmt.Errorf("ping failed: %v", err)
 	}
 	return &pb.PingResponse{Message: "Success"}, nil
 }
+
+// metadataStatus converts errors of metadata to gRPC status: names owned by another type fail precondition,
+// writes, which storage can't accept for a while, are unavailable
+func metadataStatus(err error) error {
+	switch {
+	case errors.Is(err, entities.ErrStorageDegraded), errors.Is(err, entities.ErrJournalFull), errors.Is(err, entities.ErrFlushBacklog):
+		return status.Error(codes.Unavailable, err.Error())
+	case errors.Is(err, entities.ErrMetricTypeConflict):
+		return status.Error(codes.FailedPrecondition, err.Error())
+	case errors.Is(err, entities.ErrMetadataNotFound):
+		return status.Error(codes.NotFound, err.Error())
+	case errors.Is(err, entities.ErrMissingField), errors.Is(err, entities.ErrMetricNotSupportedType), errors.Is(err, entities.ErrInvalidMetadata),
+		errors.Is(err, entities.ErrNameTooLong):
+		return status.Error(codes.InvalidArgument, err.Error())
+	default:
+		return err
+	}
+}
+
+func metadataFromPb(m *pb.MetricMetadata) entities.MetricMetadata {
+	return entities.MetricMetadata{Name: m.Name, Type: m.MetricType, Unit: m.Unit, Help: m.Help}
+}
+
+func metadataToPb(m entities.MetricMetadata) *pb.MetricMetadata {
+	return &pb.MetricMetadata{Name: m.Name, MetricType: m.Type, Unit: m.Unit, Help: m.Help}
+}
+
+// metricFromPb converts protobuf metric to entity, value is taken from field matching metric type
+func metricFromPb(m *pb.Metric) (entities.Metric, error) {
+	if m == nil {
+		return entities.Metric{}, entities.ErrMissingField
+	}
+
+	metric := entities.Metric{
+		ID:     m.Id,
+		MType:  m.MetricType,
+		Labels: m.Labels,
+	}
+	switch m.MetricType {
+	case entities.Gauge:
+		metric.Value = &m.Value
+	case entities.Counter:
+		metric.Delta = &m.Delta
+	case entities.Histogram:
+		if m.Histogram == nil {
+			return entities.Metric{}, entities.ErrMissingField
+		}
+		metric.Histogram = &entities.HistogramValue{
+			Bounds: m.Histogram.Bounds,
+			Counts: m.Histogram.Counts,
+			Sum:    m.Histogram.Sum,
+			Count:  m.Histogram.Count,
+		}
+	case entities.Summary:
+		if m.Summary == nil {
+			return entities.Metric{}, entities.ErrMissingField
+		}
+		metric.Summary = &entities.SummaryValue{
+			Accuracy:  m.Summary.Accuracy,
+			ZeroCount: m.Summary.ZeroCount,
+			Positive:  sketchBinsFromPb(m.Summary.Positive),
+			Negative:  sketchBinsFromPb(m.Summary.Negative),
+			Sum:       m.Summary.Sum,
+			Count:     m.Summary.Count,
+		}
+	default:
+		return entities.Metric{}, fmt.Errorf("unknown metric type: %s", m.MetricType)
+	}
+	return metric, nil
+}
+
+// metricToPb converts metric entity to protobuf
+func metricToPb(m entities.Metric) *pb.Metric {
+	res := &pb.Metric{
+		Id:         m.ID,
+		MetricType: m.MType,
+		Labels:     m.Labels,
+	}
+	switch {
+	case m.MType == entities.Gauge && m.Value != nil:
+		res.Value = *m.Value
+	case m.MType == entities.Counter && m.Delta != nil:
+		res.Delta = *m.Delta
+	case m.Histogram != nil:
+		res.Histogram = &pb.Histogram{
+			Bounds: m.Histogram.Bounds,
+			Counts: m.Histogram.Counts,
+			Sum:    m.Histogram.Sum,
+			Count:  m.Histogram.Count,
+		}
+	case m.Summary != nil:
+		res.Summary = &pb.Summary{
+			Accuracy:  m.Summary.Accuracy,
+			ZeroCount: m.Summary.ZeroCount,
+			Positive:  sketchBinsToPb(m.Summary.Positive),
+			Negative:  sketchBinsToPb(m.Summary.Negative),
+			Sum:       m.Summary.Sum,
+			Count:     m.Summary.Count,
+		}
+	}
+	return res
+}
+
+func sketchBinsFromPb(bins []*pb.SketchBin) []entities.SketchBin {
+	res := make([]entities.SketchBin, 0, len(bins))
+	for _, b := range bins {
+		res = append(res, entities.SketchBin{Index: b.Index, Count: b.Count})
+	}
+	return res
+}
+
+func sketchBinsToPb(bins []entities.SketchBin) []*pb.SketchBin {
+	res := make([]*pb.SketchBin, 0, len(bins))
+	for _, b := range bins {
+		res = append(res, &pb.SketchBin{Index: b.Index, Count: b.Count})
+	}
+	return res
+}
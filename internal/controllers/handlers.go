@@ -6,30 +6,44 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 
 	"github.com/melkomukovki/go-musthave-metrics/internal/controllers/middleware"
 	"github.com/melkomukovki/go-musthave-metrics/internal/entities"
+	"github.com/melkomukovki/go-musthave-metrics/internal/exposition"
+	"github.com/melkomukovki/go-musthave-metrics/internal/influx"
 	"github.com/melkomukovki/go-musthave-metrics/internal/services"
 )
 
 // AppHandler define handler structure
 type AppHandler struct {
-	Service *services.Service
+	Service    *services.Service
+	Influx     *influx.Converter    // Converter of points written with InfluxDB line protocol
+	Prometheus *exposition.Importer // Importer of pushed Prometheus expositions
 }
 
-// NewHandler adds needed routers and middleware to our gin engine
-func NewHandler(router *gin.Engine, service *services.Service, hashKey string, certKey *rsa.PrivateKey, subnet string) {
-	handler := AppHandler{Service: service}
+// NewHandler adds needed routers and middleware to our gin engine.
+// If apiKeys is not empty, every request must carry API key of tenant, otherwise metrics belong to entities.DefaultTenant.
+// If exposeMetrics is false, `/metrics` route is not added, see NewExpositionHandler.
+// Points written to InfluxDB compatible `/api/v2/write` are converted to metrics by influxConverter
+func NewHandler(router *gin.Engine, service *services.Service, hashKey string, certKey *rsa.PrivateKey, subnet string, apiKeys map[string]string, exposeMetrics bool, influxConverter *influx.Converter) {
+	handler := AppHandler{Service: service, Influx: influxConverter, Prometheus: exposition.NewImporter()}
+	// Handlers pass gin context to service, tenant is stored in request context
+	router.ContextWithFallback = true
 
 	appRoutes := router.Group("/")
 	appRoutes.Use(middleware.LoggerMiddleware(), gin.Recovery())
 	if subnet != "" {
 		appRoutes.Use(middleware.SubnetValidatorMiddleware(subnet))
 	}
+	if len(apiKeys) > 0 {
+		appRoutes.Use(middleware.TenantMiddleware(apiKeys))
+	}
 	appRoutes.Use(middleware.GzipMiddleware())
 	if certKey != nil {
 		appRoutes.Use(middleware.CryptoMiddleware(certKey))
@@ -41,16 +55,50 @@ func NewHandler(router *gin.Engine, service *services.Service, hashKey string, c
 		appRoutes.POST("/update/", handler.postMetricJSON)
 		appRoutes.POST("/updates/", handler.postMultipleMetrics)
 		appRoutes.POST("/update/:mType/:mName/mValue", handler.postMetric)
+		appRoutes.POST("/import/prometheus", handler.importPrometheus)
+		appRoutes.POST("/api/v2/write", handler.influxWrite)
 
 		appRoutes.POST("/value/", handler.getMetricJSON)
 		appRoutes.GET("/value/:mType/:mName", handler.getMetric)
+		appRoutes.DELETE("/value/:mType/:mName", handler.deleteMetric)
+		appRoutes.POST("/reset/counter/:mName", handler.resetCounter)
+
+		appRoutes.GET("/history/:mType/:mName", handler.getMetricHistory)
+		appRoutes.GET("/rollups/:mName", handler.getGaugeRollups)
+
+		appRoutes.GET("/metadata/", handler.listMetadata)
+		appRoutes.GET("/metadata/:mName", handler.getMetadata)
+		appRoutes.PUT("/metadata/:mName", handler.putMetadata)
+		appRoutes.DELETE("/metadata/:mName", handler.deleteMetadata)
 
 		appRoutes.GET("/ping", handler.ping)
+		appRoutes.GET("/journal", handler.getJournal)
 
+		if exposeMetrics {
+			appRoutes.GET("/metrics", handler.exposeMetrics)
+		}
 		appRoutes.GET("/", handler.showMetrics)
 	}
 }
 
+// NewExpositionHandler adds only `/metrics` route to gin engine, which is served on separate address from ingest API.
+// Scrapes are checked by subnet and API key of tenant the same way as API requests
+func NewExpositionHandler(router *gin.Engine, service *services.Service, subnet string, apiKeys map[string]string) {
+	handler := AppHandler{Service: service}
+	router.ContextWithFallback = true
+
+	routes := router.Group("/")
+	routes.Use(middleware.LoggerMiddleware(), gin.Recovery())
+	if subnet != "" {
+		routes.Use(middleware.SubnetValidatorMiddleware(subnet))
+	}
+	if len(apiKeys) > 0 {
+		routes.Use(middleware.TenantMiddleware(apiKeys))
+	}
+	routes.Use(middleware.GzipMiddleware())
+	routes.GET("/metrics", handler.exposeMetrics)
+}
+
 func (a *AppHandler) postMetricJSON(c *gin.Context) {
 	var v entities.Metric
 	if err := c.BindJSON(&v); err != nil {
@@ -61,24 +109,42 @@ func (a *AppHandler) postMetricJSON(c *gin.Context) {
 		return
 	}
 
-	err := a.Service.AddMetric(c, v)
+	cond, err := requestCondition(c)
 	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	}
+	if cond.IsZero() {
+		err = a.Service.AddMetric(c, v)
+	} else {
+		_, err = a.Service.UpdateGauge(c, v, cond)
+	}
+	switch {
+	case errors.Is(err, entities.ErrConditionFailed), errors.Is(err, entities.ErrMetricTypeConflict):
+		c.AbortWithStatusJSON(http.StatusConflict, gin.H{"message": err.Error()})
+		return
+	case err != nil:
 		c.AbortWithStatusJSON(
-			http.StatusBadRequest,
+			ingestionStatus(c, err),
 			gin.H{
 				"message": fmt.Sprintf("Invalid payload. Error: %s", err.Error()), // TODO
 			})
 		return
 	}
 
-	rM, err := a.Service.GetMetric(c, v.MType, v.ID)
+	// Write journaled while database is unavailable is applied later, so stored value can't be read until then.
+	// Write is accepted anyway, and written value is returned: retry would count counter twice
+	if stats, ok := a.Service.JournalStats(); ok && (stats.Degraded || stats.Records > 0) {
+		c.JSON(http.StatusAccepted, v)
+		return
+	}
+	rM, err := a.Service.GetMetric(c, v.MType, v.ID, v.Labels)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{
-			"message": err.Error(),
-		})
+		c.JSON(http.StatusAccepted, v)
 		return
 	}
 
+	setETag(c, rM)
 	c.JSON(http.StatusOK, rM)
 }
 
@@ -94,7 +160,7 @@ func (a *AppHandler) postMultipleMetrics(c *gin.Context) {
 
 	err := a.Service.AddMultipleMetrics(c, metrics)
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{
+		c.JSON(ingestionStatus(c, err), gin.H{
 			"message": err.Error(),
 		})
 		return
@@ -103,10 +169,107 @@ func (a *AppHandler) postMultipleMetrics(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{"message": "success"})
 }
 
+// importPrometheus stores gauges and counters pushed in Prometheus text or OpenMetrics format.
+// Counter samples are cumulative totals, so increments since the previous pushed totals are added to stored counters.
+// Lines, which can't be imported, are skipped and returned with their errors
+func (a *AppHandler) importPrometheus(c *gin.Context) {
+	batch, err := a.Prometheus.Import(entities.TenantFromContext(c), c.Request.Body)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": fmt.Sprintf("Invalid payload. Error: %s", err.Error())})
+		return
+	}
+
+	// Totals of counters are saved only if they are written, so failed pushes may be retried
+	failed, err := a.Service.AddMetricsPartially(c, batch.Metrics)
+	imported := 0
+	if err != nil && len(failed) == 0 {
+		batch.Abort()
+	} else {
+		batch.Commit(failed)
+		imported = len(batch.Metrics) - len(failed)
+	}
+	lineErrs := lineErrorsOf(batch, failed)
+
+	switch {
+	case err != nil:
+		c.JSON(ingestionStatus(c, err), gin.H{"message": err.Error(), "imported": imported, "errors": lineErrs})
+	case imported == 0:
+		status := http.StatusOK
+		if len(lineErrs) > 0 {
+			status = http.StatusBadRequest
+		}
+		c.JSON(status, gin.H{"message": "no metrics imported", "imported": 0, "errors": lineErrs})
+	default:
+		c.JSON(http.StatusOK, gin.H{"message": "success", "imported": imported, "errors": lineErrs})
+	}
+}
+
+// lineErrorsOf returns errors of lines, which weren't parsed or which metrics failed to be written, ordered by line
+func lineErrorsOf(batch *exposition.Batch, failed map[int]error) []exposition.LineError {
+	lineErrs := append([]exposition.LineError{}, batch.LineErrs...)
+	for i, err := range failed {
+		lineErrs = append(lineErrs, exposition.LineError{Line: batch.Lines[i], Message: err.Error()})
+	}
+	sort.SliceStable(lineErrs, func(i, j int) bool { return lineErrs[i].Line < lineErrs[j].Line })
+	return lineErrs
+}
+
+// influxWrite stores fields of points written with InfluxDB line protocol, `org` and `bucket` are ignored.
+// Responds as InfluxDB v2: no content if all lines are written, otherwise error with code and message.
+// Lines, which can't be written, are skipped and listed in partial write error
+func (a *AppHandler) influxWrite(c *gin.Context) {
+	points, lineErrs, err := influx.Parse(c.Request.Body, c.DefaultQuery("precision", "ns"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"code": "invalid", "message": err.Error()})
+		return
+	}
+	batch := a.Influx.Convert(entities.TenantFromContext(c), points)
+	lineErrs = append(lineErrs, batch.LineErrs...)
+
+	// Values of counters are saved only if they are written, so failed writes may be retried
+	failed, err := a.Service.AddMetricsPartially(c, batch.Metrics)
+	if err != nil && len(failed) == 0 {
+		batch.Abort()
+	} else {
+		batch.Commit(failed)
+	}
+	if err != nil {
+		status, code := ingestionStatus(c, err), "invalid"
+		switch status {
+		case http.StatusConflict:
+			code = "conflict"
+		case http.StatusServiceUnavailable:
+			code = "unavailable"
+		}
+		c.JSON(status, gin.H{"code": code, "message": err.Error()})
+		return
+	}
+
+	// Metrics rejected by type conflicts reject their lines
+	failedLines := make(map[int]bool)
+	for i := range batch.Metrics {
+		if err, ok := failed[i]; ok {
+			lineErrs = append(lineErrs, influx.LineError{Line: batch.Lines[i], Message: err.Error()})
+			failedLines[batch.Lines[i]] = true
+		}
+	}
+	if len(lineErrs) > 0 {
+		written := len(points) - len(batch.LineErrs) - len(failedLines)
+		c.JSON(http.StatusBadRequest, gin.H{"code": "invalid", "message": influx.PartialWriteError(written, lineErrs)})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
 func (a *AppHandler) postMetric(c *gin.Context) {
 	mType := c.Params.ByName("mType")
 	mName := c.Params.ByName("mName")
 	mValue := c.Params.ByName("mValue")
+	labels, err := queryLabels(c)
+	if err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
 
 	switch mType {
 	case entities.Gauge:
@@ -114,10 +277,10 @@ func (a *AppHandler) postMetric(c *gin.Context) {
 		if err != nil {
 			c.String(http.StatusBadRequest, "Can't convert value %s to float64", mValue)
 		}
-		metric := entities.Metric{ID: mName, MType: mType, Value: &value}
+		metric := entities.Metric{ID: mName, MType: mType, Value: &value, Labels: labels}
 		err = a.Service.AddMetric(c, metric)
 		if err != nil {
-			c.String(http.StatusBadRequest, "Can't add gauge metric: %s - %s. Error: %s", mName, mValue, err.Error())
+			c.String(ingestionStatus(c, err), "Can't add gauge metric: %s - %s. Error: %s", mName, mValue, err.Error())
 			return
 		}
 	case entities.Counter:
@@ -125,10 +288,10 @@ func (a *AppHandler) postMetric(c *gin.Context) {
 		if err != nil {
 			c.String(http.StatusBadRequest, "Can't convert value %s to int64", mValue)
 		}
-		metric := entities.Metric{ID: mName, MType: mType, Delta: &value}
+		metric := entities.Metric{ID: mName, MType: mType, Delta: &value, Labels: labels}
 		err = a.Service.AddMetric(c, metric)
 		if err != nil {
-			c.String(http.StatusBadRequest, "Can't add counter metric: %s - %s. Error: %s", mName, mValue, err.Error())
+			c.String(ingestionStatus(c, err), "Can't add counter metric: %s - %s. Error: %s", mName, mValue, err.Error())
 			return
 		}
 	default:
@@ -148,7 +311,7 @@ func (a *AppHandler) getMetricJSON(c *gin.Context) {
 		return
 	}
 
-	res, err := a.Service.GetMetric(c, v.MType, v.ID)
+	res, err := a.Service.GetMetric(c, v.MType, v.ID, v.Labels)
 	if err != nil {
 		if errors.Is(err, entities.ErrMetricNotFound) {
 			c.JSON(http.StatusNotFound, gin.H{
@@ -162,19 +325,29 @@ func (a *AppHandler) getMetricJSON(c *gin.Context) {
 		return
 	}
 
+	setETag(c, res)
 	c.JSON(http.StatusOK, res)
 }
 
 func (a *AppHandler) getMetric(c *gin.Context) {
 	mType := c.Params.ByName("mType")
 	mName := c.Params.ByName("mName")
+	labels, err := queryLabels(c)
+	if err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
 
-	metric, err := a.Service.GetMetric(c, mType, mName)
+	metric, err := a.Service.GetMetric(c, mType, mName, labels)
 	if err != nil {
 		c.String(http.StatusNotFound, err.Error())
 		return
 	}
 
+	if setETag(c, metric) && c.GetHeader("If-None-Match") == c.Writer.Header().Get("ETag") {
+		c.Status(http.StatusNotModified)
+		return
+	}
 	switch metric.MType {
 	case entities.Gauge:
 		fV := fmt.Sprintf("%.3f", *metric.Value)
@@ -184,34 +357,414 @@ func (a *AppHandler) getMetric(c *gin.Context) {
 	case entities.Counter:
 		c.String(http.StatusOK, "%d", *metric.Delta)
 		return
+	case entities.Histogram, entities.Summary:
+		c.String(http.StatusOK, formatDistribution(metric))
+		return
 	default:
 		c.String(http.StatusInternalServerError, "unexpected metric type from store")
 	}
 }
 
+func (a *AppHandler) deleteMetric(c *gin.Context) {
+	mType := c.Params.ByName("mType")
+	mName := c.Params.ByName("mName")
+	labels, err := queryLabels(c)
+	if err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	err = a.Service.DeleteMetric(c, mType, mName, labels)
+	switch {
+	case err == nil:
+		c.String(http.StatusOK, "OK")
+	case errors.Is(err, entities.ErrMetricNotFound):
+		c.String(http.StatusNotFound, err.Error())
+	case errors.Is(err, entities.ErrMetricNotSupportedType):
+		c.String(http.StatusBadRequest, "Invalid metric type: %s", mType)
+	default:
+		c.String(http.StatusInternalServerError, err.Error())
+	}
+}
+
+func (a *AppHandler) resetCounter(c *gin.Context) {
+	mName := c.Params.ByName("mName")
+	labels, err := queryLabels(c)
+	if err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	err = a.Service.ResetCounter(c, mName, labels)
+	switch {
+	case err == nil:
+		c.String(http.StatusOK, "OK")
+	case errors.Is(err, entities.ErrMetricNotFound):
+		c.String(http.StatusNotFound, err.Error())
+	default:
+		c.String(http.StatusInternalServerError, err.Error())
+	}
+}
+
+func (a *AppHandler) getMetricHistory(c *gin.Context) {
+	mType := c.Params.ByName("mType")
+	mName := c.Params.ByName("mName")
+	labels, err := queryLabels(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	}
+
+	from, to, err := queryTimeRange(c, time.Hour)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	}
+
+	var step time.Duration
+	if v := c.Query("step"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"message": fmt.Sprintf("Invalid `step` parameter. Error: %s", err.Error())})
+			return
+		}
+		step = d
+	}
+
+	history, err := a.Service.GetMetricHistory(c, mType, mName, labels, from, to, step)
+	if err != nil {
+		if errors.Is(err, entities.ErrMetricNotSupportedType) || errors.Is(err, entities.ErrInvalidTimeRange) {
+			c.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"message": err.Error()})
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, history)
+}
+
+func (a *AppHandler) getGaugeRollups(c *gin.Context) {
+	mName := c.Params.ByName("mName")
+	labels, err := queryLabels(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	}
+
+	from, to, err := queryTimeRange(c, 24*time.Hour)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	}
+
+	resolution := c.DefaultQuery("resolution", entities.DefaultRollupResolution)
+	rollups, err := a.Service.GetGaugeRollups(c, mName, labels, resolution, from, to)
+	if err != nil {
+		if errors.Is(err, entities.ErrInvalidResolution) || errors.Is(err, entities.ErrInvalidTimeRange) {
+			c.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"message": err.Error()})
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, rollups)
+}
+
+// queryTimeRange reads RFC 3339 `from` and `to` query parameters.
+// By default range ends now and starts window before its end
+func queryTimeRange(c *gin.Context, window time.Duration) (from, to time.Time, err error) {
+	to = time.Now()
+	if v := c.Query("to"); v != "" {
+		if to, err = time.Parse(time.RFC3339, v); err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("Invalid `to` parameter. Error: %s", err.Error())
+		}
+	}
+
+	from = to.Add(-window)
+	if v := c.Query("from"); v != "" {
+		if from, err = time.Parse(time.RFC3339, v); err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("Invalid `from` parameter. Error: %s", err.Error())
+		}
+	}
+	return from, to, nil
+}
+
+// retryAfter - seconds client should wait before retrying write, which storage can't accept now.
+// Journal of unavailable database is replayed as often
+const retryAfter = "5"
+
+// ingestionStatus returns HTTP status of failed write: conflict if metric name is owned by another type,
+// service unavailable with Retry-After if storage can't accept writes for a while, otherwise bad request
+func ingestionStatus(c *gin.Context, err error) int {
+	switch {
+	case errors.Is(err, entities.ErrMetricTypeConflict):
+		return http.StatusConflict
+	case errors.Is(err, entities.ErrStorageDegraded), errors.Is(err, entities.ErrJournalFull), errors.Is(err, entities.ErrFlushBacklog):
+		c.Header("Retry-After", retryAfter)
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusBadRequest
+	}
+}
+
+func (a *AppHandler) listMetadata(c *gin.Context) {
+	metadata, err := a.Service.GetAllMetadata(c)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, metadata)
+}
+
+func (a *AppHandler) getMetadata(c *gin.Context) {
+	meta, err := a.Service.GetMetadata(c, c.Params.ByName("mName"))
+	switch {
+	case err == nil:
+		c.JSON(http.StatusOK, meta)
+	case errors.Is(err, entities.ErrMetadataNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"message": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"message": err.Error()})
+	}
+}
+
+// putMetadata stores metadata from JSON body, name is taken from path
+func (a *AppHandler) putMetadata(c *gin.Context) {
+	var meta entities.MetricMetadata
+	if err := c.BindJSON(&meta); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"message": fmt.Sprintf("Invalid payload. Error: %s", err.Error())})
+		return
+	}
+	meta.Name = c.Params.ByName("mName")
+
+	err := a.Service.SetMetadata(c, meta)
+	switch {
+	case err == nil:
+		c.JSON(http.StatusOK, meta)
+	case errors.Is(err, entities.ErrMetricTypeConflict):
+		c.JSON(http.StatusConflict, gin.H{"message": err.Error()})
+	case errors.Is(err, entities.ErrMissingField), errors.Is(err, entities.ErrMetricNotSupportedType), errors.Is(err, entities.ErrInvalidMetadata):
+		c.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+	case errors.Is(err, entities.ErrStorageDegraded):
+		c.JSON(http.StatusServiceUnavailable, gin.H{"message": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"message": err.Error()})
+	}
+}
+
+func (a *AppHandler) deleteMetadata(c *gin.Context) {
+	err := a.Service.DeleteMetadata(c, c.Params.ByName("mName"))
+	switch {
+	case err == nil:
+		c.String(http.StatusOK, "OK")
+	case errors.Is(err, entities.ErrMetadataNotFound):
+		c.String(http.StatusNotFound, err.Error())
+	case errors.Is(err, entities.ErrStorageDegraded):
+		c.String(http.StatusServiceUnavailable, err.Error())
+	default:
+		c.String(http.StatusInternalServerError, err.Error())
+	}
+}
+
 func (a *AppHandler) ping(c *gin.Context) {
 	err := a.Service.Ping(c)
-	if err != nil {
-		c.String(http.StatusInternalServerError, "Internal Server Error")
-	} else {
+	switch {
+	case err == nil:
 		c.String(http.StatusOK, "Pong")
+	case errors.Is(err, entities.ErrStorageDegraded):
+		// Writes are still accepted, they are journaled until database returns
+		stats, _ := a.Service.JournalStats()
+		c.String(http.StatusOK, "Degraded: %d writes (%d bytes) journaled", stats.Records, stats.Bytes)
+	default:
+		c.String(http.StatusInternalServerError, "Internal Server Error")
+	}
+}
+
+func (a *AppHandler) getJournal(c *gin.Context) {
+	stats, ok := a.Service.JournalStats()
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"message": "storage works without journal"})
+		return
 	}
+	c.JSON(http.StatusOK, stats)
 }
 
 func (a *AppHandler) showMetrics(c *gin.Context) {
-	metrics, err := a.Service.GetAllMetrics(c)
+	matchers, err := queryMatchers(c)
+	if err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	metrics, err := a.Service.GetAllMetrics(c, matchers)
+	if err != nil {
+		c.String(http.StatusInternalServerError, "Internal Server Error")
+	}
+	metadata, err := a.Service.GetAllMetadata(c)
 	if err != nil {
 		c.String(http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+	byName := make(map[string]entities.MetricMetadata, len(metadata))
+	for _, meta := range metadata {
+		byName[meta.Name] = meta
 	}
 
 	var result string
 	for _, v := range metrics {
+		var line string
 		switch v.MType {
 		case entities.Gauge:
-			result += fmt.Sprintf("%s:%.3f\n", v.ID, *v.Value)
+			line = fmt.Sprintf("%s:%.3f", entities.SeriesKey(v.ID, v.Labels), *v.Value)
 		case entities.Counter:
-			result += fmt.Sprintf("%s:%d\n", v.ID, *v.Delta)
+			line = fmt.Sprintf("%s:%d", entities.SeriesKey(v.ID, v.Labels), *v.Delta)
+		case entities.Histogram, entities.Summary:
+			line = fmt.Sprintf("%s:%s", entities.SeriesKey(v.ID, v.Labels), formatDistribution(v))
+		default:
+			continue
+		}
+		// Unit follows value, help text is added as comment
+		meta := byName[v.ID]
+		if meta.Unit != "" {
+			line += " " + meta.Unit
+		}
+		if meta.Help != "" {
+			line += " # " + meta.Help
 		}
+		result += line + "\n"
 	}
 	c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(result))
 }
+
+// exposeMetrics renders all metrics of tenant for Prometheus scrape.
+// Format is chosen by Accept header, metrics may be filtered by `match` query parameters
+func (a *AppHandler) exposeMetrics(c *gin.Context) {
+	matchers, err := queryMatchers(c)
+	if err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	metrics, err := a.Service.GetAllMetrics(c, matchers)
+	if err != nil {
+		c.String(http.StatusInternalServerError, err.Error())
+		return
+	}
+	metadata, err := a.Service.GetAllMetadata(c)
+	if err != nil {
+		c.String(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	format := exposition.Negotiate(c.GetHeader("Accept"))
+	c.Header("Content-Type", format.ContentType())
+	c.Status(http.StatusOK)
+	if err := exposition.Write(c.Writer, format, metrics, metadata); err != nil {
+		_ = c.Error(err)
+	}
+}
+
+// formatDistribution returns text view of histogram or summary:
+// cumulative bucket counts `le<bound>=n` for histogram and p50, p90, p99 quantiles for summary
+func formatDistribution(m entities.Metric) string {
+	var b strings.Builder
+	switch {
+	case m.Histogram != nil:
+		fmt.Fprintf(&b, "count=%d sum=%g", m.Histogram.Count, m.Histogram.Sum)
+		var cumulative uint64
+		for i, count := range m.Histogram.Counts {
+			cumulative += count
+			if i < len(m.Histogram.Bounds) {
+				fmt.Fprintf(&b, " le%g=%d", m.Histogram.Bounds[i], cumulative)
+			} else {
+				fmt.Fprintf(&b, " le+Inf=%d", cumulative)
+			}
+		}
+	case m.Summary != nil:
+		fmt.Fprintf(&b, "count=%d sum=%g", m.Summary.Count, m.Summary.Sum)
+		for _, q := range []float64{0.5, 0.9, 0.99} {
+			fmt.Fprintf(&b, " p%g=%.3f", q*100, m.Summary.Quantile(q))
+		}
+	}
+	return b.String()
+}
+
+// queryLabels reads labels of series from repeated `label` query parameters, e.g. `?label=host=web1&label=cpu=2`
+func queryLabels(c *gin.Context) (map[string]string, error) {
+	params := c.QueryArray("label")
+	if len(params) == 0 {
+		return nil, nil
+	}
+
+	labels := make(map[string]string, len(params))
+	for _, p := range params {
+		name, value, ok := strings.Cut(p, "=")
+		if !ok {
+			return nil, fmt.Errorf("%w: %q, expected name=value", entities.ErrInvalidLabel, p)
+		}
+		labels[name] = value
+	}
+	return labels, entities.ValidateLabels(labels)
+}
+
+// queryMatchers reads label matchers from repeated `match` query parameters, e.g. `?match=host=~web.*`
+func queryMatchers(c *gin.Context) ([]entities.LabelMatcher, error) {
+	var matchers []entities.LabelMatcher
+	for _, p := range c.QueryArray("match") {
+		m, err := entities.ParseLabelMatcher(p)
+		if err != nil {
+			return nil, err
+		}
+		matchers = append(matchers, m)
+	}
+	return matchers, nil
+}
+
+// setETag sets ETag header to version of gauge, returns false for other metrics
+func setETag(c *gin.Context, m entities.Metric) bool {
+	if m.MType != entities.Gauge {
+		return false
+	}
+	c.Header("ETag", strconv.Quote(strconv.FormatInt(m.Version, 10)))
+	return true
+}
+
+// requestCondition reads condition of gauge update from request headers:
+// `If-Match: "<version>"` - gauge has version returned in ETag, `If-None-Match: *` - gauge doesn't exist,
+// `X-If-Value: <value>` - gauge has value, `If-Unmodified-Since: <time>` - value is observed at time,
+// gauge is updated only if it was changed earlier. Time is HTTP date or RFC 3339 with nanoseconds
+func requestCondition(c *gin.Context) (cond entities.GaugeCondition, err error) {
+	if v := c.GetHeader("If-Match"); v != "" {
+		version, err := strconv.ParseInt(strings.Trim(v, `"`), 10, 64)
+		if err != nil || version <= 0 {
+			return cond, fmt.Errorf("Invalid `If-Match` header: %q", v)
+		}
+		cond.Version = &version
+	}
+	if v := c.GetHeader("If-None-Match"); v != "" {
+		if v != "*" || cond.Version != nil {
+			return cond, fmt.Errorf("Invalid `If-None-Match` header: %q, only `*` without `If-Match` is supported", v)
+		}
+		var absent int64
+		cond.Version = &absent
+	}
+	if v := c.GetHeader("X-If-Value"); v != "" {
+		value, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return cond, fmt.Errorf("Invalid `X-If-Value` header: %q", v)
+		}
+		cond.Value = &value
+	}
+	if v := c.GetHeader("If-Unmodified-Since"); v != "" {
+		ts, err := time.Parse(time.RFC3339Nano, v)
+		if err != nil {
+			if ts, err = http.ParseTime(v); err != nil {
+				return cond, fmt.Errorf("Invalid `If-Unmodified-Since` header: %q", v)
+			}
+		}
+		cond.Timestamp = ts
+	}
+	return cond, nil
+}
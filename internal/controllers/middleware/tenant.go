@@ -0,0 +1,54 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/melkomukovki/go-musthave-metrics/internal/entities"
+)
+
+// API key is passed in header of REST request and in metadata of gRPC call
+const (
+	APIKeyHeader   = "X-API-Key"
+	APIKeyMetadata = "x-api-key"
+)
+
+// TenantMiddleware resolves tenant by API key and stores it in request context.
+// Requests without known API key are rejected
+func TenantMiddleware(keys map[string]string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		tenant, ok := keys[c.GetHeader(APIKeyHeader)]
+		if !ok {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"message": entities.ErrUnknownAPIKey.Error()})
+			return
+		}
+
+		c.Request = c.Request.WithContext(entities.ContextWithTenant(c.Request.Context(), tenant))
+		c.Next()
+	}
+}
+
+// TenantInterceptor resolves tenant by API key from metadata and stores it in call context.
+// Calls without known API key are rejected
+func TenantInterceptor(keys map[string]string) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		var key string
+		if md, ok := metadata.FromIncomingContext(ctx); ok {
+			if values := md.Get(APIKeyMetadata); len(values) > 0 {
+				key = values[0]
+			}
+		}
+
+		tenant, ok := keys[key]
+		if !ok {
+			return nil, status.Error(codes.Unauthenticated, entities.ErrUnknownAPIKey.Error())
+		}
+		return handler(entities.ContextWithTenant(ctx, tenant), req)
+	}
+}
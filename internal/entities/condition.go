@@ -0,0 +1,37 @@
+package entities
+
+import "time"
+
+// GaugeCondition - precondition of conditional gauge update, update is made only if all set fields hold.
+// Version of gauge is Unix nanoseconds of its last change, it grows with every change of gauge
+type GaugeCondition struct {
+	Version   *int64    // Current version of gauge, 0 - gauge must not exist
+	Value     *float64  // Current value of gauge, gauge must exist
+	Timestamp time.Time // Moment new value is observed at, current version must be older. Zero - not checked
+}
+
+// IsZero reports whether condition doesn't check anything
+func (c GaugeCondition) IsZero() bool {
+	return c.Version == nil && c.Value == nil && c.Timestamp.IsZero()
+}
+
+// Holds reports whether gauge satisfies condition, exists is false if gauge is absent
+func (c GaugeCondition) Holds(exists bool, value float64, version int64) bool {
+	if c.Version != nil {
+		if *c.Version == 0 && exists || *c.Version != 0 && (!exists || *c.Version != version) {
+			return false
+		}
+	}
+	if c.Value != nil && (!exists || *c.Value != value) {
+		return false
+	}
+	if !c.Timestamp.IsZero() && exists && version >= c.Timestamp.UnixNano() {
+		return false
+	}
+	return true
+}
+
+// NextVersion returns version of gauge changed at ts. Versions grow even if clock goes back
+func NextVersion(current int64, ts time.Time) int64 {
+	return max(ts.UnixNano(), current+1)
+}
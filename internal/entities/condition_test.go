@@ -0,0 +1,52 @@
+package entities
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGaugeCondition_Holds(t *testing.T) {
+	version := func(v int64) *int64 { return &v }
+	value := func(v float64) *float64 { return &v }
+	ts := time.Unix(0, 100)
+
+	tests := []struct {
+		name    string
+		cond    GaugeCondition
+		exists  bool
+		version int64
+		holds   bool
+	}{
+		{name: "Empty condition", exists: true, version: 10, holds: true},
+		{name: "Empty condition, absent gauge", holds: true},
+		{name: "Same version", cond: GaugeCondition{Version: version(10)}, exists: true, version: 10, holds: true},
+		{name: "Other version", cond: GaugeCondition{Version: version(9)}, exists: true, version: 10},
+		{name: "Version of absent gauge", cond: GaugeCondition{Version: version(10)}},
+		{name: "Absent gauge expected", cond: GaugeCondition{Version: version(0)}, holds: true},
+		{name: "Absent gauge expected, gauge exists", cond: GaugeCondition{Version: version(0)}, exists: true, version: 10},
+		{name: "Same value", cond: GaugeCondition{Value: value(1.5)}, exists: true, version: 10, holds: true},
+		{name: "Other value", cond: GaugeCondition{Value: value(2)}, exists: true, version: 10},
+		{name: "Value of absent gauge", cond: GaugeCondition{Value: value(0)}},
+		{name: "Older gauge", cond: GaugeCondition{Timestamp: ts}, exists: true, version: 99, holds: true},
+		{name: "Gauge changed at timestamp", cond: GaugeCondition{Timestamp: ts}, exists: true, version: 100},
+		{name: "Newer gauge", cond: GaugeCondition{Timestamp: ts}, exists: true, version: 101},
+		{name: "Timestamp of absent gauge", cond: GaugeCondition{Timestamp: ts}, holds: true},
+		{name: "All conditions", cond: GaugeCondition{Version: version(10), Value: value(1.5), Timestamp: ts}, exists: true, version: 10, holds: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.holds, tt.cond.Holds(tt.exists, 1.5, tt.version))
+		})
+	}
+
+	assert.True(t, GaugeCondition{}.IsZero())
+	assert.False(t, GaugeCondition{Timestamp: ts}.IsZero())
+}
+
+func TestNextVersion(t *testing.T) {
+	assert.Equal(t, int64(100), NextVersion(50, time.Unix(0, 100)))
+	// Version grows when clock goes back
+	assert.Equal(t, int64(201), NextVersion(200, time.Unix(0, 100)))
+}
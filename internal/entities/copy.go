@@ -0,0 +1,24 @@
+package entities
+
+// CopyReport describes result of copying metrics between storages
+type CopyReport struct {
+	Copied    int // Metrics written to destination
+	Unchanged int // Metrics, which already had the same value in destination
+	Deleted   int // Metrics of destination, which are absent in source
+	Metadata  int // Metadata of names written to destination
+}
+
+// Mismatch reasons
+const (
+	MismatchMissing   = "missing"   // Metric exists only in the first storage
+	MismatchExtra     = "extra"     // Metric exists only in the second storage
+	MismatchDifferent = "different" // Metric has different values
+)
+
+// MetricMismatch describes metric, which differs between two storages
+type MetricMismatch struct {
+	Tenant string
+	Metric MetricInternal // Metric of the first storage, or of the second one if it is extra
+	Other  string         // Value in the second storage, empty if metric is missing there
+	Reason string
+}
@@ -0,0 +1,279 @@
+package entities
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// DefaultBuckets - upper bounds of histogram buckets used when reporter doesn't configure them, in seconds
+var DefaultBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// DefaultSummaryAccuracy - relative accuracy of quantiles returned by summary
+const DefaultSummaryAccuracy = 0.01
+
+// Distribution is value of histogram or summary metric.
+// Reported values are observations since the previous report, values of the same series are merged
+type Distribution interface {
+	// Merge adds observations of other distribution of the same type and layout
+	Merge(other Distribution) error
+	// Validate checks that distribution is consistent
+	Validate() error
+}
+
+// HistogramValue counts observations in buckets with configurable upper bounds
+type HistogramValue struct {
+	Bounds []float64 `json:"bounds"` // Upper bounds of buckets sorted ascending, the last +Inf bucket is implicit
+	Counts []uint64  `json:"counts"` // Number of observations in every bucket, len(Bounds)+1 values
+	Sum    float64   `json:"sum"`    // Sum of observations
+	Count  uint64    `json:"count"`  // Number of observations
+}
+
+// NewHistogram returns empty histogram with given bucket bounds
+func NewHistogram(bounds []float64) *HistogramValue {
+	b := make([]float64, len(bounds))
+	copy(b, bounds)
+	return &HistogramValue{Bounds: b, Counts: make([]uint64, len(bounds)+1)}
+}
+
+// Observe adds single observation
+func (h *HistogramValue) Observe(v float64) {
+	h.Counts[sort.SearchFloat64s(h.Bounds, v)]++
+	h.Sum += v
+	h.Count++
+}
+
+// Validate checks that bounds are sorted and counts match them
+func (h *HistogramValue) Validate() error {
+	if len(h.Counts) != len(h.Bounds)+1 {
+		return fmt.Errorf("%w: histogram has %d bounds and %d counts", ErrInvalidDistribution, len(h.Bounds), len(h.Counts))
+	}
+	for i, b := range h.Bounds {
+		if math.IsNaN(b) || math.IsInf(b, 0) || (i > 0 && b <= h.Bounds[i-1]) {
+			return fmt.Errorf("%w: histogram bounds must be finite and strictly ascending", ErrInvalidDistribution)
+		}
+	}
+	var total uint64
+	for _, c := range h.Counts {
+		total += c
+	}
+	if total != h.Count {
+		return fmt.Errorf("%w: histogram count %d doesn't match buckets %d", ErrInvalidDistribution, h.Count, total)
+	}
+	return nil
+}
+
+// Merge adds observations of other histogram with the same bounds
+func (h *HistogramValue) Merge(other Distribution) error {
+	o, ok := other.(*HistogramValue)
+	if !ok {
+		return fmt.Errorf("%w: histogram can't be merged with %T", ErrDistributionMismatch, other)
+	}
+	if len(o.Bounds) != len(h.Bounds) {
+		return fmt.Errorf("%w: histogram bounds differ", ErrDistributionMismatch)
+	}
+	for i := range h.Bounds {
+		if h.Bounds[i] != o.Bounds[i] {
+			return fmt.Errorf("%w: histogram bounds differ", ErrDistributionMismatch)
+		}
+	}
+
+	for i := range h.Counts {
+		h.Counts[i] += o.Counts[i]
+	}
+	h.Sum += o.Sum
+	h.Count += o.Count
+	return nil
+}
+
+// SketchBin is bucket of summary sketch: number of observations v with gamma^(Index-1) < |v| <= gamma^Index
+type SketchBin struct {
+	Index int32  `json:"index"`
+	Count uint64 `json:"count"`
+}
+
+// SummaryValue is mergeable quantile sketch with relative accuracy guarantee (DDSketch).
+// Quantile returned by sketch differs from exact one not more than by Accuracy share of its value
+type SummaryValue struct {
+	Accuracy  float64     `json:"accuracy"`           // Relative accuracy of quantiles, in (0, 1)
+	ZeroCount uint64      `json:"zero_count"`         // Number of zero observations
+	Positive  []SketchBin `json:"positive,omitempty"` // Bins of positive observations sorted by index
+	Negative  []SketchBin `json:"negative,omitempty"` // Bins of negative observations by absolute value sorted by index
+	Sum       float64     `json:"sum"`                // Sum of observations
+	Count     uint64      `json:"count"`              // Number of observations
+}
+
+// NewSummary returns empty summary with given relative accuracy
+func NewSummary(accuracy float64) *SummaryValue {
+	return &SummaryValue{Accuracy: accuracy}
+}
+
+func (s *SummaryValue) gamma() float64 {
+	return (1 + s.Accuracy) / (1 - s.Accuracy)
+}
+
+// Observe adds single observation
+func (s *SummaryValue) Observe(v float64) {
+	s.ObserveN(v, 1)
+}
+
+// ObserveN adds n observations of the same value, e.g. sampled observation weighted by inverse of sample rate
+func (s *SummaryValue) ObserveN(v float64, n uint64) {
+	switch {
+	case v > 0:
+		s.Positive = addBin(s.Positive, SketchBin{Index: s.index(v), Count: n})
+	case v < 0:
+		s.Negative = addBin(s.Negative, SketchBin{Index: s.index(-v), Count: n})
+	default:
+		s.ZeroCount += n
+	}
+	s.Sum += v * float64(n)
+	s.Count += n
+}
+
+func (s *SummaryValue) index(v float64) int32 {
+	return int32(math.Ceil(math.Log(v) / math.Log(s.gamma())))
+}
+
+// binValue returns value, which represents all observations of bin with relative error not more than Accuracy
+func (s *SummaryValue) binValue(index int32) float64 {
+	g := s.gamma()
+	return 2 * math.Pow(g, float64(index)) / (g + 1)
+}
+
+// addBin adds bin to sorted bins
+func addBin(bins []SketchBin, bin SketchBin) []SketchBin {
+	i := sort.Search(len(bins), func(i int) bool { return bins[i].Index >= bin.Index })
+	if i < len(bins) && bins[i].Index == bin.Index {
+		bins[i].Count += bin.Count
+		return bins
+	}
+	bins = append(bins, SketchBin{})
+	copy(bins[i+1:], bins[i:])
+	bins[i] = bin
+	return bins
+}
+
+// mergeBins returns union of two sorted bin lists
+func mergeBins(a, b []SketchBin) []SketchBin {
+	res := make([]SketchBin, 0, len(a)+len(b))
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i].Index < b[j].Index:
+			res = append(res, a[i])
+			i++
+		case a[i].Index > b[j].Index:
+			res = append(res, b[j])
+			j++
+		default:
+			res = append(res, SketchBin{Index: a[i].Index, Count: a[i].Count + b[j].Count})
+			i++
+			j++
+		}
+	}
+	res = append(res, a[i:]...)
+	return append(res, b[j:]...)
+}
+
+// Validate checks accuracy, order of bins and total count
+func (s *SummaryValue) Validate() error {
+	if !(s.Accuracy > 0 && s.Accuracy < 1) {
+		return fmt.Errorf("%w: summary accuracy must be in (0, 1)", ErrInvalidDistribution)
+	}
+	total := s.ZeroCount
+	for _, bins := range [][]SketchBin{s.Positive, s.Negative} {
+		for i, b := range bins {
+			if i > 0 && b.Index <= bins[i-1].Index {
+				return fmt.Errorf("%w: summary bins must be sorted by index", ErrInvalidDistribution)
+			}
+			total += b.Count
+		}
+	}
+	if total != s.Count {
+		return fmt.Errorf("%w: summary count %d doesn't match bins %d", ErrInvalidDistribution, s.Count, total)
+	}
+	return nil
+}
+
+// Merge adds observations of other summary with the same accuracy
+func (s *SummaryValue) Merge(other Distribution) error {
+	o, ok := other.(*SummaryValue)
+	if !ok {
+		return fmt.Errorf("%w: summary can't be merged with %T", ErrDistributionMismatch, other)
+	}
+	if o.Accuracy != s.Accuracy {
+		return fmt.Errorf("%w: summary accuracy %g differs from %g", ErrDistributionMismatch, o.Accuracy, s.Accuracy)
+	}
+
+	s.Positive = mergeBins(s.Positive, o.Positive)
+	s.Negative = mergeBins(s.Negative, o.Negative)
+	s.ZeroCount += o.ZeroCount
+	s.Sum += o.Sum
+	s.Count += o.Count
+	return nil
+}
+
+// Quantile returns estimation of q-quantile, q in [0, 1]. NaN is returned for empty summary
+func (s *SummaryValue) Quantile(q float64) float64 {
+	if s.Count == 0 || q < 0 || q > 1 {
+		return math.NaN()
+	}
+
+	rank := uint64(q * float64(s.Count-1))
+	var seen uint64
+	// Negative values in ascending order are bins with descending index
+	for i := len(s.Negative) - 1; i >= 0; i-- {
+		seen += s.Negative[i].Count
+		if seen > rank {
+			return -s.binValue(s.Negative[i].Index)
+		}
+	}
+	seen += s.ZeroCount
+	if seen > rank {
+		return 0
+	}
+	for _, b := range s.Positive {
+		seen += b.Count
+		if seen > rank {
+			return s.binValue(b.Index)
+		}
+	}
+	return s.binValue(s.Positive[len(s.Positive)-1].Index)
+}
+
+// IsDistribution reports whether metric type has Distribution value
+func IsDistribution(mType string) bool {
+	return mType == Histogram || mType == Summary
+}
+
+// ParseDistribution decodes and validates internal representation of histogram or summary
+func ParseDistribution(mType, value string) (Distribution, error) {
+	var d Distribution
+	switch mType {
+	case Histogram:
+		d = &HistogramValue{}
+	case Summary:
+		d = &SummaryValue{}
+	default:
+		return nil, ErrMetricNotSupportedType
+	}
+
+	if err := json.Unmarshal([]byte(value), d); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidDistribution, err.Error())
+	}
+	if err := d.Validate(); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// FormatDistribution returns internal representation of histogram or summary
+func FormatDistribution(d Distribution) (string, error) {
+	data, err := json.Marshal(d)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
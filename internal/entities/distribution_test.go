@@ -0,0 +1,84 @@
+package entities
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHistogram_Merge(t *testing.T) {
+	a := NewHistogram([]float64{0.1, 1})
+	a.Observe(0.05)
+	a.Observe(0.5)
+	b := NewHistogram([]float64{0.1, 1})
+	b.Observe(0.1)
+	b.Observe(3)
+
+	require.NoError(t, a.Merge(b))
+	require.NoError(t, a.Validate())
+	assert.Equal(t, []uint64{2, 1, 1}, a.Counts)
+	assert.Equal(t, uint64(4), a.Count)
+	assert.InDelta(t, 3.65, a.Sum, 1e-9)
+
+	assert.ErrorIs(t, a.Merge(NewHistogram([]float64{0.1, 2})), ErrDistributionMismatch)
+	assert.ErrorIs(t, a.Merge(NewSummary(DefaultSummaryAccuracy)), ErrDistributionMismatch)
+}
+
+func TestHistogram_Validate(t *testing.T) {
+	assert.ErrorIs(t, (&HistogramValue{Bounds: []float64{1, 1}, Counts: []uint64{0, 0, 0}}).Validate(), ErrInvalidDistribution)
+	assert.ErrorIs(t, (&HistogramValue{Bounds: []float64{1}, Counts: []uint64{0, 0, 0}}).Validate(), ErrInvalidDistribution)
+	assert.ErrorIs(t, (&HistogramValue{Bounds: []float64{1}, Counts: []uint64{1, 0}, Count: 2}).Validate(), ErrInvalidDistribution)
+	assert.NoError(t, NewHistogram(DefaultBuckets).Validate())
+}
+
+func TestSummary_QuantileAccuracy(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+
+	// Observations are split between agents, merged sketch must give the same accuracy
+	var values []float64
+	merged := NewSummary(DefaultSummaryAccuracy)
+	for agent := 0; agent < 4; agent++ {
+		s := NewSummary(DefaultSummaryAccuracy)
+		for i := 0; i < 2500; i++ {
+			v := math.Exp(rnd.NormFloat64()) - 0.5
+			if i%100 == 0 {
+				v = 0
+			}
+			s.Observe(v)
+			values = append(values, v)
+		}
+		require.NoError(t, merged.Merge(s))
+	}
+	require.NoError(t, merged.Validate())
+	sort.Float64s(values)
+
+	for _, q := range []float64{0, 0.1, 0.5, 0.9, 0.99, 1} {
+		exact := values[int(q*float64(len(values)-1))]
+		assert.InDelta(t, exact, merged.Quantile(q), math.Abs(exact)*DefaultSummaryAccuracy+1e-12, "quantile %g", q)
+	}
+	assert.True(t, math.IsNaN(NewSummary(DefaultSummaryAccuracy).Quantile(0.5)))
+	assert.ErrorIs(t, merged.Merge(NewSummary(0.05)), ErrDistributionMismatch)
+}
+
+func TestParseDistribution(t *testing.T) {
+	s := NewSummary(DefaultSummaryAccuracy)
+	s.Observe(1.5)
+	s.Observe(-2)
+
+	value, err := FormatDistribution(s)
+	require.NoError(t, err)
+	d, err := ParseDistribution(Summary, value)
+	require.NoError(t, err)
+	assert.Equal(t, s, d)
+
+	_, err = ParseDistribution(Histogram, `{"bounds":[1],"counts":[1],"count":1}`)
+	assert.ErrorIs(t, err, ErrInvalidDistribution)
+	_, err = ParseDistribution(Histogram, `not json`)
+	assert.ErrorIs(t, err, ErrInvalidDistribution)
+	_, err = ParseDistribution(Gauge, `{}`)
+	assert.ErrorIs(t, err, ErrMetricNotSupportedType)
+}
@@ -5,7 +5,25 @@ import "errors"
 
 // Errors list
 var (
-	ErrMetricNotFound         = errors.New("metric not found")          // Metric not found
-	ErrMetricNotSupportedType = errors.New("not supported metric type") // Unsupported metric type
-	ErrMissingField           = errors.New("missing field")             // Missing required field
+	ErrMetricNotFound         = errors.New("metric not found")           // Metric not found
+	ErrMetricNotSupportedType = errors.New("not supported metric type")  // Unsupported metric type
+	ErrMissingField           = errors.New("missing field")              // Missing required field
+	ErrInvalidTimeRange       = errors.New("invalid time range")         // Invalid history window or step
+	ErrInvalidLabel           = errors.New("invalid label")              // Invalid label name or label matcher
+	ErrInvalidDistribution    = errors.New("invalid distribution")       // Inconsistent histogram or summary
+	ErrDistributionMismatch   = errors.New("distribution mismatch")      // Histograms with different buckets or summaries with different accuracy
+	ErrInvalidTenant          = errors.New("invalid tenant")             // Invalid tenant name or API keys configuration
+	ErrUnknownAPIKey          = errors.New("unknown API key")            // Request is made with missing or unknown API key
+	ErrInvalidResolution      = errors.New("invalid resolution")         // Unknown resolution of rollups
+	ErrInvalidRetention       = errors.New("invalid retention rule")     // Invalid retention rules configuration
+	ErrStorageDegraded        = errors.New("storage is degraded")        // Database is unavailable, writes are journaled
+	ErrJournalFull            = errors.New("journal is full")            // Database is unavailable and journal can't accept more writes
+	ErrFlushBacklog           = errors.New("too many unflushed changes") // Cache can't accept changes until pending ones are written to storage
+	ErrConditionFailed        = errors.New("condition failed")           // Current state of metric doesn't satisfy conditional update
+	ErrMetricTypeConflict     = errors.New("metric type conflict")       // Metric name is owned by another type
+	ErrMetadataNotFound       = errors.New("metadata not found")         // Metric name has no metadata
+	ErrInvalidMetadata        = errors.New("invalid metadata")           // Invalid unit or help text of metric
+	ErrInvalidGraphiteRule    = errors.New("invalid graphite rule")      // Invalid type rules of Graphite paths
+	ErrInvalidInfluxRule      = errors.New("invalid influx rule")        // Invalid type rules of InfluxDB integer fields
+	ErrNameTooLong            = errors.New("metric name is too long")    // Metric name can't be stored by every storage
 )
@@ -0,0 +1,85 @@
+package entities
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// GraphiteRule defines type of metrics received by Graphite paths matching pattern
+type GraphiteRule struct {
+	Path  string // Dotted pattern, every segment is glob matching one path segment (see path.Match)
+	MType string // Gauge or Counter
+}
+
+// Matches reports whether rule applies to Graphite path
+func (r GraphiteRule) Matches(p string) bool {
+	patterns := strings.Split(r.Path, ".")
+	segments := strings.Split(p, ".")
+	if len(patterns) != len(segments) {
+		return false
+	}
+	for i, pattern := range patterns {
+		if ok, _ := path.Match(pattern, segments[i]); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// String returns rule in form accepted by ParseGraphiteRules
+func (r GraphiteRule) String() string {
+	return "path=" + r.Path + ",type=" + r.MType
+}
+
+// GraphiteTypeFor returns type of the first rule matching path, Gauge if no rule matches
+func GraphiteTypeFor(rules []GraphiteRule, p string) string {
+	for _, r := range rules {
+		if r.Matches(p) {
+			return r.MType
+		}
+	}
+	return Gauge
+}
+
+// ParseGraphiteRules parses rules separated by `;`. Rule is comma separated `path=<pattern>` and
+// `type=<gauge|counter>`, e.g. `path=*.interface-*.if_octets.*,type=counter;path=*.load.*,type=gauge`.
+// The first rule matching path is applied to it
+func ParseGraphiteRules(s string) ([]GraphiteRule, error) {
+	var rules []GraphiteRule
+	for _, text := range strings.Split(s, ";") {
+		text = strings.TrimSpace(text)
+		if text == "" {
+			continue
+		}
+
+		var r GraphiteRule
+		for _, field := range strings.Split(text, ",") {
+			key, value, ok := strings.Cut(strings.TrimSpace(field), "=")
+			if !ok {
+				return nil, fmt.Errorf("%w: field %q of rule %q must be `key=value`", ErrInvalidGraphiteRule, field, text)
+			}
+			switch key {
+			case "path":
+				for _, pattern := range strings.Split(value, ".") {
+					if _, err := path.Match(pattern, ""); err != nil || pattern == "" {
+						return nil, fmt.Errorf("%w: rule %q has invalid path pattern", ErrInvalidGraphiteRule, text)
+					}
+				}
+				r.Path = value
+			case "type":
+				if value != Gauge && value != Counter {
+					return nil, fmt.Errorf("%w: rule %q: type must be %s or %s", ErrInvalidGraphiteRule, text, Gauge, Counter)
+				}
+				r.MType = value
+			default:
+				return nil, fmt.Errorf("%w: rule %q has unknown field %q", ErrInvalidGraphiteRule, text, key)
+			}
+		}
+		if r.Path == "" || r.MType == "" {
+			return nil, fmt.Errorf("%w: rule %q must have path and type", ErrInvalidGraphiteRule, text)
+		}
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
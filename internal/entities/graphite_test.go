@@ -0,0 +1,41 @@
+package entities
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseGraphiteRules(t *testing.T) {
+	rules, err := ParseGraphiteRules("path=*.interface-*.if_octets.*, type=counter; path=*.load.*,type=gauge ;")
+	require.NoError(t, err)
+	assert.Equal(t, []GraphiteRule{
+		{Path: "*.interface-*.if_octets.*", MType: Counter},
+		{Path: "*.load.*", MType: Gauge},
+	}, rules)
+	assert.Equal(t, "path=*.load.*,type=gauge", rules[1].String())
+
+	rules, err = ParseGraphiteRules("")
+	require.NoError(t, err)
+	assert.Empty(t, rules)
+
+	for _, s := range []string{"path=*", "type=counter", "path=*,type=summary", "path=[,type=gauge", "path=a..b,type=gauge", "name=*,type=gauge", "path"} {
+		_, err = ParseGraphiteRules(s)
+		assert.ErrorIs(t, err, ErrInvalidGraphiteRule, s)
+	}
+}
+
+func TestGraphiteTypeFor(t *testing.T) {
+	rules := []GraphiteRule{
+		{Path: "*.interface-*.if_octets.*", MType: Counter},
+		{Path: "web?.*.requests", MType: Counter},
+	}
+
+	assert.Equal(t, Counter, GraphiteTypeFor(rules, "host1.interface-eth0.if_octets.rx"))
+	assert.Equal(t, Counter, GraphiteTypeFor(rules, "web1.nginx.requests"))
+	// Star matches single segment only
+	assert.Equal(t, Gauge, GraphiteTypeFor(rules, "host1.interface-eth0.if_octets.rx.total"))
+	assert.Equal(t, Gauge, GraphiteTypeFor(rules, "db1.nginx.requests"))
+	assert.Equal(t, Gauge, GraphiteTypeFor(nil, "host1.load.shortterm"))
+}
@@ -0,0 +1,80 @@
+package entities
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// InfluxIntegerRule defines type of metrics made of integer fields of InfluxDB points
+type InfluxIntegerRule struct {
+	Name  string // Glob pattern of metric name `<measurement>_<field>` (see path.Match), empty matches all names
+	MType string // Gauge or Counter
+}
+
+// Matches reports whether rule applies to metric name
+func (r InfluxIntegerRule) Matches(name string) bool {
+	if r.Name == "" {
+		return true
+	}
+	ok, _ := path.Match(r.Name, name)
+	return ok
+}
+
+// String returns rule in form accepted by ParseInfluxIntegerRules
+func (r InfluxIntegerRule) String() string {
+	if r.Name == "" {
+		return "type=" + r.MType
+	}
+	return "name=" + r.Name + ",type=" + r.MType
+}
+
+// InfluxIntegerTypeFor returns type of the first rule matching metric name, Gauge if no rule matches
+func InfluxIntegerTypeFor(rules []InfluxIntegerRule, name string) string {
+	for _, r := range rules {
+		if r.Matches(name) {
+			return r.MType
+		}
+	}
+	return Gauge
+}
+
+// ParseInfluxIntegerRules parses rules separated by `;`. Rule is comma separated `name=<glob>` and
+// `type=<gauge|counter>`, rule without name matches all metrics, e.g. `name=net_bytes_*,type=counter;type=gauge`.
+// The first rule matching metric is applied to it
+func ParseInfluxIntegerRules(s string) ([]InfluxIntegerRule, error) {
+	var rules []InfluxIntegerRule
+	for _, text := range strings.Split(s, ";") {
+		text = strings.TrimSpace(text)
+		if text == "" {
+			continue
+		}
+
+		var r InfluxIntegerRule
+		for _, field := range strings.Split(text, ",") {
+			key, value, ok := strings.Cut(strings.TrimSpace(field), "=")
+			if !ok {
+				return nil, fmt.Errorf("%w: field %q of rule %q must be `key=value`", ErrInvalidInfluxRule, field, text)
+			}
+			switch key {
+			case "name":
+				if _, err := path.Match(value, ""); err != nil {
+					return nil, fmt.Errorf("%w: rule %q: %s", ErrInvalidInfluxRule, text, err.Error())
+				}
+				r.Name = value
+			case "type":
+				if value != Gauge && value != Counter {
+					return nil, fmt.Errorf("%w: rule %q: type must be %s or %s", ErrInvalidInfluxRule, text, Gauge, Counter)
+				}
+				r.MType = value
+			default:
+				return nil, fmt.Errorf("%w: rule %q has unknown field %q", ErrInvalidInfluxRule, text, key)
+			}
+		}
+		if r.MType == "" {
+			return nil, fmt.Errorf("%w: rule %q has no type", ErrInvalidInfluxRule, text)
+		}
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
@@ -0,0 +1,40 @@
+package entities
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseInfluxIntegerRules(t *testing.T) {
+	rules, err := ParseInfluxIntegerRules("name=net_bytes_*, type=counter; type=gauge ;")
+	require.NoError(t, err)
+	assert.Equal(t, []InfluxIntegerRule{
+		{Name: "net_bytes_*", MType: Counter},
+		{MType: Gauge},
+	}, rules)
+	assert.Equal(t, "name=net_bytes_*,type=counter", rules[0].String())
+	assert.Equal(t, "type=gauge", rules[1].String())
+
+	rules, err = ParseInfluxIntegerRules("")
+	require.NoError(t, err)
+	assert.Empty(t, rules)
+
+	for _, s := range []string{"name=net_*", "type=summary", "name=[,type=counter", "path=*,type=gauge", "type"} {
+		_, err = ParseInfluxIntegerRules(s)
+		assert.ErrorIs(t, err, ErrInvalidInfluxRule, s)
+	}
+}
+
+func TestInfluxIntegerTypeFor(t *testing.T) {
+	rules := []InfluxIntegerRule{
+		{Name: "mem_*", MType: Gauge},
+		{Name: "*_total", MType: Counter},
+	}
+
+	assert.Equal(t, Gauge, InfluxIntegerTypeFor(rules, "mem_used"))
+	assert.Equal(t, Counter, InfluxIntegerTypeFor(rules, "http_requests_total"))
+	assert.Equal(t, Gauge, InfluxIntegerTypeFor(rules, "disk_free"))
+	assert.Equal(t, Counter, InfluxIntegerTypeFor([]InfluxIntegerRule{{MType: Counter}}, "disk_free"))
+}
@@ -0,0 +1,10 @@
+package entities
+
+// JournalStats describes journal of writes made while database is unavailable
+type JournalStats struct {
+	Records  int   `json:"records"`  // Number of writes waiting for replay
+	Bytes    int64 `json:"bytes"`    // Size of journal file
+	Degraded bool  `json:"degraded"` // Database is considered unavailable
+
+	Secondary *JournalStats `json:"secondary,omitempty"` // Journal of secondary storage in dual-write mode
+}
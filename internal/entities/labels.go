@@ -0,0 +1,166 @@
+package entities
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// labelNameRe - allowed label names, same as in Prometheus
+var labelNameRe = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// ValidateLabels checks that all label names are valid
+func ValidateLabels(labels map[string]string) error {
+	for name := range labels {
+		if !labelNameRe.MatchString(name) {
+			return fmt.Errorf("%w: name %q", ErrInvalidLabel, name)
+		}
+	}
+	return nil
+}
+
+// LabelsKey returns canonical representation of labels `{a="1",b="2"}` with names sorted.
+// Empty string is returned for metric without labels
+func LabelsKey(labels map[string]string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, name := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(name)
+		b.WriteString(`="`)
+		b.WriteString(labelValueEscaper.Replace(labels[name]))
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// SeriesKey returns key, which identifies metric series of single type: name followed by canonical labels
+func SeriesKey(name string, labels map[string]string) string {
+	if len(labels) == 0 {
+		return name
+	}
+	return name + LabelsKey(labels)
+}
+
+// CloneLabels returns copy of labels, nil for metric without labels
+func CloneLabels(labels map[string]string) map[string]string {
+	if len(labels) == 0 {
+		return nil
+	}
+	res := make(map[string]string, len(labels))
+	for k, v := range labels {
+		res[k] = v
+	}
+	return res
+}
+
+// MatchType define how LabelMatcher compares label value
+type MatchType int
+
+// Label match types
+const (
+	MatchEqual     MatchType = iota // Label value is equal to matcher value
+	MatchNotEqual                   // Label value is not equal to matcher value
+	MatchRegexp                     // Label value matches regular expression
+	MatchNotRegexp                  // Label value doesn't match regular expression
+)
+
+// LabelMatcher selects metrics by label value. Absent label is matched as empty value
+type LabelMatcher struct {
+	Type  MatchType
+	Name  string
+	Value string
+	re    *regexp.Regexp
+}
+
+// NewLabelMatcher returns matcher, regular expressions are anchored on both ends
+func NewLabelMatcher(t MatchType, name, value string) (LabelMatcher, error) {
+	m := LabelMatcher{Type: t, Name: name, Value: value}
+	if !labelNameRe.MatchString(name) {
+		return LabelMatcher{}, fmt.Errorf("%w: name %q", ErrInvalidLabel, name)
+	}
+
+	switch t {
+	case MatchEqual, MatchNotEqual:
+	case MatchRegexp, MatchNotRegexp:
+		re, err := regexp.Compile("^(?:" + value + ")$")
+		if err != nil {
+			return LabelMatcher{}, fmt.Errorf("%w: %s", ErrInvalidLabel, err.Error())
+		}
+		m.re = re
+	default:
+		return LabelMatcher{}, fmt.Errorf("%w: unknown match type %d", ErrInvalidLabel, t)
+	}
+	return m, nil
+}
+
+// ParseLabelMatcher parses matcher in form `name=value`, `name!=value`, `name=~regexp` or `name!~regexp`
+func ParseLabelMatcher(s string) (LabelMatcher, error) {
+	i := strings.IndexAny(s, "=!")
+	if i < 0 {
+		return LabelMatcher{}, fmt.Errorf("%w: matcher %q has no operator", ErrInvalidLabel, s)
+	}
+
+	name, rest := s[:i], s[i:]
+	switch {
+	case strings.HasPrefix(rest, "!="):
+		return NewLabelMatcher(MatchNotEqual, name, rest[2:])
+	case strings.HasPrefix(rest, "=~"):
+		return NewLabelMatcher(MatchRegexp, name, rest[2:])
+	case strings.HasPrefix(rest, "!~"):
+		return NewLabelMatcher(MatchNotRegexp, name, rest[2:])
+	case strings.HasPrefix(rest, "="):
+		return NewLabelMatcher(MatchEqual, name, rest[1:])
+	default:
+		return LabelMatcher{}, fmt.Errorf("%w: matcher %q has no operator", ErrInvalidLabel, s)
+	}
+}
+
+// Matches reports whether labels satisfy matcher
+func (m LabelMatcher) Matches(labels map[string]string) bool {
+	value := labels[m.Name]
+	switch m.Type {
+	case MatchEqual:
+		return value == m.Value
+	case MatchNotEqual:
+		return value != m.Value
+	case MatchRegexp:
+		return m.re.MatchString(value)
+	case MatchNotRegexp:
+		return !m.re.MatchString(value)
+	default:
+		return false
+	}
+}
+
+// String returns matcher in form accepted by ParseLabelMatcher
+func (m LabelMatcher) String() string {
+	ops := [...]string{MatchEqual: "=", MatchNotEqual: "!=", MatchRegexp: "=~", MatchNotRegexp: "!~"}
+	return m.Name + ops[m.Type] + m.Value
+}
+
+// MatchLabels reports whether labels satisfy all matchers
+func MatchLabels(labels map[string]string, matchers []LabelMatcher) bool {
+	for _, m := range matchers {
+		if !m.Matches(labels) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,60 @@
+package entities
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSeriesKey(t *testing.T) {
+	assert.Equal(t, "PollCount", SeriesKey("PollCount", nil))
+	assert.Equal(t,
+		`CPUutilization{cpu="1",host="web \"1\""}`,
+		SeriesKey("CPUutilization", map[string]string{"host": `web "1"`, "cpu": "1"}),
+	)
+	assert.Equal(t,
+		SeriesKey("m", map[string]string{"a": "1", "b": "2"}),
+		SeriesKey("m", map[string]string{"b": "2", "a": "1"}),
+	)
+}
+
+func TestValidateLabels(t *testing.T) {
+	assert.NoError(t, ValidateLabels(map[string]string{"host": "a", "_cpu2": ""}))
+	assert.ErrorIs(t, ValidateLabels(map[string]string{"2cpu": "a"}), ErrInvalidLabel)
+	assert.ErrorIs(t, ValidateLabels(map[string]string{"host-name": "a"}), ErrInvalidLabel)
+}
+
+func TestParseLabelMatcher(t *testing.T) {
+	labels := map[string]string{"host": "web1", "cpu": "2"}
+
+	tests := []struct {
+		input   string
+		matches bool
+		err     bool
+	}{
+		{input: "host=web1", matches: true},
+		{input: "host!=web1", matches: false},
+		{input: "host=~web.*", matches: true},
+		{input: "host=~web", matches: false},
+		{input: "cpu!~1|3", matches: true},
+		{input: "dc=", matches: true},
+		{input: "dc!=", matches: false},
+		{input: "host", err: true},
+		{input: "=web1", err: true},
+		{input: "host=~(", err: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			m, err := ParseLabelMatcher(tt.input)
+			if tt.err {
+				assert.ErrorIs(t, err, ErrInvalidLabel)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.matches, m.Matches(labels))
+			assert.Equal(t, tt.input, m.String())
+		})
+	}
+}
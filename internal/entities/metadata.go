@@ -0,0 +1,57 @@
+package entities
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// MetricMetadata describes metric name: type owning the name, unit and help text.
+// Values of the name are accepted only with owning type
+type MetricMetadata struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+	Unit string `json:"unit,omitempty"`
+	Help string `json:"help,omitempty"`
+}
+
+// unitRe - allowed units, e.g. `bytes`, `seconds`, `%`, `requests/s`
+var unitRe = regexp.MustCompile(`^[a-zA-Z0-9_%./]*$`)
+
+// Validate checks that metadata has name, known type and unit without spaces
+func (m MetricMetadata) Validate() error {
+	if m.Name == "" || m.Type == "" {
+		return ErrMissingField
+	}
+	if !IsKnownType(m.Type) {
+		return ErrMetricNotSupportedType
+	}
+	if err := CheckNameLength(m.Name); err != nil {
+		return err
+	}
+	if !unitRe.MatchString(m.Unit) {
+		return fmt.Errorf("%w: unit %q", ErrInvalidMetadata, m.Unit)
+	}
+	if strings.ContainsAny(m.Help, "\r\n") {
+		return fmt.Errorf("%w: help must be single line", ErrInvalidMetadata)
+	}
+	return nil
+}
+
+// ValidateClaims checks that names claimed by types are not empty and types are known
+func ValidateClaims(types map[string]string) error {
+	for name, mType := range types {
+		if name == "" {
+			return ErrMissingField
+		}
+		if !IsKnownType(mType) {
+			return ErrMetricNotSupportedType
+		}
+	}
+	return nil
+}
+
+// TypeConflict returns error of storing name with type other than owner
+func TypeConflict(name, owner, mType string) error {
+	return fmt.Errorf("%w: %q is %s, can't store it as %s", ErrMetricTypeConflict, name, owner, mType)
+}
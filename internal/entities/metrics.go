@@ -1,22 +1,74 @@
 package entities
 
+import (
+	"fmt"
+	"time"
+	"unicode/utf8"
+)
+
 // Metric types
 const (
-	Gauge   = "gauge"
-	Counter = "counter"
+	Gauge     = "gauge"
+	Counter   = "counter"
+	Histogram = "histogram"
+	Summary   = "summary"
 )
 
+// MaxNameLength - maximum number of characters in metric name, which every storage can store
+const MaxNameLength = 50
+
+// CheckNameLength returns ErrNameTooLong if metric name is longer than MaxNameLength
+func CheckNameLength(name string) error {
+	if utf8.RuneCountInString(name) > MaxNameLength {
+		return fmt.Errorf("%w: %q has more than %d characters", ErrNameTooLong, name, MaxNameLength)
+	}
+	return nil
+}
+
+// IsKnownType reports whether metric type is supported
+func IsKnownType(mType string) bool {
+	return mType == Gauge || mType == Counter || IsDistribution(mType)
+}
+
 // Metric define model for external usage
 type Metric struct {
-	ID    string   `json:"id" binding:"required"`   // Metric name
-	MType string   `json:"type" binding:"required"` // Metric type
-	Delta *int64   `json:"delta,omitempty"`         // Value for counter metric
-	Value *float64 `json:"value,omitempty"`         // Value for gauge metric
+	ID        string            `json:"id" binding:"required"`   // Metric name
+	MType     string            `json:"type" binding:"required"` // Metric type
+	Delta     *int64            `json:"delta,omitempty"`         // Value for counter metric
+	Value     *float64          `json:"value,omitempty"`         // Value for gauge metric
+	Histogram *HistogramValue   `json:"histogram,omitempty"`     // Value for histogram metric
+	Summary   *SummaryValue     `json:"summary,omitempty"`       // Value for summary metric
+	Labels    map[string]string `json:"labels,omitempty"`        // Dimensions of metric, series is identified by name, type and labels
+	Version   int64             `json:"-"`                       // Version of gauge, see GaugeCondition. Returned by API as ETag
 }
 
-// MetricInternal define model for internal usage
+// MetricInternal define model for internal usage.
+// Value of histogram and summary is JSON, see ParseDistribution
 type MetricInternal struct {
-	ID    string
-	MType string
-	Value string
+	ID      string
+	MType   string
+	Value   string
+	Labels  map[string]string `json:",omitempty"`
+	Version int64             `json:",omitempty"` // Version of gauge read from storage, ignored by writes
+}
+
+// MetricPoint define single historical value of metric for external usage
+type MetricPoint struct {
+	Timestamp time.Time `json:"timestamp"`       // Moment when value was stored
+	Delta     *int64    `json:"delta,omitempty"` // Value for counter metric
+	Value     *float64  `json:"value,omitempty"` // Value for gauge metric
+}
+
+// MetricHistory define historical values of metric for external usage
+type MetricHistory struct {
+	ID     string            `json:"id"`               // Metric name
+	MType  string            `json:"type"`             // Metric type
+	Labels map[string]string `json:"labels,omitempty"` // Dimensions of metric
+	Points []MetricPoint     `json:"points"`           // Values ordered by timestamp
+}
+
+// MetricPointInternal define single historical value of metric for internal usage
+type MetricPointInternal struct {
+	Timestamp time.Time
+	Value     string
 }
@@ -0,0 +1,133 @@
+package entities
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RetentionRule defines how long series of matching metrics and their history are kept
+type RetentionRule struct {
+	MType   string        // Metric type, empty matches all types
+	Name    string        // Glob pattern of metric name (see path.Match), empty matches all names
+	TTL     time.Duration // Series not updated for TTL are deleted, zero keeps series forever
+	History time.Duration // History values older than History are deleted, zero keeps whole history
+}
+
+// Matches reports whether rule applies to metric
+func (r RetentionRule) Matches(mType, name string) bool {
+	if r.MType != "" && r.MType != mType {
+		return false
+	}
+	if r.Name == "" {
+		return true
+	}
+	ok, _ := path.Match(r.Name, name)
+	return ok
+}
+
+// String returns rule in form accepted by ParseRetentionRules
+func (r RetentionRule) String() string {
+	var parts []string
+	if r.MType != "" {
+		parts = append(parts, "type="+r.MType)
+	}
+	if r.Name != "" {
+		parts = append(parts, "name="+r.Name)
+	}
+	if r.TTL > 0 {
+		parts = append(parts, "ttl="+r.TTL.String())
+	}
+	if r.History > 0 {
+		parts = append(parts, "history="+r.History.String())
+	}
+	return strings.Join(parts, ",")
+}
+
+// RetentionRuleFor returns the first rule, which matches metric
+func RetentionRuleFor(rules []RetentionRule, mType, name string) (RetentionRule, bool) {
+	for _, r := range rules {
+		if r.Matches(mType, name) {
+			return r, true
+		}
+	}
+	return RetentionRule{}, false
+}
+
+// ParseRetentionRules parses rules separated by `;`. Rule is comma separated list of
+// `type=<metric type>`, `name=<glob>`, `ttl=<duration>` and `history=<duration>`, e.g.
+// `type=gauge,ttl=24h;name=Poll*,history=7d`. Durations accept `d` suffix for days.
+// The first rule matching metric is applied to it
+func ParseRetentionRules(s string) ([]RetentionRule, error) {
+	var rules []RetentionRule
+	for _, text := range strings.Split(s, ";") {
+		text = strings.TrimSpace(text)
+		if text == "" {
+			continue
+		}
+
+		var r RetentionRule
+		for _, field := range strings.Split(text, ",") {
+			key, value, ok := strings.Cut(strings.TrimSpace(field), "=")
+			if !ok {
+				return nil, fmt.Errorf("%w: field %q of rule %q must be `key=value`", ErrInvalidRetention, field, text)
+			}
+			var err error
+			switch key {
+			case "type":
+				if !IsKnownType(value) {
+					return nil, fmt.Errorf("%w: rule %q: %s", ErrInvalidRetention, text, ErrMetricNotSupportedType.Error())
+				}
+				r.MType = value
+			case "name":
+				if _, err = path.Match(value, ""); err != nil {
+					return nil, fmt.Errorf("%w: rule %q: %s", ErrInvalidRetention, text, err.Error())
+				}
+				r.Name = value
+			case "ttl":
+				r.TTL, err = parseRetentionDuration(value)
+			case "history":
+				r.History, err = parseRetentionDuration(value)
+			default:
+				return nil, fmt.Errorf("%w: rule %q has unknown field %q", ErrInvalidRetention, text, key)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("%w: rule %q: %s", ErrInvalidRetention, text, err.Error())
+			}
+		}
+		if r.TTL == 0 && r.History == 0 {
+			return nil, fmt.Errorf("%w: rule %q has neither ttl nor history", ErrInvalidRetention, text)
+		}
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
+
+// parseRetentionDuration parses positive duration, `d` suffix means days
+func parseRetentionDuration(s string) (time.Duration, error) {
+	var d time.Duration
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration %q", s)
+		}
+		d = time.Duration(n) * 24 * time.Hour
+	} else {
+		var err error
+		if d, err = time.ParseDuration(s); err != nil {
+			return 0, err
+		}
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("duration %q must be positive", s)
+	}
+	return d, nil
+}
+
+// PruneReport describes result of single retention run
+type PruneReport struct {
+	Series        int // Number of deleted series
+	HistoryPoints int // Number of deleted history values
+}
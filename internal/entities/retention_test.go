@@ -0,0 +1,50 @@
+package entities
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRetentionRules(t *testing.T) {
+	rules, err := ParseRetentionRules("type=gauge, ttl=24h; name=Poll*,history=7d ;")
+	require.NoError(t, err)
+	assert.Equal(t, []RetentionRule{
+		{MType: Gauge, TTL: 24 * time.Hour},
+		{Name: "Poll*", History: 7 * 24 * time.Hour},
+	}, rules)
+
+	rules, err = ParseRetentionRules("")
+	require.NoError(t, err)
+	assert.Empty(t, rules)
+
+	for _, s := range []string{"type=gauge", "type=nonType,ttl=1h", "name=[,ttl=1h", "ttl=-1h", "ttl=xd", "size=1,ttl=1h", "ttl"} {
+		_, err = ParseRetentionRules(s)
+		assert.ErrorIs(t, err, ErrInvalidRetention, s)
+	}
+}
+
+func TestRetentionRuleFor(t *testing.T) {
+	rules := []RetentionRule{
+		{MType: Gauge, Name: "CPU*", TTL: time.Hour},
+		{MType: Gauge, TTL: 24 * time.Hour},
+		{Name: "Poll*", History: time.Hour},
+	}
+
+	r, ok := RetentionRuleFor(rules, Gauge, "CPUutilization1")
+	require.True(t, ok)
+	assert.Equal(t, time.Hour, r.TTL)
+
+	r, ok = RetentionRuleFor(rules, Gauge, "Alloc")
+	require.True(t, ok)
+	assert.Equal(t, 24*time.Hour, r.TTL)
+
+	r, ok = RetentionRuleFor(rules, Counter, "PollCount")
+	require.True(t, ok)
+	assert.Equal(t, time.Hour, r.History)
+
+	_, ok = RetentionRuleFor(rules, Counter, "Errors")
+	assert.False(t, ok)
+}
@@ -0,0 +1,100 @@
+package entities
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// RollupResolution describes width of gauge rollup buckets
+type RollupResolution struct {
+	Name   string        // Name used in API, e.g. `1m`
+	Step   time.Duration // Width of bucket
+	Retain int           // Number of the latest buckets kept by memory storage
+}
+
+// DefaultRollupResolution - resolution of rollups returned when client doesn't choose it
+const DefaultRollupResolution = "1m"
+
+// RollupResolutions - resolutions, which rollups are maintained for every gauge
+var RollupResolutions = []RollupResolution{
+	{Name: "1m", Step: time.Minute, Retain: 24 * 60},
+	{Name: "10m", Step: 10 * time.Minute, Retain: 7 * 24 * 6},
+	{Name: "1h", Step: time.Hour, Retain: 30 * 24},
+}
+
+// ParseResolution returns rollup resolution by name
+func ParseResolution(name string) (RollupResolution, error) {
+	for _, r := range RollupResolutions {
+		if r.Name == name {
+			return r, nil
+		}
+	}
+	return RollupResolution{}, fmt.Errorf("%w: %q", ErrInvalidResolution, name)
+}
+
+// ResolutionOf returns rollup resolution by width of bucket
+func ResolutionOf(step time.Duration) (RollupResolution, error) {
+	for _, r := range RollupResolutions {
+		if r.Step == step {
+			return r, nil
+		}
+	}
+	return RollupResolution{}, fmt.Errorf("%w: %s", ErrInvalidResolution, step)
+}
+
+// RollupInternal define aggregate of gauge values observed in bucket [Bucket, Bucket+Step) for internal usage
+type RollupInternal struct {
+	ID     string
+	Labels map[string]string
+	Step   time.Duration
+	Bucket time.Time // Start of bucket, multiple of Step since Unix epoch
+	Min    float64
+	Max    float64
+	Sum    float64
+	Count  uint64
+}
+
+// NewRollup returns rollup of single gauge value observed at moment ts
+func NewRollup(id string, labels map[string]string, step time.Duration, ts time.Time, value float64) RollupInternal {
+	return RollupInternal{
+		ID:     id,
+		Labels: labels,
+		Step:   step,
+		Bucket: ts.Truncate(step),
+		Min:    value,
+		Max:    value,
+		Sum:    value,
+		Count:  1,
+	}
+}
+
+// Merge adds values aggregated by other rollup of the same bucket
+func (r *RollupInternal) Merge(other RollupInternal) {
+	if r.Count == 0 {
+		r.Min, r.Max = other.Min, other.Max
+	} else {
+		r.Min = math.Min(r.Min, other.Min)
+		r.Max = math.Max(r.Max, other.Max)
+	}
+	r.Sum += other.Sum
+	r.Count += other.Count
+}
+
+// Rollup define aggregate of gauge values in bucket for external usage
+type Rollup struct {
+	Timestamp time.Time `json:"timestamp"` // Start of bucket
+	Min       float64   `json:"min"`
+	Max       float64   `json:"max"`
+	Avg       float64   `json:"avg"`
+	Sum       float64   `json:"sum"`
+	Count     uint64    `json:"count"`
+}
+
+// MetricRollups define rollups of gauge for external usage
+type MetricRollups struct {
+	ID         string            `json:"id"`               // Metric name
+	Labels     map[string]string `json:"labels,omitempty"` // Dimensions of metric
+	Resolution string            `json:"resolution"`       // Width of buckets
+	Points     []Rollup          `json:"points"`           // Buckets ordered by timestamp
+}
@@ -0,0 +1,42 @@
+package entities
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRollup_Merge(t *testing.T) {
+	ts := time.Date(2024, 5, 1, 10, 7, 30, 0, time.UTC)
+	r := NewRollup("CPU", nil, 10*time.Minute, ts, 5)
+	assert.Equal(t, time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC), r.Bucket)
+
+	r.Merge(NewRollup("CPU", nil, 10*time.Minute, ts.Add(time.Minute), 1))
+	r.Merge(NewRollup("CPU", nil, 10*time.Minute, ts.Add(2*time.Minute), 9))
+	assert.Equal(t, 1.0, r.Min)
+	assert.Equal(t, 9.0, r.Max)
+	assert.Equal(t, 15.0, r.Sum)
+	assert.EqualValues(t, 3, r.Count)
+
+	empty := RollupInternal{}
+	empty.Merge(r)
+	assert.Equal(t, 1.0, empty.Min)
+	assert.Equal(t, 9.0, empty.Max)
+}
+
+func TestParseResolution(t *testing.T) {
+	r, err := ParseResolution("10m")
+	require.NoError(t, err)
+	assert.Equal(t, 10*time.Minute, r.Step)
+
+	r, err = ResolutionOf(time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, "1h", r.Name)
+
+	_, err = ParseResolution("5m")
+	assert.ErrorIs(t, err, ErrInvalidResolution)
+	_, err = ResolutionOf(time.Second)
+	assert.ErrorIs(t, err, ErrInvalidResolution)
+}
@@ -0,0 +1,52 @@
+package entities
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// DefaultTenant owns metrics of requests without tenant, e.g. when API keys are not configured
+const DefaultTenant = "default"
+
+// tenantRe - allowed tenant names
+var tenantRe = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,64}$`)
+
+type tenantKey struct{}
+
+// ContextWithTenant returns context of request made on behalf of tenant
+func ContextWithTenant(ctx context.Context, tenant string) context.Context {
+	return context.WithValue(ctx, tenantKey{}, tenant)
+}
+
+// TenantFromContext returns tenant of request, DefaultTenant if context has no tenant
+func TenantFromContext(ctx context.Context) string {
+	if tenant, ok := ctx.Value(tenantKey{}).(string); ok && tenant != "" {
+		return tenant
+	}
+	return DefaultTenant
+}
+
+// ParseAPIKeys parses comma separated `key:tenant` pairs into map from API key to tenant
+func ParseAPIKeys(s string) (map[string]string, error) {
+	keys := make(map[string]string)
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		key, tenant, ok := strings.Cut(pair, ":")
+		if !ok || key == "" {
+			return nil, fmt.Errorf("%w: API key pair %q must be `key:tenant`", ErrInvalidTenant, pair)
+		}
+		if !tenantRe.MatchString(tenant) {
+			return nil, fmt.Errorf("%w: name %q", ErrInvalidTenant, tenant)
+		}
+		if _, ok := keys[key]; ok {
+			return nil, fmt.Errorf("%w: API key of tenant %q is duplicated", ErrInvalidTenant, tenant)
+		}
+		keys[key] = tenant
+	}
+	return keys, nil
+}
@@ -0,0 +1,31 @@
+package entities
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTenantFromContext(t *testing.T) {
+	ctx := context.Background()
+	assert.Equal(t, DefaultTenant, TenantFromContext(ctx))
+	assert.Equal(t, "team-a", TenantFromContext(ContextWithTenant(ctx, "team-a")))
+	assert.Equal(t, DefaultTenant, TenantFromContext(ContextWithTenant(ctx, "")))
+}
+
+func TestParseAPIKeys(t *testing.T) {
+	keys, err := ParseAPIKeys("secret1:team-a, secret2:team_b,")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"secret1": "team-a", "secret2": "team_b"}, keys)
+
+	keys, err = ParseAPIKeys("")
+	require.NoError(t, err)
+	assert.Empty(t, keys)
+
+	for _, s := range []string{"secret", ":team", "secret:", "secret:team a", "k:a,k:b"} {
+		_, err = ParseAPIKeys(s)
+		assert.ErrorIs(t, err, ErrInvalidTenant, s)
+	}
+}
@@ -0,0 +1,266 @@
+// Package exposition renders metrics in Prometheus text and OpenMetrics formats
+package exposition
+
+import (
+	"bufio"
+	"io"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/melkomukovki/go-musthave-metrics/internal/entities"
+)
+
+// Format define exposition format of metrics
+type Format int
+
+// Supported exposition formats
+const (
+	FormatText        Format = iota // Prometheus text format 0.0.4
+	FormatOpenMetrics               // OpenMetrics text format 1.0.0
+)
+
+// Content types of exposition formats
+const (
+	ContentTypeText        = "text/plain; version=0.0.4; charset=utf-8"
+	ContentTypeOpenMetrics = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+)
+
+// SummaryQuantiles - quantiles exposed for summary metrics
+var SummaryQuantiles = []float64{0.5, 0.9, 0.99}
+
+// ContentType returns value of Content-Type header of format
+func (f Format) ContentType() string {
+	if f == FormatOpenMetrics {
+		return ContentTypeOpenMetrics
+	}
+	return ContentTypeText
+}
+
+// Negotiate selects format by Accept header. OpenMetrics is chosen only if it is accepted
+// with quality not lower than any other media range, Prometheus text format is the default
+func Negotiate(accept string) Format {
+	var openMetrics, other float64
+	for _, part := range strings.Split(accept, ",") {
+		params := strings.Split(part, ";")
+		mediaType := strings.ToLower(strings.TrimSpace(params[0]))
+		if mediaType == "" {
+			continue
+		}
+
+		q := 1.0
+		for _, p := range params[1:] {
+			name, value, ok := strings.Cut(strings.TrimSpace(p), "=")
+			if !ok || strings.ToLower(strings.TrimSpace(name)) != "q" {
+				continue
+			}
+			if v, err := strconv.ParseFloat(strings.TrimSpace(value), 64); err == nil && v >= 0 && v <= 1 {
+				q = v
+			}
+		}
+
+		if mediaType == "application/openmetrics-text" {
+			openMetrics = math.Max(openMetrics, q)
+		} else {
+			other = math.Max(other, q)
+		}
+	}
+
+	if openMetrics > 0 && openMetrics >= other {
+		return FormatOpenMetrics
+	}
+	return FormatText
+}
+
+var (
+	invalidNameChars = regexp.MustCompile(`[^a-zA-Z0-9_:]`)
+	unitRe           = regexp.MustCompile(`^[a-zA-Z0-9_]+$`)
+)
+
+// SanitizeName replaces characters not allowed in Prometheus metric names with underscores.
+// Name starting with digit is prefixed by underscore
+func SanitizeName(name string) string {
+	name = invalidNameChars.ReplaceAllString(name, "_")
+	if name == "" || (name[0] >= '0' && name[0] <= '9') {
+		name = "_" + name
+	}
+	return name
+}
+
+// family is metrics of one type exposed under the same name
+type family struct {
+	name   string
+	mType  string
+	meta   entities.MetricMetadata
+	series []entities.Metric
+}
+
+// Write renders metrics in format. Names are sanitized, metrics of other types,
+// which name collides with already exposed one, are skipped, as the format allows only one type per name.
+// Metadata provides help text and unit of metrics with the same name
+func Write(w io.Writer, format Format, metrics []entities.Metric, metadata []entities.MetricMetadata) error {
+	bw := bufio.NewWriter(w)
+	for _, f := range groupFamilies(format, metrics, metadata) {
+		writeFamily(bw, format, f)
+	}
+	if format == FormatOpenMetrics {
+		bw.WriteString("# EOF\n")
+	}
+	return bw.Flush()
+}
+
+// groupFamilies groups metrics by exposed name, families and their series are sorted.
+// Type owning name by metadata wins collision, otherwise type of the first metric in order
+func groupFamilies(format Format, metrics []entities.Metric, metadata []entities.MetricMetadata) []*family {
+	byName := make(map[string]entities.MetricMetadata, len(metadata))
+	for _, meta := range metadata {
+		byName[meta.Name] = meta
+	}
+
+	sorted := make([]entities.Metric, len(metrics))
+	copy(sorted, metrics)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		a, b := sorted[i], sorted[j]
+		_, aOwned := byName[a.ID]
+		_, bOwned := byName[b.ID]
+		switch {
+		case aOwned != bOwned:
+			return aOwned
+		case a.ID != b.ID:
+			return a.ID < b.ID
+		case a.MType != b.MType:
+			return a.MType < b.MType
+		default:
+			return entities.LabelsKey(a.Labels) < entities.LabelsKey(b.Labels)
+		}
+	})
+
+	families := make(map[string]*family)
+	seen := make(map[string]bool)
+	for _, m := range sorted {
+		// Values stored before name was claimed may have another type
+		if meta, ok := byName[m.ID]; ok && meta.Type != m.MType {
+			continue
+		}
+		name := familyName(format, m)
+		f, ok := families[name]
+		if !ok {
+			f = &family{name: name, mType: m.MType, meta: byName[m.ID]}
+			families[name] = f
+		}
+		key := name + entities.LabelsKey(m.Labels)
+		if f.mType != m.MType || seen[key] {
+			continue
+		}
+		seen[key] = true
+		f.series = append(f.series, m)
+	}
+
+	res := make([]*family, 0, len(families))
+	for _, f := range families {
+		sort.SliceStable(f.series, func(i, j int) bool {
+			return entities.LabelsKey(f.series[i].Labels) < entities.LabelsKey(f.series[j].Labels)
+		})
+		res = append(res, f)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].name < res[j].name })
+	return res
+}
+
+// familyName returns exposed name of metric. OpenMetrics counter family has no `_total` suffix, it is added to samples
+func familyName(format Format, m entities.Metric) string {
+	name := SanitizeName(m.ID)
+	if format == FormatOpenMetrics && m.MType == entities.Counter && name != "_total" {
+		name = strings.TrimSuffix(name, "_total")
+	}
+	return name
+}
+
+func writeFamily(w *bufio.Writer, format Format, f *family) {
+	if f.meta.Help != "" {
+		w.WriteString("# HELP " + f.name + " " + escapeHelp(format, f.meta.Help) + "\n")
+	}
+	w.WriteString("# TYPE " + f.name + " " + f.mType + "\n")
+	if format == FormatOpenMetrics && unitRe.MatchString(f.meta.Unit) && strings.HasSuffix(f.name, "_"+f.meta.Unit) {
+		w.WriteString("# UNIT " + f.name + " " + f.meta.Unit + "\n")
+	}
+
+	for _, m := range f.series {
+		switch f.mType {
+		case entities.Gauge:
+			writeSample(w, f.name, m.Labels, formatFloat(*m.Value))
+		case entities.Counter:
+			name := f.name
+			if format == FormatOpenMetrics {
+				name += "_total"
+			}
+			writeSample(w, name, m.Labels, strconv.FormatInt(*m.Delta, 10))
+		case entities.Histogram:
+			h := m.Histogram
+			var cumulative uint64
+			for i, count := range h.Counts {
+				cumulative += count
+				le := "+Inf"
+				if i < len(h.Bounds) {
+					le = formatFloat(h.Bounds[i])
+				}
+				writeSample(w, f.name+"_bucket", withLabel(m.Labels, "le", le), strconv.FormatUint(cumulative, 10))
+			}
+			writeSample(w, f.name+"_sum", m.Labels, formatFloat(h.Sum))
+			writeSample(w, f.name+"_count", m.Labels, strconv.FormatUint(h.Count, 10))
+		case entities.Summary:
+			s := m.Summary
+			for _, q := range SummaryQuantiles {
+				writeSample(w, f.name, withLabel(m.Labels, "quantile", formatFloat(q)), formatFloat(s.Quantile(q)))
+			}
+			writeSample(w, f.name+"_sum", m.Labels, formatFloat(s.Sum))
+			writeSample(w, f.name+"_count", m.Labels, strconv.FormatUint(s.Count, 10))
+		}
+	}
+}
+
+func writeSample(w *bufio.Writer, name string, labels map[string]string, value string) {
+	w.WriteString(name)
+	w.WriteString(entities.LabelsKey(labels))
+	w.WriteByte(' ')
+	w.WriteString(value)
+	w.WriteByte('\n')
+}
+
+// withLabel returns copy of labels with additional label, e.g. `le` of histogram bucket
+func withLabel(labels map[string]string, name, value string) map[string]string {
+	res := make(map[string]string, len(labels)+1)
+	for k, v := range labels {
+		res[k] = v
+	}
+	res[name] = value
+	return res
+}
+
+var (
+	textHelpEscaper        = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	openMetricsHelpEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escapeHelp(format Format, help string) string {
+	if format == FormatOpenMetrics {
+		return openMetricsHelpEscaper.Replace(help)
+	}
+	return textHelpEscaper.Replace(help)
+}
+
+// formatFloat returns value in the shortest form, infinities and NaN are written as `+Inf`, `-Inf` and `NaN`
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	default:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	}
+}
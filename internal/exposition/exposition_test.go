@@ -0,0 +1,143 @@
+package exposition
+
+import (
+	"bytes"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/melkomukovki/go-musthave-metrics/internal/entities"
+)
+
+func gauge(name string, v float64, labels map[string]string) entities.Metric {
+	return entities.Metric{ID: name, MType: entities.Gauge, Value: &v, Labels: labels}
+}
+
+func counter(name string, d int64, labels map[string]string) entities.Metric {
+	return entities.Metric{ID: name, MType: entities.Counter, Delta: &d, Labels: labels}
+}
+
+func TestNegotiate(t *testing.T) {
+	tests := []struct {
+		accept string
+		want   Format
+	}{
+		{accept: "", want: FormatText},
+		{accept: "*/*", want: FormatText},
+		{accept: "text/plain;version=0.0.4", want: FormatText},
+		{accept: "application/openmetrics-text", want: FormatOpenMetrics},
+		{
+			accept: "application/openmetrics-text;version=1.0.0,application/openmetrics-text;version=0.0.1;q=0.75,text/plain;version=0.0.4;q=0.5,*/*;q=0.1",
+			want:   FormatOpenMetrics,
+		},
+		{accept: "application/openmetrics-text;q=0.3,text/plain;q=0.5", want: FormatText},
+		{accept: "application/openmetrics-text;q=0", want: FormatText},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.accept, func(t *testing.T) {
+			assert.Equal(t, tt.want, Negotiate(tt.accept))
+		})
+	}
+}
+
+func TestSanitizeName(t *testing.T) {
+	assert.Equal(t, "Alloc", SanitizeName("Alloc"))
+	assert.Equal(t, "http_requests:rate", SanitizeName("http_requests:rate"))
+	assert.Equal(t, "cpu_usage_percent", SanitizeName("cpu.usage-percent"))
+	assert.Equal(t, "_2xx_responses", SanitizeName("2xx responses"))
+	assert.Equal(t, "_", SanitizeName(""))
+}
+
+func TestWrite_Text(t *testing.T) {
+	h := entities.NewHistogram([]float64{0.1, 1})
+	h.Observe(0.05)
+	h.Observe(0.5)
+	h.Observe(3)
+
+	metrics := []entities.Metric{
+		gauge("Alloc", 1.5, nil),
+		counter("PollCount", 7, map[string]string{"host": `web "1"`}),
+		counter("PollCount", 3, map[string]string{"host": "web2"}),
+		gauge("free.memory", math.Inf(1), nil),
+		{ID: "latency_seconds", MType: entities.Histogram, Histogram: h, Labels: map[string]string{"route": "/"}},
+	}
+	metadata := []entities.MetricMetadata{
+		{Name: "Alloc", Type: entities.Gauge, Unit: "bytes", Help: `Allocated heap \ objects`},
+	}
+
+	var b bytes.Buffer
+	require.NoError(t, Write(&b, FormatText, metrics, metadata))
+	assert.Equal(t, `# HELP Alloc Allocated heap \\ objects
+# TYPE Alloc gauge
+Alloc 1.5
+# TYPE PollCount counter
+PollCount{host="web \"1\""} 7
+PollCount{host="web2"} 3
+# TYPE free_memory gauge
+free_memory +Inf
+# TYPE latency_seconds histogram
+latency_seconds_bucket{le="0.1",route="/"} 1
+latency_seconds_bucket{le="1",route="/"} 2
+latency_seconds_bucket{le="+Inf",route="/"} 3
+latency_seconds_sum{route="/"} 3.55
+latency_seconds_count{route="/"} 3
+`, b.String())
+}
+
+func TestWrite_OpenMetrics(t *testing.T) {
+	metrics := []entities.Metric{
+		counter("requests_total", 10, nil),
+		gauge("heap_bytes", 2048, nil),
+	}
+	metadata := []entities.MetricMetadata{
+		{Name: "requests_total", Type: entities.Counter, Help: `Served "requests"`},
+		{Name: "heap_bytes", Type: entities.Gauge, Unit: "bytes"},
+	}
+
+	var b bytes.Buffer
+	require.NoError(t, Write(&b, FormatOpenMetrics, metrics, metadata))
+	assert.Equal(t, `# TYPE heap_bytes gauge
+# UNIT heap_bytes bytes
+heap_bytes 2048
+# HELP requests Served \"requests\"
+# TYPE requests counter
+requests_total 10
+# EOF
+`, b.String())
+}
+
+func TestWrite_Summary(t *testing.T) {
+	s := entities.NewSummary(entities.DefaultSummaryAccuracy)
+	var b bytes.Buffer
+	require.NoError(t, Write(&b, FormatText, []entities.Metric{{ID: "rtt", MType: entities.Summary, Summary: s}}, nil))
+	assert.Equal(t, `# TYPE rtt summary
+rtt{quantile="0.5"} NaN
+rtt{quantile="0.9"} NaN
+rtt{quantile="0.99"} NaN
+rtt_sum 0
+rtt_count 0
+`, b.String())
+}
+
+func TestWrite_NameCollisions(t *testing.T) {
+	metrics := []entities.Metric{
+		gauge("load-avg", 1, nil),
+		gauge("load.avg", 2, nil),
+		counter("load_avg", 3, nil),
+		counter("owned", 4, nil),
+		gauge("owned", 5, nil),
+	}
+	metadata := []entities.MetricMetadata{{Name: "owned", Type: entities.Gauge}}
+
+	var b bytes.Buffer
+	require.NoError(t, Write(&b, FormatText, metrics, metadata))
+	// The first name in order wins collision, metadata owner wins over stored values of other type
+	assert.Equal(t, `# TYPE load_avg gauge
+load_avg 1
+# TYPE owned gauge
+owned 5
+`, b.String())
+}
@@ -0,0 +1,107 @@
+package exposition
+
+import (
+	"io"
+	"sync"
+
+	"github.com/melkomukovki/go-musthave-metrics/internal/entities"
+)
+
+// Importer turns pushed expositions to metrics. Samples of counters are cumulative totals, so their increments
+// since the previous written total of series are returned: the first total creates counter, lower total means
+// that counter was reset and is returned as increment
+type Importer struct {
+	mu      sync.Mutex
+	tenants map[string]*counters
+}
+
+// counters keeps previous totals of counters of tenant by series
+type counters struct {
+	mu   sync.Mutex
+	last map[string]int64
+}
+
+// NewImporter returns importer, which knows no previous totals
+func NewImporter() *Importer {
+	return &Importer{tenants: make(map[string]*counters)}
+}
+
+// Batch is metrics imported from exposition. Counters of tenant stay locked until batch is committed or aborted,
+// so concurrent pushes don't compute increments from the same previous totals
+type Batch struct {
+	Metrics  []entities.Metric
+	Lines    []int       // Line of sample, which metric with the same index is made of
+	LineErrs []LineError // Lines, which can't be imported
+
+	counters *counters
+	totals   []counterTotal // Totals of counters by index of metric
+}
+
+// counterTotal is total of counter series, key is empty for gauges
+type counterTotal struct {
+	key   string
+	total int64
+}
+
+// Import parses exposition pushed by tenant, see Parse. Metrics must be written and then passed to Batch.Commit.
+// Error is returned only if reader fails
+func (im *Importer) Import(tenant string, r io.Reader) (*Batch, error) {
+	samples, lineErrs, err := parse(r)
+	if err != nil {
+		return nil, err
+	}
+
+	im.mu.Lock()
+	tc, ok := im.tenants[tenant]
+	if !ok {
+		tc = &counters{last: make(map[string]int64)}
+		im.tenants[tenant] = tc
+	}
+	im.mu.Unlock()
+
+	tc.mu.Lock()
+	b := &Batch{LineErrs: lineErrs, counters: tc}
+	// Counter may repeat in exposition, then its increment is counted from the previous sample
+	pending := make(map[string]int64)
+	for _, s := range samples {
+		m := s.metric
+		var t counterTotal
+		if m.MType == entities.Counter {
+			t = counterTotal{key: entities.SeriesKey(m.ID, m.Labels), total: *m.Delta}
+			prev, ok := pending[t.key]
+			if !ok {
+				prev, ok = tc.last[t.key]
+			}
+			var delta int64
+			if ok {
+				delta = t.total - prev
+				if t.total < prev {
+					delta = t.total
+				}
+			}
+			m.Delta = &delta
+			pending[t.key] = t.total
+		}
+		b.Metrics = append(b.Metrics, m)
+		b.Lines = append(b.Lines, s.line)
+		b.totals = append(b.totals, t)
+	}
+	return b, nil
+}
+
+// Commit saves totals of written counters as previous totals of their series and unlocks counters.
+// failed are errors of metrics, which weren't written, by index: totals of their counters aren't saved,
+// so the same totals pushed again are counted again
+func (b *Batch) Commit(failed map[int]error) {
+	for i, t := range b.totals {
+		if _, ok := failed[i]; t.key != "" && !ok {
+			b.counters.last[t.key] = t.total
+		}
+	}
+	b.counters.mu.Unlock()
+}
+
+// Abort unlocks counters when no metrics of batch were written
+func (b *Batch) Abort() {
+	b.counters.mu.Unlock()
+}
@@ -0,0 +1,76 @@
+package exposition
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/melkomukovki/go-musthave-metrics/internal/entities"
+	"github.com/melkomukovki/go-musthave-metrics/internal/infra/memstorage"
+	"github.com/melkomukovki/go-musthave-metrics/internal/services"
+)
+
+func TestImporter_CountersAreCumulative(t *testing.T) {
+	ctx := context.Background()
+	service := &services.Service{ServiceRepo: memstorage.NewClient(0, "", false, 1)}
+	im := NewImporter()
+	push := func(tenant, exposition string) {
+		b, err := im.Import(tenant, strings.NewReader(exposition))
+		require.NoError(t, err)
+		failed, err := service.AddMetricsPartially(entities.ContextWithTenant(ctx, tenant), b.Metrics)
+		require.NoError(t, err)
+		b.Commit(failed)
+	}
+	total := func(tenant string) int64 {
+		m, err := service.GetMetric(entities.ContextWithTenant(ctx, tenant), entities.Counter, "requests_total", map[string]string{"code": "200"})
+		require.NoError(t, err)
+		return *m.Delta
+	}
+
+	// The first total creates counter, the same total pushed again doesn't change it
+	push(entities.DefaultTenant, "# TYPE requests counter\nrequests_total{code=\"200\"} 100\n")
+	push(entities.DefaultTenant, "# TYPE requests counter\nrequests_total{code=\"200\"} 100\n")
+	assert.Equal(t, int64(0), total(entities.DefaultTenant))
+
+	push(entities.DefaultTenant, "# TYPE requests counter\nrequests_total{code=\"200\"} 130\nrequests_total{code=\"200\"} 150\n")
+	assert.Equal(t, int64(50), total(entities.DefaultTenant))
+
+	// Lower total means that counter was reset
+	push(entities.DefaultTenant, "# TYPE requests counter\nrequests_total{code=\"200\"} 20\n")
+	assert.Equal(t, int64(70), total(entities.DefaultTenant))
+
+	// Tenants have their own previous totals
+	push("team-a", "# TYPE requests counter\nrequests_total{code=\"200\"} 20\n")
+	assert.Equal(t, int64(0), total("team-a"))
+}
+
+func TestBatch_Commit(t *testing.T) {
+	im := NewImporter()
+	push := func(total string) *Batch {
+		b, err := im.Import(entities.DefaultTenant, strings.NewReader("# TYPE requests counter\nrequests_total "+total+"\n"))
+		require.NoError(t, err)
+		require.Len(t, b.Metrics, 1)
+		assert.Equal(t, []int{2}, b.Lines)
+		return b
+	}
+
+	push("100").Commit(nil)
+
+	// Totals of counters, which weren't written, are counted again when they are retried
+	b := push("150")
+	assert.Equal(t, int64(50), *b.Metrics[0].Delta)
+	b.Abort()
+	b = push("150")
+	assert.Equal(t, int64(50), *b.Metrics[0].Delta)
+	b.Commit(map[int]error{0: entities.ErrNameTooLong})
+	b = push("150")
+	assert.Equal(t, int64(50), *b.Metrics[0].Delta)
+	b.Commit(nil)
+
+	b = push("150")
+	assert.Equal(t, int64(0), *b.Metrics[0].Delta)
+	b.Commit(nil)
+}
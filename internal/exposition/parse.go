@@ -0,0 +1,272 @@
+package exposition
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/melkomukovki/go-musthave-metrics/internal/entities"
+)
+
+// maxLineSize - maximum length of exposition line
+const maxLineSize = 1 << 20
+
+// LineError describes line of exposition, which can't be imported
+type LineError struct {
+	Line    int    `json:"line"`    // Line number starting from 1
+	Message string `json:"message"` // Reason why line is skipped
+}
+
+// Error implements error interface
+func (e LineError) Error() string {
+	return fmt.Sprintf("line %d: %s", e.Line, e.Message)
+}
+
+// metricNameRe - allowed metric names of exposition
+var metricNameRe = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+
+// Suffixes of samples, which belong to family without them
+var sampleSuffixes = []string{"_total", "_created", "_bucket", "_sum", "_count", "_gcount", "_gsum", "_info"}
+
+// Parse reads metrics in Prometheus text or OpenMetrics format. Only gauges and counters are returned,
+// samples of other types, samples without type and malformed lines are skipped and reported as line errors.
+// Gauge values must be finite, counter values must be non-negative integers: Delta of counter is its cumulative
+// total, see Importer. Timestamps and exemplars are ignored. Error is returned only if reader fails
+func Parse(r io.Reader) (metrics []entities.Metric, lineErrs []LineError, err error) {
+	samples, lineErrs, err := parse(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, s := range samples {
+		metrics = append(metrics, s.metric)
+	}
+	return metrics, lineErrs, nil
+}
+
+// sample is metric of exposition line
+type sample struct {
+	line   int
+	metric entities.Metric
+}
+
+// parse reads samples of exposition, see Parse
+func parse(r io.Reader) (samples []sample, lineErrs []LineError, err error) {
+	types := make(map[string]string)
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxLineSize)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		if strings.HasPrefix(line, "#") {
+			fields := strings.Fields(line)
+			if len(fields) == 2 && fields[1] == "EOF" {
+				break
+			}
+			if len(fields) >= 2 && fields[1] == "TYPE" {
+				if len(fields) != 4 || !metricNameRe.MatchString(fields[2]) {
+					lineErrs = append(lineErrs, LineError{Line: lineNo, Message: "malformed TYPE line"})
+					continue
+				}
+				types[fields[2]] = strings.ToLower(fields[3])
+			}
+			// HELP, UNIT and other comments are ignored
+			continue
+		}
+
+		m, skip, err := parseSample(line, types)
+		if err != nil {
+			lineErrs = append(lineErrs, LineError{Line: lineNo, Message: err.Error()})
+			continue
+		}
+		if !skip {
+			samples = append(samples, sample{line: lineNo, metric: m})
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	return samples, lineErrs, nil
+}
+
+// parseSample converts sample line to metric. Skip is true for samples, which carry no value, e.g. `_created` of counter
+func parseSample(line string, types map[string]string) (m entities.Metric, skip bool, err error) {
+	name, labels, value, err := splitSample(line)
+	if err != nil {
+		return entities.Metric{}, false, err
+	}
+
+	family := familyOf(name, types)
+	switch mType := types[family]; mType {
+	case entities.Gauge:
+		if name != family {
+			return entities.Metric{}, false, fmt.Errorf("unexpected sample %q of gauge %q", name, family)
+		}
+		v, err := parseValue(value)
+		if err != nil {
+			return entities.Metric{}, false, err
+		}
+		// JSON API can't return infinities and NaN, so they aren't stored
+		if math.IsInf(v, 0) || math.IsNaN(v) {
+			return entities.Metric{}, false, fmt.Errorf("gauge %q value %s is not finite", name, value)
+		}
+		return entities.Metric{ID: name, MType: entities.Gauge, Value: &v, Labels: labels}, false, nil
+	case entities.Counter:
+		switch {
+		case name == family+"_created":
+			return entities.Metric{}, true, nil
+		case name != family && name != family+"_total":
+			return entities.Metric{}, false, fmt.Errorf("unexpected sample %q of counter %q", name, family)
+		}
+		v, err := parseValue(value)
+		if err != nil {
+			return entities.Metric{}, false, err
+		}
+		if v < 0 || v != math.Trunc(v) || v >= math.MaxInt64 {
+			return entities.Metric{}, false, fmt.Errorf("counter %q value %s is not a non-negative integer", name, value)
+		}
+		d := int64(v)
+		return entities.Metric{ID: name, MType: entities.Counter, Delta: &d, Labels: labels}, false, nil
+	case "":
+		return entities.Metric{}, false, fmt.Errorf("metric %q has no TYPE, untyped metrics are not supported", name)
+	default:
+		return entities.Metric{}, false, fmt.Errorf("type %s of metric %q is not supported", mType, family)
+	}
+}
+
+// familyOf returns name of declared family, which sample belongs to
+func familyOf(name string, types map[string]string) string {
+	if _, ok := types[name]; ok {
+		return name
+	}
+	for _, suffix := range sampleSuffixes {
+		if family, ok := strings.CutSuffix(name, suffix); ok {
+			if _, ok := types[family]; ok {
+				return family
+			}
+		}
+	}
+	return name
+}
+
+// splitSample splits line `name{label="value",...} value [timestamp] [# exemplar]` into its parts
+func splitSample(line string) (name string, labels map[string]string, value string, err error) {
+	i := strings.IndexAny(line, "{ \t")
+	if i < 0 {
+		return "", nil, "", errors.New("sample has no value")
+	}
+	name, rest := line[:i], line[i:]
+	if !metricNameRe.MatchString(name) {
+		return "", nil, "", fmt.Errorf("invalid metric name %q", name)
+	}
+
+	if rest[0] == '{' {
+		labels, rest, err = parseLabels(rest[1:])
+		if err != nil {
+			return "", nil, "", err
+		}
+		if err := entities.ValidateLabels(labels); err != nil {
+			return "", nil, "", err
+		}
+	}
+
+	if j := strings.Index(rest, "#"); j >= 0 {
+		rest = rest[:j]
+	}
+	fields := strings.Fields(rest)
+	switch len(fields) {
+	case 1:
+	case 2:
+		if _, err := strconv.ParseFloat(fields[1], 64); err != nil {
+			return "", nil, "", fmt.Errorf("invalid timestamp %q", fields[1])
+		}
+	default:
+		return "", nil, "", errors.New("sample must have value and optional timestamp")
+	}
+	return name, labels, fields[0], nil
+}
+
+// parseLabels parses labels until closing brace, returns the rest of line after it
+func parseLabels(s string) (labels map[string]string, rest string, err error) {
+	for {
+		s = strings.TrimLeft(s, " \t")
+		if strings.HasPrefix(s, "}") {
+			return labels, s[1:], nil
+		}
+
+		eq := strings.IndexByte(s, '=')
+		if eq < 0 {
+			return nil, "", errors.New("label has no value")
+		}
+		name := strings.TrimSpace(s[:eq])
+		s = strings.TrimLeft(s[eq+1:], " \t")
+		if !strings.HasPrefix(s, `"`) {
+			return nil, "", fmt.Errorf("value of label %q is not quoted", name)
+		}
+
+		var value strings.Builder
+		closed := false
+		i := 1
+		for ; i < len(s) && !closed; i++ {
+			switch s[i] {
+			case '"':
+				closed = true
+			case '\\':
+				if i+1 == len(s) {
+					return nil, "", fmt.Errorf("unterminated value of label %q", name)
+				}
+				i++
+				switch s[i] {
+				case 'n':
+					value.WriteByte('\n')
+				case '\\', '"':
+					value.WriteByte(s[i])
+				default:
+					return nil, "", fmt.Errorf("invalid escape in value of label %q", name)
+				}
+			default:
+				value.WriteByte(s[i])
+			}
+		}
+		if !closed {
+			return nil, "", fmt.Errorf("unterminated value of label %q", name)
+		}
+
+		if labels == nil {
+			labels = make(map[string]string)
+		}
+		if _, ok := labels[name]; ok {
+			return nil, "", fmt.Errorf("duplicate label %q", name)
+		}
+		labels[name] = value.String()
+
+		s = strings.TrimLeft(s[i:], " \t")
+		switch {
+		case strings.HasPrefix(s, ","):
+			s = s[1:]
+		case strings.HasPrefix(s, "}"):
+		default:
+			return nil, "", errors.New("labels must be separated by comma")
+		}
+	}
+}
+
+// parseValue parses sample value
+func parseValue(s string) (float64, error) {
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid value %q", s)
+	}
+	return v, nil
+}
@@ -0,0 +1,112 @@
+package exposition
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/melkomukovki/go-musthave-metrics/internal/entities"
+)
+
+func TestParse(t *testing.T) {
+	input := `# HELP go_goroutines Number of goroutines
+# TYPE go_goroutines gauge
+go_goroutines 42
+# TYPE http_requests_total counter
+http_requests_total{code="200",path="/a \"b\""} 1027 1395066363000
+http_requests_total{code="500" , path="/"} 3
+# TYPE go_gc_duration_seconds summary
+go_gc_duration_seconds{quantile="0.5"} 0.0001
+go_gc_duration_seconds_sum 0.5
+process_start_time 1.7e9
+# TYPE temperature gauge
+temperature{room="hall\nway"} -1.5 # {trace_id="1"} 1
+temperature NaN
+temperature{room=hall} 1
+`
+
+	metrics, lineErrs, err := Parse(strings.NewReader(input))
+	require.NoError(t, err)
+
+	assert.Equal(t, []entities.Metric{
+		gauge("go_goroutines", 42, nil),
+		counter("http_requests_total", 1027, map[string]string{"code": "200", "path": `/a "b"`}),
+		counter("http_requests_total", 3, map[string]string{"code": "500", "path": "/"}),
+		gauge("temperature", -1.5, map[string]string{"room": "hall\nway"}),
+	}, metrics)
+
+	lines := make([]int, 0, len(lineErrs))
+	for _, e := range lineErrs {
+		lines = append(lines, e.Line)
+	}
+	assert.Equal(t, []int{8, 9, 10, 13, 14}, lines)
+	assert.Contains(t, lineErrs[0].Message, "type summary")
+	assert.Contains(t, lineErrs[2].Message, "untyped")
+	assert.Contains(t, lineErrs[3].Message, "not finite")
+	assert.Contains(t, lineErrs[4].Message, "not quoted")
+}
+
+func TestParse_OpenMetrics(t *testing.T) {
+	input := `# TYPE requests counter
+# HELP requests Served requests
+requests_total{host="a"} 10
+requests_created{host="a"} 1.6e9
+# TYPE fraction counter
+fraction_total 1.5
+# EOF
+ignored 1
+`
+
+	metrics, lineErrs, err := Parse(strings.NewReader(input))
+	require.NoError(t, err)
+	assert.Equal(t, []entities.Metric{counter("requests_total", 10, map[string]string{"host": "a"})}, metrics)
+	require.Len(t, lineErrs, 1)
+	assert.Equal(t, 6, lineErrs[0].Line)
+}
+
+func TestParse_RoundTrip(t *testing.T) {
+	// OpenMetrics exposes counters with `_total` suffix, so only names with it are kept in both formats
+	metrics := []entities.Metric{
+		gauge("Alloc", 1024, nil),
+		counter("polls_total", 5, map[string]string{"host": `web "1"`, "cpu": "0"}),
+	}
+
+	for _, format := range []Format{FormatText, FormatOpenMetrics} {
+		var b bytes.Buffer
+		require.NoError(t, Write(&b, format, metrics, nil))
+
+		parsed, lineErrs, err := Parse(&b)
+		require.NoError(t, err)
+		assert.Empty(t, lineErrs)
+		assert.Equal(t, metrics, parsed)
+	}
+}
+
+func TestParse_MalformedLines(t *testing.T) {
+	tests := []string{
+		"# TYPE gauge",
+		"2abc 1",
+		"m",
+		"m 1 2 3",
+		"m{a=\"1\" b=\"2\"} 1",
+		"m{a=\"1\",a=\"2\"} 1",
+		"m{a=\"1} 1",
+		"m{a=\"\\x\"} 1",
+		"m{2a=\"1\"} 1",
+		"m one",
+		"m 1 soon",
+	}
+
+	for _, line := range tests {
+		t.Run(line, func(t *testing.T) {
+			metrics, lineErrs, err := Parse(strings.NewReader("# TYPE m gauge\n" + line + "\n"))
+			require.NoError(t, err)
+			assert.Empty(t, metrics)
+			require.Len(t, lineErrs, 1)
+			assert.Equal(t, 2, lineErrs[0].Line)
+		})
+	}
+}
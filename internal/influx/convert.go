@@ -0,0 +1,199 @@
+package influx
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/melkomukovki/go-musthave-metrics/internal/entities"
+)
+
+// Modes of converting tags
+const (
+	TagsAsLabels = "labels" // Tags become labels of metrics
+	TagsAsSuffix = "suffix" // Tag values are appended to metric name in order of tag keys, e.g. `cpu_usage_idle.cpu0.web1`
+)
+
+// Converter turns fields of points to metrics named `<measurement>_<field>`.
+// Float and boolean fields are gauges, string fields are skipped. Type of integer fields is chosen by rules,
+// integers matching no rule are gauges. Values of counters are cumulative, so their increments since the previous
+// written value of series are returned: the first value creates counter, lower value means that counter was reset
+// and is returned as increment
+type Converter struct {
+	integerRules []entities.InfluxIntegerRule
+	tags         string
+
+	mu      sync.Mutex
+	tenants map[string]*counters
+}
+
+// counters keeps previous values of counters of tenant by series
+type counters struct {
+	mu   sync.Mutex
+	last map[string]int64
+}
+
+// NewConverter returns converter, tags are converted according to mode TagsAsLabels or TagsAsSuffix
+func NewConverter(integerRules []entities.InfluxIntegerRule, tags string) *Converter {
+	return &Converter{
+		integerRules: integerRules,
+		tags:         tags,
+		tenants:      make(map[string]*counters),
+	}
+}
+
+// Batch is metrics converted from points. Counters of tenant stay locked until batch is committed or aborted,
+// so concurrent writes don't compute increments from the same previous values
+type Batch struct {
+	Metrics  []entities.Metric
+	Lines    []int       // Line of point, which metric with the same index is made of
+	LineErrs []LineError // Points, which can't be converted
+
+	counters *counters
+	values   []counterValue // Values of counters by index of metric
+}
+
+// counterValue is value of counter series, key is empty for other metrics
+type counterValue struct {
+	key   string
+	value int64
+}
+
+// Convert converts points written by tenant to metrics, which must be written and then passed to Batch.Commit.
+// Points with negative counter values are skipped and reported as line errors
+func (c *Converter) Convert(tenant string, points []Point) *Batch {
+	c.mu.Lock()
+	tc, ok := c.tenants[tenant]
+	if !ok {
+		tc = &counters{last: make(map[string]int64)}
+		c.tenants[tenant] = tc
+	}
+	c.mu.Unlock()
+
+	tc.mu.Lock()
+	b := &Batch{counters: tc}
+	// Counter may repeat in batch, then its increment is counted from the previous point
+	pending := make(map[string]int64)
+	for _, p := range points {
+		metrics, values, err := c.convert(tc, pending, p)
+		if err != nil {
+			b.LineErrs = append(b.LineErrs, LineError{Line: p.Line, Message: err.Error()})
+			continue
+		}
+		for i := range metrics {
+			b.Lines = append(b.Lines, p.Line)
+			if values[i].key != "" {
+				pending[values[i].key] = values[i].value
+			}
+		}
+		b.Metrics = append(b.Metrics, metrics...)
+		b.values = append(b.values, values...)
+	}
+	return b
+}
+
+// Commit saves values of written counters as previous values of their series and unlocks counters.
+// failed are errors of metrics, which weren't written, by index: values of their counters aren't saved,
+// so the same values written again are counted again
+func (b *Batch) Commit(failed map[int]error) {
+	for i, v := range b.values {
+		if _, ok := failed[i]; v.key != "" && !ok {
+			b.counters.last[v.key] = v.value
+		}
+	}
+	b.counters.mu.Unlock()
+}
+
+// Abort unlocks counters when no metrics of batch were written
+func (b *Batch) Abort() {
+	b.counters.mu.Unlock()
+}
+
+// convert returns metrics of all fields of point and values of its counters.
+// Point is rejected as a whole if any of its metrics can't be written
+func (c *Converter) convert(tc *counters, pending map[string]int64, p Point) ([]entities.Metric, []counterValue, error) {
+	suffix, labels := c.convertTags(p.Tags)
+
+	var metrics []entities.Metric
+	var values []counterValue
+	for _, f := range p.Fields {
+		if f.Kind == String {
+			continue // Strings have no numeric value
+		}
+		id := p.Measurement + "_" + f.Key
+		m := entities.Metric{ID: id + suffix, Labels: labels}
+		var v counterValue
+
+		switch f.Kind {
+		case Float, Boolean:
+			value := f.Float
+			m.MType, m.Value = entities.Gauge, &value
+		case Integer, Unsigned:
+			if entities.InfluxIntegerTypeFor(c.integerRules, id) == entities.Gauge {
+				value := float64(f.Int)
+				m.MType, m.Value = entities.Gauge, &value
+				break
+			}
+			if f.Int < 0 {
+				return nil, nil, fmt.Errorf("counter %q value %d is negative", m.ID, f.Int)
+			}
+			v = counterValue{key: entities.SeriesKey(m.ID, labels), value: f.Int}
+			prev, ok := pending[v.key]
+			if !ok {
+				prev, ok = tc.last[v.key]
+			}
+			var delta int64
+			if ok {
+				delta = f.Int - prev
+				if f.Int < prev {
+					delta = f.Int
+				}
+			}
+			m.MType, m.Delta = entities.Counter, &delta
+		}
+		metrics = append(metrics, m)
+		values = append(values, v)
+	}
+	return metrics, values, nil
+}
+
+// convertTags returns suffix of metric name or labels made of tags
+func (c *Converter) convertTags(tags map[string]string) (suffix string, labels map[string]string) {
+	if len(tags) == 0 {
+		return "", nil
+	}
+
+	if c.tags == TagsAsSuffix {
+		keys := make([]string, 0, len(tags))
+		for k := range tags {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		var b strings.Builder
+		for _, k := range keys {
+			b.WriteByte('.')
+			b.WriteString(tags[k])
+		}
+		return b.String(), nil
+	}
+
+	labels = make(map[string]string, len(tags))
+	for k, v := range tags {
+		labels[labelName(k)] = v
+	}
+	return "", labels
+}
+
+var invalidLabelChars = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+
+// labelName replaces characters of tag key, which aren't allowed in label names, with underscores
+func labelName(key string) string {
+	key = invalidLabelChars.ReplaceAllString(key, "_")
+	if key[0] >= '0' && key[0] <= '9' {
+		key = "_" + key
+	}
+	return key
+}
@@ -0,0 +1,108 @@
+package influx
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/melkomukovki/go-musthave-metrics/internal/entities"
+)
+
+func TestConverter_Metrics(t *testing.T) {
+	rules := []entities.InfluxIntegerRule{{Name: "net_bytes_*", MType: entities.Counter}}
+	c := NewConverter(rules, TagsAsLabels)
+
+	point := func(line int, recv, procs int64) Point {
+		return Point{
+			Line:        line,
+			Measurement: "net",
+			Tags:        map[string]string{"interface": "eth0", "data-center": "eu"},
+			Fields: []Field{
+				{Key: "bytes_recv", Kind: Integer, Int: recv},
+				{Key: "procs", Kind: Integer, Int: procs},
+				{Key: "up", Kind: Boolean, Float: 1},
+				{Key: "status", Kind: String, Str: "ok"},
+			},
+		}
+	}
+	labels := map[string]string{"interface": "eth0", "data_center": "eu"}
+	gauge := func(id string, v float64) entities.Metric {
+		return entities.Metric{ID: id, MType: entities.Gauge, Value: &v, Labels: labels}
+	}
+	counter := func(id string, d int64) entities.Metric {
+		return entities.Metric{ID: id, MType: entities.Counter, Delta: &d, Labels: labels}
+	}
+
+	convert := func(tenant string, points ...Point) *Batch {
+		b := c.Convert(tenant, points)
+		b.Commit(nil)
+		return b
+	}
+
+	// The first value of counter is baseline
+	b := convert(entities.DefaultTenant, point(1, 1000, 7))
+	assert.Empty(t, b.LineErrs)
+	assert.Equal(t, []entities.Metric{counter("net_bytes_recv", 0), gauge("net_procs", 7), gauge("net_up", 1)}, b.Metrics)
+	assert.Equal(t, []int{1, 1, 1}, b.Lines)
+
+	// Increment is returned, lower value means reset, counters of tenants are independent
+	b = convert(entities.DefaultTenant, point(1, 1500, 7), point(2, 300, 7))
+	require.Len(t, b.Metrics, 6)
+	assert.Equal(t, counter("net_bytes_recv", 500), b.Metrics[0])
+	assert.Equal(t, counter("net_bytes_recv", 300), b.Metrics[3])
+	b = convert("other", point(1, 1500, 7))
+	assert.Equal(t, counter("net_bytes_recv", 0), b.Metrics[0])
+
+	// Point with negative counter is skipped as a whole
+	b = convert(entities.DefaultTenant, point(3, -1, 7))
+	assert.Empty(t, b.Metrics)
+	require.Len(t, b.LineErrs, 1)
+	assert.Equal(t, 3, b.LineErrs[0].Line)
+}
+
+func TestBatch_Commit(t *testing.T) {
+	rules := []entities.InfluxIntegerRule{{MType: entities.Counter}}
+	c := NewConverter(rules, TagsAsLabels)
+	point := func(requests int64) []Point {
+		return []Point{{Line: 1, Measurement: "http", Fields: []Field{{Key: "requests", Kind: Integer, Int: requests}}}}
+	}
+	delta := func(b *Batch) int64 {
+		require.Len(t, b.Metrics, 1)
+		return *b.Metrics[0].Delta
+	}
+
+	c.Convert(entities.DefaultTenant, point(100)).Commit(nil)
+
+	// Values of counters, which weren't written, are counted again when they are retried
+	b := c.Convert(entities.DefaultTenant, point(150))
+	assert.Equal(t, int64(50), delta(b))
+	b.Abort()
+	b = c.Convert(entities.DefaultTenant, point(150))
+	assert.Equal(t, int64(50), delta(b))
+	b.Commit(map[int]error{0: entities.ErrMetricTypeConflict})
+	b = c.Convert(entities.DefaultTenant, point(150))
+	assert.Equal(t, int64(50), delta(b))
+	b.Commit(nil)
+
+	b = c.Convert(entities.DefaultTenant, point(150))
+	assert.Equal(t, int64(0), delta(b))
+	b.Commit(nil)
+}
+
+func TestConverter_TagsAsSuffix(t *testing.T) {
+	c := NewConverter(nil, TagsAsSuffix)
+	b := c.Convert(entities.DefaultTenant, []Point{{
+		Measurement: "cpu",
+		Tags:        map[string]string{"host": "web1", "cpu": "cpu0"},
+		Fields:      []Field{{Key: "usage_idle", Kind: Float, Float: 97.5}, {Key: "count", Kind: Integer, Int: 4}},
+	}})
+	b.Commit(nil)
+	assert.Empty(t, b.LineErrs)
+
+	idle, count := 97.5, 4.0
+	assert.Equal(t, []entities.Metric{
+		{ID: "cpu_usage_idle.cpu0.web1", MType: entities.Gauge, Value: &idle},
+		{ID: "cpu_count.cpu0.web1", MType: entities.Gauge, Value: &count},
+	}, b.Metrics)
+}
@@ -0,0 +1,252 @@
+// Package influx parses InfluxDB line protocol and converts its points to metrics
+package influx
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxLineSize - maximum length of line protocol line
+const maxLineSize = 1 << 20
+
+// FieldKind define type of field value
+type FieldKind int
+
+// Kinds of field values
+const (
+	Float FieldKind = iota
+	Integer
+	Unsigned
+	Boolean
+	String
+)
+
+// Field is single value of point
+type Field struct {
+	Key   string
+	Kind  FieldKind
+	Float float64 // Value of float field, 1 or 0 for boolean field
+	Int   int64   // Value of integer and unsigned field
+	Str   string  // Value of string field
+}
+
+// Point is single line of line protocol
+type Point struct {
+	Line        int // Line number starting from 1
+	Measurement string
+	Tags        map[string]string
+	Fields      []Field
+	Time        time.Time // Zero if line has no timestamp
+}
+
+// LineError describes line, which can't be written
+type LineError struct {
+	Line    int
+	Message string
+}
+
+// Error implements error interface
+func (e LineError) Error() string {
+	return fmt.Sprintf("line %d: %s", e.Line, e.Message)
+}
+
+// PartialWriteError returns message of InfluxDB partial write error listing lines ordered by number
+func PartialWriteError(written int, lineErrs []LineError) string {
+	sorted := make([]LineError, len(lineErrs))
+	copy(sorted, lineErrs)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Line < sorted[j].Line })
+
+	msgs := make([]string, 0, len(sorted))
+	for _, e := range sorted {
+		msgs = append(msgs, e.Error())
+	}
+	return fmt.Sprintf("partial write error (%d written): %s", written, strings.Join(msgs, "; "))
+}
+
+// precisions - units of timestamps accepted by write API
+var precisions = map[string]time.Duration{
+	"ns": time.Nanosecond,
+	"us": time.Microsecond,
+	"ms": time.Millisecond,
+	"s":  time.Second,
+}
+
+// Parse reads points of line protocol `measurement[,tag=value...] field=value[,field=value...] [timestamp]`,
+// timestamps are in precision units. Malformed lines are skipped and reported as line errors.
+// Error is returned only if precision is unknown or reader fails
+func Parse(r io.Reader, precision string) (points []Point, lineErrs []LineError, err error) {
+	unit, ok := precisions[precision]
+	if !ok {
+		return nil, nil, fmt.Errorf("invalid precision %q, expected one of ns, us, ms, s", precision)
+	}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxLineSize)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		p, err := parseLine(line, unit)
+		if err != nil {
+			lineErrs = append(lineErrs, LineError{Line: lineNo, Message: fmt.Sprintf("unable to parse '%s': %s", line, err.Error())})
+			continue
+		}
+		p.Line = lineNo
+		points = append(points, p)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, err
+	}
+	return points, lineErrs, nil
+}
+
+func parseLine(line string, unit time.Duration) (Point, error) {
+	var p Point
+
+	// Measurement escapes comma and space
+	measurement, rest := scanToken(line, ", ")
+	if measurement == "" {
+		return Point{}, errors.New("missing measurement")
+	}
+	p.Measurement = measurement
+
+	// Tag keys and values escape comma, equals sign and space
+	for strings.HasPrefix(rest, ",") {
+		var key, value string
+		key, rest = scanToken(rest[1:], ",= ")
+		if key == "" || !strings.HasPrefix(rest, "=") {
+			return Point{}, errors.New("invalid tag: missing key or value")
+		}
+		value, rest = scanToken(rest[1:], ",= ")
+		if value == "" || strings.HasPrefix(rest, "=") {
+			return Point{}, fmt.Errorf("invalid tag %q: invalid value", key)
+		}
+		if p.Tags == nil {
+			p.Tags = make(map[string]string)
+		}
+		p.Tags[key] = value
+	}
+
+	if !strings.HasPrefix(rest, " ") {
+		return Point{}, errors.New("missing fields")
+	}
+	rest = strings.TrimLeft(rest, " ")
+	for {
+		var key string
+		key, rest = scanToken(rest, ",= ")
+		if key == "" || !strings.HasPrefix(rest, "=") {
+			return Point{}, errors.New("invalid field: missing key or value")
+		}
+
+		var f Field
+		var err error
+		if f, rest, err = parseFieldValue(rest[1:]); err != nil {
+			return Point{}, fmt.Errorf("invalid field %q: %s", key, err.Error())
+		}
+		f.Key = key
+		p.Fields = append(p.Fields, f)
+
+		if !strings.HasPrefix(rest, ",") {
+			break
+		}
+		rest = rest[1:]
+	}
+
+	rest = strings.TrimSpace(rest)
+	if rest != "" {
+		ts, err := strconv.ParseInt(rest, 10, 64)
+		if err != nil {
+			return Point{}, fmt.Errorf("invalid timestamp %q", rest)
+		}
+		if ts > math.MaxInt64/int64(unit) || ts < math.MinInt64/int64(unit) {
+			return Point{}, fmt.Errorf("timestamp %d is out of range", ts)
+		}
+		p.Time = time.Unix(0, ts*int64(unit))
+	}
+	return p, nil
+}
+
+// scanToken reads token until one of stop characters, which isn't escaped by backslash.
+// Returns unescaped token and the rest of string starting with stop character
+func scanToken(s, stops string) (token, rest string) {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c == '\\' && i+1 < len(s) && strings.IndexByte(",= ", s[i+1]) >= 0 {
+			b.WriteByte(s[i+1])
+			i++
+			continue
+		}
+		if strings.IndexByte(stops, c) >= 0 {
+			return b.String(), s[i:]
+		}
+		b.WriteByte(c)
+	}
+	return b.String(), ""
+}
+
+// parseFieldValue parses value at the beginning of s, returns the rest after it
+func parseFieldValue(s string) (f Field, rest string, err error) {
+	if strings.HasPrefix(s, `"`) {
+		var b strings.Builder
+		for i := 1; i < len(s); i++ {
+			switch {
+			case s[i] == '\\' && i+1 < len(s) && (s[i+1] == '"' || s[i+1] == '\\'):
+				b.WriteByte(s[i+1])
+				i++
+			case s[i] == '"':
+				return Field{Kind: String, Str: b.String()}, s[i+1:], nil
+			default:
+				b.WriteByte(s[i])
+			}
+		}
+		return Field{}, "", errors.New("unterminated string")
+	}
+
+	end := strings.IndexAny(s, ", ")
+	if end < 0 {
+		end = len(s)
+	}
+	raw, rest := s[:end], s[end:]
+
+	switch {
+	case raw == "":
+		return Field{}, "", errors.New("missing value")
+	case strings.HasSuffix(raw, "i"):
+		v, err := strconv.ParseInt(raw[:len(raw)-1], 10, 64)
+		if err != nil {
+			return Field{}, "", fmt.Errorf("invalid integer %q", raw)
+		}
+		return Field{Kind: Integer, Int: v}, rest, nil
+	case strings.HasSuffix(raw, "u"):
+		v, err := strconv.ParseUint(raw[:len(raw)-1], 10, 64)
+		if err != nil || v > math.MaxInt64 {
+			return Field{}, "", fmt.Errorf("invalid unsigned %q", raw)
+		}
+		return Field{Kind: Unsigned, Int: int64(v)}, rest, nil
+	}
+
+	switch raw {
+	case "t", "T", "true", "True", "TRUE":
+		return Field{Kind: Boolean, Float: 1}, rest, nil
+	case "f", "F", "false", "False", "FALSE":
+		return Field{Kind: Boolean, Float: 0}, rest, nil
+	}
+
+	v, err := strconv.ParseFloat(raw, 64)
+	if err != nil || math.IsInf(v, 0) || math.IsNaN(v) {
+		return Field{}, "", fmt.Errorf("invalid float %q", raw)
+	}
+	return Field{Kind: Float, Float: v}, rest, nil
+}
@@ -0,0 +1,108 @@
+package influx
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParse(t *testing.T) {
+	input := `# comment
+cpu,cpu=cpu-total,host=web\ 1 usage_idle=97.5,usage_user=1.25 1700000000000000000
+net,interface=eth0 bytes_recv=1024i,bytes_sent=2048u,up=true,status="link \"up\", 1Gb/s"
+
+disk\,io free=1e9
+weather,location=us\,midwest temperature=82 1700000000
+`
+
+	points, lineErrs, err := Parse(strings.NewReader(input), "ns")
+	require.NoError(t, err)
+	assert.Empty(t, lineErrs)
+
+	assert.Equal(t, []Point{
+		{
+			Line:        2,
+			Measurement: "cpu",
+			Tags:        map[string]string{"cpu": "cpu-total", "host": "web 1"},
+			Fields: []Field{
+				{Key: "usage_idle", Kind: Float, Float: 97.5},
+				{Key: "usage_user", Kind: Float, Float: 1.25},
+			},
+			Time: time.Unix(1700000000, 0),
+		},
+		{
+			Line:        3,
+			Measurement: "net",
+			Tags:        map[string]string{"interface": "eth0"},
+			Fields: []Field{
+				{Key: "bytes_recv", Kind: Integer, Int: 1024},
+				{Key: "bytes_sent", Kind: Unsigned, Int: 2048},
+				{Key: "up", Kind: Boolean, Float: 1},
+				{Key: "status", Kind: String, Str: `link "up", 1Gb/s`},
+			},
+		},
+		{
+			Line:        5,
+			Measurement: "disk,io",
+			Fields:      []Field{{Key: "free", Kind: Float, Float: 1e9}},
+		},
+		{
+			Line:        6,
+			Measurement: "weather",
+			Tags:        map[string]string{"location": "us,midwest"},
+			Fields:      []Field{{Key: "temperature", Kind: Float, Float: 82}},
+			Time:        time.Unix(0, 1700000000),
+		},
+	}, points)
+}
+
+func TestParse_Precision(t *testing.T) {
+	points, _, err := Parse(strings.NewReader("m v=1 1700000000"), "s")
+	require.NoError(t, err)
+	require.Len(t, points, 1)
+	assert.Equal(t, time.Unix(1700000000, 0), points[0].Time)
+
+	_, _, err = Parse(strings.NewReader("m v=1"), "h")
+	assert.Error(t, err)
+
+	// Timestamp, which overflows nanoseconds, is rejected
+	_, lineErrs, err := Parse(strings.NewReader("m v=1 1700000000000"), "s")
+	require.NoError(t, err)
+	assert.Len(t, lineErrs, 1)
+}
+
+func TestParse_MalformedLines(t *testing.T) {
+	tests := []string{
+		"m",
+		"m,host=a",
+		",host=a v=1",
+		"m,host v=1",
+		"m,host= v=1",
+		"m,=a v=1",
+		"m v=",
+		"m =1",
+		"m v",
+		"m v=1,",
+		"m v=abc",
+		"m v=1.5i",
+		"m v=-1u",
+		"m v=NaN",
+		`m v="open`,
+		"m v=1 soon",
+		"m v=1 1 2",
+	}
+
+	for _, line := range tests {
+		t.Run(line, func(t *testing.T) {
+			points, lineErrs, err := Parse(strings.NewReader("ok v=1\n"+line+"\n"), "ns")
+			require.NoError(t, err)
+			assert.Len(t, points, 1)
+			require.Len(t, lineErrs, 1)
+			assert.Equal(t, 2, lineErrs[0].Line)
+			assert.Contains(t, lineErrs[0].Message, "unable to parse")
+		})
+	}
+}
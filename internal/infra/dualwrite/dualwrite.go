@@ -0,0 +1,214 @@
+// Package dualwrite implements StorageService
+// Changes are written to two storages, reads are served by the primary one
+package dualwrite
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/melkomukovki/go-musthave-metrics/internal/entities"
+	"github.com/melkomukovki/go-musthave-metrics/internal/services"
+)
+
+// Storage writes changes to primary storage and mirrors successful ones to secondary storage.
+// Failure of secondary storage doesn't fail request: it is logged and counted,
+// storages are brought back in sync by copying metrics between them
+type Storage struct {
+	Primary   services.ServiceRepository
+	Secondary services.ServiceRepository
+
+	failures atomic.Int64
+}
+
+// mirror records result of change applied to secondary storage
+func (s *Storage) mirror(op string, err error) {
+	if err == nil || errors.Is(err, entities.ErrMetricNotFound) || errors.Is(err, entities.ErrMetadataNotFound) {
+		return
+	}
+	s.failures.Add(1)
+	log.Warn().Err(err).Str("op", op).Msg("failed to mirror change to secondary storage")
+}
+
+// SecondaryFailures returns number of changes, which were not mirrored to secondary storage
+func (s *Storage) SecondaryFailures() int64 {
+	return s.failures.Load()
+}
+
+// AddMetric allow to add metric to both storages
+func (s *Storage) AddMetric(ctx context.Context, metric entities.MetricInternal) error {
+	if err := s.Primary.AddMetric(ctx, metric); err != nil {
+		return err
+	}
+	s.mirror("add", s.Secondary.AddMetric(ctx, metric))
+	return nil
+}
+
+// UpdateGauge checks condition against primary storage, stored gauge is mirrored to secondary storage unconditionally
+func (s *Storage) UpdateGauge(ctx context.Context, metric entities.MetricInternal, cond entities.GaugeCondition) (int64, error) {
+	version, err := s.Primary.UpdateGauge(ctx, metric, cond)
+	if err != nil {
+		return 0, err
+	}
+	s.mirror("update", s.Secondary.AddMetric(ctx, metric))
+	return version, nil
+}
+
+// AddMultipleMetrics allow to add multiple metrics to both storages
+func (s *Storage) AddMultipleMetrics(ctx context.Context, metrics []entities.MetricInternal) error {
+	if err := s.Primary.AddMultipleMetrics(ctx, metrics); err != nil {
+		return err
+	}
+	s.mirror("batch", s.Secondary.AddMultipleMetrics(ctx, metrics))
+	return nil
+}
+
+// MergeMetric merges histogram or summary into values of both storages
+func (s *Storage) MergeMetric(ctx context.Context, metric entities.MetricInternal) error {
+	if err := s.Primary.MergeMetric(ctx, metric); err != nil {
+		return err
+	}
+	s.mirror("merge", s.Secondary.MergeMetric(ctx, metric))
+	return nil
+}
+
+// IncrementCounter adds delta to the counter in both storages
+func (s *Storage) IncrementCounter(ctx context.Context, mName string, labels map[string]string, delta int64) error {
+	if err := s.Primary.IncrementCounter(ctx, mName, labels, delta); err != nil {
+		return err
+	}
+	s.mirror("inc", s.Secondary.IncrementCounter(ctx, mName, labels, delta))
+	return nil
+}
+
+// DeleteMetric removes metric from both storages, returns entities.ErrMetricNotFound if primary storage doesn't have it
+func (s *Storage) DeleteMetric(ctx context.Context, mType, mName string, labels map[string]string) error {
+	if err := s.Primary.DeleteMetric(ctx, mType, mName, labels); err != nil {
+		return err
+	}
+	s.mirror("del", s.Secondary.DeleteMetric(ctx, mType, mName, labels))
+	return nil
+}
+
+// ResetCounter sets counter to zero in both storages, returns entities.ErrMetricNotFound if primary storage doesn't have it
+func (s *Storage) ResetCounter(ctx context.Context, mName string, labels map[string]string) error {
+	if err := s.Primary.ResetCounter(ctx, mName, labels); err != nil {
+		return err
+	}
+	s.mirror("reset", s.Secondary.ResetCounter(ctx, mName, labels))
+	return nil
+}
+
+// MergeRollups merges gauge rollups into both storages
+func (s *Storage) MergeRollups(ctx context.Context, rollups []entities.RollupInternal) error {
+	if err := s.Primary.MergeRollups(ctx, rollups); err != nil {
+		return err
+	}
+	s.mirror("rollups", s.Secondary.MergeRollups(ctx, rollups))
+	return nil
+}
+
+// Prune applies retention rules to both storages, report of primary storage is returned
+func (s *Storage) Prune(ctx context.Context, rules []entities.RetentionRule, now time.Time) (entities.PruneReport, error) {
+	report, err := s.Primary.Prune(ctx, rules, now)
+	if err != nil {
+		return entities.PruneReport{}, err
+	}
+	_, err = s.Secondary.Prune(ctx, rules, now)
+	s.mirror("prune", err)
+	return report, nil
+}
+
+// ClaimMetricTypes claims names in primary storage, claims are mirrored to secondary storage
+func (s *Storage) ClaimMetricTypes(ctx context.Context, types map[string]string) error {
+	if err := s.Primary.ClaimMetricTypes(ctx, types); err != nil {
+		return err
+	}
+	s.mirror("claim", s.Secondary.ClaimMetricTypes(ctx, types))
+	return nil
+}
+
+// SetMetadata stores metadata in both storages
+func (s *Storage) SetMetadata(ctx context.Context, meta entities.MetricMetadata) error {
+	if err := s.Primary.SetMetadata(ctx, meta); err != nil {
+		return err
+	}
+	s.mirror("metadata", s.Secondary.SetMetadata(ctx, meta))
+	return nil
+}
+
+// DeleteMetadata removes metadata from both storages, primary storage decides whether metadata exists
+func (s *Storage) DeleteMetadata(ctx context.Context, name string) error {
+	if err := s.Primary.DeleteMetadata(ctx, name); err != nil {
+		return err
+	}
+	s.mirror("delete metadata", s.Secondary.DeleteMetadata(ctx, name))
+	return nil
+}
+
+// GetMetadata returns metadata from primary storage
+func (s *Storage) GetMetadata(ctx context.Context, name string) (entities.MetricMetadata, error) {
+	return s.Primary.GetMetadata(ctx, name)
+}
+
+// GetAllMetadata returns metadata of all names from primary storage
+func (s *Storage) GetAllMetadata(ctx context.Context) ([]entities.MetricMetadata, error) {
+	return s.Primary.GetAllMetadata(ctx)
+}
+
+// GetMetric returns metric from primary storage
+func (s *Storage) GetMetric(ctx context.Context, mType, mName string, labels map[string]string) (entities.MetricInternal, error) {
+	return s.Primary.GetMetric(ctx, mType, mName, labels)
+}
+
+// GetAllMetrics returns metrics from primary storage, which labels satisfy all matchers
+func (s *Storage) GetAllMetrics(ctx context.Context, matchers []entities.LabelMatcher) ([]entities.MetricInternal, error) {
+	return s.Primary.GetAllMetrics(ctx, matchers)
+}
+
+// GetMetricHistory returns history from primary storage
+func (s *Storage) GetMetricHistory(ctx context.Context, mType, mName string, labels map[string]string, from, to time.Time) ([]entities.MetricPointInternal, error) {
+	return s.Primary.GetMetricHistory(ctx, mType, mName, labels, from, to)
+}
+
+// GetRollups returns rollups from primary storage
+func (s *Storage) GetRollups(ctx context.Context, mName string, labels map[string]string, step time.Duration, from, to time.Time) ([]entities.RollupInternal, error) {
+	return s.Primary.GetRollups(ctx, mName, labels, step, from, to)
+}
+
+// Ping checks primary storage, unavailable secondary storage is only logged
+func (s *Storage) Ping(ctx context.Context) error {
+	if err := s.Secondary.Ping(ctx); err != nil {
+		log.Warn().Err(err).Msg("secondary storage is unavailable")
+	}
+	return s.Primary.Ping(ctx)
+}
+
+// JournalStats returns state of primary storage journal, zero if it works without journal.
+// Journal of secondary storage is reported as Secondary, so its outage is visible too
+func (s *Storage) JournalStats() entities.JournalStats {
+	var stats entities.JournalStats
+	if reporter, ok := s.Primary.(services.JournalReporter); ok {
+		stats = reporter.JournalStats()
+	}
+	if reporter, ok := s.Secondary.(services.JournalReporter); ok {
+		secondary := reporter.JournalStats()
+		stats.Secondary = &secondary
+	}
+	return stats
+}
+
+// Close closes both storages
+func (s *Storage) Close() error {
+	var errs []error
+	for _, repo := range []services.ServiceRepository{s.Primary, s.Secondary} {
+		if closer, ok := repo.(io.Closer); ok {
+			errs = append(errs, closer.Close())
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,104 @@
+package dualwrite
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/melkomukovki/go-musthave-metrics/internal/entities"
+	"github.com/melkomukovki/go-musthave-metrics/internal/infra/memstorage"
+	"github.com/melkomukovki/go-musthave-metrics/internal/infra/storagetest"
+	"github.com/melkomukovki/go-musthave-metrics/internal/services"
+)
+
+var errUnavailable = errors.New("storage is unavailable")
+
+// brokenStorage is memory storage, which rejects all writes of single metrics
+type brokenStorage struct {
+	*memstorage.MemStorage
+}
+
+func (b *brokenStorage) AddMetric(context.Context, entities.MetricInternal) error {
+	return errUnavailable
+}
+
+func TestStorage_Mirror(t *testing.T) {
+	primary := memstorage.NewClient(0, "", false, 1)
+	secondary := memstorage.NewClient(0, "", false, 1)
+	s := &Storage{Primary: primary, Secondary: secondary}
+	ctx := context.Background()
+
+	require.NoError(t, s.AddMetric(ctx, entities.MetricInternal{ID: "Alloc", MType: entities.Gauge, Value: "1.5"}))
+	require.NoError(t, s.IncrementCounter(ctx, "PollCount", nil, 3))
+	require.NoError(t, s.AddMultipleMetrics(ctx, []entities.MetricInternal{{ID: "PollCount", MType: entities.Counter, Value: "2"}}))
+
+	for _, repo := range []*memstorage.MemStorage{primary, secondary} {
+		metric, err := repo.GetMetric(ctx, entities.Counter, "PollCount", nil)
+		require.NoError(t, err)
+		assert.Equal(t, "5", metric.Value)
+		metric, err = repo.GetMetric(ctx, entities.Gauge, "Alloc", nil)
+		require.NoError(t, err)
+		assert.Equal(t, "1.5", metric.Value)
+	}
+
+	require.NoError(t, s.DeleteMetric(ctx, entities.Gauge, "Alloc", nil))
+	_, err := secondary.GetMetric(ctx, entities.Gauge, "Alloc", nil)
+	assert.ErrorIs(t, err, entities.ErrMetricNotFound)
+
+	// Primary decides whether metric exists
+	assert.ErrorIs(t, s.DeleteMetric(ctx, entities.Gauge, "Alloc", nil), entities.ErrMetricNotFound)
+	assert.Zero(t, s.SecondaryFailures())
+}
+
+func TestStorage_SecondaryFailure(t *testing.T) {
+	primary := memstorage.NewClient(0, "", false, 1)
+	secondary := &brokenStorage{MemStorage: memstorage.NewClient(0, "", false, 1)}
+	ctx := context.Background()
+
+	s := &Storage{Primary: primary, Secondary: secondary}
+	require.NoError(t, s.AddMetric(ctx, entities.MetricInternal{ID: "Alloc", MType: entities.Gauge, Value: "1.5"}))
+	assert.Equal(t, int64(1), s.SecondaryFailures())
+
+	metric, err := s.GetMetric(ctx, entities.Gauge, "Alloc", nil)
+	require.NoError(t, err)
+	assert.Equal(t, "1.5", metric.Value)
+
+	// Failed primary write is not mirrored
+	s = &Storage{Primary: secondary, Secondary: primary}
+	assert.ErrorIs(t, s.AddMetric(ctx, entities.MetricInternal{ID: "Alloc", MType: entities.Gauge, Value: "2"}), errUnavailable)
+	metric, err = primary.GetMetric(ctx, entities.Gauge, "Alloc", nil)
+	require.NoError(t, err)
+	assert.Equal(t, "1.5", metric.Value)
+	assert.Zero(t, s.SecondaryFailures())
+}
+
+// journaledStorage is memory storage reporting journal
+type journaledStorage struct {
+	*memstorage.MemStorage
+	stats entities.JournalStats
+}
+
+func (j *journaledStorage) JournalStats() entities.JournalStats {
+	return j.stats
+}
+
+func TestStorage_JournalStats(t *testing.T) {
+	journaled := &journaledStorage{MemStorage: memstorage.NewClient(0, "", false, 1), stats: entities.JournalStats{Records: 2, Bytes: 100, Degraded: true}}
+	plain := memstorage.NewClient(0, "", false, 1)
+
+	s := &Storage{Primary: journaled, Secondary: plain}
+	assert.Equal(t, journaled.stats, s.JournalStats())
+
+	// Outage of secondary storage is reported apart from primary one
+	s = &Storage{Primary: plain, Secondary: journaled}
+	assert.Equal(t, entities.JournalStats{Secondary: &journaled.stats}, s.JournalStats())
+}
+
+func TestStorage_Conformance(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) services.ServiceRepository {
+		return &Storage{Primary: memstorage.NewClient(0, "", false, 1), Secondary: memstorage.NewClient(0, "", false, 1)}
+	})
+}
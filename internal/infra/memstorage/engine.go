@@ -0,0 +1,489 @@
+package memstorage
+
+import (
+	"math"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/melkomukovki/go-musthave-metrics/internal/entities"
+)
+
+// shardCount - number of independently locked parts of engine, must be power of two
+const shardCount = 64
+
+// cell keeps value of single metric series: float64 bits for gauge, int64 for counter.
+// Value is updated atomically, so writers of existing metric never take shard lock for writing
+type cell struct {
+	bits    atomic.Uint64
+	version atomic.Int64 // Version of gauge, changed after value, see entities.GaugeCondition
+	text    atomic.Pointer[formatted]
+	updated atomic.Int64 // Unix nanoseconds of the last change
+	history ringBuffer
+	name    string
+	labels  map[string]string // Copy owned by cell, never changed
+}
+
+// formatted is string representation of cell value, valid while value is not changed
+type formatted struct {
+	bits  uint64
+	value string
+}
+
+// record marks cell changed now and adds its new value to history
+func (c *cell) record(bits uint64) {
+	now := time.Now().UnixNano()
+	c.updated.Store(now)
+	c.history.push(now, bits)
+}
+
+// value returns string representation of cell value. It is cached, so reading of unchanged metrics doesn't allocate
+func (c *cell) value(mType string) string {
+	bits := c.bits.Load()
+	if f := c.text.Load(); f != nil && f.bits == bits {
+		return f.value
+	}
+	f := &formatted{bits: bits, value: formatValue(mType, bits)}
+	c.text.Store(f)
+	return f.value
+}
+
+// distCell keeps histogram or summary series. Merge changes several fields, so value is protected by mutex
+type distCell struct {
+	mu      sync.Mutex
+	value   entities.Distribution // nil until the first value is stored
+	updated int64                 // Unix nanoseconds of the last change
+	name    string
+	labels  map[string]string // Copy owned by cell, never changed
+}
+
+// format returns internal representation of value
+func (c *distCell) format() (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return entities.FormatDistribution(c.value)
+}
+
+// shard keeps part of metrics, cells are keyed by entities.SeriesKey. Lock protects maps only, not values of cells
+type shard struct {
+	mu         sync.RWMutex
+	gauges     map[string]*cell
+	counters   map[string]*cell
+	histograms map[string]*distCell
+	summaries  map[string]*distCell
+	rollups    map[string]*rollupSeries           // Rollups of gauges
+	metadata   map[string]entities.MetricMetadata // Metadata keyed by metric name
+}
+
+func (s *shard) dists(mType string) map[string]*distCell {
+	if mType == entities.Histogram {
+		return s.histograms
+	}
+	return s.summaries
+}
+
+func (s *shard) metrics(mType string) map[string]*cell {
+	if mType == entities.Gauge {
+		return s.gauges
+	}
+	return s.counters
+}
+
+// engine is sharded map of typed metric cells. All series of one metric name are kept in the same shard
+type engine struct {
+	shards [shardCount]shard
+}
+
+func newEngine() *engine {
+	e := &engine{}
+	for i := range e.shards {
+		e.shards[i].gauges = make(map[string]*cell)
+		e.shards[i].counters = make(map[string]*cell)
+		e.shards[i].histograms = make(map[string]*distCell)
+		e.shards[i].summaries = make(map[string]*distCell)
+		e.shards[i].rollups = make(map[string]*rollupSeries)
+		e.shards[i].metadata = make(map[string]entities.MetricMetadata)
+	}
+	return e
+}
+
+// fnvOffset - initial value of FNV-1a hash
+const fnvOffset = uint32(2166136261)
+
+// fnvAdd continues FNV-1a hash h by bytes of s
+func fnvAdd(h uint32, s string) uint32 {
+	for i := 0; i < len(s); i++ {
+		h ^= uint32(s[i])
+		h *= 16777619
+	}
+	return h
+}
+
+// shardOf returns shard of metric name using FNV-1a hash
+func (e *engine) shardOf(name string) *shard {
+	return &e.shards[fnvAdd(fnvOffset, name)&(shardCount-1)]
+}
+
+// lookup returns cell of metric series or nil if it doesn't exist
+func (e *engine) lookup(mType, name string, labels map[string]string) *cell {
+	s := e.shardOf(name)
+	key := entities.SeriesKey(name, labels)
+	s.mu.RLock()
+	c := s.metrics(mType)[key]
+	s.mu.RUnlock()
+	return c
+}
+
+// cellOf returns cell of metric series, creating it when series doesn't exist.
+// created is true for the new cell, its value is zero
+func (e *engine) cellOf(mType, name string, labels map[string]string) (c *cell, created bool) {
+	if c = e.lookup(mType, name, labels); c != nil {
+		return c, false
+	}
+
+	s := e.shardOf(name)
+	key := entities.SeriesKey(name, labels)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	metrics := s.metrics(mType)
+	if c = metrics[key]; c != nil {
+		return c, false
+	}
+	c = &cell{name: name, labels: entities.CloneLabels(labels)}
+	metrics[key] = c
+	return c, true
+}
+
+func (e *engine) setGauge(name string, labels map[string]string, value float64) {
+	e.setGaugeAt(name, labels, value, time.Now())
+}
+
+// setGaugeAt stores gauge value observed at ts and returns its version
+func (e *engine) setGaugeAt(name string, labels map[string]string, value float64, ts time.Time) int64 {
+	c, _ := e.cellOf(entities.Gauge, name, labels)
+	bits := math.Float64bits(value)
+	c.bits.Store(bits)
+	c.record(bits)
+	// Version is changed after value, so reader, which loads version first, never gets new version with old value
+	for {
+		current := c.version.Load()
+		next := entities.NextVersion(current, ts)
+		if c.version.CompareAndSwap(current, next) {
+			return next
+		}
+	}
+}
+
+// updateGauge stores gauge value if gauge satisfies condition and returns its version.
+// Caller must exclude concurrent changes of gauge
+func (e *engine) updateGauge(name string, labels map[string]string, value float64, cond entities.GaugeCondition) (int64, error) {
+	var current float64
+	var version int64
+	c := e.lookup(entities.Gauge, name, labels)
+	if c != nil {
+		version = c.version.Load()
+		current = math.Float64frombits(c.bits.Load())
+	}
+	if !cond.Holds(c != nil, current, version) {
+		return 0, entities.ErrConditionFailed
+	}
+
+	ts := time.Now()
+	if cond.Timestamp.After(ts) {
+		ts = cond.Timestamp
+	}
+	return e.setGaugeAt(name, labels, value, ts), nil
+}
+
+func (e *engine) setCounter(name string, labels map[string]string, value int64) {
+	c, _ := e.cellOf(entities.Counter, name, labels)
+	c.bits.Store(uint64(value))
+	c.record(uint64(value))
+}
+
+// addCounter atomically adds delta to the counter and returns new value
+func (e *engine) addCounter(name string, labels map[string]string, delta int64) int64 {
+	c, _ := e.cellOf(entities.Counter, name, labels)
+	value := int64(c.bits.Add(uint64(delta)))
+	c.record(uint64(value))
+	return value
+}
+
+// resetCounter sets existing counter to zero, returns false if counter doesn't exist
+func (e *engine) resetCounter(name string, labels map[string]string) bool {
+	c := e.lookup(entities.Counter, name, labels)
+	if c == nil {
+		return false
+	}
+	c.bits.Store(0)
+	c.record(0)
+	return true
+}
+
+// lookupDist returns cell of histogram or summary series or nil if it doesn't exist
+func (e *engine) lookupDist(mType, name string, labels map[string]string) *distCell {
+	s := e.shardOf(name)
+	key := entities.SeriesKey(name, labels)
+	s.mu.RLock()
+	c := s.dists(mType)[key]
+	s.mu.RUnlock()
+	return c
+}
+
+// distOf returns cell of histogram or summary series, creating it when series doesn't exist
+func (e *engine) distOf(mType, name string, labels map[string]string) *distCell {
+	if c := e.lookupDist(mType, name, labels); c != nil {
+		return c
+	}
+
+	s := e.shardOf(name)
+	key := entities.SeriesKey(name, labels)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	dists := s.dists(mType)
+	if c := dists[key]; c != nil {
+		return c
+	}
+	c := &distCell{name: name, labels: entities.CloneLabels(labels)}
+	dists[key] = c
+	return c
+}
+
+// setDistribution replaces value of histogram or summary. Engine takes ownership of value
+func (e *engine) setDistribution(mType, name string, labels map[string]string, value entities.Distribution) {
+	c := e.distOf(mType, name, labels)
+	c.mu.Lock()
+	c.value = value
+	c.updated = time.Now().UnixNano()
+	c.mu.Unlock()
+}
+
+// distCopy returns copy of stored histogram or summary, nil if series has no value
+func (e *engine) distCopy(mType, name string, labels map[string]string) (entities.Distribution, error) {
+	c := e.lookupDist(mType, name, labels)
+	if c == nil {
+		return nil, nil
+	}
+	value, err := c.format()
+	if err != nil || value == "null" {
+		return nil, err
+	}
+	return entities.ParseDistribution(mType, value)
+}
+
+// mergeDistribution merges value into stored histogram or summary. Engine takes ownership of value
+func (e *engine) mergeDistribution(mType, name string, labels map[string]string, value entities.Distribution) error {
+	c := e.distOf(mType, name, labels)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.updated = time.Now().UnixNano()
+	if c.value == nil {
+		c.value = value
+		return nil
+	}
+	return c.value.Merge(value)
+}
+
+// updatedAt returns time of the last change of series in Unix nanoseconds, zero if series doesn't exist
+func (e *engine) updatedAt(mType, name string, labels map[string]string) int64 {
+	if entities.IsDistribution(mType) {
+		c := e.lookupDist(mType, name, labels)
+		if c == nil {
+			return 0
+		}
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return c.updated
+	}
+	if c := e.lookup(mType, name, labels); c != nil {
+		return c.updated.Load()
+	}
+	return 0
+}
+
+// setUpdatedAt sets time of the last change of restored series
+func (e *engine) setUpdatedAt(mType, name string, labels map[string]string, ts int64) {
+	if entities.IsDistribution(mType) {
+		if c := e.lookupDist(mType, name, labels); c != nil {
+			c.mu.Lock()
+			c.updated = ts
+			c.mu.Unlock()
+		}
+		return
+	}
+	if c := e.lookup(mType, name, labels); c != nil {
+		c.updated.Store(ts)
+	}
+}
+
+// lookupRollups returns rollups of gauge series or nil if they don't exist
+func (e *engine) lookupRollups(name string, labels map[string]string) *rollupSeries {
+	s := e.shardOf(name)
+	key := entities.SeriesKey(name, labels)
+	s.mu.RLock()
+	r := s.rollups[key]
+	s.mu.RUnlock()
+	return r
+}
+
+// rollupsOf returns rollups of gauge series, creating them when they don't exist
+func (e *engine) rollupsOf(name string, labels map[string]string) *rollupSeries {
+	if r := e.lookupRollups(name, labels); r != nil {
+		return r
+	}
+
+	s := e.shardOf(name)
+	key := entities.SeriesKey(name, labels)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r := s.rollups[key]
+	if r == nil {
+		r = newRollupSeries(name, labels)
+		s.rollups[key] = r
+	}
+	return r
+}
+
+// delete removes metric series with its history and rollups, returns false if series doesn't exist
+func (e *engine) delete(mType, name string, labels map[string]string) bool {
+	s := e.shardOf(name)
+	key := entities.SeriesKey(name, labels)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if entities.IsDistribution(mType) {
+		dists := s.dists(mType)
+		if _, ok := dists[key]; !ok {
+			return false
+		}
+		delete(dists, key)
+		return true
+	}
+
+	metrics := s.metrics(mType)
+	if _, ok := metrics[key]; !ok {
+		return false
+	}
+	delete(metrics, key)
+	if mType == entities.Gauge {
+		delete(s.rollups, key)
+	}
+	return true
+}
+
+// len returns number of stored metrics
+func (e *engine) len() int {
+	n := 0
+	for i := range e.shards {
+		s := &e.shards[i]
+		s.mu.RLock()
+		n += len(s.gauges) + len(s.counters) + len(s.histograms) + len(s.summaries)
+		s.mu.RUnlock()
+	}
+	return n
+}
+
+// appendAll appends metrics, which labels satisfy all matchers, to dst formatted as MetricInternal.
+// Labels of returned metrics are shared with engine and must not be changed
+func (e *engine) appendAll(dst []entities.MetricInternal, matchers []entities.LabelMatcher) []entities.MetricInternal {
+	for i := range e.shards {
+		s := &e.shards[i]
+		s.mu.RLock()
+		for _, c := range s.counters {
+			if entities.MatchLabels(c.labels, matchers) {
+				dst = append(dst, entities.MetricInternal{ID: c.name, MType: entities.Counter, Value: c.value(entities.Counter), Labels: c.labels})
+			}
+		}
+		for _, c := range s.gauges {
+			if entities.MatchLabels(c.labels, matchers) {
+				dst = append(dst, entities.MetricInternal{ID: c.name, MType: entities.Gauge, Value: c.value(entities.Gauge), Labels: c.labels})
+			}
+		}
+		for _, mType := range [...]string{entities.Histogram, entities.Summary} {
+			for _, c := range s.dists(mType) {
+				if !entities.MatchLabels(c.labels, matchers) {
+					continue
+				}
+				// Cell can be created by concurrent writer, which didn't store value yet
+				if value, err := c.format(); err == nil && value != "null" {
+					dst = append(dst, entities.MetricInternal{ID: c.name, MType: mType, Value: value, Labels: c.labels})
+				}
+			}
+		}
+		s.mu.RUnlock()
+	}
+	return dst
+}
+
+// formatValue returns string representation of cell value
+func formatValue(mType string, bits uint64) string {
+	if mType == entities.Gauge {
+		return strconv.FormatFloat(math.Float64frombits(bits), 'g', -1, 64)
+	}
+	return strconv.FormatInt(int64(bits), 10)
+}
+
+// parseValue returns cell value of its string representation
+func parseValue(mType, value string) (uint64, error) {
+	if mType == entities.Gauge {
+		v, err := strconv.ParseFloat(value, 64)
+		return math.Float64bits(v), err
+	}
+	v, err := strconv.ParseInt(value, 10, 64)
+	return uint64(v), err
+}
+
+// prune deletes series, which were not updated for TTL of their retention rule, and history values older
+// than history retention. Deleted series are passed to onDelete
+func (e *engine) prune(rules []entities.RetentionRule, now time.Time, onDelete func(mType, name string, labels map[string]string)) (report entities.PruneReport) {
+	// cutoff returns the oldest kept timestamp for retention period, zero period keeps everything
+	cutoff := func(period time.Duration) int64 {
+		if period <= 0 {
+			return math.MinInt64
+		}
+		return now.Add(-period).UnixNano()
+	}
+
+	for i := range e.shards {
+		s := &e.shards[i]
+		s.mu.Lock()
+		for _, mType := range [...]string{entities.Gauge, entities.Counter} {
+			metrics := s.metrics(mType)
+			for key, c := range metrics {
+				rule, ok := entities.RetentionRuleFor(rules, mType, c.name)
+				if !ok {
+					continue
+				}
+				if c.updated.Load() < cutoff(rule.TTL) {
+					delete(metrics, key)
+					if mType == entities.Gauge {
+						delete(s.rollups, key)
+					}
+					onDelete(mType, c.name, c.labels)
+					report.Series++
+					continue
+				}
+				report.HistoryPoints += c.history.dropBefore(cutoff(rule.History))
+			}
+		}
+		for _, mType := range [...]string{entities.Histogram, entities.Summary} {
+			dists := s.dists(mType)
+			for key, c := range dists {
+				rule, ok := entities.RetentionRuleFor(rules, mType, c.name)
+				if !ok {
+					continue
+				}
+				c.mu.Lock()
+				updated := c.updated
+				c.mu.Unlock()
+				if updated < cutoff(rule.TTL) {
+					delete(dists, key)
+					onDelete(mType, c.name, c.labels)
+					report.Series++
+				}
+			}
+		}
+		s.mu.Unlock()
+	}
+	return report
+}
@@ -0,0 +1,104 @@
+package memstorage
+
+import (
+	"context"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/melkomukovki/go-musthave-metrics/internal/entities"
+)
+
+func TestEngine_Values(t *testing.T) {
+	ctx := context.Background()
+	storage := NewClient(0, "", false, DefaultGenerations)
+
+	require.NoError(t, storage.AddMetric(ctx, entities.MetricInternal{ID: "PollCount", MType: entities.Counter, Value: "9223372036854775800"}))
+	require.NoError(t, storage.IncrementCounter(ctx, "PollCount", nil, 7))
+	require.NoError(t, storage.IncrementCounter(ctx, "Errors", nil, -3))
+	require.NoError(t, storage.AddMetric(ctx, entities.MetricInternal{ID: "Alloc", MType: entities.Gauge, Value: "-0.125"}))
+
+	counter, err := storage.GetMetric(ctx, entities.Counter, "PollCount", nil)
+	require.NoError(t, err)
+	assert.Equal(t, "9223372036854775807", counter.Value)
+
+	counter, err = storage.GetMetric(ctx, entities.Counter, "Errors", nil)
+	require.NoError(t, err)
+	assert.Equal(t, "-3", counter.Value)
+
+	gauge, err := storage.GetMetric(ctx, entities.Gauge, "Alloc", nil)
+	require.NoError(t, err)
+	assert.Equal(t, "-0.125", gauge.Value)
+
+	_, err = storage.GetMetric(ctx, entities.Gauge, "PollCount", nil)
+	assert.ErrorIs(t, err, entities.ErrMetricNotFound, "metrics of different types must not share cells")
+
+	all, err := storage.GetAllMetrics(ctx, nil)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []entities.MetricInternal{
+		{ID: "PollCount", MType: entities.Counter, Value: "9223372036854775807"},
+		{ID: "Errors", MType: entities.Counter, Value: "-3"},
+		{ID: "Alloc", MType: entities.Gauge, Value: "-0.125"},
+	}, all)
+}
+
+func TestEngine_IncrementCounterAllocations(t *testing.T) {
+	ctx := context.Background()
+	storage := NewClient(0, "", false, DefaultGenerations)
+	require.NoError(t, storage.IncrementCounter(ctx, "PollCount", nil, 1))
+
+	// Fill history buffer, it doesn't grow after that
+	for i := 0; i < DefaultHistoryCapacity; i++ {
+		require.NoError(t, storage.IncrementCounter(ctx, "PollCount", nil, 1))
+	}
+
+	allocs := testing.AllocsPerRun(100, func() {
+		_ = storage.IncrementCounter(ctx, "PollCount", nil, 1)
+		_ = storage.AddMetric(ctx, entities.MetricInternal{ID: "PollCount", MType: entities.Gauge, Value: "1.5"})
+	})
+	assert.Zero(t, allocs)
+}
+
+func BenchmarkIncrementCounter(b *testing.B) {
+	ctx := context.Background()
+	storage := NewClient(0, "", false, DefaultGenerations)
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			_ = storage.IncrementCounter(ctx, "PollCount", nil, 1)
+		}
+	})
+}
+
+func BenchmarkAddGauge(b *testing.B) {
+	ctx := context.Background()
+	names := make([]string, 64)
+	for i := range names {
+		names[i] = "gauge" + strconv.Itoa(i)
+	}
+
+	storage := NewClient(0, "", false, DefaultGenerations)
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for i := 0; pb.Next(); i++ {
+			_ = storage.AddMetric(ctx, entities.MetricInternal{ID: names[i%len(names)], MType: entities.Gauge, Value: "123.456"})
+		}
+	})
+}
+
+func BenchmarkGetAllMetrics(b *testing.B) {
+	const metrics = 1000
+	ctx := context.Background()
+	storage := NewClient(0, "", false, DefaultGenerations)
+	for i := 0; i < metrics; i++ {
+		_ = storage.IncrementCounter(ctx, "counter"+strconv.Itoa(i), nil, int64(i))
+		_ = storage.AddMetric(ctx, entities.MetricInternal{ID: "gauge" + strconv.Itoa(i), MType: entities.Gauge, Value: "1.5"})
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, _ = storage.GetAllMetrics(ctx, nil)
+	}
+}
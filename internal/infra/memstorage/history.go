@@ -0,0 +1,116 @@
+package memstorage
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/melkomukovki/go-musthave-metrics/internal/entities"
+)
+
+// DefaultHistoryCapacity - number of values kept in memory for every metric
+const DefaultHistoryCapacity = 1024
+
+// historyPoint is value of cell at the moment
+type historyPoint struct {
+	ts   int64 // Unix nanoseconds
+	bits uint64
+}
+
+// ringBuffer keeps last values of single metric. Oldest values are overwritten when buffer is full.
+// Buffer grows up to DefaultHistoryCapacity, so metrics updated rarely don't take much memory
+type ringBuffer struct {
+	mu     sync.RWMutex
+	points []historyPoint
+	start  int
+}
+
+func (r *ringBuffer) push(ts int64, bits uint64) {
+	p := historyPoint{ts: ts, bits: bits}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if len(r.points) < DefaultHistoryCapacity {
+		r.points = append(r.points, p)
+		return
+	}
+	r.points[r.start] = p
+	r.start = (r.start + 1) % len(r.points)
+}
+
+// dropBefore removes values older than ts and returns their number
+func (r *ringBuffer) dropBefore(ts int64) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	kept := make([]historyPoint, 0, len(r.points))
+	for i := 0; i < len(r.points); i++ {
+		if p := r.points[(r.start+i)%len(r.points)]; p.ts >= ts {
+			kept = append(kept, p)
+		}
+	}
+	dropped := len(r.points) - len(kept)
+	if dropped > 0 {
+		r.points, r.start = kept, 0
+	}
+	return dropped
+}
+
+// all returns stored values ordered by timestamp
+func (r *ringBuffer) all() []historyPoint {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	res := make([]historyPoint, len(r.points))
+	for i := range r.points {
+		res[i] = r.points[(r.start+i)%len(r.points)]
+	}
+	return res
+}
+
+// restore replaces stored values with points ordered by timestamp. Only the newest
+// DefaultHistoryCapacity points are kept
+func (r *ringBuffer) restore(points []historyPoint) {
+	if len(points) > DefaultHistoryCapacity {
+		points = points[len(points)-DefaultHistoryCapacity:]
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.points, r.start = points, 0
+}
+
+// rangeOf returns values stored between from and to (inclusive), ordered by timestamp
+func (r *ringBuffer) rangeOf(mType string, from, to time.Time) []entities.MetricPointInternal {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	fromNs, toNs := from.UnixNano(), to.UnixNano()
+	var res []entities.MetricPointInternal
+	for i := 0; i < len(r.points); i++ {
+		p := r.points[(r.start+i)%len(r.points)]
+		if p.ts < fromNs || p.ts > toNs {
+			continue
+		}
+		res = append(res, entities.MetricPointInternal{Timestamp: time.Unix(0, p.ts), Value: formatValue(mType, p.bits)})
+	}
+	return res
+}
+
+// GetMetricHistory allow to get metric values stored between from and to
+func (m *MemStorage) GetMetricHistory(ctx context.Context, mType, mName string, labels map[string]string, from, to time.Time) ([]entities.MetricPointInternal, error) {
+	if mType != entities.Gauge && mType != entities.Counter {
+		return nil, entities.ErrMetricNotSupportedType
+	}
+
+	e := m.lookupEngine(entities.TenantFromContext(ctx))
+	if e == nil {
+		return nil, nil
+	}
+	c := e.lookup(mType, mName, labels)
+	if c == nil {
+		return nil, nil
+	}
+	return c.history.rangeOf(mType, from, to), nil
+}
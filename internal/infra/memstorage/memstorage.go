@@ -4,191 +4,523 @@ package memstorage
 
 import (
 	"context"
-	"encoding/json"
-	"errors"
-	"fmt"
 	"os"
+	"slices"
+	"sort"
 	"strconv"
 	"sync"
 	"time"
 
+	"github.com/rs/zerolog/log"
+
 	"github.com/melkomukovki/go-musthave-metrics/internal/entities"
 )
 
-// NewClient return pointer to MemStorage structure
-func NewClient(storeInterval int, storePath string, restore bool) *MemStorage {
+// walFlushInterval - how often buffered WAL records are flushed when storage works in interval mode
+const walFlushInterval = time.Second
+
+// NewClient return pointer to MemStorage structure.
+// Storage keeps `generations` last snapshots in storePath, storePath.1 and so on
+func NewClient(storeInterval int, storePath string, restore bool, generations int) *MemStorage {
 	var syncMode = false
 	if storeInterval == 0 {
 		syncMode = true
 	}
+	if generations < 1 {
+		generations = DefaultGenerations
+	}
 
 	newStorage := &MemStorage{
-		GaugeMetrics:   sync.Map{},
-		CounterMetrics: sync.Map{},
-		syncStore:      syncMode,
-		storeInterval:  storeInterval,
-		storePath:      storePath,
+		tenants:       make(map[string]*engine),
+		syncStore:     syncMode,
+		storeInterval: storeInterval,
+		storePath:     storePath,
+		generations:   generations,
+		compactCh:     make(chan struct{}, 1),
+		done:          make(chan struct{}),
+	}
+
+	if storePath == "" {
+		return newStorage
 	}
 
 	if restore {
-		_ = newStorage.restoreStorage()
+		newStorage.lastRestore = newStorage.restoreStorage()
+		logRestoreReport(newStorage.lastRestore)
 	}
 
-	if !newStorage.syncStore {
-		go func() {
-			for {
-				time.Sleep(time.Duration(newStorage.storeInterval) * time.Second)
-				_ = newStorage.BackupMetrics()
-			}
-		}()
+	segments, err := listSegments(storePath)
+	if err != nil {
+		log.Error().Err(err).Str("path", storePath).Msg("failed to list WAL segments")
+	}
+	if !restore {
+		// Changes from previous run are not needed, they would be replayed on the next restore otherwise
+		for _, seg := range segments {
+			_ = os.Remove(seg.path)
+		}
+	}
+
+	// New segment must follow all existing segments and the newest snapshot
+	newStorage.walSeq, _ = snapshotWALSeq(storePath)
+	if n := len(segments); n > 0 && segments[n-1].seq >= newStorage.walSeq {
+		newStorage.walSeq = segments[n-1].seq + 1
+	}
+	newStorage.wal, err = openWAL(segmentPath(storePath, newStorage.walSeq))
+	if err != nil {
+		log.Error().Err(err).Str("path", storePath).Msg("failed to open WAL, metrics will not be persisted")
+		return newStorage
 	}
 
+	newStorage.wg.Add(1)
+	go newStorage.runPersistence()
+
 	return newStorage
 }
 
-// MemStorage define storage structure
+// MemStorage define storage structure. Metrics of every tenant are kept in separate engine
 type MemStorage struct {
-	GaugeMetrics   sync.Map
-	CounterMetrics sync.Map
-	storeInterval  int
-	syncStore      bool
-	storePath      string
+	tenantsMu     sync.RWMutex
+	tenants       map[string]*engine
+	storeInterval int
+	syncStore     bool
+	storePath     string
+	generations   int
+	lastRestore   RestoreReport
+
+	// persistMu is held for reading while change is applied and logged, and for writing while WAL is switched
+	persistMu sync.RWMutex
+	// nameMu are held while change of metric names is applied and logged, so WAL keeps order of changes
+	// of the same series. Lock of metric is chosen by hash of tenant and name
+	nameMu    [shardCount]sync.Mutex
+	compactMu sync.Mutex
+	wal       *wal
+	walSeq    uint64
+	compactCh chan struct{}
+	done      chan struct{}
+	wg        sync.WaitGroup
 }
 
-func (m *MemStorage) restoreStorage() error {
-	var metrics []entities.MetricInternal
-	data, err := os.ReadFile(m.storePath)
-	if err != nil {
-		return err
+// Load restores metrics from storage file and WAL segments written after it. Changes of loaded storage
+// are not persisted, so files of storage used by running server are left untouched
+func Load(storePath string, generations int) (*MemStorage, RestoreReport) {
+	if generations < 1 {
+		generations = DefaultGenerations
+	}
+
+	storage := &MemStorage{
+		tenants:     make(map[string]*engine),
+		syncStore:   true,
+		storePath:   storePath,
+		generations: generations,
+		compactCh:   make(chan struct{}, 1),
+		done:        make(chan struct{}),
+	}
+	storage.lastRestore = storage.restoreStorage()
+	storage.storePath = ""
+	return storage, storage.lastRestore
+}
+
+// LastRestore returns report of restore made on storage creation
+func (m *MemStorage) LastRestore() RestoreReport {
+	return m.lastRestore
+}
+
+// engineOf returns engine of tenant, creating it on the first write
+func (m *MemStorage) engineOf(tenant string) *engine {
+	if e := m.lookupEngine(tenant); e != nil {
+		return e
+	}
+
+	m.tenantsMu.Lock()
+	defer m.tenantsMu.Unlock()
+	e := m.tenants[tenant]
+	if e == nil {
+		e = newEngine()
+		m.tenants[tenant] = e
+	}
+	return e
+}
+
+// lookupEngine returns engine of tenant or nil if tenant has no metrics
+func (m *MemStorage) lookupEngine(tenant string) *engine {
+	m.tenantsMu.RLock()
+	e := m.tenants[tenant]
+	m.tenantsMu.RUnlock()
+	return e
+}
+
+// Tenants returns tenants having stored metrics or metadata
+func (m *MemStorage) Tenants(ctx context.Context) ([]string, error) {
+	m.tenantsMu.RLock()
+	defer m.tenantsMu.RUnlock()
+
+	tenants := make([]string, 0, len(m.tenants))
+	for tenant, e := range m.tenants {
+		if e.len() > 0 || e.metadataLen() > 0 {
+			tenants = append(tenants, tenant)
+		}
+	}
+	sort.Strings(tenants)
+	return tenants, nil
+}
+
+// runPersistence flushes WAL and compacts it periodically or when segment grows too large
+func (m *MemStorage) runPersistence() {
+	defer m.wg.Done()
+
+	flushTicker := time.NewTicker(walFlushInterval)
+	defer flushTicker.Stop()
+
+	var compactTick <-chan time.Time
+	if !m.syncStore {
+		compactTicker := time.NewTicker(time.Duration(m.storeInterval) * time.Second)
+		defer compactTicker.Stop()
+		compactTick = compactTicker.C
+	}
+
+	for {
+		select {
+		case <-m.done:
+			return
+		case <-flushTicker.C:
+			m.persistMu.RLock()
+			w := m.wal
+			m.persistMu.RUnlock()
+			if err := w.flush(); err != nil {
+				log.Error().Err(err).Msg("failed to flush WAL")
+			}
+		case <-compactTick:
+			if err := m.BackupMetrics(); err != nil {
+				log.Error().Err(err).Msg("failed to compact WAL")
+			}
+		case <-m.compactCh:
+			if err := m.BackupMetrics(); err != nil {
+				log.Error().Err(err).Msg("failed to compact WAL")
+			}
+		}
+	}
+}
+
+// change is change of storage in progress
+type change struct {
+	w     *wal  // Active WAL segment, nil if storage is not persistent
+	names []int // Indexes of held locks of metric names, sorted
+}
+
+// beginChange locks storage for change of metric names of tenant and returns change in progress.
+// Change must be applied to memory and then passed to commitChange. Names of persistent storage stay locked
+// until change is logged, otherwise concurrent changes of the same series could be logged in order other
+// than they are applied, and replay of WAL would restore stale values
+func (m *MemStorage) beginChange(tenant string, names ...string) change {
+	m.persistMu.RLock()
+	c := change{w: m.wal}
+	if c.w == nil {
+		return c
+	}
+
+	h := fnvAdd(fnvAdd(fnvOffset, tenant), "\x00")
+	for _, name := range names {
+		c.names = append(c.names, int(fnvAdd(h, name)&(shardCount-1)))
+	}
+	// Locks are taken in the same order by all changes to avoid deadlock
+	sort.Ints(c.names)
+	c.names = slices.Compact(c.names)
+	for _, i := range c.names {
+		m.nameMu[i].Lock()
+	}
+	return c
+}
+
+// unlockNames unlocks metric names held by change
+func (m *MemStorage) unlockNames(c change) {
+	for _, i := range c.names {
+		m.nameMu[i].Unlock()
+	}
+}
+
+// commitChange appends records of applied change to WAL and unlocks storage.
+// In sync mode it returns only after records are durable
+func (m *MemStorage) commitChange(c change, records ...walRecord) error {
+	if c.w == nil {
+		m.persistMu.RUnlock()
+		return nil
 	}
-	err = json.Unmarshal(data, &metrics)
+	seq, err := c.w.append(records...)
+	m.unlockNames(c)
+	m.persistMu.RUnlock()
 	if err != nil {
 		return err
 	}
-	for _, rm := range metrics {
-		err = m.AddMetric(context.TODO(), rm)
-		if err != nil {
-			return err
+
+	if c.w.sizeBytes() > walCompactSize {
+		select {
+		case m.compactCh <- struct{}{}:
+		default:
 		}
 	}
+
+	if m.syncStore {
+		return c.w.sync(seq)
+	}
 	return nil
 }
 
-// BackupMetrics function to store metrics to filesystem
-func (m *MemStorage) BackupMetrics() error {
-	allMetrics, _ := m.GetAllMetrics(context.TODO())
-	mJSON, err := json.Marshal(allMetrics)
+// abortChange unlocks storage when change was not applied
+func (m *MemStorage) abortChange(c change) {
+	m.unlockNames(c)
+	m.persistMu.RUnlock()
+}
+
+// exclusiveChange applies change and appends returned records to WAL while no other change is in progress.
+// It is used for changes, which must not be reordered in WAL with concurrent updates of the same metric
+func (m *MemStorage) exclusiveChange(apply func() ([]walRecord, error)) error {
+	m.persistMu.Lock()
+	records, err := apply()
+	if err != nil {
+		m.persistMu.Unlock()
+		return err
+	}
+	w := m.wal
+	if w == nil || len(records) == 0 {
+		m.persistMu.Unlock()
+		return nil
+	}
+	seq, err := w.append(records...)
+	m.persistMu.Unlock()
 	if err != nil {
 		return err
 	}
-	return os.WriteFile(m.storePath, mJSON, 0666)
+
+	if m.syncStore {
+		return w.sync(seq)
+	}
+	return nil
+}
+
+// Close stops background persistence and writes final snapshot
+func (m *MemStorage) Close() error {
+	m.persistMu.RLock()
+	persistent := m.wal != nil
+	m.persistMu.RUnlock()
+	if !persistent {
+		return nil
+	}
+
+	close(m.done)
+	m.wg.Wait()
+
+	if err := m.BackupMetrics(); err != nil {
+		return err
+	}
+	return m.wal.close()
 }
 
 // AddMetric allow to add metric to storage
 func (m *MemStorage) AddMetric(ctx context.Context, metric entities.MetricInternal) error {
+	if metric.Value == "" && entities.IsKnownType(metric.MType) {
+		return entities.ErrMissingField
+	}
+
+	tenant := entities.TenantFromContext(ctx)
+	e := m.engineOf(tenant)
 	switch metric.MType {
 	case entities.Gauge:
-		if metric.Value == "" {
-			return entities.ErrMissingField
+		value, err := strconv.ParseFloat(metric.Value, 64)
+		if err != nil {
+			return err
 		}
-		tm := entities.MetricInternal{
-			ID:    metric.ID,
-			MType: metric.MType,
-			Value: metric.Value,
+		c := m.beginChange(tenant, metric.ID)
+		e.setGauge(metric.ID, metric.Labels, value)
+		if c.w == nil {
+			return m.commitChange(c)
 		}
-		m.addGaugeMetric(tm)
+		return m.commitChange(c, walRecord{Op: walOpSet, ID: metric.ID, MType: metric.MType, Value: metric.Value, Labels: metric.Labels, Tenant: tenant})
 	case entities.Counter:
-		if metric.Value == "" {
-			return entities.ErrMissingField
+		value, err := strconv.ParseInt(metric.Value, 10, 64)
+		if err != nil {
+			return err
 		}
-		tm := entities.MetricInternal{
-			ID:    metric.ID,
-			MType: metric.MType,
-			Value: metric.Value,
+		c := m.beginChange(tenant, metric.ID)
+		e.setCounter(metric.ID, metric.Labels, value)
+		if c.w == nil {
+			return m.commitChange(c)
 		}
-		err := m.addCounterMetric(tm)
+		return m.commitChange(c, walRecord{Op: walOpSet, ID: metric.ID, MType: metric.MType, Value: metric.Value, Labels: metric.Labels, Tenant: tenant})
+	case entities.Histogram, entities.Summary:
+		value, err := entities.ParseDistribution(metric.MType, metric.Value)
 		if err != nil {
 			return err
 		}
+		c := m.beginChange(tenant, metric.ID)
+		e.setDistribution(metric.MType, metric.ID, metric.Labels, value)
+		if c.w == nil {
+			return m.commitChange(c)
+		}
+		return m.commitChange(c, walRecord{Op: walOpSet, ID: metric.ID, MType: metric.MType, Value: metric.Value, Labels: metric.Labels, Tenant: tenant})
 	default:
-		return errors.New("not supported metric type")
+		return entities.ErrMetricNotSupportedType
 	}
+}
 
-	if m.syncStore {
-		err := m.BackupMetrics()
-		if err != nil {
-			return err
+// UpdateGauge stores gauge if it satisfies condition, returns version of stored value
+func (m *MemStorage) UpdateGauge(ctx context.Context, metric entities.MetricInternal, cond entities.GaugeCondition) (version int64, err error) {
+	if metric.MType != entities.Gauge {
+		return 0, entities.ErrMetricNotSupportedType
+	}
+	if metric.Value == "" {
+		return 0, entities.ErrMissingField
+	}
+	value, err := strconv.ParseFloat(metric.Value, 64)
+	if err != nil {
+		return 0, err
+	}
+
+	tenant := entities.TenantFromContext(ctx)
+	e := m.engineOf(tenant)
+	// Condition is checked while no other change is in progress, so gauge can't change between check and update
+	err = m.exclusiveChange(func() ([]walRecord, error) {
+		if version, err = e.updateGauge(metric.ID, metric.Labels, value, cond); err != nil {
+			return nil, err
 		}
+		return []walRecord{{Op: walOpSet, ID: metric.ID, MType: metric.MType, Value: metric.Value, Labels: metric.Labels, Tenant: tenant}}, nil
+	})
+	if err != nil {
+		return 0, err
 	}
-	return nil
+	return version, nil
 }
 
-func (m *MemStorage) addGaugeMetric(metric entities.MetricInternal) {
-	m.GaugeMetrics.Store(metric.ID, metric.Value)
-}
+// MergeMetric merges histogram or summary into stored value of the series
+func (m *MemStorage) MergeMetric(ctx context.Context, metric entities.MetricInternal) error {
+	if !entities.IsDistribution(metric.MType) {
+		return entities.ErrMetricNotSupportedType
+	}
+	if metric.Value == "" {
+		return entities.ErrMissingField
+	}
+	value, err := entities.ParseDistribution(metric.MType, metric.Value)
+	if err != nil {
+		return err
+	}
 
-func (m *MemStorage) addCounterMetric(metric entities.MetricInternal) (err error) {
-	if val, ok := m.CounterMetrics.Load(metric.ID); ok {
-		v, _ := val.(int64)
-		mVal, err := strconv.ParseInt(metric.Value, 10, 64)
-		if err != nil {
-			return err
-		}
-		newVal := v + mVal
-		m.CounterMetrics.Store(metric.ID, fmt.Sprintf("%d", newVal))
-	} else {
-		m.CounterMetrics.Store(metric.ID, metric.Value)
+	tenant := entities.TenantFromContext(ctx)
+	e := m.engineOf(tenant)
+	c := m.beginChange(tenant, metric.ID)
+	if err = e.mergeDistribution(metric.MType, metric.ID, metric.Labels, value); err != nil {
+		m.abortChange(c)
+		return err
 	}
-	return nil
+	if c.w == nil {
+		return m.commitChange(c)
+	}
+	return m.commitChange(c, walRecord{Op: walOpMerge, ID: metric.ID, MType: metric.MType, Value: metric.Value, Labels: metric.Labels, Tenant: tenant})
 }
 
-// GetMetric allow to get metric from storage
-func (m *MemStorage) GetMetric(ctx context.Context, mType, mName string) (entities.MetricInternal, error) {
-	switch mType {
-	case entities.Gauge:
-		if val, ok := m.GaugeMetrics.Load(mName); ok {
-			return entities.MetricInternal{ID: mName, MType: mType, Value: val.(string)}, nil
-		} else {
-			return entities.MetricInternal{}, entities.ErrMetricNotFound
-		}
-	case entities.Counter:
-		if val, ok := m.CounterMetrics.Load(mName); ok {
-			return entities.MetricInternal{ID: mName, MType: mType, Value: val.(string)}, nil
-		} else {
-			return entities.MetricInternal{}, entities.ErrMetricNotFound
-		}
-	default:
-		return entities.MetricInternal{}, entities.ErrMetricNotSupportedType
+// IncrementCounter atomically adds delta to the counter
+func (m *MemStorage) IncrementCounter(ctx context.Context, mName string, labels map[string]string, delta int64) error {
+	tenant := entities.TenantFromContext(ctx)
+	e := m.engineOf(tenant)
+	c := m.beginChange(tenant, mName)
+	e.addCounter(mName, labels, delta)
+	if c.w == nil {
+		return m.commitChange(c)
 	}
+	return m.commitChange(c, walRecord{Op: walOpIncrement, ID: mName, MType: entities.Counter, Value: strconv.FormatInt(delta, 10), Labels: labels, Tenant: tenant})
 }
 
-// GetAllMetrics allow to get all metrics from memory storage
-func (m *MemStorage) GetAllMetrics(ctx context.Context) ([]entities.MetricInternal, error) {
-	var res []entities.MetricInternal
+// DeleteMetric removes metric and its history
+func (m *MemStorage) DeleteMetric(ctx context.Context, mType, mName string, labels map[string]string) error {
+	if !entities.IsKnownType(mType) {
+		return entities.ErrMetricNotSupportedType
+	}
 
-	m.CounterMetrics.Range(func(key, value interface{}) bool {
-		tm := entities.MetricInternal{
-			ID:    key.(string),
-			MType: entities.Counter,
-			Value: value.(string),
+	tenant := entities.TenantFromContext(ctx)
+	return m.exclusiveChange(func() ([]walRecord, error) {
+		if e := m.lookupEngine(tenant); e == nil || !e.delete(mType, mName, labels) {
+			return nil, entities.ErrMetricNotFound
 		}
-		res = append(res, tm)
-
-		return true
+		return []walRecord{{Op: walOpDelete, ID: mName, MType: mType, Labels: labels, Tenant: tenant}}, nil
 	})
+}
 
-	m.GaugeMetrics.Range(func(key, value interface{}) bool {
-		tm := entities.MetricInternal{
-			ID:    key.(string),
-			MType: entities.Gauge,
-			Value: value.(string),
+// ResetCounter sets existing counter to zero
+func (m *MemStorage) ResetCounter(ctx context.Context, mName string, labels map[string]string) error {
+	tenant := entities.TenantFromContext(ctx)
+	return m.exclusiveChange(func() ([]walRecord, error) {
+		if e := m.lookupEngine(tenant); e == nil || !e.resetCounter(mName, labels) {
+			return nil, entities.ErrMetricNotFound
 		}
-		res = append(res, tm)
+		return []walRecord{{Op: walOpSet, ID: mName, MType: entities.Counter, Value: "0", Labels: labels, Tenant: tenant}}, nil
+	})
+}
 
-		return true
+// Prune applies retention rules to metrics of all tenants. Series restored from files, which don't keep
+// time of change, are considered updated at restore
+func (m *MemStorage) Prune(ctx context.Context, rules []entities.RetentionRule, now time.Time) (report entities.PruneReport, err error) {
+	err = m.exclusiveChange(func() ([]walRecord, error) {
+		var records []walRecord
+		m.tenantsMu.RLock()
+		defer m.tenantsMu.RUnlock()
+		for tenant, e := range m.tenants {
+			r := e.prune(rules, now, func(mType, name string, labels map[string]string) {
+				records = append(records, walRecord{Op: walOpDelete, ID: name, MType: mType, Labels: labels, Tenant: tenant})
+			})
+			report.Series += r.Series
+			report.HistoryPoints += r.HistoryPoints
+		}
+		return records, nil
 	})
+	return report, err
+}
 
-	return res, nil
+// GetMetric allow to get metric from storage
+func (m *MemStorage) GetMetric(ctx context.Context, mType, mName string, labels map[string]string) (entities.MetricInternal, error) {
+	if !entities.IsKnownType(mType) {
+		return entities.MetricInternal{}, entities.ErrMetricNotSupportedType
+	}
+
+	e := m.lookupEngine(entities.TenantFromContext(ctx))
+	if e == nil {
+		return entities.MetricInternal{}, entities.ErrMetricNotFound
+	}
+	if entities.IsDistribution(mType) {
+		d := e.lookupDist(mType, mName, labels)
+		if d == nil {
+			return entities.MetricInternal{}, entities.ErrMetricNotFound
+		}
+		value, err := d.format()
+		if err != nil {
+			return entities.MetricInternal{}, err
+		}
+		if value == "null" {
+			return entities.MetricInternal{}, entities.ErrMetricNotFound
+		}
+		return entities.MetricInternal{ID: mName, MType: mType, Value: value, Labels: d.labels}, nil
+	}
+
+	c := e.lookup(mType, mName, labels)
+	if c == nil {
+		return entities.MetricInternal{}, entities.ErrMetricNotFound
+	}
+	var version int64
+	if mType == entities.Gauge {
+		version = c.version.Load()
+	}
+	return entities.MetricInternal{ID: mName, MType: mType, Value: c.value(mType), Labels: c.labels, Version: version}, nil
+}
+
+// GetAllMetrics allow to get all metrics, which labels satisfy matchers, from memory storage
+func (m *MemStorage) GetAllMetrics(ctx context.Context, matchers []entities.LabelMatcher) ([]entities.MetricInternal, error) {
+	e := m.lookupEngine(entities.TenantFromContext(ctx))
+	if e == nil {
+		return []entities.MetricInternal{}, nil
+	}
+
+	size := 0
+	if len(matchers) == 0 {
+		size = e.len()
+	}
+	return e.appendAll(make([]entities.MetricInternal, 0, size), matchers), nil
 }
 
 // Ping check accessibility. Always return nil error
@@ -196,26 +528,131 @@ func (m *MemStorage) Ping(ctx context.Context) error {
 	return nil
 }
 
-// AddMultipleMetrics allow to add multiple metrics at once
+// batchValue is parsed metric of batch
+type batchValue struct {
+	metric  entities.MetricInternal
+	counter int64
+	gauge   float64
+	dist    entities.Distribution
+}
+
+// AddMultipleMetrics allow to add multiple metrics at once.
+// Counters, histograms and summaries of batch are added to stored values.
+// Batch is applied atomically: if distribution can't be merged, no metrics are changed
 func (m *MemStorage) AddMultipleMetrics(ctx context.Context, metrics []entities.MetricInternal) (err error) {
+	values := make([]batchValue, 0, len(metrics))
+	hasDist := false
 	for _, metric := range metrics {
+		v := batchValue{metric: metric}
 		switch metric.MType {
 		case entities.Counter:
 			if metric.Value == "" {
 				return entities.ErrMissingField
 			}
-			err := m.addCounterMetric(metric)
-			if err != nil {
+			if v.counter, err = strconv.ParseInt(metric.Value, 10, 64); err != nil {
 				return err
 			}
 		case entities.Gauge:
 			if metric.Value == "" {
 				return entities.ErrMissingField
 			}
-			m.addGaugeMetric(metric)
+			if v.gauge, err = strconv.ParseFloat(metric.Value, 64); err != nil {
+				return err
+			}
+		case entities.Histogram, entities.Summary:
+			if metric.Value == "" {
+				return entities.ErrMissingField
+			}
+			if v.dist, err = entities.ParseDistribution(metric.MType, metric.Value); err != nil {
+				return err
+			}
+			hasDist = true
 		default:
 			return entities.ErrMetricNotSupportedType
 		}
+		values = append(values, v)
+	}
+
+	tenant := entities.TenantFromContext(ctx)
+	e := m.engineOf(tenant)
+	records := make([]walRecord, 0, len(values))
+	for _, v := range values {
+		op := walOpSet
+		switch v.metric.MType {
+		case entities.Counter:
+			op = walOpIncrement
+		case entities.Histogram, entities.Summary:
+			op = walOpMerge
+		}
+		records = append(records, walRecord{Op: op, ID: v.metric.ID, MType: v.metric.MType, Value: v.metric.Value, Labels: v.metric.Labels, Tenant: tenant})
+	}
+
+	if !hasDist {
+		// Gauges and counters can't fail after parsing, so batch is applied concurrently with changes of other metrics
+		names := make([]string, 0, len(values))
+		for _, v := range values {
+			names = append(names, v.metric.ID)
+		}
+		c := m.beginChange(tenant, names...)
+		applyBatch(e, values, nil)
+		if c.w == nil {
+			return m.commitChange(c)
+		}
+		return m.commitChange(c, records...)
+	}
+
+	// Merge of distribution may fail, so merged values are computed before batch is applied
+	// while no other change can modify them
+	return m.exclusiveChange(func() ([]walRecord, error) {
+		merged, err := mergedDistributions(e, values)
+		if err != nil {
+			return nil, err
+		}
+		applyBatch(e, values, merged)
+		return records, nil
+	})
+}
+
+// distKey identifies histogram or summary series inside tenant
+func distKey(mType, name string, labels map[string]string) string {
+	return mType + ":" + entities.SeriesKey(name, labels)
+}
+
+// mergedDistributions returns values of histograms and summaries after batch is merged into stored ones
+func mergedDistributions(e *engine, values []batchValue) (map[string]entities.Distribution, error) {
+	merged := make(map[string]entities.Distribution)
+	for _, v := range values {
+		if v.dist == nil {
+			continue
+		}
+		key := distKey(v.metric.MType, v.metric.ID, v.metric.Labels)
+		current, ok := merged[key]
+		if !ok {
+			var err error
+			if current, err = e.distCopy(v.metric.MType, v.metric.ID, v.metric.Labels); err != nil {
+				return nil, err
+			}
+		}
+		if current == nil {
+			current = v.dist
+		} else if err := current.Merge(v.dist); err != nil {
+			return nil, err
+		}
+		merged[key] = current
+	}
+	return merged, nil
+}
+
+// applyBatch changes engine by parsed batch, histograms and summaries are replaced by merged values
+func applyBatch(e *engine, values []batchValue, merged map[string]entities.Distribution) {
+	for _, v := range values {
+		switch v.metric.MType {
+		case entities.Counter:
+			e.addCounter(v.metric.ID, v.metric.Labels, v.counter)
+		case entities.Gauge:
+			e.setGauge(v.metric.ID, v.metric.Labels, v.gauge)
+		default:
+			e.setDistribution(v.metric.MType, v.metric.ID, v.metric.Labels, merged[distKey(v.metric.MType, v.metric.ID, v.metric.Labels)])
+		}
 	}
-	return nil
 }
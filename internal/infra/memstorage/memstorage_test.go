@@ -0,0 +1,595 @@
+package memstorage
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/melkomukovki/go-musthave-metrics/internal/entities"
+	"github.com/melkomukovki/go-musthave-metrics/internal/infra/storagetest"
+	"github.com/melkomukovki/go-musthave-metrics/internal/services"
+)
+
+func TestMemStorage_IncrementCounterConcurrent(t *testing.T) {
+	const (
+		workers    = 50
+		increments = 1000
+	)
+
+	storage := NewClient(300, filepath.Join(t.TempDir(), "metrics.json"), false, DefaultGenerations)
+	ctx := context.Background()
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < increments; j++ {
+				assert.NoError(t, storage.IncrementCounter(ctx, "PollCount", nil, 1))
+			}
+		}()
+	}
+	wg.Wait()
+
+	metric, err := storage.GetMetric(ctx, entities.Counter, "PollCount", nil)
+	require.NoError(t, err)
+	assert.Equal(t, "50000", metric.Value)
+}
+
+func TestMemStorage_AddMultipleMetricsConcurrent(t *testing.T) {
+	const (
+		workers = 20
+		batches = 200
+	)
+
+	storage := NewClient(300, filepath.Join(t.TempDir(), "metrics.json"), false, DefaultGenerations)
+	ctx := context.Background()
+
+	batch := []entities.MetricInternal{
+		{ID: "PollCount", MType: entities.Counter, Value: "2"},
+		{ID: "Alloc", MType: entities.Gauge, Value: "1.5"},
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < batches; j++ {
+				assert.NoError(t, storage.AddMultipleMetrics(ctx, batch))
+				assert.NoError(t, storage.IncrementCounter(ctx, "PollCount", nil, 1))
+			}
+		}()
+	}
+	wg.Wait()
+
+	metric, err := storage.GetMetric(ctx, entities.Counter, "PollCount", nil)
+	require.NoError(t, err)
+	assert.Equal(t, "12000", metric.Value)
+}
+
+func TestMemStorage_RestoreFromWAL(t *testing.T) {
+	ctx := context.Background()
+	storePath := filepath.Join(t.TempDir(), "metrics.json")
+
+	// Storage is not closed, so restore has only WAL written in sync mode
+	storage := NewClient(0, storePath, false, DefaultGenerations)
+	require.NoError(t, storage.AddMetric(ctx, entities.MetricInternal{ID: "Alloc", MType: entities.Gauge, Value: "1.5"}))
+	require.NoError(t, storage.IncrementCounter(ctx, "PollCount", nil, 3))
+	require.NoError(t, storage.AddMultipleMetrics(ctx, []entities.MetricInternal{
+		{ID: "PollCount", MType: entities.Counter, Value: "4"},
+		{ID: "Alloc", MType: entities.Gauge, Value: "2.5"},
+	}))
+
+	restored := NewClient(0, storePath, true, DefaultGenerations)
+
+	gauge, err := restored.GetMetric(ctx, entities.Gauge, "Alloc", nil)
+	require.NoError(t, err)
+	assert.Equal(t, "2.5", gauge.Value)
+
+	counter, err := restored.GetMetric(ctx, entities.Counter, "PollCount", nil)
+	require.NoError(t, err)
+	assert.Equal(t, "7", counter.Value)
+}
+
+func TestMemStorage_RestoreConcurrentSets(t *testing.T) {
+	const (
+		workers = 8
+		sets    = 100
+	)
+
+	ctx := context.Background()
+	storePath := filepath.Join(t.TempDir(), "metrics.json")
+	storage := NewClient(0, storePath, false, DefaultGenerations)
+
+	// Changes of the same series must be logged in order they are applied to memory
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < sets; j++ {
+				value := strconv.Itoa(i*sets + j)
+				assert.NoError(t, storage.AddMetric(ctx, entities.MetricInternal{ID: "Alloc", MType: entities.Gauge, Value: value}))
+				assert.NoError(t, storage.AddMultipleMetrics(ctx, []entities.MetricInternal{
+					{ID: "Alloc", MType: entities.Gauge, Value: value},
+					{ID: "PollCount", MType: entities.Counter, Value: "1"},
+				}))
+				assert.NoError(t, storage.AddMetric(ctx, entities.MetricInternal{ID: "PollCount", MType: entities.Counter, Value: value}))
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	restored := NewClient(0, storePath, true, DefaultGenerations)
+	for _, m := range []entities.MetricInternal{{ID: "Alloc", MType: entities.Gauge}, {ID: "PollCount", MType: entities.Counter}} {
+		expected, err := storage.GetMetric(ctx, m.MType, m.ID, nil)
+		require.NoError(t, err)
+		actual, err := restored.GetMetric(ctx, m.MType, m.ID, nil)
+		require.NoError(t, err)
+		assert.Equal(t, expected.Value, actual.Value, m.ID)
+	}
+}
+
+func TestLoad(t *testing.T) {
+	ctx := context.Background()
+	storePath := filepath.Join(t.TempDir(), "metrics.json")
+
+	storage := NewClient(0, storePath, false, DefaultGenerations)
+	require.NoError(t, storage.IncrementCounter(ctx, "PollCount", nil, 3))
+	require.NoError(t, storage.Close())
+
+	// Changes of loaded storage don't reach files
+	loaded, report := Load(storePath, DefaultGenerations)
+	assert.Empty(t, report.Rejected)
+	require.NoError(t, loaded.IncrementCounter(ctx, "PollCount", nil, 4))
+	require.NoError(t, loaded.Close())
+
+	restored := NewClient(0, storePath, true, DefaultGenerations)
+	counter, err := restored.GetMetric(ctx, entities.Counter, "PollCount", nil)
+	require.NoError(t, err)
+	assert.Equal(t, "3", counter.Value)
+}
+
+func TestMemStorage_RestoreAfterCompaction(t *testing.T) {
+	ctx := context.Background()
+	storePath := filepath.Join(t.TempDir(), "metrics.json")
+
+	storage := NewClient(0, storePath, false, 1)
+	require.NoError(t, storage.IncrementCounter(ctx, "PollCount", nil, 5))
+	require.NoError(t, storage.BackupMetrics())
+	require.NoError(t, storage.IncrementCounter(ctx, "PollCount", nil, 2))
+
+	restored := NewClient(0, storePath, true, 1)
+	counter, err := restored.GetMetric(ctx, entities.Counter, "PollCount", nil)
+	require.NoError(t, err)
+	assert.Equal(t, "7", counter.Value, "compacted changes must not be replayed twice")
+
+	require.NoError(t, restored.IncrementCounter(ctx, "PollCount", nil, 1))
+	require.NoError(t, restored.Close())
+
+	segments, err := listSegments(storePath)
+	require.NoError(t, err)
+	assert.Len(t, segments, 1, "only the active segment must remain after close when single generation is kept")
+
+	reopened := NewClient(0, storePath, true, 1)
+	counter, err = reopened.GetMetric(ctx, entities.Counter, "PollCount", nil)
+	require.NoError(t, err)
+	assert.Equal(t, "8", counter.Value)
+}
+
+func TestMemStorage_RestoreHistory(t *testing.T) {
+	ctx := context.Background()
+	storePath := filepath.Join(t.TempDir(), "metrics.json")
+	from, to := time.Unix(0, 0), time.Now().Add(time.Hour)
+
+	storage := NewClient(0, storePath, false, 1)
+	for _, v := range []float64{1, 2.5, 3} {
+		require.NoError(t, storage.AddMetric(ctx, entities.MetricInternal{ID: "Alloc", MType: entities.Gauge, Value: strconv.FormatFloat(v, 'g', -1, 64)}))
+	}
+	require.NoError(t, storage.IncrementCounter(ctx, "PollCount", nil, 5))
+	require.NoError(t, storage.IncrementCounter(ctx, "PollCount", nil, 2))
+	require.NoError(t, storage.BackupMetrics())
+
+	restored := NewClient(0, storePath, true, 1)
+	for _, m := range []struct {
+		mType, mName string
+		points       int
+	}{{entities.Gauge, "Alloc", 3}, {entities.Counter, "PollCount", 2}} {
+		expected, err := storage.GetMetricHistory(ctx, m.mType, m.mName, nil, from, to)
+		require.NoError(t, err)
+		require.Len(t, expected, m.points)
+		actual, err := restored.GetMetricHistory(ctx, m.mType, m.mName, nil, from, to)
+		require.NoError(t, err)
+		assert.Equal(t, expected, actual)
+	}
+}
+
+func TestMemStorage_SyncModeGroupCommit(t *testing.T) {
+	const workers = 20
+
+	ctx := context.Background()
+	storePath := filepath.Join(t.TempDir(), "metrics.json")
+	storage := NewClient(0, storePath, false, DefaultGenerations)
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				assert.NoError(t, storage.IncrementCounter(ctx, "PollCount", nil, 1))
+			}
+		}()
+	}
+	wg.Wait()
+
+	restored := NewClient(0, storePath, true, DefaultGenerations)
+	counter, err := restored.GetMetric(ctx, entities.Counter, "PollCount", nil)
+	require.NoError(t, err)
+	assert.Equal(t, "1000", counter.Value)
+}
+
+func TestMemStorage_RestoreFallsBackToValidGeneration(t *testing.T) {
+	ctx := context.Background()
+	storePath := filepath.Join(t.TempDir(), "metrics.json")
+
+	storage := NewClient(0, storePath, false, DefaultGenerations)
+	require.NoError(t, storage.IncrementCounter(ctx, "PollCount", nil, 5))
+	require.NoError(t, storage.BackupMetrics())
+	require.NoError(t, storage.IncrementCounter(ctx, "PollCount", nil, 2))
+	require.NoError(t, storage.BackupMetrics())
+	require.NoError(t, storage.IncrementCounter(ctx, "PollCount", nil, 1))
+
+	// Damage the newest generation as if crash happened while it was written
+	data, err := os.ReadFile(storePath)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(storePath, data[:len(data)-5], 0666))
+
+	restored := NewClient(0, storePath, true, DefaultGenerations)
+	report := restored.LastRestore()
+	assert.Equal(t, generationPath(storePath, 1), report.Snapshot)
+	assert.Contains(t, report.RejectedSnapshots, storePath)
+
+	counter, err := restored.GetMetric(ctx, entities.Counter, "PollCount", nil)
+	require.NoError(t, err)
+	assert.Equal(t, "8", counter.Value, "segments after older generation must be replayed")
+}
+
+func TestMemStorage_RestoreReportsRejectedRecords(t *testing.T) {
+	ctx := context.Background()
+	storePath := filepath.Join(t.TempDir(), "metrics.json")
+
+	storage := NewClient(0, storePath, false, DefaultGenerations)
+	require.NoError(t, storage.IncrementCounter(ctx, "PollCount", nil, 5))
+
+	segments, err := listSegments(storePath)
+	require.NoError(t, err)
+	require.Len(t, segments, 1)
+
+	f, err := os.OpenFile(segments[0].path, os.O_APPEND|os.O_WRONLY, 0666)
+	require.NoError(t, err)
+	_, err = f.WriteString(`{"op":"set","id":"Alloc","type":"gauge","value":"abc"}` + "\n" + `{"op":"inc","id":"PollCount"`)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	restored := NewClient(0, storePath, true, DefaultGenerations)
+	report := restored.LastRestore()
+	assert.Equal(t, 1, report.Applied)
+	require.Len(t, report.Rejected, 2)
+	assert.Equal(t, 2, report.Rejected[0].Line)
+	assert.Equal(t, 3, report.Rejected[1].Line)
+	assert.ErrorIs(t, report.Rejected[1].Err, errTruncatedRecord)
+
+	counter, err := restored.GetMetric(ctx, entities.Counter, "PollCount", nil)
+	require.NoError(t, err)
+	assert.Equal(t, "5", counter.Value)
+}
+
+func TestMemStorage_DeleteAndResetArePersisted(t *testing.T) {
+	ctx := context.Background()
+	storePath := filepath.Join(t.TempDir(), "metrics.json")
+
+	storage := NewClient(0, storePath, false, DefaultGenerations)
+	require.NoError(t, storage.AddMetric(ctx, entities.MetricInternal{ID: "CPUutilization1", MType: entities.Gauge, Value: "12.5"}))
+	require.NoError(t, storage.AddMetric(ctx, entities.MetricInternal{ID: "CPUutilization2", MType: entities.Gauge, Value: "3"}))
+	require.NoError(t, storage.IncrementCounter(ctx, "PollCount", nil, 5))
+	require.NoError(t, storage.BackupMetrics())
+
+	require.NoError(t, storage.DeleteMetric(ctx, entities.Gauge, "CPUutilization1", nil))
+	require.NoError(t, storage.ResetCounter(ctx, "PollCount", nil))
+	require.NoError(t, storage.IncrementCounter(ctx, "PollCount", nil, 2))
+
+	assert.ErrorIs(t, storage.DeleteMetric(ctx, entities.Gauge, "CPUutilization1", nil), entities.ErrMetricNotFound)
+	assert.ErrorIs(t, storage.DeleteMetric(ctx, entities.Counter, "CPUutilization2", nil), entities.ErrMetricNotFound)
+	assert.ErrorIs(t, storage.ResetCounter(ctx, "missing", nil), entities.ErrMetricNotFound)
+	assert.ErrorIs(t, storage.DeleteMetric(ctx, "nonType", "PollCount", nil), entities.ErrMetricNotSupportedType)
+
+	check := func(s *MemStorage) {
+		_, err := s.GetMetric(ctx, entities.Gauge, "CPUutilization1", nil)
+		assert.ErrorIs(t, err, entities.ErrMetricNotFound)
+
+		counter, err := s.GetMetric(ctx, entities.Counter, "PollCount", nil)
+		require.NoError(t, err)
+		assert.Equal(t, "2", counter.Value)
+
+		all, err := s.GetAllMetrics(ctx, nil)
+		require.NoError(t, err)
+		assert.Len(t, all, 2)
+	}
+
+	// Deletion after snapshot is restored from WAL
+	restored := NewClient(0, storePath, true, DefaultGenerations)
+	check(restored)
+
+	// Deletion is included in the new snapshot
+	require.NoError(t, restored.Close())
+	check(NewClient(0, storePath, true, 1))
+}
+
+func TestMemStorage_Labels(t *testing.T) {
+	ctx := context.Background()
+	storePath := filepath.Join(t.TempDir(), "metrics.json")
+
+	hostA := map[string]string{"host": "a", "cpu": "1"}
+	hostB := map[string]string{"host": "b", "cpu": "1"}
+
+	storage := NewClient(0, storePath, false, DefaultGenerations)
+	require.NoError(t, storage.AddMetric(ctx, entities.MetricInternal{ID: "CPUutilization", MType: entities.Gauge, Value: "10", Labels: hostA}))
+	require.NoError(t, storage.AddMetric(ctx, entities.MetricInternal{ID: "CPUutilization", MType: entities.Gauge, Value: "20", Labels: hostB}))
+	require.NoError(t, storage.AddMetric(ctx, entities.MetricInternal{ID: "CPUutilization", MType: entities.Gauge, Value: "30"}))
+	require.NoError(t, storage.IncrementCounter(ctx, "PollCount", hostA, 2))
+	require.NoError(t, storage.AddMultipleMetrics(ctx, []entities.MetricInternal{
+		{ID: "PollCount", MType: entities.Counter, Value: "3", Labels: map[string]string{"cpu": "1", "host": "a"}},
+	}))
+
+	// Changing caller's map must not change stored series
+	hostA["host"] = "c"
+
+	hostMatcher, err := entities.ParseLabelMatcher("host=~a|b")
+	require.NoError(t, err)
+
+	check := func(s *MemStorage) {
+		gauge, err := s.GetMetric(ctx, entities.Gauge, "CPUutilization", map[string]string{"host": "b", "cpu": "1"})
+		require.NoError(t, err)
+		assert.Equal(t, "20", gauge.Value)
+		assert.Equal(t, map[string]string{"host": "b", "cpu": "1"}, gauge.Labels)
+
+		gauge, err = s.GetMetric(ctx, entities.Gauge, "CPUutilization", nil)
+		require.NoError(t, err)
+		assert.Equal(t, "30", gauge.Value)
+
+		counter, err := s.GetMetric(ctx, entities.Counter, "PollCount", map[string]string{"host": "a", "cpu": "1"})
+		require.NoError(t, err)
+		assert.Equal(t, "5", counter.Value)
+
+		_, err = s.GetMetric(ctx, entities.Counter, "PollCount", nil)
+		assert.ErrorIs(t, err, entities.ErrMetricNotFound)
+
+		all, err := s.GetAllMetrics(ctx, nil)
+		require.NoError(t, err)
+		assert.Len(t, all, 4)
+
+		matched, err := s.GetAllMetrics(ctx, []entities.LabelMatcher{hostMatcher})
+		require.NoError(t, err)
+		assert.Len(t, matched, 3)
+	}
+	check(storage)
+
+	restored := NewClient(0, storePath, true, DefaultGenerations)
+	check(restored)
+
+	require.NoError(t, restored.Close())
+	check(NewClient(0, storePath, true, 1))
+}
+
+func TestMemStorage_Distributions(t *testing.T) {
+	ctx := context.Background()
+	storePath := filepath.Join(t.TempDir(), "metrics.json")
+
+	report := func(mType string, values ...float64) entities.MetricInternal {
+		var d entities.Distribution
+		if mType == entities.Histogram {
+			h := entities.NewHistogram([]float64{1, 10})
+			for _, v := range values {
+				h.Observe(v)
+			}
+			d = h
+		} else {
+			s := entities.NewSummary(entities.DefaultSummaryAccuracy)
+			for _, v := range values {
+				s.Observe(v)
+			}
+			d = s
+		}
+		value, err := entities.FormatDistribution(d)
+		require.NoError(t, err)
+		return entities.MetricInternal{ID: "Latency", MType: mType, Value: value}
+	}
+
+	storage := NewClient(0, storePath, false, DefaultGenerations)
+	require.NoError(t, storage.MergeMetric(ctx, report(entities.Histogram, 0.5, 5)))
+	require.NoError(t, storage.BackupMetrics())
+	require.NoError(t, storage.AddMultipleMetrics(ctx, []entities.MetricInternal{
+		report(entities.Histogram, 50),
+		report(entities.Summary, 1, 2, 3),
+	}))
+
+	mismatched := entities.NewHistogram([]float64{2})
+	value, err := entities.FormatDistribution(mismatched)
+	require.NoError(t, err)
+	err = storage.MergeMetric(ctx, entities.MetricInternal{ID: "Latency", MType: entities.Histogram, Value: value})
+	assert.ErrorIs(t, err, entities.ErrDistributionMismatch)
+	assert.ErrorIs(t, storage.MergeMetric(ctx, report(entities.Gauge)), entities.ErrMetricNotSupportedType)
+
+	check := func(s *MemStorage) {
+		metric, err := s.GetMetric(ctx, entities.Histogram, "Latency", nil)
+		require.NoError(t, err)
+		d, err := entities.ParseDistribution(entities.Histogram, metric.Value)
+		require.NoError(t, err)
+		h := d.(*entities.HistogramValue)
+		assert.Equal(t, []uint64{1, 1, 1}, h.Counts)
+		assert.Equal(t, 55.5, h.Sum)
+
+		metric, err = s.GetMetric(ctx, entities.Summary, "Latency", nil)
+		require.NoError(t, err)
+		d, err = entities.ParseDistribution(entities.Summary, metric.Value)
+		require.NoError(t, err)
+		assert.EqualValues(t, 3, d.(*entities.SummaryValue).Count)
+
+		all, err := s.GetAllMetrics(ctx, nil)
+		require.NoError(t, err)
+		assert.Len(t, all, 2)
+	}
+	check(storage)
+
+	// Merges after snapshot are restored from WAL
+	restored := NewClient(0, storePath, true, DefaultGenerations)
+	check(restored)
+
+	require.NoError(t, restored.DeleteMetric(ctx, entities.Summary, "Latency", nil))
+	_, err = restored.GetMetric(ctx, entities.Summary, "Latency", nil)
+	assert.ErrorIs(t, err, entities.ErrMetricNotFound)
+}
+
+func TestMemStorage_Tenants(t *testing.T) {
+	storePath := filepath.Join(t.TempDir(), "metrics.json")
+	teamA := entities.ContextWithTenant(context.Background(), "team-a")
+	teamB := entities.ContextWithTenant(context.Background(), "team-b")
+
+	storage := NewClient(0, storePath, false, DefaultGenerations)
+	require.NoError(t, storage.AddMetric(teamA, entities.MetricInternal{ID: "Alloc", MType: entities.Gauge, Value: "1"}))
+	require.NoError(t, storage.BackupMetrics())
+	require.NoError(t, storage.AddMetric(teamB, entities.MetricInternal{ID: "Alloc", MType: entities.Gauge, Value: "2"}))
+	require.NoError(t, storage.IncrementCounter(teamB, "PollCount", nil, 3))
+
+	assert.ErrorIs(t, storage.DeleteMetric(teamA, entities.Counter, "PollCount", nil), entities.ErrMetricNotFound)
+	assert.ErrorIs(t, storage.ResetCounter(context.Background(), "PollCount", nil), entities.ErrMetricNotFound)
+
+	check := func(s *MemStorage) {
+		metric, err := s.GetMetric(teamA, entities.Gauge, "Alloc", nil)
+		require.NoError(t, err)
+		assert.Equal(t, "1", metric.Value)
+
+		metric, err = s.GetMetric(teamB, entities.Gauge, "Alloc", nil)
+		require.NoError(t, err)
+		assert.Equal(t, "2", metric.Value)
+
+		_, err = s.GetMetric(context.Background(), entities.Gauge, "Alloc", nil)
+		assert.ErrorIs(t, err, entities.ErrMetricNotFound)
+
+		all, err := s.GetAllMetrics(teamA, nil)
+		require.NoError(t, err)
+		assert.Len(t, all, 1)
+		all, err = s.GetAllMetrics(teamB, nil)
+		require.NoError(t, err)
+		assert.Len(t, all, 2)
+
+		tenants, err := s.Tenants(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, []string{"team-a", "team-b"}, tenants)
+	}
+	check(storage)
+
+	// Tenants are kept both in snapshot and in WAL
+	restored := NewClient(0, storePath, true, DefaultGenerations)
+	check(restored)
+	require.NoError(t, restored.Close())
+	check(NewClient(0, storePath, true, 1))
+}
+
+func TestMemStorage_Prune(t *testing.T) {
+	ctx := context.Background()
+	storePath := filepath.Join(t.TempDir(), "metrics.json")
+	teamA := entities.ContextWithTenant(ctx, "team-a")
+
+	storage := NewClient(0, storePath, false, DefaultGenerations)
+	require.NoError(t, storage.AddMetric(ctx, entities.MetricInternal{ID: "Alloc", MType: entities.Gauge, Value: "1"}))
+	require.NoError(t, storage.AddMetric(teamA, entities.MetricInternal{ID: "Alloc", MType: entities.Gauge, Value: "2"}))
+	require.NoError(t, storage.AddMetric(ctx, entities.MetricInternal{ID: "Latency", MType: entities.Histogram, Value: `{"bounds":[1],"counts":[1,0],"sum":0.5,"count":1}`}))
+	require.NoError(t, storage.IncrementCounter(ctx, "PollCount", nil, 1))
+	require.NoError(t, storage.IncrementCounter(ctx, "PollCount", nil, 1))
+
+	rules, err := entities.ParseRetentionRules("type=gauge,ttl=24h;type=histogram,ttl=1h;name=Poll*,history=1h")
+	require.NoError(t, err)
+
+	report, err := storage.Prune(ctx, rules, time.Now())
+	require.NoError(t, err)
+	assert.Equal(t, entities.PruneReport{}, report, "fresh metrics must be kept")
+
+	report, err = storage.Prune(ctx, rules, time.Now().Add(2*time.Hour))
+	require.NoError(t, err)
+	assert.Equal(t, entities.PruneReport{Series: 1, HistoryPoints: 2}, report)
+
+	report, err = storage.Prune(ctx, rules, time.Now().Add(25*time.Hour))
+	require.NoError(t, err)
+	assert.Equal(t, entities.PruneReport{Series: 2}, report)
+
+	check := func(s *MemStorage) {
+		all, err := s.GetAllMetrics(ctx, nil)
+		require.NoError(t, err)
+		assert.Equal(t, []entities.MetricInternal{{ID: "PollCount", MType: entities.Counter, Value: "2"}}, all)
+		all, err = s.GetAllMetrics(teamA, nil)
+		require.NoError(t, err)
+		assert.Empty(t, all)
+	}
+	check(storage)
+
+	// Pruned series are not restored from WAL
+	check(NewClient(0, storePath, true, DefaultGenerations))
+}
+
+func TestMemStorage_PruneTTLWithHistory(t *testing.T) {
+	ctx := context.Background()
+	storePath := filepath.Join(t.TempDir(), "metrics.json")
+	now := time.Now()
+
+	storage := NewClient(0, storePath, false, DefaultGenerations)
+	require.NoError(t, storage.AddMetric(ctx, entities.MetricInternal{ID: "Alloc", MType: entities.Gauge, Value: "1"}))
+
+	rules, err := entities.ParseRetentionRules("type=gauge,ttl=24h,history=1h")
+	require.NoError(t, err)
+
+	report, err := storage.Prune(ctx, rules, now.Add(3*time.Hour))
+	require.NoError(t, err)
+	assert.Equal(t, entities.PruneReport{HistoryPoints: 1}, report)
+
+	report, err = storage.Prune(ctx, rules, now.Add(3*time.Hour))
+	require.NoError(t, err)
+	assert.Equal(t, entities.PruneReport{}, report, "series must be kept after its history is pruned")
+
+	all, err := storage.GetAllMetrics(ctx, nil)
+	require.NoError(t, err)
+	assert.Equal(t, []entities.MetricInternal{{ID: "Alloc", MType: entities.Gauge, Value: "1"}}, all)
+
+	// Time of change is restored from WAL and snapshot, not set to time of restore
+	require.NoError(t, storage.BackupMetrics())
+	require.NoError(t, storage.AddMetric(ctx, entities.MetricInternal{ID: "HeapAlloc", MType: entities.Gauge, Value: "2"}))
+	restored := NewClient(0, storePath, true, DefaultGenerations)
+	report, err = restored.Prune(ctx, rules, now.Add(25*time.Hour))
+	require.NoError(t, err)
+	assert.Equal(t, entities.PruneReport{Series: 2}, report)
+}
+
+func TestMemStorage_Conformance(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) services.ServiceRepository {
+		return NewClient(0, "", false, 1)
+	})
+}
+
+func TestMemStorage_PersistentConformance(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) services.ServiceRepository {
+		storage := NewClient(0, filepath.Join(t.TempDir(), "metrics.json"), false, 1)
+		t.Cleanup(func() {
+			require.NoError(t, storage.Close())
+		})
+		return storage
+	})
+}
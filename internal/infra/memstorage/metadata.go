@@ -0,0 +1,171 @@
+package memstorage
+
+import (
+	"context"
+	"sort"
+
+	"github.com/melkomukovki/go-musthave-metrics/internal/entities"
+)
+
+// metadataOf returns metadata of metric name
+func (e *engine) metadataOf(name string) (entities.MetricMetadata, bool) {
+	s := e.shardOf(name)
+	s.mu.RLock()
+	meta, ok := s.metadata[name]
+	s.mu.RUnlock()
+	return meta, ok
+}
+
+// setMetadata stores metadata of metric name, replacing previous one
+func (e *engine) setMetadata(meta entities.MetricMetadata) {
+	s := e.shardOf(meta.Name)
+	s.mu.Lock()
+	s.metadata[meta.Name] = meta
+	s.mu.Unlock()
+}
+
+// deleteMetadata removes metadata of metric name, returns false if name has no metadata
+func (e *engine) deleteMetadata(name string) bool {
+	s := e.shardOf(name)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.metadata[name]; !ok {
+		return false
+	}
+	delete(s.metadata, name)
+	return true
+}
+
+// appendMetadata appends metadata of all names to dst
+func (e *engine) appendMetadata(dst []entities.MetricMetadata) []entities.MetricMetadata {
+	for i := range e.shards {
+		s := &e.shards[i]
+		s.mu.RLock()
+		for _, meta := range s.metadata {
+			dst = append(dst, meta)
+		}
+		s.mu.RUnlock()
+	}
+	return dst
+}
+
+// metadataLen returns number of names having metadata
+func (e *engine) metadataLen() int {
+	n := 0
+	for i := range e.shards {
+		s := &e.shards[i]
+		s.mu.RLock()
+		n += len(s.metadata)
+		s.mu.RUnlock()
+	}
+	return n
+}
+
+// unclaimed returns sorted names of types, which have no metadata.
+// entities.ErrMetricTypeConflict is returned if any name is owned by another type
+func (e *engine) unclaimed(types map[string]string) ([]string, error) {
+	names := make([]string, 0, len(types))
+	for name := range types {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var missing []string
+	for _, name := range names {
+		meta, ok := e.metadataOf(name)
+		switch {
+		case !ok:
+			missing = append(missing, name)
+		case meta.Type != types[name]:
+			return nil, entities.TypeConflict(name, meta.Type, types[name])
+		}
+	}
+	return missing, nil
+}
+
+// metadataRecord returns WAL record, which stores metadata of tenant
+func metadataRecord(tenant string, meta entities.MetricMetadata) walRecord {
+	return walRecord{Op: walOpMeta, ID: meta.Name, MType: meta.Type, Unit: meta.Unit, Help: meta.Help, Tenant: tenant}
+}
+
+// ClaimMetricTypes stores types as owners of names without metadata.
+// Names already owned by the same type are checked without locking storage for change
+func (m *MemStorage) ClaimMetricTypes(ctx context.Context, types map[string]string) error {
+	if err := entities.ValidateClaims(types); err != nil {
+		return err
+	}
+
+	tenant := entities.TenantFromContext(ctx)
+	e := m.engineOf(tenant)
+	if missing, err := e.unclaimed(types); err != nil || len(missing) == 0 {
+		return err
+	}
+
+	// New names are claimed while no other change is in progress, so concurrent claims of different types
+	// can't both succeed. If any name is owned by another type, no names are claimed
+	return m.exclusiveChange(func() ([]walRecord, error) {
+		missing, err := e.unclaimed(types)
+		if err != nil {
+			return nil, err
+		}
+		records := make([]walRecord, 0, len(missing))
+		for _, name := range missing {
+			meta := entities.MetricMetadata{Name: name, Type: types[name]}
+			e.setMetadata(meta)
+			records = append(records, metadataRecord(tenant, meta))
+		}
+		return records, nil
+	})
+}
+
+// SetMetadata stores metadata of metric name. Owning type of name can't be changed
+func (m *MemStorage) SetMetadata(ctx context.Context, meta entities.MetricMetadata) error {
+	if err := meta.Validate(); err != nil {
+		return err
+	}
+
+	tenant := entities.TenantFromContext(ctx)
+	e := m.engineOf(tenant)
+	return m.exclusiveChange(func() ([]walRecord, error) {
+		if current, ok := e.metadataOf(meta.Name); ok && current.Type != meta.Type {
+			return nil, entities.TypeConflict(meta.Name, current.Type, meta.Type)
+		}
+		e.setMetadata(meta)
+		return []walRecord{metadataRecord(tenant, meta)}, nil
+	})
+}
+
+// GetMetadata returns metadata of metric name
+func (m *MemStorage) GetMetadata(ctx context.Context, name string) (entities.MetricMetadata, error) {
+	e := m.lookupEngine(entities.TenantFromContext(ctx))
+	if e == nil {
+		return entities.MetricMetadata{}, entities.ErrMetadataNotFound
+	}
+	meta, ok := e.metadataOf(name)
+	if !ok {
+		return entities.MetricMetadata{}, entities.ErrMetadataNotFound
+	}
+	return meta, nil
+}
+
+// GetAllMetadata returns metadata of all names ordered by name
+func (m *MemStorage) GetAllMetadata(ctx context.Context) ([]entities.MetricMetadata, error) {
+	e := m.lookupEngine(entities.TenantFromContext(ctx))
+	if e == nil {
+		return []entities.MetricMetadata{}, nil
+	}
+	res := e.appendMetadata([]entities.MetricMetadata{})
+	sort.Slice(res, func(i, j int) bool { return res[i].Name < res[j].Name })
+	return res, nil
+}
+
+// DeleteMetadata removes metadata of metric name, so it may be claimed by another type
+func (m *MemStorage) DeleteMetadata(ctx context.Context, name string) error {
+	tenant := entities.TenantFromContext(ctx)
+	return m.exclusiveChange(func() ([]walRecord, error) {
+		if e := m.lookupEngine(tenant); e == nil || !e.deleteMetadata(name) {
+			return nil, entities.ErrMetadataNotFound
+		}
+		return []walRecord{{Op: walOpMetaDelete, ID: name, Tenant: tenant}}, nil
+	})
+}
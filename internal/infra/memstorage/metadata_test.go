@@ -0,0 +1,46 @@
+package memstorage
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/melkomukovki/go-musthave-metrics/internal/entities"
+)
+
+func TestMemStorage_MetadataIsPersisted(t *testing.T) {
+	ctx := context.Background()
+	teamA := entities.ContextWithTenant(ctx, "team-a")
+	storePath := filepath.Join(t.TempDir(), "metrics.json")
+
+	storage := NewClient(0, storePath, false, DefaultGenerations)
+	require.NoError(t, storage.SetMetadata(ctx, entities.MetricMetadata{Name: "Alloc", Type: entities.Gauge, Unit: "bytes", Help: "Allocated heap"}))
+	require.NoError(t, storage.ClaimMetricTypes(teamA, map[string]string{"PollCount": entities.Counter}))
+	require.NoError(t, storage.BackupMetrics())
+
+	// Changes after snapshot are restored from WAL
+	require.NoError(t, storage.ClaimMetricTypes(ctx, map[string]string{"PollCount": entities.Counter}))
+	require.NoError(t, storage.DeleteMetadata(teamA, "PollCount"))
+
+	restored := NewClient(0, storePath, true, DefaultGenerations)
+	assert.Empty(t, restored.LastRestore().Rejected)
+
+	metadata, err := restored.GetAllMetadata(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []entities.MetricMetadata{
+		{Name: "Alloc", Type: entities.Gauge, Unit: "bytes", Help: "Allocated heap"},
+		{Name: "PollCount", Type: entities.Counter},
+	}, metadata)
+
+	_, err = restored.GetMetadata(teamA, "PollCount")
+	assert.ErrorIs(t, err, entities.ErrMetadataNotFound)
+
+	// Tenant without metrics is listed while it has metadata
+	require.NoError(t, restored.SetMetadata(teamA, entities.MetricMetadata{Name: "Alloc", Type: entities.Gauge}))
+	tenants, err := restored.Tenants(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []string{entities.DefaultTenant, "team-a"}, tenants)
+}
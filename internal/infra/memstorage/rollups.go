@@ -0,0 +1,166 @@
+package memstorage
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/melkomukovki/go-musthave-metrics/internal/entities"
+)
+
+// rollupBucket is aggregate of gauge values in bucket
+type rollupBucket struct {
+	start int64 // Unix nanoseconds
+	min   float64
+	max   float64
+	sum   float64
+	count uint64
+}
+
+// rollupSeries keeps the latest buckets of gauge for every resolution.
+// Buckets of resolution entities.RollupResolutions[i] are kept in buckets[i] sorted by start
+type rollupSeries struct {
+	mu      sync.Mutex
+	buckets [][]rollupBucket
+	name    string
+	labels  map[string]string // Copy owned by series, never changed
+}
+
+func newRollupSeries(name string, labels map[string]string) *rollupSeries {
+	return &rollupSeries{
+		buckets: make([][]rollupBucket, len(entities.RollupResolutions)),
+		name:    name,
+		labels:  entities.CloneLabels(labels),
+	}
+}
+
+// resolutionIndex returns index of resolution in entities.RollupResolutions
+func resolutionIndex(step time.Duration) (int, error) {
+	for i, r := range entities.RollupResolutions {
+		if r.Step == step {
+			return i, nil
+		}
+	}
+	_, err := entities.ResolutionOf(step)
+	return 0, err
+}
+
+// merge adds rollup to bucket with the same start. Only Retain latest buckets of resolution are kept
+func (s *rollupSeries) merge(i int, r entities.RollupInternal) {
+	start := r.Bucket.UnixNano()
+	retain := entities.RollupResolutions[i].Retain
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	bs := s.buckets[i]
+	pos := sort.Search(len(bs), func(j int) bool { return bs[j].start >= start })
+	if pos < len(bs) && bs[pos].start == start {
+		b := &bs[pos]
+		b.min = min(b.min, r.Min)
+		b.max = max(b.max, r.Max)
+		b.sum += r.Sum
+		b.count += r.Count
+		return
+	}
+	if pos == 0 && len(bs) >= retain {
+		// Bucket is older than all kept ones
+		return
+	}
+
+	bs = append(bs, rollupBucket{})
+	copy(bs[pos+1:], bs[pos:])
+	bs[pos] = rollupBucket{start: start, min: r.Min, max: r.Max, sum: r.Sum, count: r.Count}
+	if len(bs) > retain {
+		bs = bs[:copy(bs, bs[1:])]
+	}
+	s.buckets[i] = bs
+}
+
+// rangeOf returns buckets of resolution, which start between from and to (inclusive)
+func (s *rollupSeries) rangeOf(i int, name string, labels map[string]string, from, to time.Time) []entities.RollupInternal {
+	step := entities.RollupResolutions[i].Step
+	fromNs, toNs := from.UnixNano(), to.UnixNano()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var res []entities.RollupInternal
+	for _, b := range s.buckets[i] {
+		if b.start < fromNs || b.start > toNs {
+			continue
+		}
+		res = append(res, entities.RollupInternal{
+			ID:     name,
+			Labels: labels,
+			Step:   step,
+			Bucket: time.Unix(0, b.start),
+			Min:    b.min,
+			Max:    b.max,
+			Sum:    b.sum,
+			Count:  b.count,
+		})
+	}
+	return res
+}
+
+// appendAll appends buckets of all resolutions to dst. Labels of returned rollups are shared with series
+// and must not be changed
+func (s *rollupSeries) appendAll(dst []entities.RollupInternal) []entities.RollupInternal {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, bs := range s.buckets {
+		for _, b := range bs {
+			dst = append(dst, entities.RollupInternal{
+				ID:     s.name,
+				Labels: s.labels,
+				Step:   entities.RollupResolutions[i].Step,
+				Bucket: time.Unix(0, b.start),
+				Min:    b.min,
+				Max:    b.max,
+				Sum:    b.sum,
+				Count:  b.count,
+			})
+		}
+	}
+	return dst
+}
+
+// MergeRollups merges gauge rollups into buckets kept in memory. Rollups are persisted with snapshot only,
+// so rollups merged since the last snapshot are lost on crash
+func (m *MemStorage) MergeRollups(ctx context.Context, rollups []entities.RollupInternal) error {
+	indexes := make([]int, len(rollups))
+	for j, r := range rollups {
+		i, err := resolutionIndex(r.Step)
+		if err != nil {
+			return err
+		}
+		indexes[j] = i
+	}
+
+	e := m.engineOf(entities.TenantFromContext(ctx))
+	for j, r := range rollups {
+		e.rollupsOf(r.ID, r.Labels).merge(indexes[j], r)
+	}
+	return nil
+}
+
+// GetRollups allow to get gauge rollups of resolution step, which buckets start between from and to
+func (m *MemStorage) GetRollups(ctx context.Context, mName string, labels map[string]string, step time.Duration, from, to time.Time) ([]entities.RollupInternal, error) {
+	i, err := resolutionIndex(step)
+	if err != nil {
+		return nil, err
+	}
+
+	e := m.lookupEngine(entities.TenantFromContext(ctx))
+	if e == nil {
+		return nil, nil
+	}
+	s := e.lookupRollups(mName, labels)
+	if s == nil {
+		return nil, nil
+	}
+	return s.rangeOf(i, mName, entities.CloneLabels(labels), from, to), nil
+}
@@ -0,0 +1,101 @@
+package memstorage
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/melkomukovki/go-musthave-metrics/internal/entities"
+)
+
+func TestMemStorage_Rollups(t *testing.T) {
+	ctx := context.Background()
+	storage := NewClient(0, "", false, DefaultGenerations)
+	start := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+
+	for i, v := range []float64{5, 1, 9} {
+		ts := start.Add(time.Duration(i) * 20 * time.Second)
+		require.NoError(t, storage.MergeRollups(ctx, []entities.RollupInternal{
+			entities.NewRollup("cpu", nil, time.Minute, ts, v),
+		}))
+	}
+	// Out of order bucket
+	require.NoError(t, storage.MergeRollups(ctx, []entities.RollupInternal{
+		entities.NewRollup("cpu", nil, time.Minute, start.Add(-time.Minute), 2),
+	}))
+
+	rollups, err := storage.GetRollups(ctx, "cpu", nil, time.Minute, start.Add(-time.Hour), start.Add(time.Hour))
+	require.NoError(t, err)
+	require.Len(t, rollups, 2)
+	assert.True(t, rollups[0].Bucket.Equal(start.Add(-time.Minute)))
+	assert.Equal(t, entities.RollupInternal{ID: "cpu", Step: time.Minute, Bucket: rollups[1].Bucket, Min: 1, Max: 9, Sum: 15, Count: 3}, rollups[1])
+	assert.True(t, rollups[1].Bucket.Equal(start))
+
+	rollups, err = storage.GetRollups(ctx, "cpu", nil, time.Hour, start, start)
+	require.NoError(t, err)
+	assert.Empty(t, rollups)
+
+	_, err = storage.GetRollups(ctx, "cpu", nil, time.Second, start, start)
+	assert.ErrorIs(t, err, entities.ErrInvalidResolution)
+	assert.ErrorIs(t, storage.MergeRollups(ctx, []entities.RollupInternal{{ID: "cpu", Step: time.Second}}), entities.ErrInvalidResolution)
+
+	// Rollups are removed together with gauge
+	require.NoError(t, storage.AddMetric(ctx, entities.MetricInternal{ID: "cpu", MType: entities.Gauge, Value: "9"}))
+	require.NoError(t, storage.DeleteMetric(ctx, entities.Gauge, "cpu", nil))
+	rollups, err = storage.GetRollups(ctx, "cpu", nil, time.Minute, start.Add(-time.Hour), start.Add(time.Hour))
+	require.NoError(t, err)
+	assert.Empty(t, rollups)
+}
+
+func TestMemStorage_RollupsRetention(t *testing.T) {
+	ctx := context.Background()
+	storage := NewClient(0, "", false, DefaultGenerations)
+	start := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	retain := entities.RollupResolutions[0].Retain
+
+	for i := 0; i <= retain; i++ {
+		require.NoError(t, storage.MergeRollups(ctx, []entities.RollupInternal{
+			entities.NewRollup("cpu", nil, time.Minute, start.Add(time.Duration(i)*time.Minute), 1),
+		}))
+	}
+	// Bucket older than all kept ones is dropped
+	require.NoError(t, storage.MergeRollups(ctx, []entities.RollupInternal{
+		entities.NewRollup("cpu", nil, time.Minute, start, 1),
+	}))
+
+	rollups, err := storage.GetRollups(ctx, "cpu", nil, time.Minute, start, start.Add(48*time.Hour))
+	require.NoError(t, err)
+	require.Len(t, rollups, retain)
+	assert.True(t, rollups[0].Bucket.Equal(start.Add(time.Minute)))
+}
+
+func TestMemStorage_RestoreRollups(t *testing.T) {
+	ctx := context.Background()
+	storePath := filepath.Join(t.TempDir(), "metrics.json")
+	start := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	labels := map[string]string{"host": "a"}
+
+	storage := NewClient(0, storePath, false, 1)
+	for i, v := range []float64{5, 1, 9} {
+		ts := start.Add(time.Duration(i) * 40 * time.Second)
+		require.NoError(t, storage.MergeRollups(ctx, []entities.RollupInternal{
+			entities.NewRollup("cpu", labels, time.Minute, ts, v),
+			entities.NewRollup("cpu", labels, time.Hour, ts, v),
+		}))
+	}
+	require.NoError(t, storage.BackupMetrics())
+
+	restored := NewClient(0, storePath, true, 1)
+	for _, step := range []time.Duration{time.Minute, time.Hour} {
+		expected, err := storage.GetRollups(ctx, "cpu", labels, step, start.Add(-time.Hour), start.Add(time.Hour))
+		require.NoError(t, err)
+		require.NotEmpty(t, expected)
+		actual, err := restored.GetRollups(ctx, "cpu", labels, step, start.Add(-time.Hour), start.Add(time.Hour))
+		require.NoError(t, err)
+		assert.Equal(t, expected, actual)
+	}
+}
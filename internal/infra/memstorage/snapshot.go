@@ -0,0 +1,573 @@
+package memstorage
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/melkomukovki/go-musthave-metrics/internal/entities"
+)
+
+// DefaultGenerations - number of snapshot files kept by default
+const DefaultGenerations = 3
+
+// snapshotHeaderPrefix starts the first line of snapshot file: `# metrics snapshot v1 sha256=<hex> wal_seq=<n>`
+const snapshotHeaderPrefix = "# metrics snapshot v1"
+
+var errChecksumMismatch = errors.New("snapshot checksum mismatch")
+
+// snapshot describes content of storage file.
+// WALSeq is the first WAL segment, which changes are not included in snapshot.
+// History isn't written to WAL: values replayed from WAL are added to history with time of restore.
+// Rollups aren't written to WAL too, rollups merged after snapshot are lost on crash
+type snapshot struct {
+	WALSeq   uint64             `json:"wal_seq"`
+	Metrics  []snapshotMetric   `json:"metrics"`
+	Metadata []snapshotMetadata `json:"metadata,omitempty"`
+	History  []snapshotHistory  `json:"history,omitempty"`
+	Rollups  []snapshotRollup   `json:"rollups,omitempty"`
+}
+
+// snapshotMetric is metric of tenant, tenant is empty in snapshots written before tenants were introduced
+type snapshotMetric struct {
+	entities.MetricInternal
+	Tenant  string `json:",omitempty"`
+	Updated int64  `json:",omitempty"` // Unix nanoseconds of the last change, zero in snapshots written before it was introduced
+}
+
+// snapshotMetadata is metadata of metric name of tenant
+type snapshotMetadata struct {
+	entities.MetricMetadata
+	Tenant string `json:"tenant"`
+}
+
+// snapshotHistory is history of gauge or counter series of tenant
+type snapshotHistory struct {
+	Tenant string                         `json:"tenant"`
+	MType  string                         `json:"type"`
+	ID     string                         `json:"id"`
+	Labels map[string]string              `json:"labels,omitempty"`
+	Points []entities.MetricPointInternal `json:"points"`
+}
+
+// snapshotRollup is bucket of gauge rollup of tenant
+type snapshotRollup struct {
+	entities.RollupInternal
+	Tenant string `json:"tenant"`
+}
+
+// RejectedRecord describes record, which was skipped during restore
+type RejectedRecord struct {
+	Source string // Snapshot or WAL segment file
+	Line   int    // Line in WAL segment or index of metric or metadata in snapshot
+	Record string // Raw record
+	Err    error  // Reason
+}
+
+// RestoreReport describes result of storage restore
+type RestoreReport struct {
+	Snapshot          string           // Snapshot generation used for restore, empty if none was valid
+	RejectedSnapshots map[string]error // Newer generations, which were skipped
+	Segments          []string         // Replayed WAL segments
+	Applied           int              // Number of applied records
+	Rejected          []RejectedRecord // Skipped records
+}
+
+// generationPath returns path of snapshot generation: 0 is the newest
+func generationPath(storePath string, generation int) string {
+	if generation == 0 {
+		return storePath
+	}
+	return fmt.Sprintf("%s.%d", storePath, generation)
+}
+
+// encodeSnapshot returns snapshot content with checksum header
+func encodeSnapshot(snap snapshot) ([]byte, error) {
+	body, err := json.Marshal(snap)
+	if err != nil {
+		return nil, err
+	}
+
+	sum := sha256.Sum256(body)
+	header := fmt.Sprintf("%s sha256=%s wal_seq=%d\n", snapshotHeaderPrefix, hex.EncodeToString(sum[:]), snap.WALSeq)
+	return append([]byte(header), body...), nil
+}
+
+// decodeSnapshot validates checksum and parses snapshot content
+func decodeSnapshot(data []byte) (snapshot, error) {
+	data = bytes.TrimSpace(data)
+	if len(data) == 0 {
+		return snapshot{}, nil
+	}
+
+	// Files written before checksums were introduced: array of metrics or snapshot object
+	if !bytes.HasPrefix(data, []byte(snapshotHeaderPrefix)) {
+		if data[0] == '[' {
+			var metrics []snapshotMetric
+			if err := json.Unmarshal(data, &metrics); err != nil {
+				return snapshot{}, err
+			}
+			return snapshot{Metrics: metrics}, nil
+		}
+		var snap snapshot
+		if err := json.Unmarshal(data, &snap); err != nil {
+			return snapshot{}, err
+		}
+		return snap, nil
+	}
+
+	header, body, ok := bytes.Cut(data, []byte("\n"))
+	if !ok {
+		return snapshot{}, errors.New("snapshot has no body")
+	}
+	var checksum string
+	for _, field := range strings.Fields(string(header)) {
+		if v, found := strings.CutPrefix(field, "sha256="); found {
+			checksum = v
+		}
+	}
+	sum := sha256.Sum256(body)
+	if checksum != hex.EncodeToString(sum[:]) {
+		return snapshot{}, errChecksumMismatch
+	}
+
+	var snap snapshot
+	if err := json.Unmarshal(body, &snap); err != nil {
+		return snapshot{}, err
+	}
+	return snap, nil
+}
+
+// readSnapshot reads and validates snapshot file
+func readSnapshot(path string) (snapshot, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return snapshot{}, err
+	}
+	return decodeSnapshot(data)
+}
+
+// snapshotWALSeq reads WAL sequence number from snapshot header without validating the body
+func snapshotWALSeq(path string) (uint64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+
+	header, err := bufio.NewReader(file).ReadString('\n')
+	if err != nil || !strings.HasPrefix(header, snapshotHeaderPrefix) {
+		// Files written before checksums were introduced have no header
+		snap, err := readSnapshot(path)
+		return snap.WALSeq, err
+	}
+	for _, field := range strings.Fields(header) {
+		if v, found := strings.CutPrefix(field, "wal_seq="); found {
+			return strconv.ParseUint(v, 10, 64)
+		}
+	}
+	return 0, errors.New("snapshot header has no wal_seq")
+}
+
+// latestSnapshot returns the newest valid generation. Invalid generations are added to report
+func latestSnapshot(storePath string, generations int, report *RestoreReport) (snap snapshot, path string) {
+	for g := 0; g < generations; g++ {
+		p := generationPath(storePath, g)
+		snap, err := readSnapshot(p)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			report.RejectedSnapshots[p] = err
+			continue
+		}
+		return snap, p
+	}
+	return snapshot{}, ""
+}
+
+// writeSnapshot writes snapshot to temporary file, syncs it and renames over the newest generation.
+// Previous generations are shifted, the oldest one is dropped
+func writeSnapshot(storePath string, generations int, snap snapshot) error {
+	data, err := encodeSnapshot(snap)
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Dir(storePath)
+	tmp, err := os.CreateTemp(dir, filepath.Base(storePath)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = os.Remove(tmp.Name())
+	}()
+
+	if _, err = tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+
+	for g := generations - 1; g > 0; g-- {
+		err = os.Rename(generationPath(storePath, g-1), generationPath(storePath, g))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	if err = os.Rename(tmp.Name(), storePath); err != nil {
+		return err
+	}
+
+	return syncDir(dir)
+}
+
+// syncDir makes renames in directory durable
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = d.Close()
+	}()
+	return d.Sync()
+}
+
+// restoreStorage loads the newest valid snapshot and replays WAL segments written after it
+func (m *MemStorage) restoreStorage() RestoreReport {
+	report := RestoreReport{RejectedSnapshots: make(map[string]error)}
+
+	snap, path := latestSnapshot(m.storePath, m.generations, &report)
+	report.Snapshot = path
+	for i, rm := range snap.Metrics {
+		err := m.applyRecord(walRecord{Op: walOpSet, ID: rm.ID, MType: rm.MType, Value: rm.Value, Labels: rm.Labels, Tenant: rm.Tenant, TS: rm.Updated})
+		if err != nil {
+			raw, _ := json.Marshal(rm)
+			report.Rejected = append(report.Rejected, RejectedRecord{Source: path, Line: i + 1, Record: string(raw), Err: err})
+			continue
+		}
+		report.Applied++
+	}
+	for i, meta := range snap.Metadata {
+		if err := m.applyRecord(metadataRecord(meta.Tenant, meta.MetricMetadata)); err != nil {
+			raw, _ := json.Marshal(meta)
+			report.Rejected = append(report.Rejected, RejectedRecord{Source: path, Line: i + 1, Record: string(raw), Err: err})
+			continue
+		}
+		report.Applied++
+	}
+	// History replaces value added to it when metric was restored above
+	for i, h := range snap.History {
+		if err := m.applyHistory(h); err != nil {
+			raw, _ := json.Marshal(h)
+			report.Rejected = append(report.Rejected, RejectedRecord{Source: path, Line: i + 1, Record: string(raw), Err: err})
+			continue
+		}
+		report.Applied++
+	}
+	for i, r := range snap.Rollups {
+		if err := m.applyRollup(r); err != nil {
+			raw, _ := json.Marshal(r)
+			report.Rejected = append(report.Rejected, RejectedRecord{Source: path, Line: i + 1, Record: string(raw), Err: err})
+			continue
+		}
+		report.Applied++
+	}
+
+	segments, err := listSegments(m.storePath)
+	if err != nil {
+		report.Rejected = append(report.Rejected, RejectedRecord{Source: m.storePath + ".wal.*", Err: err})
+		return report
+	}
+	for _, seg := range segments {
+		if seg.seq < snap.WALSeq {
+			continue
+		}
+		report.Segments = append(report.Segments, seg.path)
+		err = readWAL(seg.path, func(r walRecord) error {
+			if err := m.applyRecord(r); err != nil {
+				return err
+			}
+			report.Applied++
+			return nil
+		}, func(line int, data []byte, err error) {
+			report.Rejected = append(report.Rejected, RejectedRecord{Source: seg.path, Line: line, Record: strings.TrimSpace(string(data)), Err: err})
+		})
+		if err != nil {
+			report.Rejected = append(report.Rejected, RejectedRecord{Source: seg.path, Err: err})
+		}
+	}
+	return report
+}
+
+// logRestoreReport writes details of restore to log
+func logRestoreReport(report RestoreReport) {
+	for path, err := range report.RejectedSnapshots {
+		log.Warn().Err(err).Str("path", path).Msg("snapshot generation rejected")
+	}
+	for _, r := range report.Rejected {
+		log.Warn().Err(r.Err).Str("source", r.Source).Int("line", r.Line).Str("record", r.Record).Msg("record rejected during restore")
+	}
+	log.Info().
+		Str("snapshot", report.Snapshot).
+		Strs("segments", report.Segments).
+		Int("applied", report.Applied).
+		Int("rejected", len(report.Rejected)).
+		Msg("metrics restored")
+}
+
+// applyRecord changes storage according to WAL record without logging it
+func (m *MemStorage) applyRecord(r walRecord) error {
+	tenant := r.Tenant
+	if tenant == "" {
+		tenant = entities.DefaultTenant
+	}
+	e := m.engineOf(tenant)
+
+	switch {
+	case r.Op == walOpSet && r.MType == entities.Gauge:
+		value, err := strconv.ParseFloat(r.Value, 64)
+		if err != nil {
+			return err
+		}
+		e.setGauge(r.ID, r.Labels, value)
+	case r.Op == walOpSet && r.MType == entities.Counter:
+		value, err := strconv.ParseInt(r.Value, 10, 64)
+		if err != nil {
+			return err
+		}
+		e.setCounter(r.ID, r.Labels, value)
+	case r.Op == walOpIncrement && r.MType == entities.Counter:
+		delta, err := strconv.ParseInt(r.Value, 10, 64)
+		if err != nil {
+			return err
+		}
+		e.addCounter(r.ID, r.Labels, delta)
+	case r.Op == walOpSet && entities.IsDistribution(r.MType):
+		value, err := entities.ParseDistribution(r.MType, r.Value)
+		if err != nil {
+			return err
+		}
+		e.setDistribution(r.MType, r.ID, r.Labels, value)
+	case r.Op == walOpMerge && entities.IsDistribution(r.MType):
+		value, err := entities.ParseDistribution(r.MType, r.Value)
+		if err != nil {
+			return err
+		}
+		if err = e.mergeDistribution(r.MType, r.ID, r.Labels, value); err != nil {
+			return err
+		}
+	case r.Op == walOpDelete && entities.IsKnownType(r.MType):
+		e.delete(r.MType, r.ID, r.Labels)
+	case r.Op == walOpMeta:
+		meta := entities.MetricMetadata{Name: r.ID, Type: r.MType, Unit: r.Unit, Help: r.Help}
+		if err := meta.Validate(); err != nil {
+			return err
+		}
+		e.setMetadata(meta)
+	case r.Op == walOpMetaDelete:
+		e.deleteMetadata(r.ID)
+	default:
+		return entities.ErrMetricNotSupportedType
+	}
+
+	// Series changed by record without time of change are considered changed at restore
+	if r.TS != 0 && (r.Op == walOpSet || r.Op == walOpIncrement || r.Op == walOpMerge) {
+		e.setUpdatedAt(r.MType, r.ID, r.Labels, r.TS)
+	}
+	return nil
+}
+
+// applyHistory replaces history of restored metric series
+func (m *MemStorage) applyHistory(h snapshotHistory) error {
+	if h.MType != entities.Gauge && h.MType != entities.Counter {
+		return entities.ErrMetricNotSupportedType
+	}
+	e := m.lookupEngine(h.Tenant)
+	if e == nil {
+		return entities.ErrMetricNotFound
+	}
+	c := e.lookup(h.MType, h.ID, h.Labels)
+	if c == nil {
+		return entities.ErrMetricNotFound
+	}
+
+	points := make([]historyPoint, len(h.Points))
+	for i, p := range h.Points {
+		bits, err := parseValue(h.MType, p.Value)
+		if err != nil {
+			return err
+		}
+		points[i] = historyPoint{ts: p.Timestamp.UnixNano(), bits: bits}
+	}
+	c.history.restore(points)
+	return nil
+}
+
+// applyRollup merges restored rollup bucket
+func (m *MemStorage) applyRollup(r snapshotRollup) error {
+	i, err := resolutionIndex(r.Step)
+	if err != nil {
+		return err
+	}
+	m.engineOf(r.Tenant).rollupsOf(r.ID, r.Labels).merge(i, r.RollupInternal)
+	return nil
+}
+
+// snapshotMetrics returns metrics of all tenants
+func (m *MemStorage) snapshotMetrics() []snapshotMetric {
+	m.tenantsMu.RLock()
+	defer m.tenantsMu.RUnlock()
+
+	var res []snapshotMetric
+	for tenant, e := range m.tenants {
+		for _, metric := range e.appendAll(nil, nil) {
+			updated := e.updatedAt(metric.MType, metric.ID, metric.Labels)
+			res = append(res, snapshotMetric{MetricInternal: metric, Tenant: tenant, Updated: updated})
+		}
+	}
+	return res
+}
+
+// snapshotAllMetadata returns metadata of all tenants
+func (m *MemStorage) snapshotAllMetadata() []snapshotMetadata {
+	m.tenantsMu.RLock()
+	defer m.tenantsMu.RUnlock()
+
+	var res []snapshotMetadata
+	for tenant, e := range m.tenants {
+		for _, meta := range e.appendMetadata(nil) {
+			res = append(res, snapshotMetadata{MetricMetadata: meta, Tenant: tenant})
+		}
+	}
+	return res
+}
+
+// snapshotAllHistory returns history of gauges and counters of all tenants
+func (m *MemStorage) snapshotAllHistory() []snapshotHistory {
+	m.tenantsMu.RLock()
+	defer m.tenantsMu.RUnlock()
+
+	var res []snapshotHistory
+	for tenant, e := range m.tenants {
+		for i := range e.shards {
+			s := &e.shards[i]
+			s.mu.RLock()
+			for _, mType := range [...]string{entities.Gauge, entities.Counter} {
+				for _, c := range s.metrics(mType) {
+					h := snapshotHistory{Tenant: tenant, MType: mType, ID: c.name, Labels: c.labels}
+					for _, p := range c.history.all() {
+						h.Points = append(h.Points, entities.MetricPointInternal{Timestamp: time.Unix(0, p.ts), Value: formatValue(mType, p.bits)})
+					}
+					res = append(res, h)
+				}
+			}
+			s.mu.RUnlock()
+		}
+	}
+	return res
+}
+
+// snapshotAllRollups returns rollups of gauges of all tenants
+func (m *MemStorage) snapshotAllRollups() []snapshotRollup {
+	m.tenantsMu.RLock()
+	defer m.tenantsMu.RUnlock()
+
+	var res []snapshotRollup
+	var rollups []entities.RollupInternal
+	for tenant, e := range m.tenants {
+		for i := range e.shards {
+			s := &e.shards[i]
+			s.mu.RLock()
+			for _, series := range s.rollups {
+				rollups = series.appendAll(rollups[:0])
+				for _, r := range rollups {
+					res = append(res, snapshotRollup{RollupInternal: r, Tenant: tenant})
+				}
+			}
+			s.mu.RUnlock()
+		}
+	}
+	return res
+}
+
+// BackupMetrics compacts write-ahead log: current state is written as the new snapshot generation
+// and WAL segments not needed by any kept generation are removed
+func (m *MemStorage) BackupMetrics() error {
+	if m.storePath == "" {
+		return nil
+	}
+
+	m.compactMu.Lock()
+	defer m.compactMu.Unlock()
+
+	// Capture state and switch to the new segment atomically with respect to writers
+	m.persistMu.Lock()
+	metrics := m.snapshotMetrics()
+	metadata := m.snapshotAllMetadata()
+	history := m.snapshotAllHistory()
+	nextSeq := m.walSeq + 1
+	nextWAL, err := openWAL(segmentPath(m.storePath, nextSeq))
+	if err != nil {
+		m.persistMu.Unlock()
+		return err
+	}
+	sealed := m.wal
+	m.wal, m.walSeq = nextWAL, nextSeq
+	m.persistMu.Unlock()
+	// Rollups aren't written to WAL, so they are captured without blocking writers
+	rollups := m.snapshotAllRollups()
+
+	if sealed != nil {
+		if err = sealed.close(); err != nil {
+			return err
+		}
+	}
+
+	if err = writeSnapshot(m.storePath, m.generations, snapshot{WALSeq: nextSeq, Metrics: metrics, Metadata: metadata, History: history, Rollups: rollups}); err != nil {
+		return err
+	}
+
+	// Older generations are restored together with segments written after them, so keep those segments
+	keepFrom := nextSeq
+	for g := 1; g < m.generations; g++ {
+		seq, err := snapshotWALSeq(generationPath(m.storePath, g))
+		if err == nil && seq < keepFrom {
+			keepFrom = seq
+		}
+	}
+
+	segments, err := listSegments(m.storePath)
+	if err != nil {
+		return err
+	}
+	for _, seg := range segments {
+		if seg.seq >= keepFrom {
+			break
+		}
+		if err = os.Remove(seg.path); err != nil {
+			log.Error().Err(err).Str("path", seg.path).Msg("failed to remove compacted WAL segment")
+		}
+	}
+	return nil
+}
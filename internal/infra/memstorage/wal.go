@@ -0,0 +1,257 @@
+package memstorage
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Write-ahead log operations
+const (
+	walOpSet        = "set"      // Replace metric value
+	walOpIncrement  = "inc"      // Add value to counter
+	walOpDelete     = "del"      // Remove metric
+	walOpMerge      = "merge"    // Merge histogram or summary into stored value
+	walOpMeta       = "meta"     // Replace metadata of metric name
+	walOpMetaDelete = "meta-del" // Remove metadata of metric name
+)
+
+// walCompactSize - size of WAL segment in bytes, after which compaction is requested
+const walCompactSize = 4 << 20
+
+var (
+	errWALClosed       = errors.New("write-ahead log is closed")
+	errTruncatedRecord = errors.New("truncated record")
+)
+
+// walRecord describes single change of storage
+type walRecord struct {
+	Op     string            `json:"op"`
+	ID     string            `json:"id"`
+	MType  string            `json:"type"`
+	Value  string            `json:"value"`
+	Labels map[string]string `json:"labels,omitempty"`
+	Tenant string            `json:"tenant,omitempty"` // Empty in records written before tenants were introduced
+	Unit   string            `json:"unit,omitempty"`   // Unit of metadata record
+	Help   string            `json:"help,omitempty"`   // Help text of metadata record
+	TS     int64             `json:"ts,omitempty"`     // Unix nanoseconds of change, zero in records written before it was introduced
+}
+
+// wal is append-only segment of write-ahead log.
+// Records are buffered, sync makes them durable; concurrent callers of sync share one fsync (group commit)
+type wal struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	file    *os.File
+	w       *bufio.Writer
+	size    int64
+	seq     uint64 // number of last appended record
+	synced  uint64 // number of last durable record
+	syncing bool
+	closed  bool
+	err     error
+}
+
+func openWAL(path string) (*wal, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+
+	w := &wal{file: file, w: bufio.NewWriter(file), size: info.Size()}
+	w.cond = sync.NewCond(&w.mu)
+	return w, nil
+}
+
+// append writes records to the buffer and returns number of the last one
+func (w *wal) append(records ...walRecord) (uint64, error) {
+	now := time.Now().UnixNano()
+	var buf []byte
+	for _, r := range records {
+		if r.TS == 0 {
+			r.TS = now
+		}
+		line, err := json.Marshal(r)
+		if err != nil {
+			return 0, err
+		}
+		buf = append(append(buf, line...), '\n')
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.err != nil {
+		return 0, w.err
+	}
+	if w.closed {
+		return 0, errWALClosed
+	}
+	if _, err := w.w.Write(buf); err != nil {
+		w.err = err
+		return 0, err
+	}
+	w.size += int64(len(buf))
+	w.seq++
+	return w.seq, nil
+}
+
+// sync blocks until record with number seq is written and fsynced
+func (w *wal) sync(seq uint64) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for w.synced < seq {
+		if w.err != nil {
+			return w.err
+		}
+		if w.syncing {
+			w.cond.Wait()
+			continue
+		}
+
+		// Become leader: flush everything appended so far and fsync it for all waiting callers
+		w.syncing = true
+		target := w.seq
+		err := w.w.Flush()
+		if err == nil {
+			w.mu.Unlock()
+			err = w.file.Sync()
+			w.mu.Lock()
+		}
+		w.syncing = false
+		if err != nil {
+			w.err = err
+		} else if target > w.synced {
+			w.synced = target
+		}
+		w.cond.Broadcast()
+	}
+	return nil
+}
+
+// flush makes all appended records durable
+func (w *wal) flush() error {
+	w.mu.Lock()
+	seq := w.seq
+	w.mu.Unlock()
+	return w.sync(seq)
+}
+
+// sizeBytes returns current size of segment
+func (w *wal) sizeBytes() int64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.size
+}
+
+// close flushes and closes segment, all appended records are considered durable after that
+func (w *wal) close() error {
+	if err := w.flush(); err != nil {
+		return err
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for w.syncing {
+		w.cond.Wait()
+	}
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+
+	err := w.w.Flush()
+	if err == nil {
+		err = w.file.Sync()
+	}
+	if e := w.file.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		w.err = err
+		return err
+	}
+	w.synced = w.seq
+	w.cond.Broadcast()
+	return nil
+}
+
+// readWAL calls apply for every record of segment. Records which can't be decoded or applied are passed to reject.
+// Truncated last record (crash during write) is rejected too
+func readWAL(path string, apply func(r walRecord) error, reject func(line int, data []byte, err error)) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+
+	reader := bufio.NewReader(file)
+	for line := 1; ; line++ {
+		data, err := reader.ReadBytes('\n')
+		if len(data) > 0 && data[len(data)-1] != '\n' {
+			reject(line, data, errTruncatedRecord)
+			return nil
+		}
+		if len(data) > 0 {
+			var r walRecord
+			if e := json.Unmarshal(data, &r); e != nil {
+				reject(line, data, e)
+			} else if e = apply(r); e != nil {
+				reject(line, data, e)
+			}
+		}
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+	}
+}
+
+// walSegment describes WAL segment file, named `<storePath>.wal.<seq>`
+type walSegment struct {
+	seq  uint64
+	path string
+}
+
+func segmentPath(storePath string, seq uint64) string {
+	return fmt.Sprintf("%s.wal.%d", storePath, seq)
+}
+
+// listSegments returns WAL segments of storePath ordered by sequence number
+func listSegments(storePath string) ([]walSegment, error) {
+	files, err := filepath.Glob(storePath + ".wal.*")
+	if err != nil {
+		return nil, err
+	}
+
+	var segments []walSegment
+	prefix := storePath + ".wal."
+	for _, f := range files {
+		seq, err := strconv.ParseUint(strings.TrimPrefix(f, prefix), 10, 64)
+		if err != nil {
+			continue
+		}
+		segments = append(segments, walSegment{seq: seq, path: f})
+	}
+	sort.Slice(segments, func(i, j int) bool { return segments[i].seq < segments[j].seq })
+	return segments, nil
+}
@@ -0,0 +1,407 @@
+package postgres
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/rs/zerolog/log"
+
+	"github.com/melkomukovki/go-musthave-metrics/internal/entities"
+)
+
+// Journal operations, every write method of repository has its own
+const (
+	journalOpAdd       = "add"
+	journalOpBatch     = "batch"
+	journalOpMerge     = "merge"
+	journalOpIncrement = "inc"
+	journalOpDelete    = "del"
+	journalOpReset     = "reset"
+	journalOpRollups   = "rollups"
+)
+
+// journalRecord is write made while database was unavailable
+type journalRecord struct {
+	Op      string                    `json:"op"`
+	Tenant  string                    `json:"tenant"`
+	Metrics []entities.MetricInternal `json:"metrics,omitempty"`
+	Rollups []entities.RollupInternal `json:"rollups,omitempty"`
+	MType   string                    `json:"type,omitempty"`
+	ID      string                    `json:"id,omitempty"`
+	Labels  map[string]string         `json:"labels,omitempty"`
+	Delta   int64                     `json:"delta,omitempty"`
+}
+
+// validate checks record, so invalid write is rejected instead of being journaled
+func (r journalRecord) validate() error {
+	for _, m := range r.Metrics {
+		if _, _, _, err := columnValues(m.MType, m.Value); err != nil {
+			return err
+		}
+		if r.Op == journalOpMerge && !entities.IsDistribution(m.MType) {
+			return entities.ErrMetricNotSupportedType
+		}
+	}
+	for _, rollup := range r.Rollups {
+		if _, err := entities.ResolutionOf(rollup.Step); err != nil {
+			return err
+		}
+	}
+	if r.Op == journalOpDelete && !entities.IsKnownType(r.MType) {
+		return entities.ErrMetricNotSupportedType
+	}
+	return nil
+}
+
+// Journal is append-only file of writes made while database is unavailable, limited by size.
+// Records are replayed in order once database returns
+type Journal struct {
+	mu       sync.Mutex
+	path     string
+	maxBytes int64
+	file     *os.File
+	size     int64
+	records  int
+	degraded atomic.Bool // Database is considered unavailable, writes go to journal without trying database
+
+	replayMu sync.Mutex
+}
+
+// OpenJournal opens journal at path, records left by previous run are kept for replay
+func OpenJournal(path string, maxBytes int64) (*Journal, error) {
+	j := &Journal{path: path, maxBytes: maxBytes}
+	if err := j.open(); err != nil {
+		return nil, err
+	}
+
+	var complete int64
+	err := j.scan(j.size, func(line []byte) bool {
+		complete += int64(len(line))
+		j.records++
+		return true
+	})
+	// Last record truncated by crash during write is dropped, otherwise next record would be appended to it
+	if err == nil && complete < j.size {
+		log.Warn().Str("path", path).Int64("bytes", j.size-complete).Msg("dropping truncated journal record")
+		if err = j.file.Truncate(complete); err == nil {
+			j.size = complete
+		}
+	}
+	if err != nil {
+		_ = j.file.Close()
+		return nil, err
+	}
+	return j, nil
+}
+
+func (j *Journal) open() error {
+	file, err := os.OpenFile(j.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+	j.file, j.size = file, info.Size()
+	return nil
+}
+
+// Stats returns number of journaled writes and size of journal
+func (j *Journal) Stats() entities.JournalStats {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return entities.JournalStats{Records: j.records, Bytes: j.size, Degraded: j.degraded.Load()}
+}
+
+// active reports whether writes go to journal: database is unavailable or earlier writes are not replayed yet
+func (j *Journal) active() bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.records > 0 || j.degraded.Load()
+}
+
+// appendIfActive journals record if database is unavailable or earlier writes are not replayed yet,
+// so writes reach database in the order they were made
+func (j *Journal) appendIfActive(r journalRecord) (bool, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.records == 0 && !j.degraded.Load() {
+		return false, nil
+	}
+	return true, j.appendLocked(r)
+}
+
+// append journals record after database failed to apply it
+func (j *Journal) append(r journalRecord) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.appendLocked(r)
+}
+
+func (j *Journal) appendLocked(r journalRecord) error {
+	line, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+	if j.size+int64(len(line)) > j.maxBytes {
+		return entities.ErrJournalFull
+	}
+
+	// Write is acknowledged to client, so it must survive restart
+	if _, err = j.file.Write(line); err != nil {
+		return err
+	}
+	if err = j.file.Sync(); err != nil {
+		return err
+	}
+	j.size += int64(len(line))
+	j.records++
+	return nil
+}
+
+// scan calls f for complete records stored in the first limit bytes of journal until f returns false
+func (j *Journal) scan(limit int64, f func(line []byte) bool) error {
+	file, err := os.Open(j.path)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+
+	reader := bufio.NewReader(io.LimitReader(file, limit))
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(line) > 0 && line[len(line)-1] == '\n' && !f(line) {
+			return nil
+		}
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+	}
+}
+
+// replay applies journaled records in order and removes applied ones from journal.
+// Replay stops at the first record, which can't be applied because database is unavailable.
+// Records are removed after they are applied, so replay interrupted by crash may apply some of them twice
+func (j *Journal) replay(apply func(r journalRecord) error) (replayed int, err error) {
+	j.replayMu.Lock()
+	defer j.replayMu.Unlock()
+
+	j.mu.Lock()
+	limit := j.size
+	j.mu.Unlock()
+
+	var offset int64
+	var applyErr error
+	err = j.scan(limit, func(line []byte) bool {
+		var r journalRecord
+		if e := json.Unmarshal(line, &r); e != nil {
+			log.Error().Err(e).Str("path", j.path).Msg("dropping undecodable journal record")
+		} else if e = apply(r); e != nil {
+			if isUnavailableError(e) {
+				applyErr = e
+				return false
+			}
+			log.Error().Err(e).Str("op", r.Op).Msg("dropping journaled write rejected by database")
+		}
+		offset += int64(len(line))
+		replayed++
+		return true
+	})
+	if err == nil {
+		err = applyErr
+	}
+	if cErr := j.compact(offset, replayed); err == nil {
+		err = cErr
+	}
+	if err != nil && isUnavailableError(err) {
+		j.degraded.Store(true)
+	}
+	return replayed, err
+}
+
+// compact removes first offset bytes holding n replayed records from journal.
+// Records appended during replay are moved to the new journal file
+func (j *Journal) compact(offset int64, n int) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if offset >= j.size {
+		offset = j.size
+	}
+	if offset == 0 {
+		return nil
+	}
+
+	src, err := os.Open(j.path)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = src.Close()
+	}()
+	if _, err = src.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+
+	tmpPath := j.path + ".tmp"
+	tmp, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(tmp, src); err == nil {
+		err = tmp.Sync()
+	}
+	if cErr := tmp.Close(); err == nil {
+		err = cErr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, j.path)
+	}
+	if err != nil {
+		_ = os.Remove(tmpPath)
+		return err
+	}
+
+	_ = j.file.Close()
+	j.records -= n
+	return j.open()
+}
+
+// Close closes journal file, not replayed records stay in it
+func (j *Journal) Close() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.file.Close()
+}
+
+// isUnavailableError reports whether error means that database can't be reached
+func isUnavailableError(err error) bool {
+	var connErr *pgconn.ConnectError
+	var netErr net.Error
+	return isRetriableError(err) || errors.As(err, &connErr) || errors.As(err, &netErr) || pgconn.Timeout(err)
+}
+
+// write applies record to database. With journal, record is journaled instead
+// while database is unavailable or earlier journaled writes are not replayed yet
+func (s *PgRepository) write(ctx context.Context, r journalRecord) error {
+	if s.Journal == nil {
+		return s.apply(ctx, r)
+	}
+
+	if err := r.validate(); err != nil {
+		return err
+	}
+	r.Tenant = entities.TenantFromContext(ctx)
+	if journaled, err := s.Journal.appendIfActive(r); journaled {
+		return err
+	}
+
+	err := s.apply(ctx, r)
+	if err != nil && isUnavailableError(err) {
+		log.Warn().Err(err).Msg("database is unavailable, writes are journaled")
+		s.Journal.degraded.Store(true)
+		return s.Journal.append(r)
+	}
+	return err
+}
+
+// apply makes write described by record
+func (s *PgRepository) apply(ctx context.Context, r journalRecord) error {
+	if (r.Op == journalOpAdd || r.Op == journalOpMerge) && len(r.Metrics) != 1 {
+		return fmt.Errorf("journal operation %s requires one metric, got %d", r.Op, len(r.Metrics))
+	}
+
+	switch r.Op {
+	case journalOpAdd:
+		return s.addMetric(ctx, r.Metrics[0])
+	case journalOpBatch:
+		return s.addMultipleMetrics(ctx, r.Metrics)
+	case journalOpMerge:
+		return s.mergeMetric(ctx, r.Metrics[0])
+	case journalOpIncrement:
+		return s.incrementCounter(ctx, r.ID, r.Labels, r.Delta)
+	case journalOpDelete:
+		return s.deleteMetric(ctx, r.MType, r.ID, r.Labels)
+	case journalOpReset:
+		return s.resetCounter(ctx, r.ID, r.Labels)
+	case journalOpRollups:
+		return s.mergeRollups(ctx, r.Rollups)
+	default:
+		return fmt.Errorf("unknown journal operation: %s", r.Op)
+	}
+}
+
+// ReplayJournal applies journaled writes once database is reachable, returns number of replayed writes
+func (s *PgRepository) ReplayJournal(ctx context.Context) (int, error) {
+	if s.Journal == nil {
+		return 0, nil
+	}
+	if err := s.DB.Ping(ctx); err != nil {
+		s.Journal.degraded.Store(true)
+		return 0, err
+	}
+	// Writes keep going to journal until it is empty, so clearing the flag doesn't break their order
+	s.Journal.degraded.Store(false)
+
+	return s.Journal.replay(func(r journalRecord) error {
+		return s.apply(entities.ContextWithTenant(ctx, r.Tenant), r)
+	})
+}
+
+// RunJournalReplay replays journal every interval until ctx is done
+func (s *PgRepository) RunJournalReplay(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if stats := s.Journal.Stats(); stats.Records > 0 || stats.Degraded {
+			replayed, err := s.ReplayJournal(ctx)
+			if err != nil {
+				log.Warn().Err(err).Int("records", stats.Records).Int64("bytes", stats.Bytes).Msg("journal is not replayed, database is unavailable")
+			}
+			if replayed > 0 {
+				log.Info().Int("replayed", replayed).Int("left", s.Journal.Stats().Records).Msg("journal replayed")
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// JournalStats returns state of journal, zero if repository works without it
+func (s *PgRepository) JournalStats() entities.JournalStats {
+	if s.Journal == nil {
+		return entities.JournalStats{}
+	}
+	return s.Journal.Stats()
+}
+
+// Close closes journal, database pool is owned by caller
+func (s *PgRepository) Close() error {
+	if s.Journal == nil {
+		return nil
+	}
+	return s.Journal.Close()
+}
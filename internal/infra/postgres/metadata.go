@@ -0,0 +1,231 @@
+package postgres
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+
+	"github.com/melkomukovki/go-musthave-metrics/internal/entities"
+)
+
+const (
+	sqlGetMetricTypesQuery   = `SELECT name, type FROM metric_metadata WHERE tenant=$1 AND name = ANY($2)`
+	sqlClaimMetricTypesQuery = `
+		insert into metric_metadata (tenant, name, type) select $1, name, type from unnest($2::text[], $3::text[]) AS c(name, type)
+		on conflict (tenant, name) do update set type = metric_metadata.type
+		returning name, type`
+	// Type of existing metadata isn't changed, so no rows are returned if name is owned by another type
+	sqlSetMetadataQuery = `
+		insert into metric_metadata (tenant, name, type, unit, help) values ($1, $2, $3, $4, $5)
+		on conflict (tenant, name) do update set unit = excluded.unit, help = excluded.help
+		WHERE metric_metadata.type = excluded.type
+		returning name`
+	sqlGetMetadataQuery    = `SELECT name, type, unit, help FROM metric_metadata WHERE tenant=$1 AND name=$2`
+	sqlGetAllMetadataQuery = `SELECT name, type, unit, help FROM metric_metadata WHERE tenant=$1 ORDER BY name`
+	sqlDeleteMetadataQuery = `DELETE FROM metric_metadata WHERE tenant=$1 AND name=$2`
+)
+
+// ClaimMetricTypes stores types as owners of names without metadata in postgresql.
+// Claims can't be journaled, since they depend on stored metadata: while database is unavailable
+// writes are accepted without checking types
+func (s *PgRepository) ClaimMetricTypes(ctx context.Context, types map[string]string) error {
+	if err := entities.ValidateClaims(types); err != nil {
+		return err
+	}
+	names := make([]string, 0, len(types))
+	for name := range types {
+		names = append(names, name)
+	}
+	if len(names) == 0 {
+		return nil
+	}
+	// Names are claimed in the same order by all writers, so concurrent claims don't deadlock
+	sort.Strings(names)
+
+	if s.Journal != nil && s.Journal.active() {
+		return nil
+	}
+
+	nCtx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+
+	err := s.retryOperation(func() error {
+		return s.claimMetricTypes(nCtx, names, types)
+	})
+	if err != nil && s.Journal != nil && isUnavailableError(err) {
+		s.Journal.degraded.Store(true)
+		return nil
+	}
+	return err
+}
+
+// claimMetricTypes reads owners of names and claims names without metadata in one transaction,
+// which is rolled back if any name turns out to be owned by another type
+func (s *PgRepository) claimMetricTypes(ctx context.Context, names []string, types map[string]string) error {
+	tenant := entities.TenantFromContext(ctx)
+	owners, err := metricTypes(ctx, s.DB.Query, sqlGetMetricTypesQuery, tenant, names)
+	if err != nil {
+		return err
+	}
+
+	var missing, missingTypes []string
+	for _, name := range names {
+		owner, ok := owners[name]
+		switch {
+		case !ok:
+			missing = append(missing, name)
+			missingTypes = append(missingTypes, types[name])
+		case owner != types[name]:
+			return entities.TypeConflict(name, owner, types[name])
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+
+	tx, err := s.DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = tx.Rollback(ctx)
+	}()
+
+	// Names claimed concurrently are returned with type of the winner
+	if owners, err = metricTypes(ctx, tx.Query, sqlClaimMetricTypesQuery, tenant, missing, missingTypes); err != nil {
+		return err
+	}
+	for _, name := range missing {
+		if owners[name] != types[name] {
+			return entities.TypeConflict(name, owners[name], types[name])
+		}
+	}
+	return tx.Commit(ctx)
+}
+
+// metricTypes runs query returning names with their owning types
+func metricTypes(ctx context.Context, query func(context.Context, string, ...any) (pgx.Rows, error), sql string, args ...any) (map[string]string, error) {
+	rows, err := query(ctx, sql, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	owners := make(map[string]string)
+	for rows.Next() {
+		var name, mType string
+		if err = rows.Scan(&name, &mType); err != nil {
+			return nil, err
+		}
+		owners[name] = mType
+	}
+	return owners, rows.Err()
+}
+
+// SetMetadata stores metadata of metric name in postgresql.
+// Metadata isn't journaled: while journal is replayed it fails with entities.ErrStorageDegraded
+func (s *PgRepository) SetMetadata(ctx context.Context, meta entities.MetricMetadata) error {
+	if err := meta.Validate(); err != nil {
+		return err
+	}
+	if s.Journal != nil && s.Journal.active() {
+		return entities.ErrStorageDegraded
+	}
+
+	nCtx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+
+	tenant := entities.TenantFromContext(nCtx)
+	var name string
+	err := s.retryOperation(func() error {
+		return s.DB.QueryRow(nCtx, sqlSetMetadataQuery, tenant, meta.Name, meta.Type, meta.Unit, meta.Help).Scan(&name)
+	})
+	if errors.Is(err, pgx.ErrNoRows) {
+		current, err := s.GetMetadata(ctx, meta.Name)
+		if err != nil {
+			return err
+		}
+		return entities.TypeConflict(meta.Name, current.Type, meta.Type)
+	}
+	return s.degradedError(err)
+}
+
+// GetMetadata returns metadata of metric name stored in postgresql
+func (s *PgRepository) GetMetadata(ctx context.Context, name string) (meta entities.MetricMetadata, err error) {
+	nCtx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+
+	err = s.retryOperation(func() error {
+		return s.DB.QueryRow(nCtx, sqlGetMetadataQuery, entities.TenantFromContext(nCtx), name).
+			Scan(&meta.Name, &meta.Type, &meta.Unit, &meta.Help)
+	})
+	if errors.Is(err, pgx.ErrNoRows) {
+		return entities.MetricMetadata{}, entities.ErrMetadataNotFound
+	}
+	if err != nil {
+		return entities.MetricMetadata{}, err
+	}
+	return meta, nil
+}
+
+// GetAllMetadata returns metadata of all names stored in postgresql ordered by name
+func (s *PgRepository) GetAllMetadata(ctx context.Context) (metadata []entities.MetricMetadata, err error) {
+	nCtx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	var rows pgx.Rows
+	err = s.retryOperation(func() error {
+		tRows, e := s.DB.Query(nCtx, sqlGetAllMetadataQuery, entities.TenantFromContext(nCtx))
+		rows = tRows
+		return e
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	metadata = []entities.MetricMetadata{}
+	for rows.Next() {
+		var meta entities.MetricMetadata
+		if err = rows.Scan(&meta.Name, &meta.Type, &meta.Unit, &meta.Help); err != nil {
+			return nil, err
+		}
+		metadata = append(metadata, meta)
+	}
+	return metadata, rows.Err()
+}
+
+// DeleteMetadata removes metadata of metric name from postgresql.
+// Metadata isn't journaled: while journal is replayed it fails with entities.ErrStorageDegraded
+func (s *PgRepository) DeleteMetadata(ctx context.Context, name string) error {
+	if s.Journal != nil && s.Journal.active() {
+		return entities.ErrStorageDegraded
+	}
+
+	nCtx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+
+	var deleted int64
+	err := s.retryOperation(func() error {
+		tag, err := s.DB.Exec(nCtx, sqlDeleteMetadataQuery, entities.TenantFromContext(nCtx), name)
+		deleted = tag.RowsAffected()
+		return err
+	})
+	if err == nil && deleted == 0 {
+		return entities.ErrMetadataNotFound
+	}
+	return s.degradedError(err)
+}
+
+// degradedError marks journal degraded if err is caused by unavailable database
+func (s *PgRepository) degradedError(err error) error {
+	if err != nil && s.Journal != nil && isUnavailableError(err) {
+		s.Journal.degraded.Store(true)
+		return fmt.Errorf("%w: %v", entities.ErrStorageDegraded, err)
+	}
+	return err
+}
@@ -0,0 +1,218 @@
+package postgres
+
+import (
+	"context"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/rs/zerolog/log"
+)
+
+// migrationLockID - key of advisory lock, taken while migrations are applied
+const migrationLockID = 7_263_301_842
+
+const (
+	sqlCreateMigrationsTableQuery = `
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version bigint PRIMARY KEY,
+			name varchar(255) NOT NULL,
+			applied_at timestamptz NOT NULL DEFAULT now()
+		);`
+	sqlGetAppliedMigrationsQuery = `SELECT version FROM schema_migrations ORDER BY version`
+	sqlAddMigrationQuery         = `INSERT INTO schema_migrations (version, name) VALUES ($1, $2)`
+	sqlDeleteMigrationQuery      = `DELETE FROM schema_migrations WHERE version = $1`
+)
+
+//go:embed migrations/*.sql
+var migrationsFS embed.FS
+
+// migration describes single schema change
+type migration struct {
+	version int64
+	name    string
+	up      string
+	down    string
+}
+
+// loadMigrations reads embedded files named `<version>_<name>.up.sql` and `<version>_<name>.down.sql`
+func loadMigrations() ([]migration, error) {
+	files, err := fs.Glob(migrationsFS, "migrations/*.sql")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[int64]*migration)
+	for _, file := range files {
+		base := path.Base(file)
+
+		var direction string
+		switch {
+		case strings.HasSuffix(base, ".up.sql"):
+			direction = "up"
+		case strings.HasSuffix(base, ".down.sql"):
+			direction = "down"
+		default:
+			return nil, fmt.Errorf("migration %s: unknown direction", base)
+		}
+
+		versionStr, name, ok := strings.Cut(strings.TrimSuffix(base, "."+direction+".sql"), "_")
+		if !ok {
+			return nil, fmt.Errorf("migration %s: invalid file name", base)
+		}
+		version, err := strconv.ParseInt(versionStr, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("migration %s: invalid version: %w", base, err)
+		}
+
+		data, err := migrationsFS.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &migration{version: version, name: name}
+			byVersion[version] = m
+		}
+		if m.name != name {
+			return nil, fmt.Errorf("migration %d: name mismatch %q and %q", version, m.name, name)
+		}
+		if direction == "up" {
+			m.up = string(data)
+		} else {
+			m.down = string(data)
+		}
+	}
+
+	migrations := make([]migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.up == "" || m.down == "" {
+			return nil, fmt.Errorf("migration %d_%s: both up and down files are required", m.version, m.name)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].version < migrations[j].version })
+
+	return migrations, nil
+}
+
+// MigrateUp applies all pending migrations and returns number of applied ones
+func MigrateUp(ctx context.Context, db *pgxpool.Pool) (applied int, err error) {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return 0, err
+	}
+
+	err = withMigrationLock(ctx, db, func(conn *pgx.Conn, done map[int64]bool) error {
+		for _, m := range migrations {
+			if done[m.version] {
+				continue
+			}
+			if err := applyMigration(ctx, conn, m.version, m.up, func(tx pgx.Tx) error {
+				_, err := tx.Exec(ctx, sqlAddMigrationQuery, m.version, m.name)
+				return err
+			}); err != nil {
+				return fmt.Errorf("migration %d_%s up: %w", m.version, m.name, err)
+			}
+			log.Info().Int64("version", m.version).Str("name", m.name).Msg("migration applied")
+			applied++
+		}
+		return nil
+	})
+	return applied, err
+}
+
+// MigrateDown reverts last `steps` applied migrations and returns number of reverted ones
+func MigrateDown(ctx context.Context, db *pgxpool.Pool, steps int) (reverted int, err error) {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return 0, err
+	}
+
+	err = withMigrationLock(ctx, db, func(conn *pgx.Conn, done map[int64]bool) error {
+		for i := len(migrations) - 1; i >= 0 && reverted < steps; i-- {
+			m := migrations[i]
+			if !done[m.version] {
+				continue
+			}
+			if err := applyMigration(ctx, conn, m.version, m.down, func(tx pgx.Tx) error {
+				_, err := tx.Exec(ctx, sqlDeleteMigrationQuery, m.version)
+				return err
+			}); err != nil {
+				return fmt.Errorf("migration %d_%s down: %w", m.version, m.name, err)
+			}
+			log.Info().Int64("version", m.version).Str("name", m.name).Msg("migration reverted")
+			reverted++
+		}
+		return nil
+	})
+	return reverted, err
+}
+
+// withMigrationLock takes advisory lock, so concurrent servers don't apply migrations at the same time,
+// and calls f with set of already applied versions
+func withMigrationLock(ctx context.Context, db *pgxpool.Pool, f func(conn *pgx.Conn, done map[int64]bool) error) error {
+	conn, err := db.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+
+	if _, err = conn.Exec(ctx, "SELECT pg_advisory_lock($1)", migrationLockID); err != nil {
+		return err
+	}
+	defer func() {
+		if _, e := conn.Exec(context.Background(), "SELECT pg_advisory_unlock($1)", migrationLockID); e != nil {
+			log.Error().Err(e).Msg("Failed release migration lock")
+		}
+	}()
+
+	if _, err = conn.Exec(ctx, sqlCreateMigrationsTableQuery); err != nil {
+		return err
+	}
+
+	rows, err := conn.Query(ctx, sqlGetAppliedMigrationsQuery)
+	if err != nil {
+		return err
+	}
+	versions, err := pgx.CollectRows(rows, pgx.RowTo[int64])
+	if err != nil {
+		return err
+	}
+
+	done := make(map[int64]bool, len(versions))
+	for _, v := range versions {
+		done[v] = true
+	}
+
+	return f(conn.Conn(), done)
+}
+
+// applyMigration executes migration script and bookkeeping in one transaction
+func applyMigration(ctx context.Context, conn *pgx.Conn, version int64, script string, record func(tx pgx.Tx) error) error {
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if e := tx.Rollback(ctx); e != nil && !errors.Is(e, pgx.ErrTxClosed) {
+			log.Error().Err(e).Int64("version", version).Msg("Failed rollback transaction")
+		}
+	}()
+
+	if _, err = tx.Exec(ctx, script); err != nil {
+		return err
+	}
+	if err = record(tx); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
@@ -0,0 +1,6 @@
+CREATE TABLE IF NOT EXISTS metric_storage (
+    name varchar(50) NOT NULL,
+    type varchar(20) NOT NULL,
+    value double precision NOT NULL,
+    PRIMARY KEY (name, type)
+);
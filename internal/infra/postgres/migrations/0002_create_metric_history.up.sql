@@ -0,0 +1,8 @@
+CREATE TABLE IF NOT EXISTS metric_history (
+    name varchar(50) NOT NULL,
+    type varchar(20) NOT NULL,
+    value double precision NOT NULL,
+    created_at timestamptz NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS metric_history_name_type_created_at_idx ON metric_history (name, type, created_at);
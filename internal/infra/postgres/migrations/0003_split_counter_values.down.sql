@@ -0,0 +1,7 @@
+UPDATE metric_storage SET value = delta WHERE type = 'counter';
+ALTER TABLE metric_storage DROP COLUMN IF EXISTS delta;
+ALTER TABLE metric_storage ALTER COLUMN value SET NOT NULL;
+
+UPDATE metric_history SET value = delta WHERE type = 'counter';
+ALTER TABLE metric_history DROP COLUMN IF EXISTS delta;
+ALTER TABLE metric_history ALTER COLUMN value SET NOT NULL;
@@ -0,0 +1,8 @@
+-- Counters were stored in `value double precision` column, move them to exact `delta bigint` column
+ALTER TABLE metric_storage ADD COLUMN IF NOT EXISTS delta bigint;
+ALTER TABLE metric_storage ALTER COLUMN value DROP NOT NULL;
+UPDATE metric_storage SET delta = value::bigint, value = NULL WHERE type = 'counter' AND delta IS NULL;
+
+ALTER TABLE metric_history ADD COLUMN IF NOT EXISTS delta bigint;
+ALTER TABLE metric_history ALTER COLUMN value DROP NOT NULL;
+UPDATE metric_history SET delta = value::bigint, value = NULL WHERE type = 'counter' AND delta IS NULL;
@@ -0,0 +1,10 @@
+-- Labeled series can't be represented without labels
+DELETE FROM metric_storage WHERE labels <> '{}';
+ALTER TABLE metric_storage DROP CONSTRAINT IF EXISTS metric_storage_pkey;
+ALTER TABLE metric_storage DROP COLUMN IF EXISTS labels;
+ALTER TABLE metric_storage ADD PRIMARY KEY (name, type);
+
+DELETE FROM metric_history WHERE labels <> '{}';
+DROP INDEX IF EXISTS metric_history_name_type_labels_created_at_idx;
+ALTER TABLE metric_history DROP COLUMN IF EXISTS labels;
+CREATE INDEX IF NOT EXISTS metric_history_name_type_created_at_idx ON metric_history (name, type, created_at);
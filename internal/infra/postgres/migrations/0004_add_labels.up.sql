@@ -0,0 +1,8 @@
+-- Series are identified by name, type and labels
+ALTER TABLE metric_storage ADD COLUMN IF NOT EXISTS labels jsonb NOT NULL DEFAULT '{}';
+ALTER TABLE metric_storage DROP CONSTRAINT IF EXISTS metric_storage_pkey;
+ALTER TABLE metric_storage ADD PRIMARY KEY (name, type, labels);
+
+ALTER TABLE metric_history ADD COLUMN IF NOT EXISTS labels jsonb NOT NULL DEFAULT '{}';
+DROP INDEX IF EXISTS metric_history_name_type_created_at_idx;
+CREATE INDEX IF NOT EXISTS metric_history_name_type_labels_created_at_idx ON metric_history (name, type, labels, created_at);
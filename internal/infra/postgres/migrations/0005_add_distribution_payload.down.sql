@@ -0,0 +1,3 @@
+-- Histograms and summaries can't be represented without payload
+DELETE FROM metric_storage WHERE payload IS NOT NULL;
+ALTER TABLE metric_storage DROP COLUMN IF EXISTS payload;
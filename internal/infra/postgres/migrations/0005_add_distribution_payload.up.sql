@@ -0,0 +1,2 @@
+-- Histograms and summaries are stored as JSON documents, they are not kept in history
+ALTER TABLE metric_storage ADD COLUMN IF NOT EXISTS payload jsonb;
@@ -0,0 +1,10 @@
+-- Only metrics of default tenant can be kept in the single namespace
+DELETE FROM metric_storage WHERE tenant <> 'default';
+ALTER TABLE metric_storage DROP CONSTRAINT IF EXISTS metric_storage_pkey;
+ALTER TABLE metric_storage DROP COLUMN IF EXISTS tenant;
+ALTER TABLE metric_storage ADD PRIMARY KEY (name, type, labels);
+
+DELETE FROM metric_history WHERE tenant <> 'default';
+DROP INDEX IF EXISTS metric_history_tenant_name_type_labels_created_at_idx;
+ALTER TABLE metric_history DROP COLUMN IF EXISTS tenant;
+CREATE INDEX IF NOT EXISTS metric_history_name_type_labels_created_at_idx ON metric_history (name, type, labels, created_at);
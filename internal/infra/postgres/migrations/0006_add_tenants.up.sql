@@ -0,0 +1,8 @@
+-- Series are partitioned by tenant, existing metrics belong to default tenant
+ALTER TABLE metric_storage ADD COLUMN IF NOT EXISTS tenant varchar(64) NOT NULL DEFAULT 'default';
+ALTER TABLE metric_storage DROP CONSTRAINT IF EXISTS metric_storage_pkey;
+ALTER TABLE metric_storage ADD PRIMARY KEY (tenant, name, type, labels);
+
+ALTER TABLE metric_history ADD COLUMN IF NOT EXISTS tenant varchar(64) NOT NULL DEFAULT 'default';
+DROP INDEX IF EXISTS metric_history_name_type_labels_created_at_idx;
+CREATE INDEX IF NOT EXISTS metric_history_tenant_name_type_labels_created_at_idx ON metric_history (tenant, name, type, labels, created_at);
@@ -0,0 +1,13 @@
+-- Aggregates of gauge values in time buckets, resolution is width of bucket in seconds
+CREATE TABLE IF NOT EXISTS metric_rollups (
+    tenant varchar(64) NOT NULL DEFAULT 'default',
+    name varchar(50) NOT NULL,
+    labels jsonb NOT NULL DEFAULT '{}',
+    resolution integer NOT NULL,
+    bucket timestamptz NOT NULL,
+    min double precision NOT NULL,
+    max double precision NOT NULL,
+    sum double precision NOT NULL,
+    count bigint NOT NULL,
+    PRIMARY KEY (tenant, name, labels, resolution, bucket)
+);
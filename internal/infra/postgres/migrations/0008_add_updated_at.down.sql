@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS metric_history_created_at_idx;
+ALTER TABLE metric_storage DROP COLUMN IF EXISTS updated_at;
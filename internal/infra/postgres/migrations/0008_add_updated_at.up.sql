@@ -0,0 +1,3 @@
+-- Time of the last change of series, used by retention
+ALTER TABLE metric_storage ADD COLUMN IF NOT EXISTS updated_at timestamptz NOT NULL DEFAULT now();
+CREATE INDEX IF NOT EXISTS metric_history_created_at_idx ON metric_history (created_at);
@@ -0,0 +1 @@
+ALTER TABLE metric_storage DROP COLUMN IF EXISTS version;
@@ -0,0 +1,3 @@
+-- Version of series is Unix nanoseconds of its last change, it is compared by conditional updates of gauges.
+-- Default is evaluated for every existing row, so they get non-zero versions
+ALTER TABLE metric_storage ADD COLUMN IF NOT EXISTS version bigint NOT NULL DEFAULT (extract(epoch from clock_timestamp()) * 1000000000)::bigint;
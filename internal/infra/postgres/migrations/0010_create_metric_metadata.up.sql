@@ -0,0 +1,13 @@
+-- Metadata of metric names: owning type, unit and help text
+CREATE TABLE IF NOT EXISTS metric_metadata (
+    tenant varchar(64) NOT NULL DEFAULT 'default',
+    name varchar(50) NOT NULL,
+    type varchar(20) NOT NULL,
+    unit varchar(32) NOT NULL DEFAULT '',
+    help text NOT NULL DEFAULT '',
+    PRIMARY KEY (tenant, name)
+);
+-- Names stored with single type are owned by it, names stored with several types are claimed by the next write
+INSERT INTO metric_metadata (tenant, name, type)
+SELECT tenant, name, min(type) FROM metric_storage GROUP BY tenant, name HAVING count(DISTINCT type) = 1
+ON CONFLICT DO NOTHING;
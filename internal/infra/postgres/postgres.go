@@ -3,9 +3,13 @@
 package postgres
 
 import (
+	"cmp"
 	"context"
 	"errors"
+	"fmt"
 	"github.com/rs/zerolog/log"
+	"slices"
+	"strconv"
 	"time"
 
 	"github.com/jackc/pgerrcode"
@@ -17,68 +21,360 @@ import (
 )
 
 const (
-	sqlCreateTableQuery = `
-		CREATE TABLE IF NOT EXISTS metric_storage (
-			name varchar(50) NOT NULL,
-			type varchar(20) NOT NULL,
-			value double precision NOT NULL,
-			PRIMARY KEY (name, type)
-		);`
-	sqlAddMetricQuery     = `insert into metric_storage (name, type, value) values ($1, $2, $3) on conflict (name, type) do update set value = excluded.value;`
-	sqlGetMetricQuery     = `SELECT name, type, value FROM metric_storage WHERE name=$1 AND type=$2`
-	sqlGetAllMetricsQuery = `SELECT name, type, value FROM metric_storage`
+	// sqlNowVersion - version of series changed now, see entities.GaugeCondition
+	sqlNowVersion = `(extract(epoch from clock_timestamp()) * 1000000000)::bigint`
+	// Series belong to tenant passed as the last parameter of every query
+	sqlAddMetricQuery = `
+		WITH upsert AS (
+			insert into metric_storage (name, type, labels, value, delta, payload, tenant) values ($1, $2, $3, $4, $5, $6, $7)
+			on conflict (tenant, name, type, labels) do update set value = excluded.value, delta = excluded.delta, payload = excluded.payload, updated_at = now(),
+				version = greatest(` + sqlNowVersion + `, metric_storage.version + 1)
+			returning tenant, name, type, labels, value, delta, payload
+		)
+		insert into metric_history (tenant, name, type, labels, value, delta)
+		select tenant, name, type, labels, value, delta from upsert where payload is null;`
+	// Gauge is changed only if it satisfies condition: $5 - version it must be older than (0 - not checked),
+	// $6 - expected version, $7 - expected value. Update requires existing gauge, upsert creates it
+	sqlUpdateGaugeIfQuery = `
+		WITH updated AS (
+			UPDATE metric_storage SET value = $3, updated_at = now(), version = greatest(` + sqlNowVersion + `, $5, version + 1)
+			WHERE name=$1 AND type='gauge' AND labels=$2 AND tenant=$4
+				AND ($5 = 0 OR version < $5) AND ($6::bigint IS NULL OR version = $6) AND ($7::double precision IS NULL OR value = $7)
+			returning tenant, name, type, labels, value, delta, version
+		), history AS (
+			insert into metric_history (tenant, name, type, labels, value, delta) select tenant, name, type, labels, value, delta from updated
+		)
+		SELECT version FROM updated`
+	sqlUpsertGaugeIfQuery = `
+		WITH upsert AS (
+			insert into metric_storage (name, type, labels, value, tenant, version) values ($1, 'gauge', $2, $3, $4, greatest(` + sqlNowVersion + `, $5))
+			on conflict (tenant, name, type, labels) do update set value = excluded.value, updated_at = now(),
+				version = greatest(` + sqlNowVersion + `, $5, metric_storage.version + 1)
+			WHERE ($5 = 0 OR metric_storage.version < $5) AND ($6::bigint IS NULL OR metric_storage.version = $6)
+			returning tenant, name, type, labels, value, delta, version
+		), history AS (
+			insert into metric_history (tenant, name, type, labels, value, delta) select tenant, name, type, labels, value, delta from upsert
+		)
+		SELECT version FROM upsert`
+	// Distribution is inserted if series doesn't exist, otherwise stored payload is locked and merged
+	sqlInsertDistributionQuery = `
+		insert into metric_storage (name, type, labels, payload, tenant) values ($1, $2, $3, $4, $5)
+		on conflict (tenant, name, type, labels) do nothing
+		returning name`
+	sqlLockDistributionQuery   = `SELECT payload FROM metric_storage WHERE name=$1 AND type=$2 AND labels=$3 AND tenant=$4 FOR UPDATE`
+	sqlUpdateDistributionQuery = `UPDATE metric_storage SET payload = $4, updated_at = now() WHERE name=$1 AND type=$2 AND labels=$3 AND tenant=$5`
+	sqlIncrementCounterQuery   = `
+		WITH upsert AS (
+			insert into metric_storage (name, type, labels, delta, tenant) values ($1, 'counter', $2, $3, $4)
+			on conflict (tenant, name, type, labels) do update set delta = metric_storage.delta + excluded.delta, updated_at = now()
+			returning tenant, name, type, labels, value, delta
+		)
+		insert into metric_history (tenant, name, type, labels, value, delta) select tenant, name, type, labels, value, delta from upsert;`
+	sqlDeleteMetricQuery = `
+		WITH deleted AS (
+			DELETE FROM metric_storage WHERE name=$1 AND type=$2 AND labels=$3 AND tenant=$4
+			returning tenant, name, type, labels
+		), history AS (
+			DELETE FROM metric_history WHERE (tenant, name, type, labels) IN (SELECT tenant, name, type, labels FROM deleted)
+		), rollups AS (
+			DELETE FROM metric_rollups WHERE (tenant, name, labels) IN (SELECT tenant, name, labels FROM deleted WHERE type='gauge')
+		)
+		SELECT count(*) FROM deleted`
+	sqlResetCounterQuery = `
+		WITH reset AS (
+			UPDATE metric_storage SET delta = 0, updated_at = now() WHERE name=$1 AND type='counter' AND labels=$2 AND tenant=$3
+			returning tenant, name, type, labels, value, delta
+		), history AS (
+			insert into metric_history (tenant, name, type, labels, value, delta) select tenant, name, type, labels, value, delta from reset
+		)
+		SELECT count(*) FROM reset`
+	sqlGetMetricQuery = `SELECT name, type, labels, value, delta, payload, version FROM metric_storage WHERE name=$1 AND type=$2 AND labels=$3 AND tenant=$4`
+	// Equality matchers are passed as $1 to narrow selection, the rest of matchers are applied after query
+	sqlGetAllMetricsQuery    = `SELECT name, type, labels, value, delta, payload FROM metric_storage WHERE labels @> $1 AND tenant=$2`
+	sqlGetMetricHistoryQuery = `
+		SELECT created_at, value, delta FROM metric_history
+		WHERE name=$1 AND type=$2 AND labels=$3 AND created_at >= $4 AND created_at <= $5 AND tenant=$6
+		ORDER BY created_at`
+	sqlMergeRollupQuery = `
+		insert into metric_rollups (name, labels, resolution, bucket, min, max, sum, count, tenant) values ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		on conflict (tenant, name, labels, resolution, bucket) do update set
+			min = least(metric_rollups.min, excluded.min),
+			max = greatest(metric_rollups.max, excluded.max),
+			sum = metric_rollups.sum + excluded.sum,
+			count = metric_rollups.count + excluded.count`
+	// Retention reads all series and deletes expired ones or their old history
+	sqlGetSeriesUpdatesQuery = `SELECT tenant, name, type, labels, updated_at FROM metric_storage`
+	sqlGetTenantsQuery       = `SELECT tenant FROM metric_storage UNION SELECT tenant FROM metric_metadata ORDER BY tenant`
+	sqlPruneHistoryQuery     = `
+		WITH deleted AS (
+			DELETE FROM metric_history WHERE name=$1 AND type=$2 AND labels=$3 AND created_at < $4 AND tenant=$5
+			returning 1
+		)
+		SELECT count(*) FROM deleted`
+	sqlGetRollupsQuery = `
+		SELECT bucket, min, max, sum, count FROM metric_rollups
+		WHERE name=$1 AND labels=$2 AND resolution=$3 AND bucket >= $4 AND bucket <= $5 AND tenant=$6
+		ORDER BY bucket`
 )
 
-// NewClient creates postgresql pool connection
+// NewClient creates postgresql pool connection and applies pending migrations
 func NewClient(connectionDSN string) (*pgxpool.Pool, error) {
-	conn, err := pgxpool.New(context.Background(), connectionDSN)
+	conn, err := Open(connectionDSN)
 	if err != nil {
 		return nil, err
 	}
 
-	err = migrate(conn)
+	_, err = MigrateUp(context.Background(), conn)
 	if err != nil {
+		conn.Close()
 		return nil, err
 	}
 	return conn, nil
 }
 
+// Open creates postgresql pool connection without applying migrations
+func Open(connectionDSN string) (*pgxpool.Pool, error) {
+	return pgxpool.New(context.Background(), connectionDSN)
+}
+
 // PgRepository describes repository structure
 type PgRepository struct {
-	DB *pgxpool.Pool
+	DB      *pgxpool.Pool
+	Journal *Journal // Writes are journaled while database is unavailable, nil to fail them instead
 }
 
 // AddMetric allow to add metric to postgresql storage
-func (s *PgRepository) AddMetric(ctx context.Context, metric entities.MetricInternal) (err error) {
+func (s *PgRepository) AddMetric(ctx context.Context, metric entities.MetricInternal) error {
+	return s.write(ctx, journalRecord{Op: journalOpAdd, Metrics: []entities.MetricInternal{metric}})
+}
+
+// MergeMetric merges histogram or summary into value stored in postgresql
+func (s *PgRepository) MergeMetric(ctx context.Context, metric entities.MetricInternal) error {
+	return s.write(ctx, journalRecord{Op: journalOpMerge, Metrics: []entities.MetricInternal{metric}})
+}
+
+// IncrementCounter atomically adds delta to the counter stored in postgresql
+func (s *PgRepository) IncrementCounter(ctx context.Context, mName string, labels map[string]string, delta int64) error {
+	return s.write(ctx, journalRecord{Op: journalOpIncrement, ID: mName, Labels: labels, Delta: delta})
+}
+
+// AddMultipleMetrics allow to add multiple metrics to postgresql storage in one transaction
+func (s *PgRepository) AddMultipleMetrics(ctx context.Context, metrics []entities.MetricInternal) error {
+	return s.write(ctx, journalRecord{Op: journalOpBatch, Metrics: metrics})
+}
+
+// DeleteMetric removes metric and its history from postgresql.
+// While writes are journaled, existence of metric isn't checked
+func (s *PgRepository) DeleteMetric(ctx context.Context, mType, mName string, labels map[string]string) error {
+	return s.write(ctx, journalRecord{Op: journalOpDelete, MType: mType, ID: mName, Labels: labels})
+}
+
+// ResetCounter sets counter stored in postgresql to zero.
+// While writes are journaled, existence of counter isn't checked
+func (s *PgRepository) ResetCounter(ctx context.Context, mName string, labels map[string]string) error {
+	return s.write(ctx, journalRecord{Op: journalOpReset, ID: mName, Labels: labels})
+}
+
+// MergeRollups merges gauge rollups into buckets stored in postgresql
+func (s *PgRepository) MergeRollups(ctx context.Context, rollups []entities.RollupInternal) error {
+	return s.write(ctx, journalRecord{Op: journalOpRollups, Rollups: rollups})
+}
+
+// addMetric upserts metric in postgresql
+func (s *PgRepository) addMetric(ctx context.Context, metric entities.MetricInternal) (err error) {
+	value, delta, payload, err := columnValues(metric.MType, metric.Value)
+	if err != nil {
+		return err
+	}
+
 	nCtx, cancel := context.WithTimeout(ctx, 2*time.Second)
 	defer cancel()
 
 	err = s.retryOperation(func() error {
-		_, err = s.DB.Exec(nCtx, sqlAddMetricQuery, metric.ID, metric.MType, metric.Value)
+		_, err = s.DB.Exec(nCtx, sqlAddMetricQuery, metric.ID, metric.MType, labelsParam(metric.Labels), value, delta, payload, entities.TenantFromContext(nCtx))
 		return err
 	})
 	return err
 }
 
-// AddMultipleMetrics allow to add multiple metrics to postgresql storage
-func (s *PgRepository) AddMultipleMetrics(ctx context.Context, metrics []entities.MetricInternal) error {
+// UpdateGauge stores gauge in postgresql if it satisfies condition, returns version of stored value.
+// Condition depends on current value, so update isn't journaled: while journal is replayed it fails with entities.ErrStorageDegraded
+func (s *PgRepository) UpdateGauge(ctx context.Context, metric entities.MetricInternal, cond entities.GaugeCondition) (version int64, err error) {
+	if metric.MType != entities.Gauge {
+		return 0, entities.ErrMetricNotSupportedType
+	}
+	value, _, _, err := columnValues(metric.MType, metric.Value)
+	if err != nil {
+		return 0, err
+	}
+	var ts int64
+	if !cond.Timestamp.IsZero() {
+		ts = cond.Timestamp.UnixNano()
+	}
+	// Absent gauge satisfies condition, which doesn't require it to exist, so only such condition may create it.
+	// Such condition has no expected value, so upsert has no parameter for it
+	tenant := entities.TenantFromContext(ctx)
+	query, args := sqlUpdateGaugeIfQuery, []any{metric.ID, labelsParam(metric.Labels), value, tenant, ts, cond.Version, cond.Value}
+	if cond.Holds(false, 0, 0) {
+		query, args = sqlUpsertGaugeIfQuery, []any{metric.ID, labelsParam(metric.Labels), value, tenant, ts, cond.Version}
+	}
+
+	if s.Journal != nil && s.Journal.active() {
+		return 0, entities.ErrStorageDegraded
+	}
+
+	nCtx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+
+	err = s.retryOperation(func() error {
+		return s.DB.QueryRow(nCtx, query, args...).Scan(&version)
+	})
+	switch {
+	case errors.Is(err, pgx.ErrNoRows):
+		return 0, entities.ErrConditionFailed
+	case err != nil && s.Journal != nil && isUnavailableError(err):
+		s.Journal.degraded.Store(true)
+		return 0, fmt.Errorf("%w: %v", entities.ErrStorageDegraded, err)
+	case err != nil:
+		return 0, err
+	}
+	return version, nil
+}
+
+// mergeMetric merges histogram or summary into value stored in postgresql
+func (s *PgRepository) mergeMetric(ctx context.Context, metric entities.MetricInternal) error {
+	if !entities.IsDistribution(metric.MType) {
+		return entities.ErrMetricNotSupportedType
+	}
+	if metric.Value == "" {
+		return entities.ErrMissingField
+	}
+
+	nCtx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+
+	return s.retryOperation(func() error {
+		tx, err := s.DB.Begin(nCtx)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			_ = tx.Rollback(nCtx)
+		}()
+
+		if err = mergeDistribution(nCtx, tx, metric); err != nil {
+			return err
+		}
+		return tx.Commit(nCtx)
+	})
+}
+
+// mergeDistribution merges histogram or summary into stored value inside transaction
+func mergeDistribution(ctx context.Context, tx pgx.Tx, metric entities.MetricInternal) error {
+	d, err := entities.ParseDistribution(metric.MType, metric.Value)
+	if err != nil {
+		return err
+	}
+	labels := labelsParam(metric.Labels)
+	tenant := entities.TenantFromContext(ctx)
+
+	var name string
+	err = tx.QueryRow(ctx, sqlInsertDistributionQuery, metric.ID, metric.MType, labels, metric.Value, tenant).Scan(&name)
+	if err == nil {
+		return nil
+	}
+	if !errors.Is(err, pgx.ErrNoRows) {
+		return err
+	}
+
+	var payload string
+	if err = tx.QueryRow(ctx, sqlLockDistributionQuery, metric.ID, metric.MType, labels, tenant).Scan(&payload); err != nil {
+		return err
+	}
+	stored, err := entities.ParseDistribution(metric.MType, payload)
+	if err != nil {
+		return err
+	}
+	if err = stored.Merge(d); err != nil {
+		return err
+	}
+	if payload, err = entities.FormatDistribution(stored); err != nil {
+		return err
+	}
+	_, err = tx.Exec(ctx, sqlUpdateDistributionQuery, metric.ID, metric.MType, labels, payload, tenant)
+	return err
+}
+
+// incrementCounter atomically adds delta to the counter stored in postgresql
+func (s *PgRepository) incrementCounter(ctx context.Context, mName string, labels map[string]string, delta int64) (err error) {
+	nCtx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+
+	err = s.retryOperation(func() error {
+		_, err = s.DB.Exec(nCtx, sqlIncrementCounterQuery, mName, labelsParam(labels), delta, entities.TenantFromContext(nCtx))
+		return err
+	})
+	return err
+}
+
+// addMultipleMetrics stores metrics in one transaction.
+// Gauges and counters are sent in one pgx.Batch, so whole request takes a single round trip
+// instead of one per metric. Statements of the batch are executed in order, so repeated
+// counter updates accumulate the same way as separate IncrementCounter calls
+func (s *PgRepository) addMultipleMetrics(ctx context.Context, metrics []entities.MetricInternal) error {
 	nCtx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
 
+	// Values are converted before the transaction, so invalid request doesn't touch database
+	type queued struct {
+		sql  string
+		args []any
+	}
+	tenant := entities.TenantFromContext(nCtx)
+	var (
+		updates       []queued
+		distributions []entities.MetricInternal
+	)
+	for _, metric := range sortedForLocking(metrics) {
+		value, delta, _, err := columnValues(metric.MType, metric.Value)
+		if err != nil {
+			return err
+		}
+
+		switch metric.MType {
+		case entities.Counter:
+			updates = append(updates, queued{sqlIncrementCounterQuery, []any{metric.ID, labelsParam(metric.Labels), delta, tenant}})
+		case entities.Histogram, entities.Summary:
+			distributions = append(distributions, metric)
+		default:
+			updates = append(updates, queued{sqlAddMetricQuery, []any{metric.ID, metric.MType, labelsParam(metric.Labels), value, delta, nil, tenant}})
+		}
+	}
+
 	err := s.retryOperation(func() error {
 		tx, err := s.DB.Begin(nCtx)
 		if err != nil {
 			return err
 		}
 		defer func() {
-			if err = tx.Rollback(nCtx); err != nil {
+			if err = tx.Rollback(nCtx); err != nil && !errors.Is(err, pgx.ErrTxClosed) {
 				log.Error().Err(err).Msg("Failed rollback transaction")
 			}
 		}()
 
-		for _, metric := range metrics {
-			_, err = tx.Exec(nCtx, sqlAddMetricQuery, metric.ID, metric.MType, metric.Value)
-			if err != nil {
+		// Batch is built on every attempt: it caches statements of the connection it was sent on
+		if len(updates) > 0 {
+			batch := &pgx.Batch{}
+			for _, u := range updates {
+				batch.Queue(u.sql, u.args...)
+			}
+			if err = tx.SendBatch(nCtx, batch).Close(); err != nil {
+				return err
+			}
+		}
+		// Distributions are merged with stored payload, which requires reading it first
+		for _, metric := range distributions {
+			if err = mergeDistribution(nCtx, tx, metric); err != nil {
 				return err
 			}
 		}
@@ -90,58 +386,326 @@ func (s *PgRepository) AddMultipleMetrics(ctx context.Context, metrics []entitie
 	return err
 }
 
-// GetMetric allow to get metrics from storage
-func (s *PgRepository) GetMetric(ctx context.Context, mType, mName string) (metric entities.MetricInternal, err error) {
+// sortedForLocking returns copy of metrics ordered by type, name and labels.
+// Concurrent batches lock rows in the same order, so they wait for each other instead of deadlocking.
+// Sort is stable to keep order of updates of the same series
+func sortedForLocking(metrics []entities.MetricInternal) []entities.MetricInternal {
+	sorted := slices.Clone(metrics)
+	slices.SortStableFunc(sorted, func(a, b entities.MetricInternal) int {
+		return cmp.Or(
+			cmp.Compare(a.MType, b.MType),
+			cmp.Compare(a.ID, b.ID),
+			cmp.Compare(entities.LabelsKey(a.Labels), entities.LabelsKey(b.Labels)),
+		)
+	})
+	return sorted
+}
+
+// deleteMetric removes metric and its history from postgresql
+func (s *PgRepository) deleteMetric(ctx context.Context, mType, mName string, labels map[string]string) (err error) {
+	if !entities.IsKnownType(mType) {
+		return entities.ErrMetricNotSupportedType
+	}
+
 	nCtx, cancel := context.WithTimeout(ctx, 2*time.Second)
 	defer cancel()
 
-	var m entities.MetricInternal
-	row := s.DB.QueryRow(nCtx, sqlGetMetricQuery, mName, mType)
-
+	var deleted int64
 	err = s.retryOperation(func() error {
-		err = row.Scan(&m.ID, &m.MType, &m.Value)
+		return s.DB.QueryRow(nCtx, sqlDeleteMetricQuery, mName, mType, labelsParam(labels), entities.TenantFromContext(nCtx)).Scan(&deleted)
+	})
+	if err != nil {
 		return err
+	}
+	if deleted == 0 {
+		return entities.ErrMetricNotFound
+	}
+	return nil
+}
+
+// resetCounter sets counter stored in postgresql to zero
+func (s *PgRepository) resetCounter(ctx context.Context, mName string, labels map[string]string) (err error) {
+	nCtx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+
+	var reset int64
+	err = s.retryOperation(func() error {
+		return s.DB.QueryRow(nCtx, sqlResetCounterQuery, mName, labelsParam(labels), entities.TenantFromContext(nCtx)).Scan(&reset)
 	})
+	if err != nil {
+		return err
+	}
+	if reset == 0 {
+		return entities.ErrMetricNotFound
+	}
+	return nil
+}
+
+// GetMetric allow to get metrics from storage
+func (s *PgRepository) GetMetric(ctx context.Context, mType, mName string, labels map[string]string) (metric entities.MetricInternal, err error) {
+	if !entities.IsKnownType(mType) {
+		return entities.MetricInternal{}, entities.ErrMetricNotSupportedType
+	}
 
+	nCtx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+
+	var m entities.MetricInternal
+	var value *float64
+	var delta *int64
+	var payload *string
+	err = s.retryOperation(func() error {
+		return s.DB.QueryRow(nCtx, sqlGetMetricQuery, mName, mType, labelsParam(labels), entities.TenantFromContext(nCtx)).
+			Scan(&m.ID, &m.MType, &m.Labels, &value, &delta, &payload, &m.Version)
+	})
+	if errors.Is(err, pgx.ErrNoRows) {
+		return entities.MetricInternal{}, entities.ErrMetricNotFound
+	}
 	if err != nil {
 		return entities.MetricInternal{}, err
 	}
 
+	m.Value = internalValue(m.MType, value, delta, payload)
+	m.Labels = entities.CloneLabels(m.Labels)
+	if m.MType != entities.Gauge {
+		m.Version = 0
+	}
 	return m, nil
 }
 
-// GetAllMetrics allow to get all metrics from postgresql
-func (s *PgRepository) GetAllMetrics(ctx context.Context) (metrics []entities.MetricInternal, err error) {
+// GetAllMetrics allow to get all metrics, which labels satisfy matchers, from postgresql
+func (s *PgRepository) GetAllMetrics(ctx context.Context, matchers []entities.LabelMatcher) (metrics []entities.MetricInternal, err error) {
 	nCtx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
 
 	var rows pgx.Rows
 	err = s.retryOperation(func() error {
-		tRows, e := s.DB.Query(nCtx, sqlGetAllMetricsQuery)
+		tRows, e := s.DB.Query(nCtx, sqlGetAllMetricsQuery, equalLabels(matchers), entities.TenantFromContext(nCtx))
 		rows = tRows
 		return e
 	})
 	if err != nil {
 		return []entities.MetricInternal{}, err
 	}
+	defer rows.Close()
 
 	for rows.Next() {
 		var mSQL entities.MetricInternal
+		var value *float64
+		var delta *int64
+		var payload *string
 
-		err := rows.Scan(&mSQL.ID, &mSQL.MType, &mSQL.Value)
+		err := rows.Scan(&mSQL.ID, &mSQL.MType, &mSQL.Labels, &value, &delta, &payload)
 		if err != nil {
 			return []entities.MetricInternal{}, err
 		}
+		if !entities.MatchLabels(mSQL.Labels, matchers) {
+			continue
+		}
+		mSQL.Value = internalValue(mSQL.MType, value, delta, payload)
+		mSQL.Labels = entities.CloneLabels(mSQL.Labels)
 		metrics = append(metrics, mSQL)
 	}
-	return metrics, nil
+	return metrics, rows.Err()
 }
 
-// Ping - check connection to database
+// GetMetricHistory allow to get metric values stored between from and to
+func (s *PgRepository) GetMetricHistory(ctx context.Context, mType, mName string, labels map[string]string, from, to time.Time) (points []entities.MetricPointInternal, err error) {
+	if mType != entities.Gauge && mType != entities.Counter {
+		return nil, entities.ErrMetricNotSupportedType
+	}
+
+	nCtx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	var rows pgx.Rows
+	err = s.retryOperation(func() error {
+		tRows, e := s.DB.Query(nCtx, sqlGetMetricHistoryQuery, mName, mType, labelsParam(labels), from, to, entities.TenantFromContext(nCtx))
+		rows = tRows
+		return e
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var p entities.MetricPointInternal
+		var value *float64
+		var delta *int64
+
+		err := rows.Scan(&p.Timestamp, &value, &delta)
+		if err != nil {
+			return nil, err
+		}
+		p.Value = internalValue(mType, value, delta, nil)
+		points = append(points, p)
+	}
+	return points, rows.Err()
+}
+
+// mergeRollups merges gauge rollups into buckets stored in postgresql
+func (s *PgRepository) mergeRollups(ctx context.Context, rollups []entities.RollupInternal) error {
+	for _, r := range rollups {
+		if _, err := entities.ResolutionOf(r.Step); err != nil {
+			return err
+		}
+	}
+
+	nCtx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	return s.retryOperation(func() error {
+		tx, err := s.DB.Begin(nCtx)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			_ = tx.Rollback(nCtx)
+		}()
+
+		tenant := entities.TenantFromContext(nCtx)
+		for _, r := range rollups {
+			_, err = tx.Exec(nCtx, sqlMergeRollupQuery,
+				r.ID, labelsParam(r.Labels), int64(r.Step/time.Second), r.Bucket, r.Min, r.Max, r.Sum, int64(r.Count), tenant)
+			if err != nil {
+				return err
+			}
+		}
+		return tx.Commit(nCtx)
+	})
+}
+
+// GetRollups allow to get gauge rollups of resolution step, which buckets start between from and to
+func (s *PgRepository) GetRollups(ctx context.Context, mName string, labels map[string]string, step time.Duration, from, to time.Time) (rollups []entities.RollupInternal, err error) {
+	if _, err = entities.ResolutionOf(step); err != nil {
+		return nil, err
+	}
+
+	nCtx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	var rows pgx.Rows
+	err = s.retryOperation(func() error {
+		tRows, e := s.DB.Query(nCtx, sqlGetRollupsQuery, mName, labelsParam(labels), int64(step/time.Second), from, to, entities.TenantFromContext(nCtx))
+		rows = tRows
+		return e
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		r := entities.RollupInternal{ID: mName, Labels: entities.CloneLabels(labels), Step: step}
+		var count int64
+		if err := rows.Scan(&r.Bucket, &r.Min, &r.Max, &r.Sum, &count); err != nil {
+			return nil, err
+		}
+		r.Count = uint64(count)
+		rollups = append(rollups, r)
+	}
+	return rollups, rows.Err()
+}
+
+// Prune applies retention rules to metrics of all tenants
+func (s *PgRepository) Prune(ctx context.Context, rules []entities.RetentionRule, now time.Time) (report entities.PruneReport, err error) {
+	nCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	var rows pgx.Rows
+	err = s.retryOperation(func() error {
+		tRows, e := s.DB.Query(nCtx, sqlGetSeriesUpdatesQuery)
+		rows = tRows
+		return e
+	})
+	if err != nil {
+		return entities.PruneReport{}, err
+	}
+
+	batch := &pgx.Batch{}
+	var deletes []bool // Kind of every queued query: series deletion or history pruning
+	for rows.Next() {
+		var tenant, name, mType string
+		var labels map[string]string
+		var updated time.Time
+		if err = rows.Scan(&tenant, &name, &mType, &labels, &updated); err != nil {
+			rows.Close()
+			return entities.PruneReport{}, err
+		}
+
+		rule, ok := entities.RetentionRuleFor(rules, mType, name)
+		switch {
+		case !ok:
+		case rule.TTL > 0 && updated.Before(now.Add(-rule.TTL)):
+			batch.Queue(sqlDeleteMetricQuery, name, mType, labels, tenant)
+			deletes = append(deletes, true)
+		case rule.History > 0:
+			batch.Queue(sqlPruneHistoryQuery, name, mType, labels, now.Add(-rule.History), tenant)
+			deletes = append(deletes, false)
+		}
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return entities.PruneReport{}, err
+	}
+	if batch.Len() == 0 {
+		return report, nil
+	}
+
+	results := s.DB.SendBatch(nCtx, batch)
+	defer func() {
+		if cErr := results.Close(); err == nil {
+			err = cErr
+		}
+	}()
+	for _, isDelete := range deletes {
+		var n int
+		if err = results.QueryRow().Scan(&n); err != nil {
+			return entities.PruneReport{}, err
+		}
+		if isDelete {
+			report.Series += n
+		} else {
+			report.HistoryPoints += n
+		}
+	}
+	return report, nil
+}
+
+// Tenants returns tenants having stored metrics or metadata
+func (s *PgRepository) Tenants(ctx context.Context) (tenants []string, err error) {
+	nCtx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+
+	rows, err := s.DB.Query(nCtx, sqlGetTenantsQuery)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var tenant string
+		if err = rows.Scan(&tenant); err != nil {
+			return nil, err
+		}
+		tenants = append(tenants, tenant)
+	}
+	return tenants, rows.Err()
+}
+
+// Ping - check connection to database.
+// With journal, unavailable database is reported as entities.ErrStorageDegraded: writes are still accepted
 func (s *PgRepository) Ping(ctx context.Context) (err error) {
 	nCtx, cancel := context.WithTimeout(ctx, time.Second)
 	defer cancel()
-	return s.DB.Ping(nCtx)
+
+	err = s.DB.Ping(nCtx)
+	if err != nil && s.Journal != nil {
+		s.Journal.degraded.Store(true)
+		return fmt.Errorf("%w: %v", entities.ErrStorageDegraded, err)
+	}
+	return err
 }
 
 func isRetriableError(err error) bool {
@@ -161,38 +725,84 @@ func isRetriableError(err error) bool {
 	return false
 }
 
-func migrate(db *pgxpool.Pool) error {
-	ctx := context.Background()
-	tx, err := db.Begin(ctx)
-	if err != nil {
-		return err
+// columnValues converts internal string value to the column matching metric type:
+// counters are stored in exact `delta bigint`, gauges in `value double precision`,
+// histograms and summaries in `payload jsonb`
+func columnValues(mType, mValue string) (value *float64, delta *int64, payload *string, err error) {
+	if mValue == "" && entities.IsKnownType(mType) {
+		return nil, nil, nil, entities.ErrMissingField
 	}
-	defer func() {
-		if e := tx.Rollback(ctx); e != nil {
-			log.Error().Err(e).Msg("Failed rollback transaction")
+	switch mType {
+	case entities.Counter:
+		d, err := strconv.ParseInt(mValue, 10, 64)
+		if err != nil {
+			return nil, nil, nil, err
 		}
-	}()
+		return nil, &d, nil, nil
+	case entities.Gauge:
+		v, err := strconv.ParseFloat(mValue, 64)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		return &v, nil, nil, nil
+	case entities.Histogram, entities.Summary:
+		if _, err := entities.ParseDistribution(mType, mValue); err != nil {
+			return nil, nil, nil, err
+		}
+		return nil, nil, &mValue, nil
+	default:
+		return nil, nil, nil, entities.ErrMetricNotSupportedType
+	}
+}
 
-	_, err = tx.Exec(ctx, sqlCreateTableQuery)
-	if err != nil {
-		return err
+// labelsParam returns labels for jsonb parameter: metric without labels is stored with empty object
+func labelsParam(labels map[string]string) map[string]string {
+	if labels == nil {
+		return map[string]string{}
+	}
+	return labels
+}
+
+// equalLabels returns labels, which must be present according to equality matchers.
+// Equality with empty value means absent label, so such matchers are skipped
+func equalLabels(matchers []entities.LabelMatcher) map[string]string {
+	res := make(map[string]string)
+	for _, m := range matchers {
+		if m.Type == entities.MatchEqual && m.Value != "" {
+			res[m.Name] = m.Value
+		}
 	}
+	return res
+}
 
-	err = tx.Commit(ctx)
-	return err
+// internalValue converts column values back to internal string representation
+func internalValue(mType string, value *float64, delta *int64, payload *string) string {
+	switch {
+	case entities.IsDistribution(mType) && payload != nil:
+		return *payload
+	case mType == entities.Counter && delta != nil:
+		return strconv.FormatInt(*delta, 10)
+	case value != nil:
+		return strconv.FormatFloat(*value, 'g', -1, 64)
+	default:
+		return ""
+	}
 }
 
+// retryOperation runs f again after retriable errors. With journal, f is run once:
+// write failed because of database is journaled, so request isn't delayed by retries
 func (s *PgRepository) retryOperation(f func() error) error {
 	const maxRetries = 3
 	var retryInterval = []time.Duration{1 * time.Second, 3 * time.Second, 5 * time.Second}
 
+	var err error
 	for i := 0; i <= maxRetries; i++ {
-		err := f()
+		err = f()
 		if err == nil {
 			return nil
 		}
 
-		if !isRetriableError(err) {
+		if !isRetriableError(err) || s.Journal != nil {
 			return err
 		}
 
@@ -200,5 +810,5 @@ func (s *PgRepository) retryOperation(f func() error) error {
 			time.Sleep(retryInterval[i])
 		}
 	}
-	return nil
+	return err
 }
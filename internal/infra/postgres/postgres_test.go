@@ -0,0 +1,439 @@
+package postgres
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/melkomukovki/go-musthave-metrics/internal/entities"
+	"github.com/melkomukovki/go-musthave-metrics/internal/infra/storagetest"
+	"github.com/melkomukovki/go-musthave-metrics/internal/services"
+)
+
+// newTestRepository connects to database from TEST_DATABASE_DSN. Test is skipped if variable is empty,
+// but fails in CI, where database must be configured
+func newTestRepository(t testing.TB) *PgRepository {
+	t.Helper()
+
+	dsn := os.Getenv("TEST_DATABASE_DSN")
+	if dsn == "" && os.Getenv("CI") != "" {
+		t.Fatal("TEST_DATABASE_DSN must be set in CI")
+	}
+	if dsn == "" {
+		t.Skip("TEST_DATABASE_DSN is not set")
+	}
+
+	pool, err := NewClient(dsn)
+	require.NoError(t, err)
+	t.Cleanup(pool.Close)
+
+	return &PgRepository{DB: pool}
+}
+
+func TestPgRepository_IncrementCounterConcurrent(t *testing.T) {
+	const (
+		workers    = 20
+		increments = 50
+		metricName = "TestConcurrentCounter"
+	)
+
+	repo := newTestRepository(t)
+	ctx := context.Background()
+
+	_, err := repo.DB.Exec(ctx, `DELETE FROM metric_storage WHERE name=$1`, metricName)
+	require.NoError(t, err)
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < increments; j++ {
+				assert.NoError(t, repo.IncrementCounter(ctx, metricName, nil, 1))
+				assert.NoError(t, repo.AddMultipleMetrics(ctx, []entities.MetricInternal{
+					{ID: metricName, MType: entities.Counter, Value: "2"},
+				}))
+			}
+		}()
+	}
+	wg.Wait()
+
+	metric, err := repo.GetMetric(ctx, entities.Counter, metricName, nil)
+	require.NoError(t, err)
+	assert.Equal(t, "3000", metric.Value)
+}
+
+func TestPgRepository_AddMultipleMetricsBatch(t *testing.T) {
+	const metricName = "TestBatch"
+
+	repo := newTestRepository(t)
+	ctx := context.Background()
+
+	_, err := repo.DB.Exec(ctx, `DELETE FROM metric_storage WHERE name LIKE $1`, metricName+"%")
+	require.NoError(t, err)
+
+	hostA := map[string]string{"host": "a"}
+	require.NoError(t, repo.AddMultipleMetrics(ctx, []entities.MetricInternal{
+		{ID: metricName + "Counter", MType: entities.Counter, Value: "1"},
+		{ID: metricName + "Gauge", MType: entities.Gauge, Value: "1.5"},
+		{ID: metricName + "Counter", MType: entities.Counter, Value: "2", Labels: hostA},
+		{ID: metricName + "Counter", MType: entities.Counter, Value: "3"},
+		{ID: metricName + "Gauge", MType: entities.Gauge, Value: "2.5"},
+	}))
+
+	metric, err := repo.GetMetric(ctx, entities.Counter, metricName+"Counter", nil)
+	require.NoError(t, err)
+	assert.Equal(t, "4", metric.Value)
+	metric, err = repo.GetMetric(ctx, entities.Counter, metricName+"Counter", hostA)
+	require.NoError(t, err)
+	assert.Equal(t, "2", metric.Value)
+	metric, err = repo.GetMetric(ctx, entities.Gauge, metricName+"Gauge", nil)
+	require.NoError(t, err)
+	assert.Equal(t, "2.5", metric.Value, "last value of the batch wins")
+
+	var history int
+	require.NoError(t, repo.DB.QueryRow(ctx, `SELECT count(*) FROM metric_history WHERE name LIKE $1`, metricName+"%").Scan(&history))
+	assert.Equal(t, 5, history)
+
+	// Invalid metric rejects whole batch
+	err = repo.AddMultipleMetrics(ctx, []entities.MetricInternal{
+		{ID: metricName + "Counter", MType: entities.Counter, Value: "1"},
+		{ID: metricName + "Counter", MType: entities.Counter, Value: "1.5"},
+	})
+	assert.Error(t, err)
+	metric, err = repo.GetMetric(ctx, entities.Counter, metricName+"Counter", nil)
+	require.NoError(t, err)
+	assert.Equal(t, "4", metric.Value)
+}
+
+// addMultipleMetricsLoop is previous implementation of AddMultipleMetrics with one query per metric,
+// kept to compare with batched version
+func addMultipleMetricsLoop(ctx context.Context, s *PgRepository, metrics []entities.MetricInternal) error {
+	tx, err := s.DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = tx.Rollback(ctx)
+	}()
+
+	tenant := entities.TenantFromContext(ctx)
+	for _, metric := range metrics {
+		value, delta, _, err := columnValues(metric.MType, metric.Value)
+		if err != nil {
+			return err
+		}
+		if metric.MType == entities.Counter {
+			_, err = tx.Exec(ctx, sqlIncrementCounterQuery, metric.ID, labelsParam(metric.Labels), delta, tenant)
+		} else {
+			_, err = tx.Exec(ctx, sqlAddMetricQuery, metric.ID, metric.MType, labelsParam(metric.Labels), value, delta, nil, tenant)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit(ctx)
+}
+
+func BenchmarkAddMultipleMetrics(b *testing.B) {
+	repo := newTestRepository(b)
+	ctx := entities.ContextWithTenant(context.Background(), "benchmark")
+
+	implementations := map[string]func(ctx context.Context, metrics []entities.MetricInternal) error{
+		"Loop": func(ctx context.Context, metrics []entities.MetricInternal) error {
+			return addMultipleMetricsLoop(ctx, repo, metrics)
+		},
+		"Batch": repo.AddMultipleMetrics,
+	}
+
+	for _, size := range []int{10, 100, 1000} {
+		metrics := make([]entities.MetricInternal, 0, size)
+		for i := 0; i < size; i++ {
+			if i%2 == 0 {
+				metrics = append(metrics, entities.MetricInternal{ID: fmt.Sprintf("BenchGauge%d", i), MType: entities.Gauge, Value: "1.5"})
+			} else {
+				metrics = append(metrics, entities.MetricInternal{ID: fmt.Sprintf("BenchCounter%d", i), MType: entities.Counter, Value: "1"})
+			}
+		}
+
+		for _, name := range []string{"Loop", "Batch"} {
+			add := implementations[name]
+			b.Run(fmt.Sprintf("%s/%d", name, size), func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					if err := add(ctx, metrics); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+
+	_, err := repo.DB.Exec(ctx, `DELETE FROM metric_storage WHERE tenant=$1`, "benchmark")
+	require.NoError(b, err)
+	_, err = repo.DB.Exec(ctx, `DELETE FROM metric_history WHERE tenant=$1`, "benchmark")
+	require.NoError(b, err)
+}
+
+func TestPgRepository_DeleteAndReset(t *testing.T) {
+	const metricName = "TestDeleteAndReset"
+
+	repo := newTestRepository(t)
+	ctx := context.Background()
+
+	require.NoError(t, repo.IncrementCounter(ctx, metricName, nil, 5))
+	require.NoError(t, repo.ResetCounter(ctx, metricName, nil))
+
+	metric, err := repo.GetMetric(ctx, entities.Counter, metricName, nil)
+	require.NoError(t, err)
+	assert.Equal(t, "0", metric.Value)
+
+	require.NoError(t, repo.DeleteMetric(ctx, entities.Counter, metricName, nil))
+	assert.ErrorIs(t, repo.DeleteMetric(ctx, entities.Counter, metricName, nil), entities.ErrMetricNotFound)
+	assert.ErrorIs(t, repo.ResetCounter(ctx, metricName, nil), entities.ErrMetricNotFound)
+
+	var history int
+	require.NoError(t, repo.DB.QueryRow(ctx, `SELECT count(*) FROM metric_history WHERE name=$1`, metricName).Scan(&history))
+	assert.Zero(t, history)
+}
+
+func TestPgRepository_Labels(t *testing.T) {
+	const metricName = "TestLabels"
+
+	repo := newTestRepository(t)
+	ctx := context.Background()
+
+	_, err := repo.DB.Exec(ctx, `DELETE FROM metric_storage WHERE name=$1`, metricName)
+	require.NoError(t, err)
+
+	hostA := map[string]string{"host": "a"}
+	hostB := map[string]string{"host": "b"}
+	require.NoError(t, repo.IncrementCounter(ctx, metricName, hostA, 1))
+	require.NoError(t, repo.IncrementCounter(ctx, metricName, hostB, 2))
+	require.NoError(t, repo.IncrementCounter(ctx, metricName, nil, 3))
+
+	metric, err := repo.GetMetric(ctx, entities.Counter, metricName, hostB)
+	require.NoError(t, err)
+	assert.Equal(t, "2", metric.Value)
+	assert.Equal(t, hostB, metric.Labels)
+
+	metric, err = repo.GetMetric(ctx, entities.Counter, metricName, nil)
+	require.NoError(t, err)
+	assert.Equal(t, "3", metric.Value)
+	assert.Nil(t, metric.Labels)
+
+	matcher, err := entities.ParseLabelMatcher("host=a")
+	require.NoError(t, err)
+	metrics, err := repo.GetAllMetrics(ctx, []entities.LabelMatcher{matcher})
+	require.NoError(t, err)
+	require.Len(t, metrics, 1)
+	assert.Equal(t, "1", metrics[0].Value)
+}
+
+func TestPgRepository_Tenants(t *testing.T) {
+	const metricName = "TestTenants"
+
+	repo := newTestRepository(t)
+	teamA := entities.ContextWithTenant(context.Background(), "team-a")
+	teamB := entities.ContextWithTenant(context.Background(), "team-b")
+
+	_, err := repo.DB.Exec(teamA, `DELETE FROM metric_storage WHERE name=$1`, metricName)
+	require.NoError(t, err)
+
+	require.NoError(t, repo.AddMetric(teamA, entities.MetricInternal{ID: metricName, MType: entities.Gauge, Value: "1"}))
+	require.NoError(t, repo.AddMetric(teamB, entities.MetricInternal{ID: metricName, MType: entities.Gauge, Value: "2"}))
+
+	metric, err := repo.GetMetric(teamA, entities.Gauge, metricName, nil)
+	require.NoError(t, err)
+	assert.Equal(t, "1", metric.Value)
+
+	require.NoError(t, repo.DeleteMetric(teamB, entities.Gauge, metricName, nil))
+	assert.ErrorIs(t, repo.DeleteMetric(teamB, entities.Gauge, metricName, nil), entities.ErrMetricNotFound)
+
+	metric, err = repo.GetMetric(teamA, entities.Gauge, metricName, nil)
+	require.NoError(t, err)
+	assert.Equal(t, "1", metric.Value)
+}
+
+func TestPgRepository_MergeDistribution(t *testing.T) {
+	const metricName = "TestMergeDistribution"
+
+	repo := newTestRepository(t)
+	ctx := context.Background()
+
+	_, err := repo.DB.Exec(ctx, `DELETE FROM metric_storage WHERE name=$1`, metricName)
+	require.NoError(t, err)
+
+	report := entities.MetricInternal{ID: metricName, MType: entities.Histogram, Value: `{"bounds":[1],"counts":[1,0],"sum":0.5,"count":1}`}
+	require.NoError(t, repo.MergeMetric(ctx, report))
+	require.NoError(t, repo.AddMultipleMetrics(ctx, []entities.MetricInternal{report, report}))
+
+	mismatched := entities.MetricInternal{ID: metricName, MType: entities.Histogram, Value: `{"bounds":[2],"counts":[0,0],"sum":0,"count":0}`}
+	assert.ErrorIs(t, repo.MergeMetric(ctx, mismatched), entities.ErrDistributionMismatch)
+
+	metric, err := repo.GetMetric(ctx, entities.Histogram, metricName, nil)
+	require.NoError(t, err)
+	d, err := entities.ParseDistribution(entities.Histogram, metric.Value)
+	require.NoError(t, err)
+	assert.Equal(t, []uint64{3, 0}, d.(*entities.HistogramValue).Counts)
+}
+
+func TestPgRepository_Rollups(t *testing.T) {
+	const metricName = "TestRollups"
+
+	repo := newTestRepository(t)
+	ctx := context.Background()
+
+	_, err := repo.DB.Exec(ctx, `DELETE FROM metric_rollups WHERE name=$1`, metricName)
+	require.NoError(t, err)
+
+	start := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	require.NoError(t, repo.MergeRollups(ctx, []entities.RollupInternal{
+		entities.NewRollup(metricName, nil, time.Minute, start, 5),
+		entities.NewRollup(metricName, nil, time.Hour, start, 5),
+	}))
+	require.NoError(t, repo.MergeRollups(ctx, []entities.RollupInternal{
+		entities.NewRollup(metricName, nil, time.Minute, start.Add(30*time.Second), 1),
+	}))
+
+	rollups, err := repo.GetRollups(ctx, metricName, nil, time.Minute, start, start.Add(time.Hour))
+	require.NoError(t, err)
+	require.Len(t, rollups, 1)
+	assert.Equal(t, 1.0, rollups[0].Min)
+	assert.Equal(t, 5.0, rollups[0].Max)
+	assert.Equal(t, 6.0, rollups[0].Sum)
+	assert.EqualValues(t, 2, rollups[0].Count)
+	assert.True(t, rollups[0].Bucket.Equal(start))
+}
+
+func TestPgRepository_Prune(t *testing.T) {
+	const metricName = "TestPrune"
+
+	repo := newTestRepository(t)
+	ctx := context.Background()
+
+	_, err := repo.DB.Exec(ctx, `DELETE FROM metric_storage WHERE name LIKE $1`, metricName+"%")
+	require.NoError(t, err)
+
+	require.NoError(t, repo.AddMetric(ctx, entities.MetricInternal{ID: metricName + "Gauge", MType: entities.Gauge, Value: "1"}))
+	require.NoError(t, repo.IncrementCounter(ctx, metricName+"Counter", nil, 1))
+	require.NoError(t, repo.IncrementCounter(ctx, metricName+"Counter", nil, 1))
+
+	rules, err := entities.ParseRetentionRules("name=TestPruneGauge,ttl=1h;name=TestPruneCounter,history=1h")
+	require.NoError(t, err)
+
+	report, err := repo.Prune(ctx, rules, time.Now().Add(2*time.Hour))
+	require.NoError(t, err)
+	assert.Equal(t, entities.PruneReport{Series: 1, HistoryPoints: 2}, report)
+
+	_, err = repo.GetMetric(ctx, entities.Gauge, metricName+"Gauge", nil)
+	assert.Error(t, err)
+	metric, err := repo.GetMetric(ctx, entities.Counter, metricName+"Counter", nil)
+	require.NoError(t, err)
+	assert.Equal(t, "2", metric.Value)
+}
+
+func TestEqualLabels(t *testing.T) {
+	var matchers []entities.LabelMatcher
+	for _, s := range []string{"host=a", "cpu=~1|2", "dc!=eu", "rack="} {
+		m, err := entities.ParseLabelMatcher(s)
+		require.NoError(t, err)
+		matchers = append(matchers, m)
+	}
+
+	assert.Equal(t, map[string]string{"host": "a"}, equalLabels(matchers))
+	assert.Equal(t, map[string]string{}, equalLabels(nil))
+}
+
+func TestSortedForLocking(t *testing.T) {
+	metrics := []entities.MetricInternal{
+		{ID: "b", MType: entities.Gauge, Value: "1"},
+		{ID: "a", MType: entities.Gauge, Value: "2", Labels: map[string]string{"host": "b"}},
+		{ID: "a", MType: entities.Counter, Value: "3"},
+		{ID: "a", MType: entities.Gauge, Value: "4", Labels: map[string]string{"host": "a"}},
+		{ID: "a", MType: entities.Gauge, Value: "5", Labels: map[string]string{"host": "b"}},
+	}
+
+	var values []string
+	for _, m := range sortedForLocking(metrics) {
+		values = append(values, m.Value)
+	}
+	assert.Equal(t, []string{"3", "4", "2", "5", "1"}, values)
+	assert.Equal(t, "1", metrics[0].Value, "input is not modified")
+}
+
+func TestColumnValues(t *testing.T) {
+	tests := []struct {
+		name  string
+		mType string
+		value string
+	}{
+		{name: "Counter above 2^53", mType: entities.Counter, value: "9007199254740993"},
+		{name: "Max int64 counter", mType: entities.Counter, value: "9223372036854775807"},
+		{name: "Gauge", mType: entities.Gauge, value: "123.456"},
+		{name: "Histogram", mType: entities.Histogram, value: `{"bounds":[1],"counts":[2,1],"sum":7.5,"count":3}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			value, delta, payload, err := columnValues(tt.mType, tt.value)
+			require.NoError(t, err)
+			assert.Equal(t, tt.value, internalValue(tt.mType, value, delta, payload))
+		})
+	}
+
+	_, _, _, err := columnValues("nonType", "1")
+	assert.ErrorIs(t, err, entities.ErrMetricNotSupportedType)
+	_, _, _, err = columnValues(entities.Summary, `{"accuracy":2}`)
+	assert.ErrorIs(t, err, entities.ErrInvalidDistribution)
+	_, _, _, err = columnValues(entities.Gauge, "")
+	assert.ErrorIs(t, err, entities.ErrMissingField)
+}
+
+func TestLoadMigrations(t *testing.T) {
+	migrations, err := loadMigrations()
+	require.NoError(t, err)
+	require.NotEmpty(t, migrations)
+
+	for i, m := range migrations {
+		assert.Equal(t, int64(i+1), m.version, "migration versions must be sequential")
+		assert.NotEmpty(t, m.up)
+		assert.NotEmpty(t, m.down)
+	}
+}
+
+func TestMigrateDownUp(t *testing.T) {
+	repo := newTestRepository(t)
+	ctx := context.Background()
+
+	migrations, err := loadMigrations()
+	require.NoError(t, err)
+
+	reverted, err := MigrateDown(ctx, repo.DB, len(migrations))
+	require.NoError(t, err)
+	assert.Equal(t, len(migrations), reverted)
+
+	applied, err := MigrateUp(ctx, repo.DB)
+	require.NoError(t, err)
+	assert.Equal(t, len(migrations), applied)
+
+	applied, err = MigrateUp(ctx, repo.DB)
+	require.NoError(t, err)
+	assert.Zero(t, applied)
+}
+
+func TestPgRepository_Conformance(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) services.ServiceRepository {
+		repo := newTestRepository(t)
+		for _, table := range []string{"metric_storage", "metric_history", "metric_rollups", "metric_metadata"} {
+			_, err := repo.DB.Exec(context.Background(), `DELETE FROM `+table+` WHERE tenant IN ($1, $2)`, storagetest.Tenant, storagetest.OtherTenant)
+			require.NoError(t, err)
+		}
+		return repo
+	})
+}
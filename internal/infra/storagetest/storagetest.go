@@ -0,0 +1,641 @@
+// Package storagetest checks that implementation of services.ServiceRepository follows the interface contract.
+// Backend runs the suite from its tests:
+//
+//	func TestConformance(t *testing.T) {
+//		storagetest.Run(t, func(t *testing.T) services.ServiceRepository { return newStorage(t) })
+//	}
+package storagetest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/melkomukovki/go-musthave-metrics/internal/entities"
+	"github.com/melkomukovki/go-musthave-metrics/internal/services"
+)
+
+// Tenants used by the suite. Shared storages, e.g. database, should remove their metrics in factory
+const (
+	Tenant      = "storagetest"
+	OtherTenant = "storagetest-other"
+)
+
+// Factory returns empty storage for test, metrics of Tenant and OtherTenant must be absent in it
+type Factory func(t *testing.T) services.ServiceRepository
+
+// Run runs conformance tests, every test gets storage from newRepo
+func Run(t *testing.T, newRepo Factory) {
+	tests := []struct {
+		name string
+		test func(t *testing.T, repo services.ServiceRepository)
+	}{
+		{"NotFound", testNotFound},
+		{"Validation", testValidation},
+		{"Gauge", testGauge},
+		{"Counter", testCounter},
+		{"Distribution", testDistribution},
+		{"Labels", testLabels},
+		{"Tenants", testTenants},
+		{"BatchAtomicity", testBatchAtomicity},
+		{"ConcurrentCounters", testConcurrentCounters},
+		{"ConcurrentBatches", testConcurrentBatches},
+		{"ConditionalGauge", testConditionalGauge},
+		{"ConditionShapes", testConditionShapes},
+		{"ConcurrentCompareAndSet", testConcurrentCompareAndSet},
+		{"Metadata", testMetadata},
+		{"ConcurrentClaims", testConcurrentClaims},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.test(t, newRepo(t))
+		})
+	}
+}
+
+// tenantCtx returns context of suite tenant
+func tenantCtx() context.Context {
+	return entities.ContextWithTenant(context.Background(), Tenant)
+}
+
+// histogram returns internal value of histogram with bounds holding values
+func histogram(t *testing.T, bounds []float64, values ...float64) string {
+	t.Helper()
+	h := entities.NewHistogram(bounds)
+	for _, v := range values {
+		h.Observe(v)
+	}
+	value, err := entities.FormatDistribution(h)
+	require.NoError(t, err)
+	return value
+}
+
+// requireValue checks current value of metric
+func requireValue(t *testing.T, ctx context.Context, repo services.ServiceRepository, mType, mName string, labels map[string]string, expected string) {
+	t.Helper()
+	metric, err := repo.GetMetric(ctx, mType, mName, labels)
+	require.NoError(t, err)
+	assert.Equal(t, expected, metric.Value)
+}
+
+// requireNotFound checks that metric doesn't exist
+func requireNotFound(t *testing.T, ctx context.Context, repo services.ServiceRepository, mType, mName string, labels map[string]string) {
+	t.Helper()
+	_, err := repo.GetMetric(ctx, mType, mName, labels)
+	require.ErrorIs(t, err, entities.ErrMetricNotFound)
+}
+
+func testNotFound(t *testing.T, repo services.ServiceRepository) {
+	ctx := tenantCtx()
+	for _, mType := range []string{entities.Gauge, entities.Counter, entities.Histogram, entities.Summary} {
+		requireNotFound(t, ctx, repo, mType, "Missing", nil)
+		assert.ErrorIs(t, repo.DeleteMetric(ctx, mType, "Missing", nil), entities.ErrMetricNotFound, mType)
+	}
+	assert.ErrorIs(t, repo.ResetCounter(ctx, "Missing", nil), entities.ErrMetricNotFound)
+
+	// Metric of one type doesn't exist for another one
+	require.NoError(t, repo.AddMetric(ctx, entities.MetricInternal{ID: "Alloc", MType: entities.Gauge, Value: "1"}))
+	requireNotFound(t, ctx, repo, entities.Counter, "Alloc", nil)
+	assert.ErrorIs(t, repo.ResetCounter(ctx, "Alloc", nil), entities.ErrMetricNotFound)
+
+	// Deleted metric is not found
+	require.NoError(t, repo.DeleteMetric(ctx, entities.Gauge, "Alloc", nil))
+	requireNotFound(t, ctx, repo, entities.Gauge, "Alloc", nil)
+	assert.ErrorIs(t, repo.DeleteMetric(ctx, entities.Gauge, "Alloc", nil), entities.ErrMetricNotFound)
+
+	_, err := repo.GetMetric(ctx, "unknown", "Alloc", nil)
+	assert.ErrorIs(t, err, entities.ErrMetricNotSupportedType)
+	assert.ErrorIs(t, repo.DeleteMetric(ctx, "unknown", "Alloc", nil), entities.ErrMetricNotSupportedType)
+
+	all, err := repo.GetAllMetrics(ctx, nil)
+	require.NoError(t, err)
+	assert.Empty(t, all)
+}
+
+func testValidation(t *testing.T, repo services.ServiceRepository) {
+	ctx := tenantCtx()
+	assert.ErrorIs(t, repo.AddMetric(ctx, entities.MetricInternal{ID: "Alloc", MType: "unknown", Value: "1"}), entities.ErrMetricNotSupportedType)
+	assert.ErrorIs(t, repo.AddMetric(ctx, entities.MetricInternal{ID: "Alloc", MType: entities.Gauge}), entities.ErrMissingField)
+	assert.Error(t, repo.AddMetric(ctx, entities.MetricInternal{ID: "Alloc", MType: entities.Gauge, Value: "abc"}))
+	assert.Error(t, repo.AddMetric(ctx, entities.MetricInternal{ID: "PollCount", MType: entities.Counter, Value: "1.5"}))
+	assert.ErrorIs(t, repo.MergeMetric(ctx, entities.MetricInternal{ID: "Alloc", MType: entities.Gauge, Value: "1"}), entities.ErrMetricNotSupportedType)
+	assert.ErrorIs(t, repo.MergeMetric(ctx, entities.MetricInternal{ID: "Latency", MType: entities.Histogram}), entities.ErrMissingField)
+	assert.ErrorIs(t, repo.AddMultipleMetrics(ctx, []entities.MetricInternal{{ID: "Alloc", MType: "unknown", Value: "1"}}), entities.ErrMetricNotSupportedType)
+	assert.ErrorIs(t, repo.AddMultipleMetrics(ctx, []entities.MetricInternal{{ID: "Alloc", MType: entities.Gauge}}), entities.ErrMissingField)
+
+	// Rejected writes don't create metrics
+	requireNotFound(t, ctx, repo, entities.Gauge, "Alloc", nil)
+	requireNotFound(t, ctx, repo, entities.Counter, "PollCount", nil)
+	requireNotFound(t, ctx, repo, entities.Histogram, "Latency", nil)
+}
+
+func testGauge(t *testing.T, repo services.ServiceRepository) {
+	ctx := tenantCtx()
+	require.NoError(t, repo.AddMetric(ctx, entities.MetricInternal{ID: "Alloc", MType: entities.Gauge, Value: "1.5"}))
+	require.NoError(t, repo.AddMetric(ctx, entities.MetricInternal{ID: "Alloc", MType: entities.Gauge, Value: "-2.25"}))
+	requireValue(t, ctx, repo, entities.Gauge, "Alloc", nil, "-2.25")
+
+	// The last value of batch wins
+	require.NoError(t, repo.AddMultipleMetrics(ctx, []entities.MetricInternal{
+		{ID: "Alloc", MType: entities.Gauge, Value: "3"},
+		{ID: "Alloc", MType: entities.Gauge, Value: "4.5"},
+	}))
+	requireValue(t, ctx, repo, entities.Gauge, "Alloc", nil, "4.5")
+
+	metric, err := repo.GetMetric(ctx, entities.Gauge, "Alloc", nil)
+	require.NoError(t, err)
+	assert.Equal(t, "Alloc", metric.ID)
+	assert.Equal(t, entities.Gauge, metric.MType)
+	assert.Empty(t, metric.Labels)
+}
+
+func testCounter(t *testing.T, repo services.ServiceRepository) {
+	ctx := tenantCtx()
+	require.NoError(t, repo.IncrementCounter(ctx, "PollCount", nil, 3))
+	require.NoError(t, repo.IncrementCounter(ctx, "PollCount", nil, 4))
+	requireValue(t, ctx, repo, entities.Counter, "PollCount", nil, "7")
+
+	// Batch increments counters, also repeated ones
+	require.NoError(t, repo.AddMultipleMetrics(ctx, []entities.MetricInternal{
+		{ID: "PollCount", MType: entities.Counter, Value: "1"},
+		{ID: "PollCount", MType: entities.Counter, Value: "2"},
+		{ID: "NewCount", MType: entities.Counter, Value: "5"},
+	}))
+	requireValue(t, ctx, repo, entities.Counter, "PollCount", nil, "10")
+	requireValue(t, ctx, repo, entities.Counter, "NewCount", nil, "5")
+
+	// AddMetric replaces value
+	require.NoError(t, repo.AddMetric(ctx, entities.MetricInternal{ID: "PollCount", MType: entities.Counter, Value: "2"}))
+	requireValue(t, ctx, repo, entities.Counter, "PollCount", nil, "2")
+
+	require.NoError(t, repo.IncrementCounter(ctx, "PollCount", nil, -5))
+	requireValue(t, ctx, repo, entities.Counter, "PollCount", nil, "-3")
+
+	// Values beyond float64 precision stay exact
+	require.NoError(t, repo.AddMetric(ctx, entities.MetricInternal{ID: "Big", MType: entities.Counter, Value: "9007199254740993"}))
+	require.NoError(t, repo.IncrementCounter(ctx, "Big", nil, 1))
+	requireValue(t, ctx, repo, entities.Counter, "Big", nil, "9007199254740994")
+
+	require.NoError(t, repo.ResetCounter(ctx, "PollCount", nil))
+	requireValue(t, ctx, repo, entities.Counter, "PollCount", nil, "0")
+	require.NoError(t, repo.IncrementCounter(ctx, "PollCount", nil, 1))
+	requireValue(t, ctx, repo, entities.Counter, "PollCount", nil, "1")
+}
+
+func testDistribution(t *testing.T, repo services.ServiceRepository) {
+	ctx := tenantCtx()
+	bounds := []float64{1, 10}
+	require.NoError(t, repo.MergeMetric(ctx, entities.MetricInternal{ID: "Latency", MType: entities.Histogram, Value: histogram(t, bounds, 0.5)}))
+	require.NoError(t, repo.MergeMetric(ctx, entities.MetricInternal{ID: "Latency", MType: entities.Histogram, Value: histogram(t, bounds, 5)}))
+	require.NoError(t, repo.AddMultipleMetrics(ctx, []entities.MetricInternal{
+		{ID: "Latency", MType: entities.Histogram, Value: histogram(t, bounds, 50)},
+	}))
+
+	metric, err := repo.GetMetric(ctx, entities.Histogram, "Latency", nil)
+	require.NoError(t, err)
+	d, err := entities.ParseDistribution(entities.Histogram, metric.Value)
+	require.NoError(t, err)
+	h := d.(*entities.HistogramValue)
+	assert.Equal(t, []uint64{1, 1, 1}, h.Counts)
+	assert.Equal(t, 55.5, h.Sum)
+
+	err = repo.MergeMetric(ctx, entities.MetricInternal{ID: "Latency", MType: entities.Histogram, Value: histogram(t, []float64{2}, 1)})
+	assert.ErrorIs(t, err, entities.ErrDistributionMismatch)
+
+	// AddMetric replaces value
+	require.NoError(t, repo.AddMetric(ctx, entities.MetricInternal{ID: "Latency", MType: entities.Histogram, Value: histogram(t, []float64{2}, 1)}))
+	metric, err = repo.GetMetric(ctx, entities.Histogram, "Latency", nil)
+	require.NoError(t, err)
+	d, err = entities.ParseDistribution(entities.Histogram, metric.Value)
+	require.NoError(t, err)
+	assert.Equal(t, []float64{2}, d.(*entities.HistogramValue).Bounds)
+
+	summary := entities.NewSummary(entities.DefaultSummaryAccuracy)
+	summary.Observe(1)
+	value, err := entities.FormatDistribution(summary)
+	require.NoError(t, err)
+	require.NoError(t, repo.MergeMetric(ctx, entities.MetricInternal{ID: "Latency", MType: entities.Summary, Value: value}))
+	require.NoError(t, repo.MergeMetric(ctx, entities.MetricInternal{ID: "Latency", MType: entities.Summary, Value: value}))
+	metric, err = repo.GetMetric(ctx, entities.Summary, "Latency", nil)
+	require.NoError(t, err)
+	d, err = entities.ParseDistribution(entities.Summary, metric.Value)
+	require.NoError(t, err)
+	assert.EqualValues(t, 2, d.(*entities.SummaryValue).Count)
+}
+
+func testLabels(t *testing.T, repo services.ServiceRepository) {
+	ctx := tenantCtx()
+	hostA := map[string]string{"host": "a"}
+	hostB := map[string]string{"host": "b", "dc": "east"}
+	require.NoError(t, repo.AddMetric(ctx, entities.MetricInternal{ID: "Alloc", MType: entities.Gauge, Value: "1"}))
+	require.NoError(t, repo.AddMetric(ctx, entities.MetricInternal{ID: "Alloc", MType: entities.Gauge, Value: "2", Labels: hostA}))
+	require.NoError(t, repo.IncrementCounter(ctx, "Alloc", hostB, 3))
+
+	requireValue(t, ctx, repo, entities.Gauge, "Alloc", nil, "1")
+	requireValue(t, ctx, repo, entities.Gauge, "Alloc", map[string]string{}, "1")
+	requireValue(t, ctx, repo, entities.Gauge, "Alloc", hostA, "2")
+	requireValue(t, ctx, repo, entities.Counter, "Alloc", map[string]string{"dc": "east", "host": "b"}, "3")
+	requireNotFound(t, ctx, repo, entities.Gauge, "Alloc", hostB)
+
+	metric, err := repo.GetMetric(ctx, entities.Gauge, "Alloc", hostA)
+	require.NoError(t, err)
+	assert.Equal(t, hostA, metric.Labels)
+
+	all, err := repo.GetAllMetrics(ctx, []entities.LabelMatcher{{Name: "host", Type: entities.MatchEqual, Value: "a"}})
+	require.NoError(t, err)
+	require.Len(t, all, 1)
+	assert.Equal(t, "2", all[0].Value)
+
+	all, err = repo.GetAllMetrics(ctx, nil)
+	require.NoError(t, err)
+	assert.Len(t, all, 3)
+
+	require.NoError(t, repo.DeleteMetric(ctx, entities.Gauge, "Alloc", hostA))
+	requireValue(t, ctx, repo, entities.Gauge, "Alloc", nil, "1")
+	requireNotFound(t, ctx, repo, entities.Gauge, "Alloc", hostA)
+}
+
+func testTenants(t *testing.T, repo services.ServiceRepository) {
+	ctx := tenantCtx()
+	other := entities.ContextWithTenant(context.Background(), OtherTenant)
+	require.NoError(t, repo.AddMetric(ctx, entities.MetricInternal{ID: "Alloc", MType: entities.Gauge, Value: "1"}))
+	require.NoError(t, repo.IncrementCounter(ctx, "PollCount", nil, 1))
+	require.NoError(t, repo.AddMetric(other, entities.MetricInternal{ID: "Alloc", MType: entities.Gauge, Value: "2"}))
+
+	requireValue(t, ctx, repo, entities.Gauge, "Alloc", nil, "1")
+	requireValue(t, other, repo, entities.Gauge, "Alloc", nil, "2")
+	requireNotFound(t, other, repo, entities.Counter, "PollCount", nil)
+	assert.ErrorIs(t, repo.ResetCounter(other, "PollCount", nil), entities.ErrMetricNotFound)
+
+	require.NoError(t, repo.DeleteMetric(other, entities.Gauge, "Alloc", nil))
+	requireValue(t, ctx, repo, entities.Gauge, "Alloc", nil, "1")
+
+	all, err := repo.GetAllMetrics(ctx, nil)
+	require.NoError(t, err)
+	assert.Len(t, all, 2)
+}
+
+func testBatchAtomicity(t *testing.T, repo services.ServiceRepository) {
+	ctx := tenantCtx()
+	bounds := []float64{1, 10}
+	require.NoError(t, repo.AddMultipleMetrics(ctx, []entities.MetricInternal{
+		{ID: "Alloc", MType: entities.Gauge, Value: "1"},
+		{ID: "PollCount", MType: entities.Counter, Value: "1"},
+		{ID: "Latency", MType: entities.Histogram, Value: histogram(t, bounds, 0.5)},
+	}))
+
+	// Invalid value rejects whole batch
+	err := repo.AddMultipleMetrics(ctx, []entities.MetricInternal{
+		{ID: "Alloc", MType: entities.Gauge, Value: "2"},
+		{ID: "PollCount", MType: entities.Counter, Value: "1"},
+		{ID: "PollCount", MType: entities.Counter, Value: "1.5"},
+	})
+	assert.Error(t, err)
+	requireValue(t, ctx, repo, entities.Gauge, "Alloc", nil, "1")
+	requireValue(t, ctx, repo, entities.Counter, "PollCount", nil, "1")
+
+	// Histogram, which can't be merged, rejects metrics preceding it
+	err = repo.AddMultipleMetrics(ctx, []entities.MetricInternal{
+		{ID: "Alloc", MType: entities.Gauge, Value: "2"},
+		{ID: "PollCount", MType: entities.Counter, Value: "1"},
+		{ID: "Latency", MType: entities.Histogram, Value: histogram(t, bounds, 5)},
+		{ID: "Created", MType: entities.Gauge, Value: "1"},
+		{ID: "Latency", MType: entities.Histogram, Value: histogram(t, []float64{2}, 1)},
+	})
+	assert.ErrorIs(t, err, entities.ErrDistributionMismatch)
+	requireValue(t, ctx, repo, entities.Gauge, "Alloc", nil, "1")
+	requireValue(t, ctx, repo, entities.Counter, "PollCount", nil, "1")
+	requireNotFound(t, ctx, repo, entities.Gauge, "Created", nil)
+
+	metric, err := repo.GetMetric(ctx, entities.Histogram, "Latency", nil)
+	require.NoError(t, err)
+	d, err := entities.ParseDistribution(entities.Histogram, metric.Value)
+	require.NoError(t, err)
+	assert.EqualValues(t, 1, d.(*entities.HistogramValue).Count)
+}
+
+func testConcurrentCounters(t *testing.T, repo services.ServiceRepository) {
+	const (
+		workers    = 10
+		increments = 20
+	)
+
+	ctx := tenantCtx()
+	var wg sync.WaitGroup
+	errs := make(chan error, workers*increments)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < increments; j++ {
+				errs <- repo.IncrementCounter(ctx, "PollCount", nil, 1)
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.NoError(t, err)
+	}
+
+	requireValue(t, ctx, repo, entities.Counter, "PollCount", nil, fmt.Sprint(workers*increments))
+}
+
+func testConcurrentBatches(t *testing.T, repo services.ServiceRepository) {
+	const (
+		workers = 10
+		batches = 10
+	)
+
+	ctx := tenantCtx()
+	bounds := []float64{1, 10}
+	var wg sync.WaitGroup
+	errs := make(chan error, workers*batches)
+	for i := 0; i < workers; i++ {
+		// Workers update the same series in different order
+		batch := []entities.MetricInternal{
+			{ID: "First", MType: entities.Counter, Value: "1"},
+			{ID: "Second", MType: entities.Counter, Value: "2"},
+			{ID: "Latency", MType: entities.Histogram, Value: histogram(t, bounds, 5)},
+			{ID: "Alloc", MType: entities.Gauge, Value: fmt.Sprint(i)},
+		}
+		if i%2 == 1 {
+			batch[0], batch[1] = batch[1], batch[0]
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < batches; j++ {
+				errs <- repo.AddMultipleMetrics(ctx, batch)
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.NoError(t, err)
+	}
+
+	requireValue(t, ctx, repo, entities.Counter, "First", nil, fmt.Sprint(workers*batches))
+	requireValue(t, ctx, repo, entities.Counter, "Second", nil, fmt.Sprint(2*workers*batches))
+	metric, err := repo.GetMetric(ctx, entities.Histogram, "Latency", nil)
+	require.NoError(t, err)
+	d, err := entities.ParseDistribution(entities.Histogram, metric.Value)
+	require.NoError(t, err)
+	assert.EqualValues(t, workers*batches, d.(*entities.HistogramValue).Count)
+}
+
+func testConditionalGauge(t *testing.T, repo services.ServiceRepository) {
+	ctx := tenantCtx()
+	version := func(v int64) *int64 { return &v }
+	value := func(v float64) *float64 { return &v }
+	gauge := func(v string) entities.MetricInternal {
+		return entities.MetricInternal{ID: "Alloc", MType: entities.Gauge, Value: v}
+	}
+
+	// Only absent gauge satisfies zero version
+	created, err := repo.UpdateGauge(ctx, gauge("1"), entities.GaugeCondition{Version: version(0)})
+	require.NoError(t, err)
+	assert.Positive(t, created)
+	_, err = repo.UpdateGauge(ctx, gauge("2"), entities.GaugeCondition{Version: version(0)})
+	assert.ErrorIs(t, err, entities.ErrConditionFailed)
+
+	metric, err := repo.GetMetric(ctx, entities.Gauge, "Alloc", nil)
+	require.NoError(t, err)
+	assert.Equal(t, "1", metric.Value)
+	assert.Equal(t, created, metric.Version)
+
+	// Every change of gauge changes its version
+	require.NoError(t, repo.AddMetric(ctx, gauge("1")))
+	metric, err = repo.GetMetric(ctx, entities.Gauge, "Alloc", nil)
+	require.NoError(t, err)
+	assert.Greater(t, metric.Version, created)
+
+	_, err = repo.UpdateGauge(ctx, gauge("3"), entities.GaugeCondition{Version: version(created)})
+	assert.ErrorIs(t, err, entities.ErrConditionFailed)
+	updated, err := repo.UpdateGauge(ctx, gauge("3"), entities.GaugeCondition{Version: version(metric.Version)})
+	require.NoError(t, err)
+	assert.Greater(t, updated, metric.Version)
+	requireValue(t, ctx, repo, entities.Gauge, "Alloc", nil, "3")
+
+	_, err = repo.UpdateGauge(ctx, gauge("4"), entities.GaugeCondition{Value: value(1)})
+	assert.ErrorIs(t, err, entities.ErrConditionFailed)
+	_, err = repo.UpdateGauge(ctx, gauge("4"), entities.GaugeCondition{Value: value(3)})
+	require.NoError(t, err)
+	requireValue(t, ctx, repo, entities.Gauge, "Alloc", nil, "4")
+
+	// Value observed before the last change is stale
+	_, err = repo.UpdateGauge(ctx, gauge("5"), entities.GaugeCondition{Timestamp: time.Unix(0, updated)})
+	assert.ErrorIs(t, err, entities.ErrConditionFailed)
+	observed := time.Now().Add(time.Hour)
+	stored, err := repo.UpdateGauge(ctx, gauge("5"), entities.GaugeCondition{Timestamp: observed})
+	require.NoError(t, err)
+	assert.GreaterOrEqual(t, stored, observed.UnixNano())
+	_, err = repo.UpdateGauge(ctx, gauge("6"), entities.GaugeCondition{Timestamp: observed.Add(-time.Second)})
+	assert.ErrorIs(t, err, entities.ErrConditionFailed)
+	requireValue(t, ctx, repo, entities.Gauge, "Alloc", nil, "5")
+
+	// Condition on absent gauge
+	_, err = repo.UpdateGauge(ctx, entities.MetricInternal{ID: "Missing", MType: entities.Gauge, Value: "1"}, entities.GaugeCondition{Value: value(1)})
+	assert.ErrorIs(t, err, entities.ErrConditionFailed)
+	requireNotFound(t, ctx, repo, entities.Gauge, "Missing", nil)
+
+	_, err = repo.UpdateGauge(ctx, entities.MetricInternal{ID: "PollCount", MType: entities.Counter, Value: "1"}, entities.GaugeCondition{Version: version(0)})
+	assert.ErrorIs(t, err, entities.ErrMetricNotSupportedType)
+}
+
+func testConditionShapes(t *testing.T, repo services.ServiceRepository) {
+	ctx := tenantCtx()
+	past, future, one := time.Unix(0, 1), time.Now().Add(time.Hour), 1.0
+
+	// Every combination of condition fields is checked on absent and existing gauge with value 1
+	tests := []struct {
+		name             string
+		cond             func(version int64) entities.GaugeCondition
+		absent, existing bool
+	}{
+		{"Absent", func(int64) entities.GaugeCondition { return entities.GaugeCondition{Version: new(int64)} }, true, false},
+		{"Version", func(v int64) entities.GaugeCondition { return entities.GaugeCondition{Version: &v} }, false, true},
+		{"Value", func(int64) entities.GaugeCondition { return entities.GaugeCondition{Value: &one} }, false, true},
+		{"Timestamp", func(int64) entities.GaugeCondition { return entities.GaugeCondition{Timestamp: future} }, true, true},
+		{"StaleTimestamp", func(int64) entities.GaugeCondition { return entities.GaugeCondition{Timestamp: past} }, true, false},
+		{"AbsentTimestamp", func(int64) entities.GaugeCondition {
+			return entities.GaugeCondition{Version: new(int64), Timestamp: future}
+		}, true, false},
+		{"VersionTimestamp", func(v int64) entities.GaugeCondition {
+			return entities.GaugeCondition{Version: &v, Timestamp: future}
+		}, false, true},
+		{"VersionValue", func(v int64) entities.GaugeCondition {
+			return entities.GaugeCondition{Version: &v, Value: &one}
+		}, false, true},
+		{"ValueTimestamp", func(int64) entities.GaugeCondition {
+			return entities.GaugeCondition{Value: &one, Timestamp: future}
+		}, false, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			existing := entities.MetricInternal{ID: "Shape" + tt.name, MType: entities.Gauge, Value: "1"}
+			require.NoError(t, repo.AddMetric(ctx, existing))
+			metric, err := repo.GetMetric(ctx, entities.Gauge, existing.ID, nil)
+			require.NoError(t, err)
+			cond := tt.cond(metric.Version)
+
+			_, err = repo.UpdateGauge(ctx, entities.MetricInternal{ID: existing.ID, MType: entities.Gauge, Value: "2"}, cond)
+			if tt.existing {
+				require.NoError(t, err)
+				requireValue(t, ctx, repo, entities.Gauge, existing.ID, nil, "2")
+			} else {
+				assert.ErrorIs(t, err, entities.ErrConditionFailed)
+				requireValue(t, ctx, repo, entities.Gauge, existing.ID, nil, "1")
+			}
+
+			absent := entities.MetricInternal{ID: "Shape" + tt.name + "Absent", MType: entities.Gauge, Value: "2"}
+			_, err = repo.UpdateGauge(ctx, absent, cond)
+			if tt.absent {
+				require.NoError(t, err)
+				requireValue(t, ctx, repo, entities.Gauge, absent.ID, nil, "2")
+			} else {
+				assert.ErrorIs(t, err, entities.ErrConditionFailed)
+				requireNotFound(t, ctx, repo, entities.Gauge, absent.ID, nil)
+			}
+		})
+	}
+}
+
+func testConcurrentCompareAndSet(t *testing.T, repo services.ServiceRepository) {
+	const (
+		workers    = 5
+		increments = 10
+	)
+
+	ctx := tenantCtx()
+	require.NoError(t, repo.AddMetric(ctx, entities.MetricInternal{ID: "Shared", MType: entities.Gauge, Value: "0"}))
+
+	// Workers increment gauge by read-modify-write, lost updates are detected by version
+	var wg sync.WaitGroup
+	errs := make(chan error, workers)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for done := 0; done < increments; {
+				metric, err := repo.GetMetric(ctx, entities.Gauge, "Shared", nil)
+				if err != nil {
+					errs <- err
+					return
+				}
+				value, err := strconv.ParseFloat(metric.Value, 64)
+				if err != nil {
+					errs <- err
+					return
+				}
+				next := entities.MetricInternal{ID: "Shared", MType: entities.Gauge, Value: strconv.FormatFloat(value+1, 'g', -1, 64)}
+				_, err = repo.UpdateGauge(ctx, next, entities.GaugeCondition{Version: &metric.Version})
+				switch {
+				case err == nil:
+					done++
+				case !errors.Is(err, entities.ErrConditionFailed):
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.NoError(t, err)
+	}
+
+	requireValue(t, ctx, repo, entities.Gauge, "Shared", nil, fmt.Sprint(workers*increments))
+}
+
+func testMetadata(t *testing.T, repo services.ServiceRepository) {
+	ctx := tenantCtx()
+	other := entities.ContextWithTenant(context.Background(), OtherTenant)
+
+	_, err := repo.GetMetadata(ctx, "Alloc")
+	assert.ErrorIs(t, err, entities.ErrMetadataNotFound)
+	metadata, err := repo.GetAllMetadata(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, metadata)
+
+	// Claims are repeatable by owner only
+	require.NoError(t, repo.ClaimMetricTypes(ctx, map[string]string{"Alloc": entities.Gauge, "PollCount": entities.Counter}))
+	require.NoError(t, repo.ClaimMetricTypes(ctx, map[string]string{"Alloc": entities.Gauge}))
+	assert.ErrorIs(t, repo.ClaimMetricTypes(ctx, map[string]string{"Alloc": entities.Counter}), entities.ErrMetricTypeConflict)
+	assert.ErrorIs(t, repo.ClaimMetricTypes(ctx, map[string]string{"Alloc": entities.Counter, "Fresh": entities.Gauge}), entities.ErrMetricTypeConflict)
+	_, err = repo.GetMetadata(ctx, "Fresh")
+	assert.ErrorIs(t, err, entities.ErrMetadataNotFound, "failed claim must not claim any name")
+	assert.ErrorIs(t, repo.ClaimMetricTypes(ctx, map[string]string{"Alloc": "nonType"}), entities.ErrMetricNotSupportedType)
+
+	// Unit and help are changed by owner only
+	require.NoError(t, repo.SetMetadata(ctx, entities.MetricMetadata{Name: "Alloc", Type: entities.Gauge, Unit: "bytes", Help: "Allocated heap"}))
+	assert.ErrorIs(t, repo.SetMetadata(ctx, entities.MetricMetadata{Name: "Alloc", Type: entities.Counter}), entities.ErrMetricTypeConflict)
+	assert.ErrorIs(t, repo.SetMetadata(ctx, entities.MetricMetadata{Name: "Alloc", Type: entities.Gauge, Unit: "kilo bytes"}), entities.ErrInvalidMetadata)
+	assert.ErrorIs(t, repo.SetMetadata(ctx, entities.MetricMetadata{Name: "Alloc"}), entities.ErrMissingField)
+
+	meta, err := repo.GetMetadata(ctx, "Alloc")
+	require.NoError(t, err)
+	assert.Equal(t, entities.MetricMetadata{Name: "Alloc", Type: entities.Gauge, Unit: "bytes", Help: "Allocated heap"}, meta)
+
+	metadata, err = repo.GetAllMetadata(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []entities.MetricMetadata{meta, {Name: "PollCount", Type: entities.Counter}}, metadata)
+
+	// Names of tenants are independent
+	require.NoError(t, repo.ClaimMetricTypes(other, map[string]string{"Alloc": entities.Counter}))
+
+	// Released name may be claimed by another type
+	require.NoError(t, repo.DeleteMetadata(ctx, "Alloc"))
+	assert.ErrorIs(t, repo.DeleteMetadata(ctx, "Alloc"), entities.ErrMetadataNotFound)
+	require.NoError(t, repo.ClaimMetricTypes(ctx, map[string]string{"Alloc": entities.Counter}))
+	meta, err = repo.GetMetadata(ctx, "Alloc")
+	require.NoError(t, err)
+	assert.Equal(t, entities.MetricMetadata{Name: "Alloc", Type: entities.Counter}, meta)
+}
+
+func testConcurrentClaims(t *testing.T, repo services.ServiceRepository) {
+	const workers = 8
+
+	ctx := tenantCtx()
+	types := [...]string{entities.Gauge, entities.Counter}
+
+	// Workers claim the same name with different types, only one type may win
+	var wg sync.WaitGroup
+	won := make([]bool, workers)
+	errs := make(chan error, workers)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			err := repo.ClaimMetricTypes(ctx, map[string]string{"Contended": types[i%len(types)]})
+			switch {
+			case err == nil:
+				won[i] = true
+			case !errors.Is(err, entities.ErrMetricTypeConflict):
+				errs <- err
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.NoError(t, err)
+	}
+
+	meta, err := repo.GetMetadata(ctx, "Contended")
+	require.NoError(t, err)
+	for i, ok := range won {
+		assert.Equal(t, types[i%len(types)] == meta.Type, ok, "worker %d", i)
+	}
+}
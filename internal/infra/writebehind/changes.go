@@ -0,0 +1,81 @@
+package writebehind
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/melkomukovki/go-musthave-metrics/internal/entities"
+)
+
+// seriesKey identifies series in dirty set
+type seriesKey struct {
+	tenant string
+	mType  string
+	series string
+}
+
+// rollupKey identifies rollup bucket in dirty set
+type rollupKey struct {
+	tenant string
+	step   time.Duration
+	series string
+	bucket int64
+}
+
+// change is pending change of series, changes made between flushes are coalesced into one
+type change struct {
+	name    string
+	labels  map[string]string
+	deleted bool                  // Series is deleted
+	replace bool                  // Value replaces stored one, otherwise delta is added to counter and dist is merged into distribution
+	value   string                // Gauge value
+	delta   int64                 // Counter value or increment
+	dist    entities.Distribution // Histogram or summary value or part to merge
+}
+
+// then returns change equal to applying c and newer one after it
+func (c *change) then(mType string, newer *change) *change {
+	if newer.deleted || newer.replace {
+		return newer
+	}
+	if c.deleted {
+		// Increment of deleted series creates it again
+		res := *newer
+		res.replace = true
+		return &res
+	}
+
+	switch mType {
+	case entities.Counter:
+		c.delta += newer.delta
+	case entities.Histogram, entities.Summary:
+		// Values are checked by memory storage before they get here, so mismatch means lost update
+		if err := c.dist.Merge(newer.dist); err != nil {
+			log.Error().Err(err).Str("metric", c.name).Msg("can't coalesce distribution changes, older change is dropped")
+			return newer
+		}
+	default:
+		return newer
+	}
+	return c
+}
+
+// metric converts change, which isn't deletion, to internal model of metric
+func (c *change) metric(mType string) (entities.MetricInternal, error) {
+	m := entities.MetricInternal{ID: c.name, MType: mType, Labels: c.labels}
+	switch mType {
+	case entities.Gauge:
+		m.Value = c.value
+	case entities.Counter:
+		m.Value = strconv.FormatInt(c.delta, 10)
+	default:
+		value, err := entities.FormatDistribution(c.dist)
+		if err != nil {
+			return entities.MetricInternal{}, err
+		}
+		m.Value = value
+	}
+	return m, nil
+}
@@ -0,0 +1,593 @@
+// Package writebehind implements StorageService
+// Metrics are served from memory, changes are coalesced and written to backing storage periodically
+package writebehind
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/melkomukovki/go-musthave-metrics/internal/entities"
+	"github.com/melkomukovki/go-musthave-metrics/internal/infra/memstorage"
+	"github.com/melkomukovki/go-musthave-metrics/internal/services"
+)
+
+// DefaultMaxDirty - number of pending changes, after which writers flush them synchronously
+const DefaultMaxDirty = 10000
+
+// Backend is storage, which keeps metrics durably
+type Backend interface {
+	services.ServiceRepository
+	// Tenants returns tenants having stored metrics
+	Tenants(ctx context.Context) ([]string, error)
+}
+
+// Storage keeps all metrics of backend in memory. Reads of current values are served from memory,
+// changes are applied to memory and written to backend by periodic flush.
+// History and rollups are read from backend, so they lag behind by flush interval.
+// Storage must be the only writer of backend, changes made to backend by others are not visible
+type Storage struct {
+	front    *memstorage.MemStorage
+	back     Backend
+	maxDirty int
+
+	// mu serializes changes of memory and dirty set, so they are recorded in the same order
+	mu      sync.Mutex
+	dirty   map[seriesKey]*change
+	rollups map[rollupKey]entities.RollupInternal
+
+	flushMu   sync.Mutex
+	done      chan struct{}
+	wg        sync.WaitGroup
+	closeOnce sync.Once
+}
+
+// NewClient loads metrics of all tenants from backend and starts flushing changes to it every flushInterval
+func NewClient(ctx context.Context, back Backend, flushInterval time.Duration, maxDirty int) (*Storage, error) {
+	if maxDirty < 1 {
+		maxDirty = DefaultMaxDirty
+	}
+
+	s := &Storage{
+		front:    memstorage.NewClient(0, "", false, 1),
+		back:     back,
+		maxDirty: maxDirty,
+		dirty:    make(map[seriesKey]*change),
+		rollups:  make(map[rollupKey]entities.RollupInternal),
+		done:     make(chan struct{}),
+	}
+
+	loaded, err := s.warmUp(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("can't load metrics from storage: %w", err)
+	}
+	log.Info().Int("metrics", loaded).Dur("flush_interval", flushInterval).Msg("write-behind cache is ready")
+
+	s.wg.Add(1)
+	go s.runFlush(flushInterval)
+
+	return s, nil
+}
+
+// warmUp copies metrics and metadata of all tenants from backend to memory
+func (s *Storage) warmUp(ctx context.Context) (loaded int, err error) {
+	tenants, err := s.back.Tenants(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, tenant := range tenants {
+		tCtx := entities.ContextWithTenant(ctx, tenant)
+		metrics, err := s.back.GetAllMetrics(tCtx, nil)
+		if err != nil {
+			return loaded, err
+		}
+		for _, m := range metrics {
+			if err = s.front.AddMetric(tCtx, m); err != nil {
+				return loaded, err
+			}
+		}
+		loaded += len(metrics)
+
+		metadata, err := s.back.GetAllMetadata(tCtx)
+		if err != nil {
+			return loaded, err
+		}
+		for _, meta := range metadata {
+			if err = s.front.SetMetadata(tCtx, meta); err != nil {
+				return loaded, err
+			}
+		}
+	}
+	return loaded, nil
+}
+
+// runFlush flushes changes periodically until storage is closed
+func (s *Storage) runFlush(interval time.Duration) {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			if err := s.Flush(context.Background()); err != nil {
+				log.Error().Err(err).Int("pending", s.pending()).Msg("failed to flush metrics to storage")
+			}
+		}
+	}
+}
+
+// Close stops periodic flush, writes pending changes and closes backend
+func (s *Storage) Close() (err error) {
+	s.closeOnce.Do(func() {
+		close(s.done)
+		s.wg.Wait()
+
+		err = s.Flush(context.Background())
+		if closer, ok := s.back.(io.Closer); ok {
+			err = errors.Join(err, closer.Close())
+		}
+	})
+	return err
+}
+
+// pending returns number of changes waiting for flush
+func (s *Storage) pending() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.dirty) + len(s.rollups)
+}
+
+// Flush writes pending changes to backend. Changes, which failed to be written, stay pending
+// and are coalesced with changes made during flush
+func (s *Storage) Flush(ctx context.Context) error {
+	s.flushMu.Lock()
+	defer s.flushMu.Unlock()
+
+	s.mu.Lock()
+	dirty, rollups := s.dirty, s.rollups
+	s.dirty = make(map[seriesKey]*change)
+	s.rollups = make(map[rollupKey]entities.RollupInternal)
+	s.mu.Unlock()
+
+	if len(dirty) == 0 && len(rollups) == 0 {
+		return nil
+	}
+
+	byTenant := make(map[string]map[seriesKey]*change)
+	for key, c := range dirty {
+		if byTenant[key.tenant] == nil {
+			byTenant[key.tenant] = make(map[seriesKey]*change)
+		}
+		byTenant[key.tenant][key] = c
+	}
+
+	var errs []error
+	failed := make(map[seriesKey]*change)
+	for tenant, changes := range byTenant {
+		tCtx := entities.ContextWithTenant(ctx, tenant)
+
+		// Gauges, counter increments and distribution merges go to backend in one batch,
+		// deletions and replacements of counters and distributions can't be expressed in batch
+		var batch []entities.MetricInternal
+		var batchKeys []seriesKey
+		for key, c := range changes {
+			if c.deleted {
+				if err := s.back.DeleteMetric(tCtx, key.mType, c.name, c.labels); err != nil && !errors.Is(err, entities.ErrMetricNotFound) {
+					errs = append(errs, err)
+					failed[key] = c
+				}
+				continue
+			}
+
+			// Change, which can't be converted to metric, stays pending
+			m, err := c.metric(key.mType)
+			if err != nil {
+				log.Error().Err(err).Str("tenant", tenant).Str("type", key.mType).Str("name", c.name).Msg("can't flush metric")
+				errs = append(errs, err)
+				failed[key] = c
+				continue
+			}
+			if c.replace && key.mType != entities.Gauge {
+				if err = s.back.AddMetric(tCtx, m); err != nil {
+					errs = append(errs, err)
+					failed[key] = c
+				}
+				continue
+			}
+			batch = append(batch, m)
+			batchKeys = append(batchKeys, key)
+		}
+
+		if len(batch) > 0 {
+			if err := s.back.AddMultipleMetrics(tCtx, batch); err != nil {
+				errs = append(errs, err)
+				for _, key := range batchKeys {
+					failed[key] = changes[key]
+				}
+			}
+		}
+	}
+
+	failedRollups := make(map[rollupKey]entities.RollupInternal)
+	rollupsByTenant := make(map[string][]rollupKey)
+	for key := range rollups {
+		rollupsByTenant[key.tenant] = append(rollupsByTenant[key.tenant], key)
+	}
+	for tenant, keys := range rollupsByTenant {
+		batch := make([]entities.RollupInternal, 0, len(keys))
+		for _, key := range keys {
+			batch = append(batch, rollups[key])
+		}
+		if err := s.back.MergeRollups(entities.ContextWithTenant(ctx, tenant), batch); err != nil {
+			errs = append(errs, err)
+			for _, key := range keys {
+				failedRollups[key] = rollups[key]
+			}
+		}
+	}
+
+	if len(failed) > 0 || len(failedRollups) > 0 {
+		s.requeue(failed, failedRollups)
+	}
+	return errors.Join(errs...)
+}
+
+// requeue returns changes, which failed to be written, to dirty set, placing them before changes made since flush started
+func (s *Storage) requeue(failed map[seriesKey]*change, failedRollups map[rollupKey]entities.RollupInternal) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for key, c := range failed {
+		if newer, ok := s.dirty[key]; ok {
+			c = c.then(key.mType, newer)
+		}
+		s.dirty[key] = c
+	}
+	for key, r := range failedRollups {
+		if newer, ok := s.rollups[key]; ok {
+			r.Merge(newer)
+		}
+		s.rollups[key] = r
+	}
+}
+
+// reserve makes room for n changes, flushing pending ones synchronously if there are too many of them
+func (s *Storage) reserve(ctx context.Context, n int) error {
+	pending := s.pending()
+	if pending == 0 || pending+n <= s.maxDirty {
+		return nil
+	}
+
+	if err := s.Flush(ctx); err != nil && s.pending()+n > s.maxDirty {
+		return fmt.Errorf("%w: %v", entities.ErrFlushBacklog, err)
+	}
+	return nil
+}
+
+// record adds change of series to dirty set, s.mu must be held
+func (s *Storage) record(ctx context.Context, mType, name string, labels map[string]string, c *change) {
+	c.name, c.labels = name, labels
+	key := seriesKey{tenant: entities.TenantFromContext(ctx), mType: mType, series: entities.SeriesKey(name, labels)}
+	if older, ok := s.dirty[key]; ok {
+		c = older.then(mType, c)
+	}
+	s.dirty[key] = c
+}
+
+// AddMetric allow to add metric to storage
+func (s *Storage) AddMetric(ctx context.Context, metric entities.MetricInternal) error {
+	c, err := replacement(metric)
+	if err != nil {
+		return err
+	}
+	if err = s.reserve(ctx, 1); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err = s.front.AddMetric(ctx, metric); err != nil {
+		return err
+	}
+	s.record(ctx, metric.MType, metric.ID, metric.Labels, c)
+	return nil
+}
+
+// UpdateGauge stores gauge if it satisfies condition, returns version of stored value.
+// Condition is checked against memory, versions of gauges are assigned by cache
+func (s *Storage) UpdateGauge(ctx context.Context, metric entities.MetricInternal, cond entities.GaugeCondition) (int64, error) {
+	if metric.MType != entities.Gauge {
+		return 0, entities.ErrMetricNotSupportedType
+	}
+	c, err := replacement(metric)
+	if err != nil {
+		return 0, err
+	}
+	if err = s.reserve(ctx, 1); err != nil {
+		return 0, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	version, err := s.front.UpdateGauge(ctx, metric, cond)
+	if err != nil {
+		return 0, err
+	}
+	s.record(ctx, metric.MType, metric.ID, metric.Labels, c)
+	return version, nil
+}
+
+// replacement returns change, which replaces value of series with metric value
+func replacement(metric entities.MetricInternal) (*change, error) {
+	if metric.Value == "" && entities.IsKnownType(metric.MType) {
+		return nil, entities.ErrMissingField
+	}
+
+	c := &change{replace: true}
+	switch metric.MType {
+	case entities.Gauge:
+		if _, err := strconv.ParseFloat(metric.Value, 64); err != nil {
+			return nil, err
+		}
+		c.value = metric.Value
+	case entities.Counter:
+		delta, err := strconv.ParseInt(metric.Value, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		c.delta = delta
+	case entities.Histogram, entities.Summary:
+		dist, err := entities.ParseDistribution(metric.MType, metric.Value)
+		if err != nil {
+			return nil, err
+		}
+		c.dist = dist
+	default:
+		return nil, entities.ErrMetricNotSupportedType
+	}
+	return c, nil
+}
+
+// MergeMetric merges histogram or summary into stored value of the series
+func (s *Storage) MergeMetric(ctx context.Context, metric entities.MetricInternal) error {
+	if !entities.IsDistribution(metric.MType) {
+		return entities.ErrMetricNotSupportedType
+	}
+	if metric.Value == "" {
+		return entities.ErrMissingField
+	}
+	dist, err := entities.ParseDistribution(metric.MType, metric.Value)
+	if err != nil {
+		return err
+	}
+	if err = s.reserve(ctx, 1); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err = s.front.MergeMetric(ctx, metric); err != nil {
+		return err
+	}
+	s.record(ctx, metric.MType, metric.ID, metric.Labels, &change{dist: dist})
+	return nil
+}
+
+// IncrementCounter adds delta to the counter, creating it if not exists
+func (s *Storage) IncrementCounter(ctx context.Context, mName string, labels map[string]string, delta int64) error {
+	if err := s.reserve(ctx, 1); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.front.IncrementCounter(ctx, mName, labels, delta); err != nil {
+		return err
+	}
+	s.record(ctx, entities.Counter, mName, labels, &change{delta: delta})
+	return nil
+}
+
+// AddMultipleMetrics allow to add multiple metrics at once.
+// Counters, histograms and summaries of batch are added to stored values.
+// If distribution can't be merged, metrics preceding it in batch stay applied
+func (s *Storage) AddMultipleMetrics(ctx context.Context, metrics []entities.MetricInternal) error {
+	changes := make([]*change, 0, len(metrics))
+	for _, metric := range metrics {
+		c, err := replacement(metric)
+		if err != nil {
+			return err
+		}
+		// Counters and distributions of batch are increments
+		c.replace = metric.MType == entities.Gauge
+		changes = append(changes, c)
+	}
+	if err := s.reserve(ctx, len(metrics)); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// Memory storage applies batch atomically, so rejected batch leaves no changes to flush
+	if err := s.front.AddMultipleMetrics(ctx, metrics); err != nil {
+		return err
+	}
+	for i, metric := range metrics {
+		s.record(ctx, metric.MType, metric.ID, metric.Labels, changes[i])
+	}
+	return nil
+}
+
+// DeleteMetric removes metric, returns entities.ErrMetricNotFound if metric doesn't exist
+func (s *Storage) DeleteMetric(ctx context.Context, mType, mName string, labels map[string]string) error {
+	if err := s.reserve(ctx, 1); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.front.DeleteMetric(ctx, mType, mName, labels); err != nil {
+		return err
+	}
+	s.record(ctx, mType, mName, labels, &change{deleted: true})
+	return nil
+}
+
+// ResetCounter sets existing counter to zero, returns entities.ErrMetricNotFound if counter doesn't exist
+func (s *Storage) ResetCounter(ctx context.Context, mName string, labels map[string]string) error {
+	if err := s.reserve(ctx, 1); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.front.ResetCounter(ctx, mName, labels); err != nil {
+		return err
+	}
+	s.record(ctx, entities.Counter, mName, labels, &change{replace: true})
+	return nil
+}
+
+// MergeRollups merges gauge rollups into pending buckets, they are merged into stored ones on flush
+func (s *Storage) MergeRollups(ctx context.Context, rollups []entities.RollupInternal) error {
+	for _, r := range rollups {
+		if _, err := entities.ResolutionOf(r.Step); err != nil {
+			return err
+		}
+	}
+	if err := s.reserve(ctx, len(rollups)); err != nil {
+		return err
+	}
+
+	tenant := entities.TenantFromContext(ctx)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, r := range rollups {
+		key := rollupKey{tenant: tenant, step: r.Step, series: entities.SeriesKey(r.ID, r.Labels), bucket: r.Bucket.UnixNano()}
+		if older, ok := s.rollups[key]; ok {
+			older.Merge(r)
+			r = older
+		}
+		s.rollups[key] = r
+	}
+	return nil
+}
+
+// ClaimMetricTypes checks owners of names in memory. Names without metadata are claimed in backend first,
+// so claims are durable and concurrent claims are resolved by backend
+func (s *Storage) ClaimMetricTypes(ctx context.Context, types map[string]string) error {
+	if err := entities.ValidateClaims(types); err != nil {
+		return err
+	}
+	var missing map[string]string
+	for name, mType := range types {
+		meta, err := s.front.GetMetadata(ctx, name)
+		switch {
+		case errors.Is(err, entities.ErrMetadataNotFound):
+			if missing == nil {
+				missing = make(map[string]string)
+			}
+			missing[name] = mType
+		case err != nil:
+			return err
+		case meta.Type != mType:
+			return entities.TypeConflict(name, meta.Type, mType)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+
+	if err := s.back.ClaimMetricTypes(ctx, missing); err != nil {
+		return err
+	}
+	return s.front.ClaimMetricTypes(ctx, missing)
+}
+
+// SetMetadata stores metadata in backend and memory
+func (s *Storage) SetMetadata(ctx context.Context, meta entities.MetricMetadata) error {
+	if err := s.back.SetMetadata(ctx, meta); err != nil {
+		return err
+	}
+	return s.front.SetMetadata(ctx, meta)
+}
+
+// GetMetadata returns metadata of metric name from memory
+func (s *Storage) GetMetadata(ctx context.Context, name string) (entities.MetricMetadata, error) {
+	return s.front.GetMetadata(ctx, name)
+}
+
+// GetAllMetadata returns metadata of all names from memory
+func (s *Storage) GetAllMetadata(ctx context.Context) ([]entities.MetricMetadata, error) {
+	return s.front.GetAllMetadata(ctx)
+}
+
+// DeleteMetadata removes metadata from backend and memory
+func (s *Storage) DeleteMetadata(ctx context.Context, name string) error {
+	if err := s.back.DeleteMetadata(ctx, name); err != nil {
+		return err
+	}
+	if err := s.front.DeleteMetadata(ctx, name); err != nil && !errors.Is(err, entities.ErrMetadataNotFound) {
+		return err
+	}
+	return nil
+}
+
+// GetMetric returns metric from memory
+func (s *Storage) GetMetric(ctx context.Context, mType, mName string, labels map[string]string) (entities.MetricInternal, error) {
+	return s.front.GetMetric(ctx, mType, mName, labels)
+}
+
+// GetAllMetrics returns metrics from memory, which labels satisfy all matchers
+func (s *Storage) GetAllMetrics(ctx context.Context, matchers []entities.LabelMatcher) ([]entities.MetricInternal, error) {
+	return s.front.GetAllMetrics(ctx, matchers)
+}
+
+// GetMetricHistory returns history stored in backend
+func (s *Storage) GetMetricHistory(ctx context.Context, mType, mName string, labels map[string]string, from, to time.Time) ([]entities.MetricPointInternal, error) {
+	return s.back.GetMetricHistory(ctx, mType, mName, labels, from, to)
+}
+
+// GetRollups returns rollups stored in backend
+func (s *Storage) GetRollups(ctx context.Context, mName string, labels map[string]string, step time.Duration, from, to time.Time) ([]entities.RollupInternal, error) {
+	return s.back.GetRollups(ctx, mName, labels, step, from, to)
+}
+
+// Prune applies retention rules to backend and memory, report of backend is returned
+func (s *Storage) Prune(ctx context.Context, rules []entities.RetentionRule, now time.Time) (entities.PruneReport, error) {
+	report, err := s.back.Prune(ctx, rules, now)
+	if err != nil {
+		return entities.PruneReport{}, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err = s.front.Prune(ctx, rules, now); err != nil {
+		return entities.PruneReport{}, err
+	}
+	return report, nil
+}
+
+// Ping checks accessibility of backend
+func (s *Storage) Ping(ctx context.Context) error {
+	return s.back.Ping(ctx)
+}
+
+// JournalStats returns state of backend journal, zero if backend works without it
+func (s *Storage) JournalStats() entities.JournalStats {
+	if reporter, ok := s.back.(services.JournalReporter); ok {
+		return reporter.JournalStats()
+	}
+	return entities.JournalStats{}
+}
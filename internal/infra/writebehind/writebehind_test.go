@@ -0,0 +1,198 @@
+package writebehind
+
+import (
+	"context"
+	"errors"
+	"math"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/melkomukovki/go-musthave-metrics/internal/entities"
+	"github.com/melkomukovki/go-musthave-metrics/internal/infra/memstorage"
+	"github.com/melkomukovki/go-musthave-metrics/internal/infra/storagetest"
+	"github.com/melkomukovki/go-musthave-metrics/internal/services"
+)
+
+var errUnavailable = errors.New("storage is unavailable")
+
+// flakyBackend is memory backend, which writes fail while it is down
+type flakyBackend struct {
+	*memstorage.MemStorage
+	down    atomic.Bool
+	batches atomic.Int32
+}
+
+func (b *flakyBackend) AddMultipleMetrics(ctx context.Context, metrics []entities.MetricInternal) error {
+	if b.down.Load() {
+		return errUnavailable
+	}
+	b.batches.Add(1)
+	return b.MemStorage.AddMultipleMetrics(ctx, metrics)
+}
+
+func (b *flakyBackend) AddMetric(ctx context.Context, metric entities.MetricInternal) error {
+	if b.down.Load() {
+		return errUnavailable
+	}
+	return b.MemStorage.AddMetric(ctx, metric)
+}
+
+func (b *flakyBackend) DeleteMetric(ctx context.Context, mType, mName string, labels map[string]string) error {
+	if b.down.Load() {
+		return errUnavailable
+	}
+	return b.MemStorage.DeleteMetric(ctx, mType, mName, labels)
+}
+
+// newTestStorage returns cache in front of memory backend, which is flushed only explicitly
+func newTestStorage(t *testing.T, maxDirty int) (*Storage, *flakyBackend) {
+	t.Helper()
+
+	back := &flakyBackend{MemStorage: memstorage.NewClient(0, "", false, 1)}
+	s, err := NewClient(context.Background(), back, time.Hour, maxDirty)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		back.down.Store(false)
+		_ = s.Close()
+	})
+	return s, back
+}
+
+func assertValue(t *testing.T, ctx context.Context, repo services.ServiceRepository, mType, mName, expected string) {
+	t.Helper()
+	metric, err := repo.GetMetric(ctx, mType, mName, nil)
+	require.NoError(t, err)
+	assert.Equal(t, expected, metric.Value)
+}
+
+func TestStorage_WarmUp(t *testing.T) {
+	back := &flakyBackend{MemStorage: memstorage.NewClient(0, "", false, 1)}
+	teamA := entities.ContextWithTenant(context.Background(), "team-a")
+	require.NoError(t, back.IncrementCounter(context.Background(), "PollCount", nil, 5))
+	require.NoError(t, back.AddMetric(teamA, entities.MetricInternal{ID: "Alloc", MType: entities.Gauge, Value: "1.5"}))
+
+	s, err := NewClient(context.Background(), back, time.Hour, 0)
+	require.NoError(t, err)
+	defer func() { _ = s.Close() }()
+
+	assertValue(t, context.Background(), s, entities.Counter, "PollCount", "5")
+	assertValue(t, teamA, s, entities.Gauge, "Alloc", "1.5")
+	_, err = s.GetMetric(context.Background(), entities.Gauge, "Alloc", nil)
+	assert.ErrorIs(t, err, entities.ErrMetricNotFound)
+}
+
+func TestStorage_Flush(t *testing.T) {
+	s, back := newTestStorage(t, 0)
+	ctx := context.Background()
+
+	require.NoError(t, s.IncrementCounter(ctx, "PollCount", nil, 1))
+	require.NoError(t, s.AddMultipleMetrics(ctx, []entities.MetricInternal{
+		{ID: "PollCount", MType: entities.Counter, Value: "2"},
+		{ID: "Alloc", MType: entities.Gauge, Value: "1"},
+		{ID: "Alloc", MType: entities.Gauge, Value: "2"},
+		{ID: "Latency", MType: entities.Histogram, Value: `{"bounds":[1],"counts":[1,0],"sum":0.5,"count":1}`},
+	}))
+	require.NoError(t, s.MergeMetric(ctx, entities.MetricInternal{ID: "Latency", MType: entities.Histogram, Value: `{"bounds":[1],"counts":[0,1],"sum":2,"count":1}`}))
+
+	// Reads are served from memory before flush
+	assertValue(t, ctx, s, entities.Counter, "PollCount", "3")
+	_, err := back.GetMetric(ctx, entities.Counter, "PollCount", nil)
+	assert.ErrorIs(t, err, entities.ErrMetricNotFound)
+
+	require.NoError(t, s.Flush(ctx))
+	assert.EqualValues(t, 1, back.batches.Load(), "changes are written in one batch")
+	assertValue(t, ctx, back, entities.Counter, "PollCount", "3")
+	assertValue(t, ctx, back, entities.Gauge, "Alloc", "2")
+	assertValue(t, ctx, back, entities.Histogram, "Latency", `{"bounds":[1],"counts":[1,1],"sum":2.5,"count":2}`)
+
+	// Counter is flushed as increment, reset and deletion replace stored value
+	require.NoError(t, s.IncrementCounter(ctx, "PollCount", nil, 4))
+	require.NoError(t, s.DeleteMetric(ctx, entities.Gauge, "Alloc", nil))
+	require.NoError(t, s.ResetCounter(ctx, "PollCount", nil))
+	require.NoError(t, s.IncrementCounter(ctx, "PollCount", nil, 2))
+	require.NoError(t, s.Flush(ctx))
+	assertValue(t, ctx, back, entities.Counter, "PollCount", "2")
+	_, err = back.GetMetric(ctx, entities.Gauge, "Alloc", nil)
+	assert.ErrorIs(t, err, entities.ErrMetricNotFound)
+}
+
+func TestStorage_FailedFlushKeepsChanges(t *testing.T) {
+	s, back := newTestStorage(t, 0)
+	ctx := context.Background()
+
+	require.NoError(t, back.IncrementCounter(ctx, "PollCount", nil, 10))
+	require.NoError(t, s.IncrementCounter(ctx, "PollCount", nil, 1))
+	require.NoError(t, s.DeleteMetric(ctx, entities.Counter, "PollCount", nil))
+	require.NoError(t, s.IncrementCounter(ctx, "PollCount", nil, 2))
+
+	back.down.Store(true)
+	assert.ErrorIs(t, s.Flush(ctx), errUnavailable)
+	require.NoError(t, s.IncrementCounter(ctx, "PollCount", nil, 3))
+
+	back.down.Store(false)
+	require.NoError(t, s.Flush(ctx))
+	assertValue(t, ctx, back, entities.Counter, "PollCount", "5")
+	assertValue(t, ctx, s, entities.Counter, "PollCount", "5")
+}
+
+func TestStorage_UnconvertibleChangeStaysPending(t *testing.T) {
+	s, _ := newTestStorage(t, 0)
+	ctx := context.Background()
+
+	key := seriesKey{tenant: entities.DefaultTenant, mType: entities.Summary, series: "Latency"}
+	s.mu.Lock()
+	s.dirty[key] = &change{name: "Latency", dist: &entities.SummaryValue{Count: 1, Sum: math.NaN()}}
+	s.mu.Unlock()
+
+	assert.Error(t, s.Flush(ctx))
+	assert.Equal(t, 1, s.pending())
+}
+
+func TestStorage_DirtyLimit(t *testing.T) {
+	s, back := newTestStorage(t, 2)
+	ctx := context.Background()
+
+	require.NoError(t, s.IncrementCounter(ctx, "A", nil, 1))
+	require.NoError(t, s.IncrementCounter(ctx, "B", nil, 1))
+	// Full dirty set is flushed by writer
+	require.NoError(t, s.IncrementCounter(ctx, "C", nil, 1))
+	assertValue(t, ctx, back, entities.Counter, "A", "1")
+
+	back.down.Store(true)
+	require.NoError(t, s.IncrementCounter(ctx, "D", nil, 1))
+	err := s.IncrementCounter(ctx, "E", nil, 1)
+	assert.ErrorIs(t, err, entities.ErrFlushBacklog)
+	_, err = s.GetMetric(ctx, entities.Counter, "E", nil)
+	assert.ErrorIs(t, err, entities.ErrMetricNotFound, "rejected change is not applied")
+}
+
+func TestStorage_CloseFlushes(t *testing.T) {
+	back := &flakyBackend{MemStorage: memstorage.NewClient(0, "", false, 1)}
+	s, err := NewClient(context.Background(), back, time.Hour, 0)
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	start := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	require.NoError(t, s.AddMetric(ctx, entities.MetricInternal{ID: "Alloc", MType: entities.Gauge, Value: "7"}))
+	require.NoError(t, s.MergeRollups(ctx, []entities.RollupInternal{entities.NewRollup("Alloc", nil, time.Minute, start, 7)}))
+	require.NoError(t, s.MergeRollups(ctx, []entities.RollupInternal{entities.NewRollup("Alloc", nil, time.Minute, start, 3)}))
+	require.NoError(t, s.Close())
+
+	assertValue(t, ctx, back, entities.Gauge, "Alloc", "7")
+	rollups, err := back.GetRollups(ctx, "Alloc", nil, time.Minute, start, start.Add(time.Minute))
+	require.NoError(t, err)
+	require.Len(t, rollups, 1)
+	assert.EqualValues(t, 2, rollups[0].Count)
+	assert.Equal(t, 10.0, rollups[0].Sum)
+}
+
+func TestStorage_Conformance(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) services.ServiceRepository {
+		s, _ := newTestStorage(t, 0)
+		return s
+	})
+}
@@ -0,0 +1,189 @@
+package listener
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/melkomukovki/go-musthave-metrics/internal/entities"
+	"github.com/melkomukovki/go-musthave-metrics/internal/services"
+)
+
+// graphiteBatchSize - number of pending metrics, which are written without waiting for flush interval
+const graphiteBatchSize = 1000
+
+// Graphite converts lines of Graphite plaintext protocol `path value timestamp` to metrics with path as ID.
+// Type of metric is chosen by rules, paths matching no rule are gauges. Values of counters are cumulative,
+// so their increments since the previous written value of path are written: the first value creates counter,
+// value lower than previous one means that counter was reset and is written as increment.
+// Timestamps are ignored. Metrics are written in batches every flush interval or when batch is full,
+// they belong to entities.DefaultTenant
+type Graphite struct {
+	service *services.Service
+	rules   []entities.GraphiteRule
+
+	mu      sync.Mutex
+	pending []entities.Metric // Delta of pending counter is its value, increment is computed on write
+
+	// writeMu serializes writes, so increments are computed from values saved by previous write
+	writeMu sync.Mutex
+	last    map[string]int64 // Previous written values of counters by path
+
+	done      chan struct{}
+	wg        sync.WaitGroup
+	closeOnce sync.Once
+}
+
+// NewGraphite returns Graphite handler, which writes pending metrics every flushInterval until closed
+func NewGraphite(service *services.Service, rules []entities.GraphiteRule, flushInterval time.Duration) *Graphite {
+	g := &Graphite{
+		service: service,
+		rules:   rules,
+		last:    make(map[string]int64),
+		done:    make(chan struct{}),
+	}
+
+	g.wg.Add(1)
+	go g.runFlush(flushInterval)
+	return g
+}
+
+// HandleLine adds metric of Graphite line to pending batch, full batch is written immediately
+func (g *Graphite) HandleLine(line string) error {
+	fields := strings.Fields(line)
+	if len(fields) != 3 {
+		return errors.New("line must be `path value timestamp`")
+	}
+	path, rawValue := fields[0], fields[1]
+	if strings.HasPrefix(path, ".") || strings.HasSuffix(path, ".") || strings.Contains(path, "..") {
+		return fmt.Errorf("invalid path %q", path)
+	}
+	value, err := strconv.ParseFloat(rawValue, 64)
+	if err != nil || math.IsInf(value, 0) || math.IsNaN(value) {
+		return fmt.Errorf("invalid value %q", rawValue)
+	}
+	if _, err := strconv.ParseFloat(fields[2], 64); err != nil {
+		return fmt.Errorf("invalid timestamp %q", fields[2])
+	}
+
+	mType := entities.GraphiteTypeFor(g.rules, path)
+	if mType == entities.Counter && (value < 0 || value != math.Trunc(value) || value >= math.MaxInt64) {
+		return fmt.Errorf("counter %q value %s is not a non-negative integer", path, rawValue)
+	}
+
+	m := entities.Metric{ID: path, MType: mType}
+	if mType == entities.Counter {
+		current := int64(value)
+		m.Delta = &current
+	} else {
+		m.Value = &value
+	}
+
+	g.mu.Lock()
+	g.pending = append(g.pending, m)
+
+	var batch []entities.Metric
+	if len(g.pending) >= graphiteBatchSize {
+		batch, g.pending = g.pending, nil
+	}
+	g.mu.Unlock()
+
+	if batch != nil {
+		// Line itself is accepted, so failed write is reported separately
+		if err := g.write(context.Background(), batch); err != nil {
+			log.Error().Err(err).Int("metrics", len(batch)).Msg("failed to write Graphite metrics")
+		}
+	}
+	return nil
+}
+
+// Flush writes pending metrics to service. Metrics, which failed to be written, are dropped, but values
+// of their counters aren't saved, so their increments are written with the next values of paths
+func (g *Graphite) Flush(ctx context.Context) error {
+	g.mu.Lock()
+	batch := g.pending
+	g.pending = nil
+	g.mu.Unlock()
+
+	if len(batch) == 0 {
+		return nil
+	}
+	return g.write(ctx, batch)
+}
+
+// write stores batch of pending metrics, values of written counters are saved as previous values of their paths
+func (g *Graphite) write(ctx context.Context, batch []entities.Metric) error {
+	g.writeMu.Lock()
+	defer g.writeMu.Unlock()
+
+	// Counter may repeat in batch, then its increment is counted from the previous value
+	metrics := make([]entities.Metric, len(batch))
+	values := make(map[string]int64)
+	for i, m := range batch {
+		metrics[i] = m
+		if m.MType != entities.Counter {
+			continue
+		}
+		current := *m.Delta
+		prev, ok := values[m.ID]
+		if !ok {
+			prev, ok = g.last[m.ID]
+		}
+		var delta int64
+		if ok {
+			delta = current - prev
+			if current < prev {
+				delta = current
+			}
+		}
+		metrics[i].Delta = &delta
+		values[m.ID] = current
+	}
+
+	failed, err := g.service.AddMetricsPartially(ctx, metrics)
+	if err == nil || len(failed) > 0 {
+		for i, m := range batch {
+			if _, ok := failed[i]; m.MType == entities.Counter && !ok {
+				g.last[m.ID] = *m.Delta
+			}
+		}
+	}
+	return writeErr(metrics, failed, err)
+}
+
+// runFlush writes pending metrics periodically until handler is closed
+func (g *Graphite) runFlush(interval time.Duration) {
+	defer g.wg.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-g.done:
+			return
+		case <-ticker.C:
+			if err := g.Flush(context.Background()); err != nil {
+				log.Error().Err(err).Msg("failed to write Graphite metrics")
+			}
+		}
+	}
+}
+
+// Close stops periodic flush and writes pending metrics.
+// It must be called after listener is shut down, so no lines are received anymore
+func (g *Graphite) Close() (err error) {
+	g.closeOnce.Do(func() {
+		close(g.done)
+		g.wg.Wait()
+		err = g.Flush(context.Background())
+	})
+	return err
+}
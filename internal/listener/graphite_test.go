@@ -0,0 +1,154 @@
+package listener
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/melkomukovki/go-musthave-metrics/internal/entities"
+	"github.com/melkomukovki/go-musthave-metrics/internal/infra/memstorage"
+	"github.com/melkomukovki/go-musthave-metrics/internal/services"
+)
+
+func TestGraphite_HandleLine(t *testing.T) {
+	ctx := context.Background()
+	service := newService()
+	rules := []entities.GraphiteRule{{Path: "*.interface-*.if_octets.*", MType: entities.Counter}}
+	graphite := NewGraphite(service, rules, time.Hour)
+	defer graphite.Close()
+
+	for _, line := range []string{
+		"web1.load.shortterm 0.5 1700000000",
+		"web1.interface-eth0.if_octets.rx 1000 1700000000",
+		"web1.interface-eth0.if_octets.rx 1500 1700000010",
+	} {
+		require.NoError(t, graphite.HandleLine(line))
+	}
+	require.NoError(t, graphite.Flush(ctx))
+
+	load, err := service.GetMetric(ctx, entities.Gauge, "web1.load.shortterm", nil)
+	require.NoError(t, err)
+	assert.Equal(t, 0.5, *load.Value)
+
+	// The first value of counter is baseline, increments are written after it
+	rx, err := service.GetMetric(ctx, entities.Counter, "web1.interface-eth0.if_octets.rx", nil)
+	require.NoError(t, err)
+	assert.Equal(t, int64(500), *rx.Delta)
+
+	// Lower value means counter was reset
+	require.NoError(t, graphite.HandleLine("web1.interface-eth0.if_octets.rx 200 1700000020"))
+	require.NoError(t, graphite.Flush(ctx))
+	rx, err = service.GetMetric(ctx, entities.Counter, "web1.interface-eth0.if_octets.rx", nil)
+	require.NoError(t, err)
+	assert.Equal(t, int64(700), *rx.Delta)
+
+	for _, line := range []string{
+		"web1.load 1",
+		"web1.load x 1700000000",
+		"web1.load nan 1700000000",
+		"web1.load 1 soon",
+		"web1..load 1 1700000000",
+		"web1.interface-eth0.if_octets.tx 1.5 1700000000",
+	} {
+		assert.Error(t, graphite.HandleLine(line), line)
+	}
+
+	// Too long path is rejected by service, other metrics of batch are written
+	require.NoError(t, graphite.HandleLine(strings.Repeat("a.", entities.MaxNameLength/2)+"b 1 1700000000"))
+	require.NoError(t, graphite.HandleLine("web1.load 2 1700000000"))
+	assert.ErrorIs(t, graphite.Flush(ctx), entities.ErrNameTooLong)
+	load, err = service.GetMetric(ctx, entities.Gauge, "web1.load", nil)
+	require.NoError(t, err)
+	assert.Equal(t, 2.0, *load.Value)
+}
+
+func TestGraphite_FullBatch(t *testing.T) {
+	ctx := context.Background()
+	service := newService()
+	graphite := NewGraphite(service, nil, time.Hour)
+	defer graphite.Close()
+
+	for i := 0; i < graphiteBatchSize; i++ {
+		require.NoError(t, graphite.HandleLine(fmt.Sprintf("host.metric%d 1 1700000000", i)))
+	}
+
+	// Batch is written without flush
+	metrics, err := service.GetAllMetrics(ctx, nil)
+	require.NoError(t, err)
+	assert.Len(t, metrics, graphiteBatchSize)
+}
+
+// downStorage is memory storage, which writes of metrics fail while it is down
+type downStorage struct {
+	*memstorage.MemStorage
+	down bool
+}
+
+var errDown = errors.New("storage is down")
+
+func (s *downStorage) AddMultipleMetrics(ctx context.Context, metrics []entities.MetricInternal) error {
+	if s.down {
+		return errDown
+	}
+	return s.MemStorage.AddMultipleMetrics(ctx, metrics)
+}
+
+func TestGraphite_FailedWriteKeepsIncrement(t *testing.T) {
+	ctx := context.Background()
+	storage := &downStorage{MemStorage: memstorage.NewClient(0, "", false, 1)}
+	service := &services.Service{ServiceRepo: storage}
+	graphite := NewGraphite(service, []entities.GraphiteRule{{Path: "*.requests", MType: entities.Counter}}, time.Hour)
+	defer graphite.Close()
+
+	require.NoError(t, graphite.HandleLine("web1.requests 100 1700000000"))
+	require.NoError(t, graphite.Flush(ctx))
+
+	storage.down = true
+	require.NoError(t, graphite.HandleLine("web1.requests 150 1700000010"))
+	assert.ErrorIs(t, graphite.Flush(ctx), errDown)
+
+	// Value, which wasn't written, isn't previous value of path, so its increment is written with the next one
+	storage.down = false
+	require.NoError(t, graphite.HandleLine("web1.requests 170 1700000020"))
+	require.NoError(t, graphite.Flush(ctx))
+	requests, err := service.GetMetric(ctx, entities.Counter, "web1.requests", nil)
+	require.NoError(t, err)
+	assert.Equal(t, int64(70), *requests.Delta)
+}
+
+func TestServer_TrustedSubnet(t *testing.T) {
+	ctx := context.Background()
+	_, subnet, err := net.ParseCIDR("10.0.0.0/8")
+	require.NoError(t, err)
+
+	service := newService()
+	graphite := NewGraphite(service, nil, time.Hour)
+	srv := &Server{Name: "Graphite", Addr: "127.0.0.1:0", Subnet: subnet, Handler: graphite}
+	require.NoError(t, srv.Start())
+
+	conn, err := net.Dial("tcp", srv.ListenAddr())
+	require.NoError(t, err)
+	_, _ = fmt.Fprint(conn, "host.load 1 1700000000\n")
+
+	// Connection of peer outside of subnet is closed without reading
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+	_, err = conn.Read(make([]byte, 1))
+	assert.Error(t, err)
+	assert.False(t, errors.Is(err, os.ErrDeadlineExceeded))
+	require.NoError(t, conn.Close())
+
+	require.NoError(t, srv.Shutdown(ctx))
+	require.NoError(t, graphite.Close())
+
+	metrics, err := service.GetAllMetrics(ctx, nil)
+	require.NoError(t, err)
+	assert.Empty(t, metrics)
+}
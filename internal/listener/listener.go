@@ -0,0 +1,220 @@
+// Package listener receives metrics in text protocols of other monitoring systems over UDP and TCP
+package listener
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/melkomukovki/go-musthave-metrics/internal/entities"
+	"github.com/melkomukovki/go-musthave-metrics/internal/services"
+)
+
+// maxLineSize - maximum size of UDP packet and TCP line
+const maxLineSize = 64 * 1024
+
+// Handler processes single line of protocol
+type Handler interface {
+	HandleLine(line string) error
+}
+
+// Server receives lines of text protocol over TCP and optionally over UDP on the same address.
+// UDP packet may contain several lines separated by newline
+type Server struct {
+	Name    string // Name of protocol used in logs
+	Addr    string
+	UDP     bool       // Listen UDP too
+	Subnet  *net.IPNet // If set, only peers from subnet are served
+	Handler Handler
+
+	udp net.PacketConn
+	tcp net.Listener
+
+	mu      sync.Mutex
+	conns   map[net.Conn]struct{}
+	closing bool
+	wg      sync.WaitGroup
+}
+
+// Start listens on address and starts serving in background. If port of address is zero,
+// UDP listens on the same port as TCP, see ListenAddr
+func (s *Server) Start() (err error) {
+	if s.tcp, err = net.Listen("tcp", s.Addr); err != nil {
+		return err
+	}
+	if s.UDP {
+		if s.udp, err = net.ListenPacket("udp", s.tcp.Addr().String()); err != nil {
+			_ = s.tcp.Close()
+			return err
+		}
+		s.wg.Add(1)
+		go s.serveUDP()
+	}
+	s.conns = make(map[net.Conn]struct{})
+
+	s.wg.Add(1)
+	go s.serveTCP()
+	log.Info().Str("address", s.ListenAddr()).Msgf("%s listener started", s.Name)
+	return nil
+}
+
+// ListenAddr returns address server listens on
+func (s *Server) ListenAddr() string {
+	return s.tcp.Addr().String()
+}
+
+// Shutdown stops listening, closes TCP connections and waits until received lines are handled
+func (s *Server) Shutdown(ctx context.Context) error {
+	err := s.tcp.Close()
+	if s.udp != nil {
+		err = errors.Join(err, s.udp.Close())
+	}
+
+	s.mu.Lock()
+	s.closing = true
+	for conn := range s.conns {
+		_ = conn.Close()
+	}
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return err
+	case <-ctx.Done():
+		return errors.Join(err, ctx.Err())
+	}
+}
+
+func (s *Server) serveUDP() {
+	defer s.wg.Done()
+
+	buf := make([]byte, maxLineSize)
+	for {
+		n, addr, err := s.udp.ReadFrom(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Error().Err(err).Msgf("%s UDP listener failed", s.Name)
+			}
+			return
+		}
+		if !s.allowed(addr) {
+			continue
+		}
+		for _, line := range strings.Split(string(buf[:n]), "\n") {
+			s.handle(line, addr)
+		}
+	}
+}
+
+func (s *Server) serveTCP() {
+	defer s.wg.Done()
+
+	for {
+		conn, err := s.tcp.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Error().Err(err).Msgf("%s TCP listener failed", s.Name)
+			}
+			return
+		}
+
+		if !s.allowed(conn.RemoteAddr()) {
+			_ = conn.Close()
+			continue
+		}
+
+		s.mu.Lock()
+		if s.closing {
+			s.mu.Unlock()
+			_ = conn.Close()
+			return
+		}
+		s.conns[conn] = struct{}{}
+		s.mu.Unlock()
+
+		s.wg.Add(1)
+		go s.serveConn(conn)
+	}
+}
+
+func (s *Server) serveConn(conn net.Conn) {
+	defer s.wg.Done()
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		_ = conn.Close()
+	}()
+
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 0, 4096), maxLineSize)
+	for scanner.Scan() {
+		s.handle(scanner.Text(), conn.RemoteAddr())
+	}
+	if err := scanner.Err(); err != nil && !errors.Is(err, net.ErrClosed) {
+		log.Warn().Err(err).Str("remote", conn.RemoteAddr().String()).Msgf("%s connection failed", s.Name)
+	}
+}
+
+// allowed reports whether peer belongs to trusted subnet. Address of peer is taken from connection,
+// as protocols have no headers to pass it through proxy
+func (s *Server) allowed(addr net.Addr) bool {
+	if s.Subnet == nil {
+		return true
+	}
+	var ip net.IP
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip = a.IP
+	case *net.UDPAddr:
+		ip = a.IP
+	}
+	if ip != nil && s.Subnet.Contains(ip) {
+		return true
+	}
+	log.Warn().Str("remote", addr.String()).Str("subnet", s.Subnet.String()).Msgf("%s peer is not allowed", s.Name)
+	return false
+}
+
+// handle passes non-empty line to handler, errors are logged, so one bad line doesn't stop others
+func (s *Server) handle(line string, addr net.Addr) {
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return
+	}
+	if err := s.Handler.HandleLine(line); err != nil {
+		log.Warn().Err(err).Str("remote", addr.String()).Str("line", line).Msgf("%s line skipped", s.Name)
+	}
+}
+
+// write stores metrics with services.Service.AddMetricsPartially, see writeErr
+func write(ctx context.Context, service *services.Service, metrics []entities.Metric) error {
+	failed, err := service.AddMetricsPartially(ctx, metrics)
+	return writeErr(metrics, failed, err)
+}
+
+// writeErr returns errors of failed metrics joined, err is returned if no metrics failed
+func writeErr(metrics []entities.Metric, failed map[int]error, err error) error {
+	if len(failed) == 0 {
+		return err
+	}
+
+	var errs []error
+	for i, m := range metrics {
+		if mErr, ok := failed[i]; ok {
+			errs = append(errs, fmt.Errorf("%s %s: %w", m.MType, m.ID, mErr))
+		}
+	}
+	return errors.Join(errs...)
+}
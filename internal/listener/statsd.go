@@ -0,0 +1,266 @@
+package listener
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/melkomukovki/go-musthave-metrics/internal/entities"
+	"github.com/melkomukovki/go-musthave-metrics/internal/services"
+)
+
+// StatsD metric kinds
+const (
+	statsdCounter   = "c"
+	statsdGauge     = "g"
+	statsdTimer     = "ms"
+	statsdHistogram = "h" // Timer of DogStatsD
+	statsdSet       = "s"
+)
+
+// statsdSample is single metric of StatsD line
+type statsdSample struct {
+	name   string
+	kind   string
+	value  float64
+	delta  bool    // Gauge value is change of current value, it starts with sign
+	rate   float64 // Sample rate in (0, 1]
+	labels map[string]string
+}
+
+// parseStatsD parses line `name:value|kind[|@rate][|#tag:value,...]`. Tags of DogStatsD are converted to labels
+func parseStatsD(line string) (statsdSample, error) {
+	parts := strings.Split(line, "|")
+	if len(parts) < 2 {
+		return statsdSample{}, errors.New("metric kind is missing")
+	}
+
+	i := strings.LastIndexByte(parts[0], ':')
+	if i <= 0 {
+		return statsdSample{}, errors.New("metric must be `name:value`")
+	}
+	s := statsdSample{name: parts[0][:i], kind: parts[1], rate: 1}
+	rawValue := parts[0][i+1:]
+
+	switch s.kind {
+	case statsdCounter, statsdGauge, statsdTimer, statsdHistogram:
+	case statsdSet:
+		return statsdSample{}, errors.New("sets are not supported")
+	default:
+		return statsdSample{}, fmt.Errorf("unknown metric kind %q", s.kind)
+	}
+
+	value, err := strconv.ParseFloat(rawValue, 64)
+	if err != nil || math.IsInf(value, 0) || math.IsNaN(value) {
+		return statsdSample{}, fmt.Errorf("invalid value %q", rawValue)
+	}
+	s.value = value
+	s.delta = s.kind == statsdGauge && (rawValue[0] == '+' || rawValue[0] == '-')
+
+	for _, p := range parts[2:] {
+		switch {
+		case strings.HasPrefix(p, "@"):
+			rate, err := strconv.ParseFloat(p[1:], 64)
+			if err != nil || rate <= 0 || rate > 1 {
+				return statsdSample{}, fmt.Errorf("invalid sample rate %q", p[1:])
+			}
+			s.rate = rate
+		case strings.HasPrefix(p, "#"):
+			if s.labels, err = parseTags(p[1:]); err != nil {
+				return statsdSample{}, err
+			}
+		}
+		// Other extensions, e.g. container ID of DogStatsD, are ignored
+	}
+	return s, nil
+}
+
+// parseTags converts comma separated `name:value` tags to labels
+func parseTags(s string) (map[string]string, error) {
+	labels := make(map[string]string)
+	for _, tag := range strings.Split(s, ",") {
+		name, value, ok := strings.Cut(tag, ":")
+		if !ok {
+			return nil, fmt.Errorf("%w: tag %q must be `name:value`", entities.ErrInvalidLabel, tag)
+		}
+		labels[name] = value
+	}
+	return labels, entities.ValidateLabels(labels)
+}
+
+type counterAggregate struct {
+	name   string
+	labels map[string]string
+	value  float64
+}
+
+type gaugeAggregate struct {
+	name    string
+	labels  map[string]string
+	value   float64
+	updated bool
+}
+
+type timerAggregate struct {
+	name    string
+	labels  map[string]string
+	summary *entities.SummaryValue
+}
+
+// StatsD aggregates received StatsD metrics in memory and writes them to service every flush interval.
+// Counters are scaled by sample rate and written as increments, fraction is kept until the next flush.
+// Gauges keep their value between flushes, so changes with sign are applied to it, only updated gauges are written.
+// Timers are written as summaries of milliseconds, sampled timer counts for 1/rate observations.
+// Metrics belong to entities.DefaultTenant
+type StatsD struct {
+	service *services.Service
+
+	mu       sync.Mutex
+	counters map[string]*counterAggregate
+	gauges   map[string]*gaugeAggregate
+	timers   map[string]*timerAggregate
+
+	done      chan struct{}
+	wg        sync.WaitGroup
+	closeOnce sync.Once
+}
+
+// NewStatsD returns StatsD handler, which flushes aggregates every flushInterval until closed
+func NewStatsD(service *services.Service, flushInterval time.Duration) *StatsD {
+	s := &StatsD{
+		service:  service,
+		counters: make(map[string]*counterAggregate),
+		gauges:   make(map[string]*gaugeAggregate),
+		timers:   make(map[string]*timerAggregate),
+		done:     make(chan struct{}),
+	}
+
+	s.wg.Add(1)
+	go s.runFlush(flushInterval)
+	return s
+}
+
+// HandleLine adds metric of StatsD line to aggregates
+func (s *StatsD) HandleLine(line string) error {
+	sample, err := parseStatsD(line)
+	if err != nil {
+		return err
+	}
+	key := entities.SeriesKey(sample.name, sample.labels)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch sample.kind {
+	case statsdCounter:
+		c, ok := s.counters[key]
+		if !ok {
+			c = &counterAggregate{name: sample.name, labels: sample.labels}
+			s.counters[key] = c
+		}
+		c.value += sample.value / sample.rate
+	case statsdGauge:
+		g, ok := s.gauges[key]
+		if !ok {
+			g = &gaugeAggregate{name: sample.name, labels: sample.labels}
+			s.gauges[key] = g
+		}
+		if sample.delta {
+			g.value += sample.value
+		} else {
+			g.value = sample.value
+		}
+		g.updated = true
+	case statsdTimer, statsdHistogram:
+		t, ok := s.timers[key]
+		if !ok {
+			t = &timerAggregate{name: sample.name, labels: sample.labels, summary: entities.NewSummary(entities.DefaultSummaryAccuracy)}
+			s.timers[key] = t
+		}
+		t.summary.ObserveN(sample.value, uint64(math.Max(1, math.Round(1/sample.rate))))
+	}
+	return nil
+}
+
+// collect returns aggregates of interval ordered by type and series, and resets them
+func (s *StatsD) collect() []entities.Metric {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var metrics []entities.Metric
+	for key, c := range s.counters {
+		delta := int64(math.Round(c.value))
+		if delta != 0 {
+			metrics = append(metrics, entities.Metric{ID: c.name, MType: entities.Counter, Delta: &delta, Labels: c.labels})
+		}
+		if c.value -= float64(delta); math.Abs(c.value) < 1e-9 {
+			delete(s.counters, key)
+		}
+	}
+	for _, g := range s.gauges {
+		if g.updated {
+			value := g.value
+			metrics = append(metrics, entities.Metric{ID: g.name, MType: entities.Gauge, Value: &value, Labels: g.labels})
+			g.updated = false
+		}
+	}
+	for _, t := range s.timers {
+		metrics = append(metrics, entities.Metric{ID: t.name, MType: entities.Summary, Summary: t.summary, Labels: t.labels})
+	}
+	s.timers = make(map[string]*timerAggregate)
+
+	sort.Slice(metrics, func(i, j int) bool {
+		if metrics[i].MType != metrics[j].MType {
+			return metrics[i].MType < metrics[j].MType
+		}
+		return entities.SeriesKey(metrics[i].ID, metrics[i].Labels) < entities.SeriesKey(metrics[j].ID, metrics[j].Labels)
+	})
+	return metrics
+}
+
+// Flush writes aggregates of interval to service. Aggregates, which failed to be written, are dropped
+func (s *StatsD) Flush(ctx context.Context) error {
+	metrics := s.collect()
+	if len(metrics) == 0 {
+		return nil
+	}
+	return write(ctx, s.service, metrics)
+}
+
+// runFlush flushes aggregates periodically until handler is closed
+func (s *StatsD) runFlush(interval time.Duration) {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			if err := s.Flush(context.Background()); err != nil {
+				log.Error().Err(err).Msg("failed to flush StatsD metrics")
+			}
+		}
+	}
+}
+
+// Close stops periodic flush and writes the rest of aggregates.
+// It must be called after listener is shut down, so no lines are received anymore
+func (s *StatsD) Close() (err error) {
+	s.closeOnce.Do(func() {
+		close(s.done)
+		s.wg.Wait()
+		err = s.Flush(context.Background())
+	})
+	return err
+}
@@ -0,0 +1,161 @@
+package listener
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/melkomukovki/go-musthave-metrics/internal/entities"
+	"github.com/melkomukovki/go-musthave-metrics/internal/infra/memstorage"
+	"github.com/melkomukovki/go-musthave-metrics/internal/services"
+)
+
+func newService() *services.Service {
+	return &services.Service{ServiceRepo: memstorage.NewClient(0, "", false, 1)}
+}
+
+func TestParseStatsD(t *testing.T) {
+	tests := []struct {
+		line string
+		want statsdSample
+		err  bool
+	}{
+		{line: "hits:1|c", want: statsdSample{name: "hits", kind: "c", value: 1, rate: 1}},
+		{line: "hits:2|c|@0.5", want: statsdSample{name: "hits", kind: "c", value: 2, rate: 0.5}},
+		{line: "load:3.2|g", want: statsdSample{name: "load", kind: "g", value: 3.2, rate: 1}},
+		{line: "load:-1|g", want: statsdSample{name: "load", kind: "g", value: -1, delta: true, rate: 1}},
+		{line: "load:+1|g", want: statsdSample{name: "load", kind: "g", value: 1, delta: true, rate: 1}},
+		{line: "api.latency:320|ms|@0.1|#route:users,dc:eu", want: statsdSample{
+			name: "api.latency", kind: "ms", value: 320, rate: 0.1, labels: map[string]string{"route": "users", "dc": "eu"},
+		}},
+		{line: "hits", err: true},
+		{line: "hits|c", err: true},
+		{line: "hits:x|c", err: true},
+		{line: "hits:1|x", err: true},
+		{line: "users:1|s", err: true},
+		{line: "hits:1|c|@2", err: true},
+		{line: "hits:1|c|#route", err: true},
+		{line: "hits:1|c|#2route:a", err: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.line, func(t *testing.T) {
+			s, err := parseStatsD(tt.line)
+			if tt.err {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, s)
+		})
+	}
+}
+
+func TestStatsD_Flush(t *testing.T) {
+	ctx := context.Background()
+	service := newService()
+	statsd := NewStatsD(service, time.Hour)
+	defer statsd.Close()
+
+	for _, line := range []string{
+		"hits:1|c", "hits:1|c|@0.5", "hits:0.4|c",
+		"load:5|g", "load:-2|g",
+		"latency:10|ms", "latency:30|ms|@0.5",
+	} {
+		require.NoError(t, statsd.HandleLine(line))
+	}
+	require.NoError(t, statsd.Flush(ctx))
+
+	hits, err := service.GetMetric(ctx, entities.Counter, "hits", nil)
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), *hits.Delta)
+
+	load, err := service.GetMetric(ctx, entities.Gauge, "load", nil)
+	require.NoError(t, err)
+	assert.Equal(t, 3.0, *load.Value)
+
+	latency, err := service.GetMetric(ctx, entities.Summary, "latency", nil)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(3), latency.Summary.Count)
+	assert.Equal(t, 70.0, latency.Summary.Sum)
+
+	// Fraction of counter is kept, gauge changes apply to value of previous interval
+	require.NoError(t, statsd.HandleLine("hits:0.6|c"))
+	require.NoError(t, statsd.HandleLine("load:+1|g"))
+	require.NoError(t, statsd.Flush(ctx))
+
+	hits, err = service.GetMetric(ctx, entities.Counter, "hits", nil)
+	require.NoError(t, err)
+	assert.Equal(t, int64(4), *hits.Delta)
+	load, err = service.GetMetric(ctx, entities.Gauge, "load", nil)
+	require.NoError(t, err)
+	assert.Equal(t, 4.0, *load.Value)
+
+	// Sampled timer is weighted by sample rate instead of being observed repeatedly
+	require.NoError(t, statsd.HandleLine("rare:2|ms|@1e-9"))
+	require.NoError(t, statsd.Flush(ctx))
+	rare, err := service.GetMetric(ctx, entities.Summary, "rare", nil)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1e9), rare.Summary.Count)
+	assert.Equal(t, 2e9, rare.Summary.Sum)
+}
+
+func TestStatsD_FlushTypeConflict(t *testing.T) {
+	ctx := context.Background()
+	service := newService()
+	require.NoError(t, service.AddMetric(ctx, entities.Metric{ID: "jobs", MType: entities.Gauge, Value: new(float64)}))
+
+	statsd := NewStatsD(service, time.Hour)
+	defer statsd.Close()
+	require.NoError(t, statsd.HandleLine("jobs:1|c"))
+	require.NoError(t, statsd.HandleLine("done:2|c"))
+
+	// Conflicting counter is dropped, others are written
+	assert.ErrorIs(t, statsd.Flush(ctx), entities.ErrMetricTypeConflict)
+	done, err := service.GetMetric(ctx, entities.Counter, "done", nil)
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), *done.Delta)
+}
+
+func TestServer_StatsD(t *testing.T) {
+	ctx := context.Background()
+	service := newService()
+	statsd := NewStatsD(service, time.Hour)
+	srv := &Server{Name: "StatsD", Addr: "127.0.0.1:0", UDP: true, Handler: statsd}
+	require.NoError(t, srv.Start())
+
+	udp, err := net.Dial("udp", srv.ListenAddr())
+	require.NoError(t, err)
+	_, err = udp.Write([]byte("hits:1|c\nhits:2|c\nbroken\n"))
+	require.NoError(t, err)
+	require.NoError(t, udp.Close())
+
+	tcp, err := net.Dial("tcp", srv.ListenAddr())
+	require.NoError(t, err)
+	_, err = fmt.Fprint(tcp, "hits:4|c\nload:7|g\n")
+	require.NoError(t, err)
+	require.NoError(t, tcp.Close())
+
+	// Lines are handled in background, aggregates are written once they arrive
+	require.Eventually(t, func() bool {
+		statsd.mu.Lock()
+		defer statsd.mu.Unlock()
+		c, ok := statsd.counters["hits"]
+		return ok && c.value == 7 && statsd.gauges["load"] != nil
+	}, time.Second, 10*time.Millisecond)
+
+	require.NoError(t, srv.Shutdown(ctx))
+	require.NoError(t, statsd.Close())
+
+	hits, err := service.GetMetric(ctx, entities.Counter, "hits", nil)
+	require.NoError(t, err)
+	assert.Equal(t, int64(7), *hits.Delta)
+	load, err := service.GetMetric(ctx, entities.Gauge, "load", nil)
+	require.NoError(t, err)
+	assert.Equal(t, 7.0, *load.Value)
+}
@@ -0,0 +1,127 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/melkomukovki/go-musthave-metrics/internal/config"
+	"github.com/melkomukovki/go-musthave-metrics/internal/infra/memstorage"
+	"github.com/melkomukovki/go-musthave-metrics/internal/infra/postgres"
+	"github.com/melkomukovki/go-musthave-metrics/internal/services"
+)
+
+// Storages, between which metrics are copied
+const (
+	copyStorageFile     = "file"
+	copyStorageDatabase = "database"
+)
+
+// errStoragesMismatch returned when storages differ after copy
+var errStoragesMismatch = errors.New("storages don't match")
+
+// RunCopy - копирование метрик между файлом хранилища и базой данных с последующей сверкой.
+// Пример: `server copy -from file -to database -f metrics.json -d <dsn>`
+func RunCopy(args []string) error {
+	fs := flag.NewFlagSet("copy", flag.ContinueOnError)
+	from := fs.String("from", copyStorageFile, "Source storage: `file` or `database`")
+	to := fs.String("to", copyStorageDatabase, "Destination storage: `file` or `database`")
+	path := fs.String("f", config.DefaultFileStoragePath, "File with metrics")
+	generations := fs.Int("store-generations", config.DefaultStoreGenerations, "Number of kept storage file generations")
+	dsn := fs.String("d", os.Getenv("DATABASE_DSN"), "Database DSN")
+	deleteExtra := fs.Bool("delete-extra", false, "Delete metrics of destination, which are absent in source")
+	verifyOnly := fs.Bool("verify-only", false, "Compare storages without copying")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *from == *to {
+		return fmt.Errorf("source and destination must be different storages")
+	}
+	if *dsn == "" {
+		return fmt.Errorf("database DSN is required")
+	}
+
+	// Source file is only read, so storage of running server can be copied
+	src, err := openCopyStorage(*from, *path, *generations, *dsn, true)
+	if err != nil {
+		return err
+	}
+	defer closeCopyStorage(src)
+	dst, err := openCopyStorage(*to, *path, *generations, *dsn, false)
+	if err != nil {
+		return err
+	}
+	defer closeCopyStorage(dst)
+
+	ctx := context.Background()
+	if !*verifyOnly {
+		report, err := services.CopyMetrics(ctx, src, dst, *deleteExtra)
+		if err != nil {
+			return err
+		}
+		log.Info().Int("copied", report.Copied).Int("unchanged", report.Unchanged).Int("deleted", report.Deleted).Int("metadata", report.Metadata).
+			Str("from", *from).Str("to", *to).Msg("metrics copied")
+	}
+
+	mismatches, err := services.VerifyMetrics(ctx, src, dst)
+	if err != nil {
+		return err
+	}
+	for _, m := range mismatches {
+		log.Warn().Str("tenant", m.Tenant).Str("type", m.Metric.MType).Str("id", m.Metric.ID).Interface("labels", m.Metric.Labels).
+			Str("value", m.Metric.Value).Str("other", m.Other).Str("reason", m.Reason).Msg("metric mismatch")
+	}
+	if len(mismatches) > 0 {
+		return fmt.Errorf("%w: %d metrics differ", errStoragesMismatch, len(mismatches))
+	}
+	log.Info().Msg("storages match")
+	return nil
+}
+
+// openCopyStorage opens storage taking part in copy
+func openCopyStorage(kind, path string, generations int, dsn string, readOnly bool) (services.TenantRepository, error) {
+	switch kind {
+	case copyStorageFile:
+		if readOnly {
+			storage, report := memstorage.Load(path, generations)
+			logRestore(report)
+			return storage, nil
+		}
+		storage := memstorage.NewClient(0, path, true, generations)
+		logRestore(storage.LastRestore())
+		return storage, nil
+	case copyStorageDatabase:
+		pool, err := postgres.NewClient(dsn)
+		if err != nil {
+			return nil, err
+		}
+		return &postgres.PgRepository{DB: pool}, nil
+	default:
+		return nil, fmt.Errorf("unknown storage: %s", kind)
+	}
+}
+
+// logRestore reports records of storage file, which can't be copied
+func logRestore(report memstorage.RestoreReport) {
+	for _, r := range report.Rejected {
+		log.Warn().Err(r.Err).Str("source", r.Source).Int("line", r.Line).Msg("record of storage file is skipped")
+	}
+}
+
+// closeCopyStorage persists changes of file storage and closes database connections
+func closeCopyStorage(storage services.TenantRepository) {
+	if pg, ok := storage.(*postgres.PgRepository); ok {
+		pg.DB.Close()
+		return
+	}
+	if closer, ok := storage.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			log.Error().Err(err).Msg("error while closing storage")
+		}
+	}
+}
@@ -6,6 +6,8 @@ import (
 	"github.com/melkomukovki/go-musthave-metrics/internal/config"
 	"github.com/melkomukovki/go-musthave-metrics/internal/controllers"
 	pc "github.com/melkomukovki/go-musthave-metrics/internal/crypto"
+	"github.com/melkomukovki/go-musthave-metrics/internal/entities"
+	"github.com/melkomukovki/go-musthave-metrics/internal/influx"
 	"github.com/melkomukovki/go-musthave-metrics/internal/infra/memstorage"
 	"github.com/melkomukovki/go-musthave-metrics/internal/services"
 	"log"
@@ -16,7 +18,7 @@ func Example_run() {
 	cfg, _ := config.GetServerConfig()
 
 	// Create ServiceRepository
-	serviceRepository := memstorage.NewClient(cfg.StoreInterval, cfg.FileStoragePath, cfg.Restore)
+	serviceRepository := memstorage.NewClient(cfg.StoreInterval, cfg.FileStoragePath, cfg.Restore, cfg.StoreGenerations)
 
 	// Wire repository and logic
 	appService := &services.Service{
@@ -31,7 +33,8 @@ func Example_run() {
 
 	// Create gin engine with routes
 	router := gin.Default()
-	controllers.NewHandler(router, appService, cfg.HashKey, cert, cfg.TrustedSubnet)
+	apiKeys, _ := entities.ParseAPIKeys(cfg.APIKeys)
+	controllers.NewHandler(router, appService, cfg.HashKey, cert, cfg.TrustedSubnet, apiKeys, true, influx.NewConverter(nil, influx.TagsAsLabels))
 
 	// Run server
 	if err := router.Run(cfg.Address); err != nil {
@@ -10,20 +10,33 @@ import (
 	"github.com/melkomukovki/go-musthave-metrics/internal/controllers"
 	"github.com/melkomukovki/go-musthave-metrics/internal/controllers/middleware"
 	pc "github.com/melkomukovki/go-musthave-metrics/internal/crypto"
+	"github.com/melkomukovki/go-musthave-metrics/internal/entities"
+	"github.com/melkomukovki/go-musthave-metrics/internal/influx"
+	"github.com/melkomukovki/go-musthave-metrics/internal/infra/dualwrite"
 	"github.com/melkomukovki/go-musthave-metrics/internal/infra/memstorage"
 	"github.com/melkomukovki/go-musthave-metrics/internal/infra/postgres"
+	"github.com/melkomukovki/go-musthave-metrics/internal/infra/writebehind"
+	"github.com/melkomukovki/go-musthave-metrics/internal/listener"
 	pb "github.com/melkomukovki/go-musthave-metrics/internal/proto"
 	"github.com/melkomukovki/go-musthave-metrics/internal/services"
 	"github.com/rs/zerolog/log"
 	"google.golang.org/grpc"
+	"io"
 	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"sync"
 	"syscall"
 	"time"
 )
 
+// journalReplayInterval - how often server tries to replay journal to database
+const journalReplayInterval = 5 * time.Second
+
+// graphiteFlushInterval - how often batches of Graphite metrics are written
+const graphiteFlushInterval = time.Second
+
 // Run - подготовка необходимых компонентов и запуск сервера
 func Run() {
 	cfg, err := config.GetServerConfig()
@@ -40,24 +53,101 @@ func Run() {
 		}
 	}
 
+	apiKeys, err := entities.ParseAPIKeys(cfg.APIKeys)
+	if err != nil {
+		log.Fatal().Err(err).Msg("can't parse API keys")
+	}
+	retentionRules, err := entities.ParseRetentionRules(cfg.RetentionRules)
+	if err != nil {
+		log.Fatal().Err(err).Msg("can't parse retention rules")
+	}
+	graphiteRules, err := entities.ParseGraphiteRules(cfg.GraphiteRules)
+	if err != nil {
+		log.Fatal().Err(err).Msg("can't parse graphite rules")
+	}
+	influxRules, err := entities.ParseInfluxIntegerRules(cfg.InfluxIntegerRules)
+	if err != nil {
+		log.Fatal().Err(err).Msg("can't parse influx integer rules")
+	}
+	// Listeners of StatsD and Graphite check subnet of peer address, protocols can't pass X-Real-IP
+	var trustedSubnet *net.IPNet
+	if cfg.TrustedSubnet != "" {
+		if _, trustedSubnet, err = net.ParseCIDR(cfg.TrustedSubnet); err != nil {
+			log.Fatal().Err(err).Msg("can't parse trusted subnet")
+		}
+	}
+
+	if cfg.MigrateOnly || cfg.MigrateDown > 0 {
+		runMigrations(cfg)
+		return
+	}
+
 	var serviceRepository services.ServiceRepository
+	var pgRepository *postgres.PgRepository
 	if cfg.DataSourceName != "" {
 		store, e := postgres.NewClient(cfg.DataSourceName)
 		if e != nil {
 			log.Fatal().Err(e).Msg("can't initialize postgresql storage")
 		}
-		serviceRepository = &postgres.PgRepository{DB: store}
+		pgRepository = &postgres.PgRepository{DB: store}
+		if cfg.JournalPath != "" {
+			pgRepository.Journal, e = postgres.OpenJournal(cfg.JournalPath, int64(cfg.JournalMaxSize)<<20)
+			if e != nil {
+				log.Fatal().Err(e).Msg("can't open journal")
+			}
+			log.Info().Int("records", pgRepository.Journal.Stats().Records).Str("path", cfg.JournalPath).Msg("journal opened")
+		}
+		serviceRepository = pgRepository
+		if cfg.CacheFlushInterval > 0 {
+			cache, e := writebehind.NewClient(context.Background(), pgRepository, time.Duration(cfg.CacheFlushInterval)*time.Second, cfg.CacheMaxDirty)
+			if e != nil {
+				log.Fatal().Err(e).Msg("can't initialize write-behind cache")
+			}
+			serviceRepository = cache
+		}
 	} else {
-		serviceRepository = memstorage.NewClient(cfg.StoreInterval, cfg.FileStoragePath, cfg.Restore)
+		serviceRepository = memstorage.NewClient(cfg.StoreInterval, cfg.FileStoragePath, cfg.Restore, cfg.StoreGenerations)
+	}
+
+	// In dual-write mode changes go to both storages, so server can be moved between them without downtime
+	switch cfg.DualWrite {
+	case config.DualWriteFile:
+		fileRepository := memstorage.NewClient(cfg.StoreInterval, cfg.FileStoragePath, cfg.Restore, cfg.StoreGenerations)
+		serviceRepository = &dualwrite.Storage{Primary: fileRepository, Secondary: serviceRepository}
+	case config.DualWriteDatabase:
+		fileRepository := memstorage.NewClient(cfg.StoreInterval, cfg.FileStoragePath, cfg.Restore, cfg.StoreGenerations)
+		serviceRepository = &dualwrite.Storage{Primary: serviceRepository, Secondary: fileRepository}
 	}
 
 	appService := &services.Service{
 		ServiceRepo: serviceRepository,
 	}
 
+	// Retention and journal replay run in background until shutdown, they must stop before storage is closed
+	backgroundCtx, stopBackground := context.WithCancel(context.Background())
+	var backgroundWG sync.WaitGroup
+	if len(retentionRules) > 0 {
+		for _, rule := range retentionRules {
+			log.Info().Str("rule", rule.String()).Msg("retention rule")
+		}
+		backgroundWG.Add(1)
+		go func() {
+			defer backgroundWG.Done()
+			appService.RunRetention(backgroundCtx, retentionRules, time.Duration(cfg.RetentionInterval)*time.Second)
+		}()
+	}
+
+	if pgRepository != nil && pgRepository.Journal != nil {
+		backgroundWG.Add(1)
+		go func() {
+			defer backgroundWG.Done()
+			pgRepository.RunJournalReplay(backgroundCtx, journalReplayInterval)
+		}()
+	}
+
 	router := gin.Default()
 	pprof.Register(router)
-	controllers.NewHandler(router, appService, cfg.HashKey, certKey, cfg.TrustedSubnet)
+	controllers.NewHandler(router, appService, cfg.HashKey, certKey, cfg.TrustedSubnet, apiKeys, cfg.MetricsAddress == "", influx.NewConverter(influxRules, cfg.InfluxTags))
 
 	srv := &http.Server{
 		Addr:    cfg.Address,
@@ -65,16 +155,60 @@ func Run() {
 	}
 
 	go func() {
-		if err = srv.ListenAndServe(); err != nil {
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
 			log.Fatal().Err(err).Msg("error while running server")
 		}
 	}()
 
+	// Prometheus may scrape metrics from separate address, which isn't exposed with ingest API
+	var metricsSrv *http.Server
+	if cfg.MetricsAddress != "" {
+		metricsRouter := gin.New()
+		controllers.NewExpositionHandler(metricsRouter, appService, cfg.TrustedSubnet, apiKeys)
+		metricsSrv = &http.Server{
+			Addr:    cfg.MetricsAddress,
+			Handler: metricsRouter,
+		}
+
+		go func() {
+			log.Info().Str("address", cfg.MetricsAddress).Msg("metrics exposition server started")
+			if err := metricsSrv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				log.Fatal().Err(err).Msg("error while running metrics exposition server")
+			}
+		}()
+	}
+
+	// StatsD metrics are aggregated in memory and written every flush interval
+	var statsd *listener.StatsD
+	var statsdSrv *listener.Server
+	if cfg.StatsdAddress != "" {
+		statsd = listener.NewStatsD(appService, time.Duration(cfg.StatsdFlush)*time.Second)
+		statsdSrv = &listener.Server{Name: "StatsD", Addr: cfg.StatsdAddress, UDP: true, Subnet: trustedSubnet, Handler: statsd}
+		if err := statsdSrv.Start(); err != nil {
+			log.Fatal().Err(err).Msg("can't start StatsD listener")
+		}
+	}
+
+	// Graphite metrics are written in batches
+	var graphite *listener.Graphite
+	var graphiteSrv *listener.Server
+	if cfg.GraphiteAddress != "" {
+		graphite = listener.NewGraphite(appService, graphiteRules, graphiteFlushInterval)
+		graphiteSrv = &listener.Server{Name: "Graphite", Addr: cfg.GraphiteAddress, Subnet: trustedSubnet, Handler: graphite}
+		if err := graphiteSrv.Start(); err != nil {
+			log.Fatal().Err(err).Msg("can't start Graphite listener")
+		}
+	}
+
 	var grpcServer *grpc.Server
 	if cfg.GrpcAddress != "" {
 		go func() {
+			interceptors := []grpc.UnaryServerInterceptor{middleware.LoggerInterceptor}
+			if len(apiKeys) > 0 {
+				interceptors = append(interceptors, middleware.TenantInterceptor(apiKeys))
+			}
 			grpcServer = grpc.NewServer(
-				grpc.UnaryInterceptor(middleware.LoggerInterceptor),
+				grpc.ChainUnaryInterceptor(interceptors...),
 			)
 			grpcHandler := controllers.NewMetricsServer(appService)
 			pb.RegisterMetricsServer(grpcServer, grpcHandler)
@@ -99,8 +233,15 @@ func Run() {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
+	// Buffered metrics are written by the steps below, so they must run even if server isn't stopped cleanly
 	if err := srv.Shutdown(ctx); err != nil {
-		log.Fatal().Err(err).Msg("error while shutting down server")
+		log.Error().Err(err).Msg("error while shutting down server")
+	}
+
+	if metricsSrv != nil {
+		if err := metricsSrv.Shutdown(ctx); err != nil {
+			log.Error().Err(err).Msg("error while shutting down metrics exposition server")
+		}
 	}
 
 	if grpcServer != nil {
@@ -108,5 +249,59 @@ func Run() {
 		log.Info().Msg("grpc server stopped")
 	}
 
+	// Aggregates are written after listener stops receiving lines, storage must be still open
+	if statsdSrv != nil {
+		if err := statsdSrv.Shutdown(ctx); err != nil {
+			log.Error().Err(err).Msg("error while shutting down StatsD listener")
+		}
+		if err := statsd.Close(); err != nil {
+			log.Error().Err(err).Msg("failed to flush StatsD metrics")
+		}
+		log.Info().Msg("StatsD listener stopped")
+	}
+	if graphiteSrv != nil {
+		if err := graphiteSrv.Shutdown(ctx); err != nil {
+			log.Error().Err(err).Msg("error while shutting down Graphite listener")
+		}
+		if err := graphite.Close(); err != nil {
+			log.Error().Err(err).Msg("failed to write Graphite metrics")
+		}
+		log.Info().Msg("Graphite listener stopped")
+	}
+
+	stopBackground()
+	backgroundWG.Wait()
+
+	if closer, ok := serviceRepository.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			log.Error().Err(err).Msg("error while closing storage")
+		}
+	}
+
 	log.Info().Msg("server gracefully stopped")
 }
+
+// runMigrations - применение или откат миграций базы данных без запуска сервера
+func runMigrations(cfg config.ServerConfig) {
+	db, err := postgres.Open(cfg.DataSourceName)
+	if err != nil {
+		log.Fatal().Err(err).Msg("can't connect to postgresql storage")
+	}
+	defer db.Close()
+
+	ctx := context.Background()
+	if cfg.MigrateDown > 0 {
+		reverted, err := postgres.MigrateDown(ctx, db, cfg.MigrateDown)
+		if err != nil {
+			log.Fatal().Err(err).Msg("can't revert migrations")
+		}
+		log.Info().Int("reverted", reverted).Msg("migrations reverted")
+		return
+	}
+
+	applied, err := postgres.MigrateUp(ctx, db)
+	if err != nil {
+		log.Fatal().Err(err).Msg("can't apply migrations")
+	}
+	log.Info().Int("applied", applied).Msg("migrations applied")
+}
@@ -0,0 +1,221 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strconv"
+
+	"github.com/melkomukovki/go-musthave-metrics/internal/entities"
+)
+
+// TenantRepository is storage, which can list tenants having metrics
+type TenantRepository interface {
+	ServiceRepository
+	// Tenants returns tenants having stored metrics
+	Tenants(ctx context.Context) ([]string, error)
+}
+
+// storageContent is current values of all metrics of storage: tenant -> metric key -> metric
+type storageContent map[string]map[string]entities.MetricInternal
+
+// metricKey identifies metric inside tenant
+func metricKey(m entities.MetricInternal) string {
+	return m.MType + ":" + entities.SeriesKey(m.ID, m.Labels)
+}
+
+// contentOf reads current values of all metrics of all tenants
+func contentOf(ctx context.Context, repo TenantRepository) (storageContent, error) {
+	tenants, err := repo.Tenants(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	content := make(storageContent, len(tenants))
+	for _, tenant := range tenants {
+		metrics, err := repo.GetAllMetrics(entities.ContextWithTenant(ctx, tenant), nil)
+		if err != nil {
+			return nil, err
+		}
+		content[tenant] = make(map[string]entities.MetricInternal, len(metrics))
+		for _, m := range metrics {
+			content[tenant][metricKey(m)] = m
+		}
+	}
+	return content, nil
+}
+
+// sortedKeys returns keys of map in ascending order, so storages are processed in stable order
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// sameValue reports whether internal values of metric are equal. Storages may format the same value
+// differently, e.g. postgresql normalizes JSON of distributions, so values are compared after parsing
+func sameValue(mType, a, b string) bool {
+	if a == b {
+		return true
+	}
+	switch mType {
+	case entities.Gauge:
+		va, errA := strconv.ParseFloat(a, 64)
+		vb, errB := strconv.ParseFloat(b, 64)
+		return errA == nil && errB == nil && va == vb
+	case entities.Histogram, entities.Summary:
+		da, errA := entities.ParseDistribution(mType, a)
+		db, errB := entities.ParseDistribution(mType, b)
+		if errA != nil || errB != nil {
+			return false
+		}
+		fa, errA := entities.FormatDistribution(da)
+		fb, errB := entities.FormatDistribution(db)
+		return errA == nil && errB == nil && fa == fb
+	default:
+		return false
+	}
+}
+
+// CopyMetrics copies current values of all metrics of all tenants from src to dst.
+// Metrics, which already have the same value in dst, are not written, so copy can be repeated safely.
+// Metrics of dst absent in src are deleted if deleteExtra is set. Metadata of names is copied the same way,
+// history and rollups are not copied
+func CopyMetrics(ctx context.Context, src, dst TenantRepository, deleteExtra bool) (report entities.CopyReport, err error) {
+	from, err := contentOf(ctx, src)
+	if err != nil {
+		return report, err
+	}
+	to, err := contentOf(ctx, dst)
+	if err != nil {
+		return report, err
+	}
+
+	for _, tenant := range sortedKeys(from) {
+		tCtx := entities.ContextWithTenant(ctx, tenant)
+		for _, key := range sortedKeys(from[tenant]) {
+			m := from[tenant][key]
+			if existing, ok := to[tenant][key]; ok && sameValue(m.MType, m.Value, existing.Value) {
+				report.Unchanged++
+				continue
+			}
+			if err = dst.AddMetric(tCtx, m); err != nil {
+				return report, err
+			}
+			report.Copied++
+		}
+	}
+
+	for _, tenant := range sortedKeys(from) {
+		n, err := copyMetadata(entities.ContextWithTenant(ctx, tenant), src, dst, deleteExtra)
+		report.Metadata += n
+		if err != nil {
+			return report, err
+		}
+	}
+
+	if !deleteExtra {
+		return report, nil
+	}
+	for _, tenant := range sortedKeys(to) {
+		tCtx := entities.ContextWithTenant(ctx, tenant)
+		for _, key := range sortedKeys(to[tenant]) {
+			if _, ok := from[tenant][key]; ok {
+				continue
+			}
+			// Metric may be deleted since it was read, then there is nothing to count
+			m := to[tenant][key]
+			err = dst.DeleteMetric(tCtx, m.MType, m.ID, m.Labels)
+			switch {
+			case errors.Is(err, entities.ErrMetricNotFound):
+				continue
+			case err != nil:
+				return report, err
+			}
+			report.Deleted++
+		}
+	}
+	return report, nil
+}
+
+// copyMetadata writes metadata of tenant from src to dst, returns number of written names.
+// Name owned by another type in dst is released first, so owner of src wins
+func copyMetadata(ctx context.Context, src, dst TenantRepository, deleteExtra bool) (copied int, err error) {
+	from, err := src.GetAllMetadata(ctx)
+	if err != nil {
+		return 0, err
+	}
+	to, err := dst.GetAllMetadata(ctx)
+	if err != nil {
+		return 0, err
+	}
+	existing := make(map[string]entities.MetricMetadata, len(to))
+	for _, meta := range to {
+		existing[meta.Name] = meta
+	}
+
+	for _, meta := range from {
+		current, ok := existing[meta.Name]
+		delete(existing, meta.Name)
+		if ok && current == meta {
+			continue
+		}
+		if ok && current.Type != meta.Type {
+			if err = dst.DeleteMetadata(ctx, meta.Name); err != nil && !errors.Is(err, entities.ErrMetadataNotFound) {
+				return copied, err
+			}
+		}
+		if err = dst.SetMetadata(ctx, meta); err != nil {
+			return copied, err
+		}
+		copied++
+	}
+
+	if !deleteExtra {
+		return copied, nil
+	}
+	for _, name := range sortedKeys(existing) {
+		if err = dst.DeleteMetadata(ctx, name); err != nil && !errors.Is(err, entities.ErrMetadataNotFound) {
+			return copied, err
+		}
+	}
+	return copied, nil
+}
+
+// VerifyMetrics compares current values of all metrics of all tenants of two storages, empty result means they match
+func VerifyMetrics(ctx context.Context, a, b TenantRepository) ([]entities.MetricMismatch, error) {
+	first, err := contentOf(ctx, a)
+	if err != nil {
+		return nil, err
+	}
+	second, err := contentOf(ctx, b)
+	if err != nil {
+		return nil, err
+	}
+
+	var mismatches []entities.MetricMismatch
+	for _, tenant := range sortedKeys(first) {
+		for _, key := range sortedKeys(first[tenant]) {
+			m := first[tenant][key]
+			other, ok := second[tenant][key]
+			switch {
+			case !ok:
+				mismatches = append(mismatches, entities.MetricMismatch{Tenant: tenant, Metric: m, Reason: entities.MismatchMissing})
+			case !sameValue(m.MType, m.Value, other.Value):
+				mismatches = append(mismatches, entities.MetricMismatch{Tenant: tenant, Metric: m, Other: other.Value, Reason: entities.MismatchDifferent})
+			}
+		}
+	}
+	for _, tenant := range sortedKeys(second) {
+		for _, key := range sortedKeys(second[tenant]) {
+			if _, ok := first[tenant][key]; !ok {
+				m := second[tenant][key]
+				mismatches = append(mismatches, entities.MetricMismatch{Tenant: tenant, Metric: m, Other: m.Value, Reason: entities.MismatchExtra})
+			}
+		}
+	}
+	return mismatches, nil
+}
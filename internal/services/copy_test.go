@@ -0,0 +1,143 @@
+package services
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/melkomukovki/go-musthave-metrics/internal/entities"
+	"github.com/melkomukovki/go-musthave-metrics/internal/infra/memstorage"
+)
+
+func newCopyStorage(t *testing.T, metrics map[string][]entities.MetricInternal) *memstorage.MemStorage {
+	t.Helper()
+	storage := memstorage.NewClient(0, "", false, 1)
+	for tenant, tenantMetrics := range metrics {
+		require.NoError(t, storage.AddMultipleMetrics(entities.ContextWithTenant(context.Background(), tenant), tenantMetrics))
+	}
+	return storage
+}
+
+func TestCopyMetrics(t *testing.T) {
+	src := newCopyStorage(t, map[string][]entities.MetricInternal{
+		entities.DefaultTenant: {
+			{ID: "Alloc", MType: entities.Gauge, Value: "1.5"},
+			{ID: "PollCount", MType: entities.Counter, Value: "7"},
+			{ID: "latency", MType: entities.Histogram, Value: `{"bounds":[1],"counts":[1,2],"sum":5.5,"count":3}`},
+		},
+		"team-a": {{ID: "Alloc", MType: entities.Gauge, Value: "2", Labels: map[string]string{"host": "a"}}},
+	})
+	dst := newCopyStorage(t, map[string][]entities.MetricInternal{
+		entities.DefaultTenant: {
+			{ID: "Alloc", MType: entities.Gauge, Value: "1.50"},
+			{ID: "PollCount", MType: entities.Counter, Value: "3"},
+			{ID: "Stale", MType: entities.Gauge, Value: "1"},
+		},
+	})
+	ctx := context.Background()
+
+	report, err := CopyMetrics(ctx, src, dst, false)
+	require.NoError(t, err)
+	// Gauge formatted differently has the same value, counter is overwritten, not incremented
+	assert.Equal(t, entities.CopyReport{Copied: 3, Unchanged: 1}, report)
+
+	counter, err := dst.GetMetric(ctx, entities.Counter, "PollCount", nil)
+	require.NoError(t, err)
+	assert.Equal(t, "7", counter.Value)
+
+	mismatches, err := VerifyMetrics(ctx, src, dst)
+	require.NoError(t, err)
+	require.Len(t, mismatches, 1)
+	assert.Equal(t, entities.MismatchExtra, mismatches[0].Reason)
+	assert.Equal(t, "Stale", mismatches[0].Metric.ID)
+
+	// Repeated copy changes nothing except deleting extra metric
+	report, err = CopyMetrics(ctx, src, dst, true)
+	require.NoError(t, err)
+	assert.Equal(t, entities.CopyReport{Unchanged: 4, Deleted: 1}, report)
+
+	mismatches, err = VerifyMetrics(ctx, src, dst)
+	require.NoError(t, err)
+	assert.Empty(t, mismatches)
+
+	// And the way back
+	report, err = CopyMetrics(ctx, dst, src, true)
+	require.NoError(t, err)
+	assert.Equal(t, entities.CopyReport{Unchanged: 4}, report)
+}
+
+func TestVerifyMetrics(t *testing.T) {
+	a := newCopyStorage(t, map[string][]entities.MetricInternal{
+		"team-a": {
+			{ID: "Alloc", MType: entities.Gauge, Value: "1"},
+			{ID: "PollCount", MType: entities.Counter, Value: "1"},
+		},
+	})
+	b := newCopyStorage(t, map[string][]entities.MetricInternal{
+		"team-a": {{ID: "Alloc", MType: entities.Gauge, Value: "2"}},
+		"team-b": {{ID: "Alloc", MType: entities.Gauge, Value: "1"}},
+	})
+
+	mismatches, err := VerifyMetrics(context.Background(), a, b)
+	require.NoError(t, err)
+
+	reasons := make(map[string]string, len(mismatches))
+	for _, m := range mismatches {
+		reasons[m.Tenant+"/"+m.Metric.ID] = m.Reason
+	}
+	assert.Equal(t, map[string]string{
+		"team-a/Alloc":     entities.MismatchDifferent,
+		"team-a/PollCount": entities.MismatchMissing,
+		"team-b/Alloc":     entities.MismatchExtra,
+	}, reasons)
+}
+
+func TestCopyMetrics_Metadata(t *testing.T) {
+	ctx := context.Background()
+	src := newCopyStorage(t, nil)
+	dst := newCopyStorage(t, nil)
+	require.NoError(t, src.SetMetadata(ctx, entities.MetricMetadata{Name: "Alloc", Type: entities.Gauge, Unit: "bytes"}))
+	require.NoError(t, src.ClaimMetricTypes(ctx, map[string]string{"PollCount": entities.Counter}))
+	require.NoError(t, dst.ClaimMetricTypes(ctx, map[string]string{"Alloc": entities.Counter, "Stale": entities.Gauge}))
+
+	// Owner of source wins, extra names are released
+	report, err := CopyMetrics(ctx, src, dst, true)
+	require.NoError(t, err)
+	assert.Equal(t, entities.CopyReport{Metadata: 2}, report)
+
+	metadata, err := dst.GetAllMetadata(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []entities.MetricMetadata{
+		{Name: "Alloc", Type: entities.Gauge, Unit: "bytes"},
+		{Name: "PollCount", Type: entities.Counter},
+	}, metadata)
+
+	report, err = CopyMetrics(ctx, src, dst, true)
+	require.NoError(t, err)
+	assert.Zero(t, report)
+}
+
+// vanishingStorage is memory storage, which metrics are deleted concurrently right before deletion is requested
+type vanishingStorage struct {
+	*memstorage.MemStorage
+}
+
+func (v vanishingStorage) DeleteMetric(ctx context.Context, mType, mName string, labels map[string]string) error {
+	_ = v.MemStorage.DeleteMetric(ctx, mType, mName, labels)
+	return v.MemStorage.DeleteMetric(ctx, mType, mName, labels)
+}
+
+func TestCopyMetrics_DeletedConcurrently(t *testing.T) {
+	ctx := context.Background()
+	src := newCopyStorage(t, nil)
+	dst := vanishingStorage{MemStorage: newCopyStorage(t, map[string][]entities.MetricInternal{
+		entities.DefaultTenant: {{ID: "Stale", MType: entities.Gauge, Value: "1"}},
+	})}
+
+	// Metric deleted by someone else isn't counted
+	report, err := CopyMetrics(ctx, src, dst, true)
+	require.NoError(t, err)
+	assert.Zero(t, report)
+}
@@ -3,20 +3,66 @@ package services
 
 import (
 	"context"
+	"sync"
+	"time"
 
 	"github.com/melkomukovki/go-musthave-metrics/internal/entities"
 )
 
 // ServiceRepository - interface, describe storage methods
 type ServiceRepository interface {
+	// AddMetric stores metric, replacing its previous value
 	AddMetric(ctx context.Context, metric entities.MetricInternal) (err error)
+	// AddMultipleMetrics stores gauges, atomically increments counters by their values
+	// and merges histograms and summaries in one operation
 	AddMultipleMetrics(ctx context.Context, metrics []entities.MetricInternal) (err error)
-	GetMetric(ctx context.Context, metricType, metricName string) (metric entities.MetricInternal, err error)
-	GetAllMetrics(ctx context.Context) (metrics []entities.MetricInternal, err error)
+	// UpdateGauge atomically stores gauge if it satisfies condition, returns version of stored value.
+	// entities.ErrConditionFailed is returned if condition doesn't hold
+	UpdateGauge(ctx context.Context, metric entities.MetricInternal, cond entities.GaugeCondition) (version int64, err error)
+	// MergeMetric atomically merges histogram or summary into stored value, creating it if not exists
+	MergeMetric(ctx context.Context, metric entities.MetricInternal) (err error)
+	// IncrementCounter atomically adds delta to the counter, creating it if not exists
+	IncrementCounter(ctx context.Context, metricName string, labels map[string]string, delta int64) (err error)
+	// GetMetric returns current value of metric, gauge is returned with its version
+	GetMetric(ctx context.Context, metricType, metricName string, labels map[string]string) (metric entities.MetricInternal, err error)
+	// GetAllMetrics returns metrics, which labels satisfy all matchers
+	GetAllMetrics(ctx context.Context, matchers []entities.LabelMatcher) (metrics []entities.MetricInternal, err error)
+	// DeleteMetric removes metric and its history, returns entities.ErrMetricNotFound if metric doesn't exist
+	DeleteMetric(ctx context.Context, metricType, metricName string, labels map[string]string) (err error)
+	// ResetCounter sets existing counter to zero, returns entities.ErrMetricNotFound if counter doesn't exist
+	ResetCounter(ctx context.Context, metricName string, labels map[string]string) (err error)
+	GetMetricHistory(ctx context.Context, metricType, metricName string, labels map[string]string, from, to time.Time) (points []entities.MetricPointInternal, err error)
+	// MergeRollups merges gauge rollups into stored buckets of the same series, resolution and start
+	MergeRollups(ctx context.Context, rollups []entities.RollupInternal) (err error)
+	// GetRollups returns gauge rollups of resolution step, which buckets start between from and to, ordered by start
+	GetRollups(ctx context.Context, metricName string, labels map[string]string, step time.Duration, from, to time.Time) (rollups []entities.RollupInternal, err error)
+	// Prune applies retention rules to metrics of all tenants: deletes series not updated for rule TTL
+	// and history values older than rule history period
+	Prune(ctx context.Context, rules []entities.RetentionRule, now time.Time) (report entities.PruneReport, err error)
+	// ClaimMetricTypes stores types as owners of names without metadata. If any name is owned by another type,
+	// entities.ErrMetricTypeConflict is returned and no names are claimed
+	ClaimMetricTypes(ctx context.Context, types map[string]string) (err error)
+	// SetMetadata stores metadata of metric name, returns entities.ErrMetricTypeConflict if name is owned by another type
+	SetMetadata(ctx context.Context, meta entities.MetricMetadata) (err error)
+	// GetMetadata returns metadata of metric name, entities.ErrMetadataNotFound if name has none
+	GetMetadata(ctx context.Context, name string) (meta entities.MetricMetadata, err error)
+	// GetAllMetadata returns metadata of all names ordered by name
+	GetAllMetadata(ctx context.Context) (metadata []entities.MetricMetadata, err error)
+	// DeleteMetadata removes metadata of metric name, stored values are kept.
+	// Returns entities.ErrMetadataNotFound if name has no metadata
+	DeleteMetadata(ctx context.Context, name string) (err error)
 	Ping(ctx context.Context) (err error)
 }
 
+// JournalReporter is implemented by storages, which journal writes while database is unavailable
+type JournalReporter interface {
+	JournalStats() entities.JournalStats
+}
+
 // Service - describe service structure
 type Service struct {
 	ServiceRepo ServiceRepository
+	Now         func() time.Time // Clock used to put gauges into rollup buckets, time.Now if nil
+
+	claims sync.Map // Recent claims of names by tenant and name, see claimTypes
 }
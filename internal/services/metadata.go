@@ -0,0 +1,80 @@
+package services
+
+import (
+	"context"
+	"time"
+
+	"github.com/melkomukovki/go-musthave-metrics/internal/entities"
+)
+
+// claimTTL - how long successful claim is trusted without asking storage.
+// Metadata deleted by another server sharing storage is noticed not later
+const claimTTL = time.Minute
+
+// claim is successful claim of metric name
+type claim struct {
+	mType   string
+	expires time.Time
+}
+
+// claimKey identifies metric name of tenant
+func claimKey(tenant, name string) string {
+	return tenant + "\x00" + name
+}
+
+// claimType makes mType owner of metric name if name has no metadata yet.
+// Returns entities.ErrMetricTypeConflict if name is owned by another type
+func (s *Service) claimType(ctx context.Context, name, mType string) error {
+	return s.claimTypes(ctx, map[string]string{name: mType})
+}
+
+// claimTypes makes types owners of metric names without metadata. Every write claims its names,
+// so names claimed recently by the same types aren't claimed in storage again
+func (s *Service) claimTypes(ctx context.Context, types map[string]string) error {
+	tenant, now := entities.TenantFromContext(ctx), s.now()
+	missing := make(map[string]string, len(types))
+	for name, mType := range types {
+		if c, ok := s.claims.Load(claimKey(tenant, name)); ok && c.(claim).mType == mType && now.Before(c.(claim).expires) {
+			continue
+		}
+		missing[name] = mType
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+
+	if err := s.ServiceRepo.ClaimMetricTypes(ctx, missing); err != nil {
+		return err
+	}
+	for name, mType := range missing {
+		s.claims.Store(claimKey(tenant, name), claim{mType: mType, expires: now.Add(claimTTL)})
+	}
+	return nil
+}
+
+// SetMetadata allow to set unit and help text of metric name. Owning type of name can't be changed,
+// metadata must be deleted first
+func (s *Service) SetMetadata(ctx context.Context, meta entities.MetricMetadata) (err error) {
+	if err = meta.Validate(); err != nil {
+		return err
+	}
+	return s.ServiceRepo.SetMetadata(ctx, meta)
+}
+
+// GetMetadata allow to get metadata of metric name
+func (s *Service) GetMetadata(ctx context.Context, name string) (meta entities.MetricMetadata, err error) {
+	return s.ServiceRepo.GetMetadata(ctx, name)
+}
+
+// GetAllMetadata allow to get metadata of all metric names ordered by name
+func (s *Service) GetAllMetadata(ctx context.Context) (metadata []entities.MetricMetadata, err error) {
+	return s.ServiceRepo.GetAllMetadata(ctx)
+}
+
+// DeleteMetadata allow to remove metadata of metric name, so the name may be stored with another type.
+// Stored values of the name are kept
+func (s *Service) DeleteMetadata(ctx context.Context, name string) (err error) {
+	err = s.ServiceRepo.DeleteMetadata(ctx, name)
+	s.claims.Delete(claimKey(entities.TenantFromContext(ctx), name))
+	return err
+}
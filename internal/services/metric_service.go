@@ -5,46 +5,160 @@ import (
 	"errors"
 	"fmt"
 	"strconv"
+	"time"
 
 	"github.com/melkomukovki/go-musthave-metrics/internal/entities"
 )
 
 // AddMetric allow to add metric
 func (s *Service) AddMetric(ctx context.Context, metric entities.Metric) (err error) {
-	var mName string
-	var mType string
-	var mValue string
+	if err = entities.ValidateLabels(metric.Labels); err != nil {
+		return err
+	}
+	if err = entities.CheckNameLength(metric.ID); err != nil {
+		return err
+	}
 
-	mName = metric.ID
 	switch metric.MType {
 	case entities.Counter:
 		if metric.Delta == nil {
 			return entities.ErrMissingField
 		}
-		mType = entities.Counter
-		pMetric, err := s.GetMetric(ctx, entities.Counter, mName)
-		if errors.Is(err, entities.ErrMetricNotFound) {
-			mValue = strconv.Itoa(int(*metric.Delta))
-		} else {
-			mValue = strconv.Itoa(int(*metric.Delta + *pMetric.Delta))
+		if err = s.claimType(ctx, metric.ID, metric.MType); err != nil {
+			return err
 		}
+		return s.ServiceRepo.IncrementCounter(ctx, metric.ID, metric.Labels, *metric.Delta)
 	case entities.Gauge:
 		if metric.Value == nil {
 			return entities.ErrMissingField
 		}
+		if err = s.claimType(ctx, metric.ID, metric.MType); err != nil {
+			return err
+		}
 
-		mType = entities.Gauge
-		mValue = fmt.Sprintf("%g", *metric.Value)
+		mSQL := entities.MetricInternal{
+			ID:     metric.ID,
+			MType:  entities.Gauge,
+			Value:  fmt.Sprintf("%g", *metric.Value),
+			Labels: metric.Labels,
+		}
+		if err = s.ServiceRepo.AddMetric(ctx, mSQL); err != nil {
+			return err
+		}
+		return s.ServiceRepo.MergeRollups(ctx, gaugeRollups(metric.ID, metric.Labels, s.now(), *metric.Value))
+	case entities.Histogram, entities.Summary:
+		mSQL, err := distributionInternal(metric)
+		if err != nil {
+			return err
+		}
+		if err = s.claimType(ctx, metric.ID, metric.MType); err != nil {
+			return err
+		}
+		return s.ServiceRepo.MergeMetric(ctx, mSQL)
 	default:
 		return entities.ErrMetricNotSupportedType
 	}
+}
+
+// UpdateGauge stores gauge if it satisfies condition, returns version of stored value
+func (s *Service) UpdateGauge(ctx context.Context, metric entities.Metric, cond entities.GaugeCondition) (version int64, err error) {
+	if err = entities.ValidateLabels(metric.Labels); err != nil {
+		return 0, err
+	}
+	if err = entities.CheckNameLength(metric.ID); err != nil {
+		return 0, err
+	}
+	if metric.MType != entities.Gauge {
+		return 0, entities.ErrMetricNotSupportedType
+	}
+	if metric.Value == nil {
+		return 0, entities.ErrMissingField
+	}
+	if err = s.claimType(ctx, metric.ID, metric.MType); err != nil {
+		return 0, err
+	}
 
 	mSQL := entities.MetricInternal{
-		ID:    mName,
-		MType: mType,
-		Value: mValue,
+		ID:     metric.ID,
+		MType:  entities.Gauge,
+		Value:  fmt.Sprintf("%g", *metric.Value),
+		Labels: metric.Labels,
+	}
+	if version, err = s.ServiceRepo.UpdateGauge(ctx, mSQL, cond); err != nil {
+		return 0, err
+	}
+	return version, s.ServiceRepo.MergeRollups(ctx, gaugeRollups(metric.ID, metric.Labels, s.now(), *metric.Value))
+}
+
+// now returns current time of service clock
+func (s *Service) now() time.Time {
+	if s.Now != nil {
+		return s.Now()
+	}
+	return time.Now()
+}
+
+// gaugeRollups returns rollups of single gauge value for every resolution
+func gaugeRollups(id string, labels map[string]string, ts time.Time, value float64) []entities.RollupInternal {
+	rollups := make([]entities.RollupInternal, 0, len(entities.RollupResolutions))
+	for _, r := range entities.RollupResolutions {
+		rollups = append(rollups, entities.NewRollup(id, labels, r.Step, ts, value))
+	}
+	return rollups
+}
+
+// distributionInternal validates histogram or summary and converts it to internal model
+func distributionInternal(metric entities.Metric) (entities.MetricInternal, error) {
+	var d entities.Distribution
+	switch {
+	case metric.MType == entities.Histogram && metric.Histogram != nil:
+		d = metric.Histogram
+	case metric.MType == entities.Summary && metric.Summary != nil:
+		d = metric.Summary
+	default:
+		return entities.MetricInternal{}, entities.ErrMissingField
 	}
-	return s.ServiceRepo.AddMetric(ctx, mSQL)
+
+	if err := d.Validate(); err != nil {
+		return entities.MetricInternal{}, err
+	}
+	value, err := entities.FormatDistribution(d)
+	if err != nil {
+		return entities.MetricInternal{}, err
+	}
+	return entities.MetricInternal{ID: metric.ID, MType: metric.MType, Value: value, Labels: metric.Labels}, nil
+}
+
+// toMetric converts internal model of metric to external one
+func toMetric(m entities.MetricInternal) (entities.Metric, error) {
+	metric := entities.Metric{ID: m.ID, MType: m.MType, Labels: m.Labels, Version: m.Version}
+	switch m.MType {
+	case entities.Counter:
+		val, err := strconv.ParseInt(m.Value, 10, 64)
+		if err != nil {
+			return entities.Metric{}, err
+		}
+		metric.Delta = &val
+	case entities.Gauge:
+		val, err := strconv.ParseFloat(m.Value, 64)
+		if err != nil {
+			return entities.Metric{}, err
+		}
+		metric.Value = &val
+	case entities.Histogram, entities.Summary:
+		d, err := entities.ParseDistribution(m.MType, m.Value)
+		if err != nil {
+			return entities.Metric{}, err
+		}
+		if h, ok := d.(*entities.HistogramValue); ok {
+			metric.Histogram = h
+		} else {
+			metric.Summary = d.(*entities.SummaryValue)
+		}
+	default:
+		return entities.Metric{}, entities.ErrMetricNotSupportedType
+	}
+	return metric, nil
 }
 
 // Ping - function to check storage availability
@@ -52,97 +166,262 @@ func (s *Service) Ping(ctx context.Context) (err error) {
 	return s.ServiceRepo.Ping(ctx)
 }
 
-// GetAllMetrics allow to get all metrics
-func (s *Service) GetAllMetrics(ctx context.Context) (metrics []entities.Metric, err error) {
-	mSQL, err := s.ServiceRepo.GetAllMetrics(ctx)
+// JournalStats returns state of storage journal, false if storage works without journal
+func (s *Service) JournalStats() (entities.JournalStats, bool) {
+	reporter, ok := s.ServiceRepo.(JournalReporter)
+	if !ok {
+		return entities.JournalStats{}, false
+	}
+	return reporter.JournalStats(), true
+}
+
+// GetAllMetrics allow to get all metrics, which labels satisfy matchers
+func (s *Service) GetAllMetrics(ctx context.Context, matchers []entities.LabelMatcher) (metrics []entities.Metric, err error) {
+	mSQL, err := s.ServiceRepo.GetAllMetrics(ctx, matchers)
 	if err != nil {
 		return nil, err
 	}
 
 	for _, m := range mSQL {
-		switch m.MType {
-		case entities.Counter:
-			val, err := strconv.ParseInt(m.Value, 10, 64)
-			if err != nil {
-				return nil, err
-			}
-			metrics = append(metrics, entities.Metric{ID: m.ID, MType: m.MType, Delta: &val})
-		case entities.Gauge:
-			val, err := strconv.ParseFloat(m.Value, 64)
-			if err != nil {
-				return nil, err
-			}
-			metrics = append(metrics, entities.Metric{ID: m.ID, MType: m.MType, Value: &val})
+		metric, err := toMetric(m)
+		if err != nil {
+			return nil, err
 		}
+		metrics = append(metrics, metric)
 	}
 
 	return metrics, nil
 }
 
 // GetMetric allow to get metric
-func (s *Service) GetMetric(ctx context.Context, mType, mName string) (metric entities.Metric, err error) {
-	m, err := s.ServiceRepo.GetMetric(ctx, mType, mName)
+func (s *Service) GetMetric(ctx context.Context, mType, mName string, labels map[string]string) (metric entities.Metric, err error) {
+	m, err := s.ServiceRepo.GetMetric(ctx, mType, mName, labels)
 	if err != nil {
 		return entities.Metric{}, err
 	}
+	return toMetric(m)
+}
 
-	switch m.MType {
-	case entities.Gauge:
-		val, err := strconv.ParseFloat(m.Value, 64)
-		if err != nil {
-			return entities.Metric{}, err
-		}
-		metric.ID = m.ID
-		metric.MType = m.MType
-		metric.Value = &val
-	case entities.Counter:
-		val, err := strconv.ParseInt(m.Value, 10, 64)
-		if err != nil {
-			return entities.Metric{}, err
-		}
-		metric.ID = m.ID
-		metric.MType = m.MType
-		metric.Delta = &val
+// DeleteMetric allow to remove metric
+func (s *Service) DeleteMetric(ctx context.Context, mType, mName string, labels map[string]string) (err error) {
+	if !entities.IsKnownType(mType) {
+		return entities.ErrMetricNotSupportedType
 	}
-	return metric, nil
+	return s.ServiceRepo.DeleteMetric(ctx, mType, mName, labels)
+}
+
+// ResetCounter allow to set counter to zero
+func (s *Service) ResetCounter(ctx context.Context, mName string, labels map[string]string) (err error) {
+	return s.ServiceRepo.ResetCounter(ctx, mName, labels)
 }
 
 // AddMultipleMetrics allow to add multiple metrics
 func (s *Service) AddMultipleMetrics(ctx context.Context, metrics []entities.Metric) (err error) {
 	var mSQL []entities.MetricInternal
+	var counterKeys []string
+	counters := make(map[string]entities.Metric)
 	counterMetrics := make(map[string]int64)
+	var distKeys []string
+	distMetrics := make(map[string]entities.MetricInternal)
+	dists := make(map[string]entities.Distribution)
+	var rollups []entities.RollupInternal
+	rollupIdx := make(map[string]int)
+	types := make(map[string]string)
+	now := s.now()
 
 	for _, m := range metrics {
+		if err = entities.ValidateLabels(m.Labels); err != nil {
+			return err
+		}
+		if err = entities.CheckNameLength(m.ID); err != nil {
+			return err
+		}
+		if owner, ok := types[m.ID]; ok && owner != m.MType {
+			return entities.TypeConflict(m.ID, owner, m.MType)
+		}
+		types[m.ID] = m.MType
+
 		switch m.MType {
 		case entities.Gauge:
 			if m.Value == nil {
 				return entities.ErrMissingField
 			}
-			mSQL = append(mSQL, entities.MetricInternal{ID: m.ID, MType: m.MType, Value: fmt.Sprintf("%g", *m.Value)})
+			mSQL = append(mSQL, entities.MetricInternal{ID: m.ID, MType: m.MType, Value: fmt.Sprintf("%g", *m.Value), Labels: m.Labels})
+			// All gauges of batch fall into the same buckets, values of the same series are aggregated
+			for _, r := range gaugeRollups(m.ID, m.Labels, now, *m.Value) {
+				key := r.Step.String() + ":" + entities.SeriesKey(m.ID, m.Labels)
+				if i, ok := rollupIdx[key]; ok {
+					rollups[i].Merge(r)
+					continue
+				}
+				rollupIdx[key] = len(rollups)
+				rollups = append(rollups, r)
+			}
 		case entities.Counter:
 			if m.Delta == nil {
 				return entities.ErrMissingField
 			}
-			counterMetrics[m.ID] += *m.Delta
+			key := entities.SeriesKey(m.ID, m.Labels)
+			if _, ok := counterMetrics[key]; !ok {
+				counterKeys = append(counterKeys, key)
+				counters[key] = m
+			}
+			counterMetrics[key] += *m.Delta
+		case entities.Histogram, entities.Summary:
+			mi, err := distributionInternal(m)
+			if err != nil {
+				return err
+			}
+			// Distribution is decoded again, so merging doesn't change caller's value
+			d, err := entities.ParseDistribution(mi.MType, mi.Value)
+			if err != nil {
+				return err
+			}
+			key := m.MType + ":" + entities.SeriesKey(m.ID, m.Labels)
+			if prev, ok := dists[key]; ok {
+				if err = prev.Merge(d); err != nil {
+					return err
+				}
+				continue
+			}
+			distKeys = append(distKeys, key)
+			distMetrics[key] = mi
+			dists[key] = d
 		default:
 			return entities.ErrMetricNotSupportedType
 		}
+	}
 
-		for metricID, aggregatedValue := range counterMetrics {
-			pMetric, err := s.GetMetric(ctx, entities.Counter, metricID)
-			if err != nil && !errors.Is(err, entities.ErrMetricNotFound) {
-				return err
+	// Counters are passed as deltas, repository increments them atomically
+	for _, key := range counterKeys {
+		mSQL = append(
+			mSQL,
+			entities.MetricInternal{ID: counters[key].ID, MType: entities.Counter, Value: strconv.FormatInt(counterMetrics[key], 10), Labels: counters[key].Labels},
+		)
+	}
+	// Histograms and summaries of the same series are merged, repository merges them with stored values
+	for _, key := range distKeys {
+		mi := distMetrics[key]
+		if mi.Value, err = entities.FormatDistribution(dists[key]); err != nil {
+			return err
+		}
+		mSQL = append(mSQL, mi)
+	}
+	if len(types) > 0 {
+		if err = s.claimTypes(ctx, types); err != nil {
+			return err
+		}
+	}
+	if err = s.ServiceRepo.AddMultipleMetrics(ctx, mSQL); err != nil {
+		return err
+	}
+	if len(rollups) == 0 {
+		return nil
+	}
+	return s.ServiceRepo.MergeRollups(ctx, rollups)
+}
+
+// AddMetricsPartially stores metrics in one batch. Name owned by another type or too long name rejects the whole
+// batch, so then metrics are written one by one: metrics, which can't be written, are returned with their errors
+// by index, and the first error not caused by metric itself is returned as err. If err is returned with no failed
+// metrics, nothing is written
+func (s *Service) AddMetricsPartially(ctx context.Context, metrics []entities.Metric) (failed map[int]error, err error) {
+	if len(metrics) == 0 {
+		return nil, nil
+	}
+	err = s.AddMultipleMetrics(ctx, metrics)
+	if !rejectsMetric(err) {
+		return nil, err
+	}
+
+	err = nil
+	failed = make(map[int]error)
+	for i, m := range metrics {
+		mErr := s.AddMetric(ctx, m)
+		if mErr == nil {
+			continue
+		}
+		failed[i] = mErr
+		if err == nil && !rejectsMetric(mErr) {
+			err = mErr
+		}
+	}
+	return failed, err
+}
+
+// rejectsMetric reports whether write failed because of metric itself, so other metrics can be written
+func rejectsMetric(err error) bool {
+	return errors.Is(err, entities.ErrMetricTypeConflict) || errors.Is(err, entities.ErrNameTooLong)
+}
+
+// GetMetricHistory allow to get metric values stored between from and to.
+// If step is positive, values are downsampled: only the last value of every step-wide bucket is returned
+func (s *Service) GetMetricHistory(ctx context.Context, mType, mName string, labels map[string]string, from, to time.Time, step time.Duration) (history entities.MetricHistory, err error) {
+	if mType != entities.Gauge && mType != entities.Counter {
+		return entities.MetricHistory{}, entities.ErrMetricNotSupportedType
+	}
+	if to.Before(from) || step < 0 {
+		return entities.MetricHistory{}, entities.ErrInvalidTimeRange
+	}
+
+	pSQL, err := s.ServiceRepo.GetMetricHistory(ctx, mType, mName, labels, from, to)
+	if err != nil {
+		return entities.MetricHistory{}, err
+	}
+
+	history = entities.MetricHistory{ID: mName, MType: mType, Labels: labels, Points: make([]entities.MetricPoint, 0, len(pSQL))}
+	for _, p := range pSQL {
+		point := entities.MetricPoint{Timestamp: p.Timestamp}
+		switch mType {
+		case entities.Counter:
+			val, err := strconv.ParseInt(p.Value, 10, 64)
+			if err != nil {
+				return entities.MetricHistory{}, err
+			}
+			point.Delta = &val
+		case entities.Gauge:
+			val, err := strconv.ParseFloat(p.Value, 64)
+			if err != nil {
+				return entities.MetricHistory{}, err
 			}
+			point.Value = &val
+		}
 
-			if !errors.Is(err, entities.ErrMetricNotFound) {
-				aggregatedValue += *pMetric.Delta
+		if step > 0 {
+			point.Timestamp = from.Add(p.Timestamp.Sub(from).Truncate(step))
+			if n := len(history.Points); n > 0 && history.Points[n-1].Timestamp.Equal(point.Timestamp) {
+				history.Points[n-1] = point
+				continue
 			}
+		}
+		history.Points = append(history.Points, point)
+	}
+
+	return history, nil
+}
+
+// GetGaugeRollups allow to get rollups of gauge with given resolution, which buckets start between from and to
+func (s *Service) GetGaugeRollups(ctx context.Context, mName string, labels map[string]string, resolution string, from, to time.Time) (rollups entities.MetricRollups, err error) {
+	res, err := entities.ParseResolution(resolution)
+	if err != nil {
+		return entities.MetricRollups{}, err
+	}
+	if to.Before(from) {
+		return entities.MetricRollups{}, entities.ErrInvalidTimeRange
+	}
+
+	rSQL, err := s.ServiceRepo.GetRollups(ctx, mName, labels, res.Step, from, to)
+	if err != nil {
+		return entities.MetricRollups{}, err
+	}
 
-			mSQL = append(
-				mSQL,
-				entities.MetricInternal{ID: metricID, MType: m.MType, Value: strconv.Itoa(int(aggregatedValue))},
-			)
+	rollups = entities.MetricRollups{ID: mName, Labels: labels, Resolution: res.Name, Points: make([]entities.Rollup, 0, len(rSQL))}
+	for _, r := range rSQL {
+		point := entities.Rollup{Timestamp: r.Bucket, Min: r.Min, Max: r.Max, Sum: r.Sum, Count: r.Count}
+		if r.Count > 0 {
+			point.Avg = r.Sum / float64(r.Count)
 		}
+		rollups.Points = append(rollups.Points, point)
 	}
-	return s.ServiceRepo.AddMultipleMetrics(ctx, mSQL)
+	return rollups, nil
 }
@@ -2,7 +2,9 @@ package services
 
 import (
 	"context"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/golang/mock/gomock"
 	"github.com/melkomukovki/go-musthave-metrics/internal/entities"
@@ -30,7 +32,9 @@ func TestService_AddMetric(t *testing.T) {
 				Value: func(v float64) *float64 { return &v }(123.456),
 			},
 			setupMock: func() {
+				mockRepo.EXPECT().ClaimMetricTypes(gomock.Any(), map[string]string{"gaugeMetric": entities.Gauge}).Return(nil)
 				mockRepo.EXPECT().AddMetric(gomock.Any(), gomock.Any()).Return(nil)
+				mockRepo.EXPECT().MergeRollups(gomock.Any(), gomock.Len(len(entities.RollupResolutions))).Return(nil)
 			},
 			expectedError: nil,
 		},
@@ -42,35 +46,45 @@ func TestService_AddMetric(t *testing.T) {
 				Delta: func(v int64) *int64 { return &v }(10),
 			},
 			setupMock: func() {
+				mockRepo.EXPECT().ClaimMetricTypes(gomock.Any(), map[string]string{"counterMetric": entities.Counter}).Return(nil)
 				mockRepo.EXPECT().
-					GetMetric(gomock.Any(), entities.Counter, "counterMetric").
-					Return(entities.MetricInternal{}, entities.ErrMetricNotFound)
-				mockRepo.EXPECT().
-					AddMetric(gomock.Any(), gomock.Any()).
+					IncrementCounter(gomock.Any(), "counterMetric", gomock.Nil(), int64(10)).
 					Return(nil)
 			},
 			expectedError: nil,
 		},
 		{
-			name: "Add Counter metric with aggregation",
+			name: "Name owned by another type",
 			input: entities.Metric{
 				ID:    "counterMetric",
-				MType: entities.Counter,
-				Delta: func(v int64) *int64 { return &v }(10),
+				MType: entities.Gauge,
+				Value: func(v float64) *float64 { return &v }(1),
 			},
 			setupMock: func() {
 				mockRepo.EXPECT().
-					GetMetric(gomock.Any(), entities.Counter, "counterMetric").
-					Return(entities.MetricInternal{
-						ID:    "counterMetric",
-						MType: entities.Counter,
-						Value: "20",
-					}, nil)
-				mockRepo.EXPECT().
-					AddMetric(gomock.Any(), gomock.Any()).
-					Return(nil)
+					ClaimMetricTypes(gomock.Any(), map[string]string{"counterMetric": entities.Gauge}).
+					Return(entities.TypeConflict("counterMetric", entities.Counter, entities.Gauge))
 			},
-			expectedError: nil,
+			expectedError: entities.ErrMetricTypeConflict,
+		},
+		{
+			name: "Name too long",
+			input: entities.Metric{
+				ID:    strings.Repeat("a", entities.MaxNameLength+1),
+				MType: entities.Gauge,
+				Value: func(v float64) *float64 { return &v }(1),
+			},
+			setupMock:     func() {},
+			expectedError: entities.ErrNameTooLong,
+		},
+		{
+			name: "Missing field for Counter",
+			input: entities.Metric{
+				ID:    "counterMetric",
+				MType: entities.Counter,
+			},
+			setupMock:     func() {},
+			expectedError: entities.ErrMissingField,
 		},
 		{
 			name: "Missing field for Gauge",
@@ -81,6 +95,44 @@ func TestService_AddMetric(t *testing.T) {
 			setupMock:     func() {},
 			expectedError: entities.ErrMissingField,
 		},
+		{
+			name: "Add Histogram metric",
+			input: entities.Metric{
+				ID:        "latency",
+				MType:     entities.Histogram,
+				Histogram: &entities.HistogramValue{Bounds: []float64{0.1, 1}, Counts: []uint64{1, 2, 0}, Sum: 1.05, Count: 3},
+			},
+			setupMock: func() {
+				mockRepo.EXPECT().ClaimMetricTypes(gomock.Any(), map[string]string{"latency": entities.Histogram}).Return(nil)
+				mockRepo.EXPECT().
+					MergeMetric(gomock.Any(), entities.MetricInternal{
+						ID:    "latency",
+						MType: entities.Histogram,
+						Value: `{"bounds":[0.1,1],"counts":[1,2,0],"sum":1.05,"count":3}`,
+					}).
+					Return(nil)
+			},
+			expectedError: nil,
+		},
+		{
+			name: "Inconsistent Histogram",
+			input: entities.Metric{
+				ID:        "latency",
+				MType:     entities.Histogram,
+				Histogram: &entities.HistogramValue{Bounds: []float64{0.1, 1}, Counts: []uint64{1, 2}, Count: 3},
+			},
+			setupMock:     func() {},
+			expectedError: entities.ErrInvalidDistribution,
+		},
+		{
+			name: "Missing field for Summary",
+			input: entities.Metric{
+				ID:    "latency",
+				MType: entities.Summary,
+			},
+			setupMock:     func() {},
+			expectedError: entities.ErrMissingField,
+		},
 		{
 			name: "Unsupported metric type",
 			input: entities.Metric{
@@ -124,7 +176,7 @@ func TestService_GetMetric(t *testing.T) {
 			mName: "gaugeMetric",
 			setupMock: func() {
 				mockRepo.EXPECT().
-					GetMetric(gomock.Any(), entities.Gauge, "gaugeMetric").
+					GetMetric(gomock.Any(), entities.Gauge, "gaugeMetric", gomock.Nil()).
 					Return(entities.MetricInternal{
 						ID:    "gaugeMetric",
 						MType: entities.Gauge,
@@ -144,7 +196,7 @@ func TestService_GetMetric(t *testing.T) {
 			mName: "counterMetric",
 			setupMock: func() {
 				mockRepo.EXPECT().
-					GetMetric(gomock.Any(), entities.Counter, "counterMetric").
+					GetMetric(gomock.Any(), entities.Counter, "counterMetric", gomock.Nil()).
 					Return(entities.MetricInternal{
 						ID:    "counterMetric",
 						MType: entities.Counter,
@@ -158,13 +210,39 @@ func TestService_GetMetric(t *testing.T) {
 			},
 			expectedError: nil,
 		},
+		{
+			name:  "Get Summary metric",
+			mType: entities.Summary,
+			mName: "latency",
+			setupMock: func() {
+				mockRepo.EXPECT().
+					GetMetric(gomock.Any(), entities.Summary, "latency", gomock.Nil()).
+					Return(entities.MetricInternal{
+						ID:    "latency",
+						MType: entities.Summary,
+						Value: `{"accuracy":0.01,"zero_count":1,"positive":[{"index":5,"count":2}],"sum":0.1,"count":3}`,
+					}, nil)
+			},
+			expectedMetric: entities.Metric{
+				ID:    "latency",
+				MType: entities.Summary,
+				Summary: &entities.SummaryValue{
+					Accuracy:  0.01,
+					ZeroCount: 1,
+					Positive:  []entities.SketchBin{{Index: 5, Count: 2}},
+					Sum:       0.1,
+					Count:     3,
+				},
+			},
+			expectedError: nil,
+		},
 		{
 			name:  "Metric not found",
 			mType: entities.Counter,
 			mName: "unknownMetric",
 			setupMock: func() {
 				mockRepo.EXPECT().
-					GetMetric(gomock.Any(), entities.Counter, "unknownMetric").
+					GetMetric(gomock.Any(), entities.Counter, "unknownMetric", gomock.Nil()).
 					Return(entities.MetricInternal{}, entities.ErrMetricNotFound)
 			},
 			expectedMetric: entities.Metric{},
@@ -176,7 +254,7 @@ func TestService_GetMetric(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 			tt.setupMock()
 
-			metric, err := s.GetMetric(context.Background(), tt.mType, tt.mName)
+			metric, err := s.GetMetric(context.Background(), tt.mType, tt.mName, nil)
 
 			assert.Equal(t, tt.expectedMetric, metric)
 			assert.ErrorIs(t, err, tt.expectedError)
@@ -202,10 +280,10 @@ func TestService_GetAllMetrics(t *testing.T) {
 	}
 
 	mockRepo.EXPECT().
-		GetAllMetrics(gomock.Any()).
+		GetAllMetrics(gomock.Any(), gomock.Nil()).
 		Return(mockMetrics, nil)
 
-	metrics, err := s.GetAllMetrics(context.Background())
+	metrics, err := s.GetAllMetrics(context.Background(), nil)
 
 	assert.Equal(t, expectedMetrics, metrics)
 	assert.NoError(t, err)
@@ -216,7 +294,7 @@ func TestService_AddMultipleMetrics(t *testing.T) {
 	defer ctrl.Finish()
 
 	mockRepo := NewMockServiceRepository(ctrl)
-	s := &Service{ServiceRepo: mockRepo}
+	s := &Service{ServiceRepo: mockRepo, Now: func() time.Time { return time.Date(2024, 5, 1, 10, 7, 30, 0, time.UTC) }}
 
 	tests := []struct {
 		name          string
@@ -229,17 +307,93 @@ func TestService_AddMultipleMetrics(t *testing.T) {
 			input: []entities.Metric{
 				{ID: "gaugeMetric", MType: entities.Gauge, Value: func(v float64) *float64 { return &v }(123.456)},
 				{ID: "counterMetric", MType: entities.Counter, Delta: func(v int64) *int64 { return &v }(10)},
+				{ID: "counterMetric", MType: entities.Counter, Delta: func(v int64) *int64 { return &v }(5)},
 			},
 			setupMock: func() {
 				mockRepo.EXPECT().
-					GetMetric(gomock.Any(), entities.Counter, "counterMetric").
-					Return(entities.MetricInternal{}, entities.ErrMetricNotFound)
+					ClaimMetricTypes(gomock.Any(), map[string]string{"gaugeMetric": entities.Gauge, "counterMetric": entities.Counter}).
+					Return(nil)
 				mockRepo.EXPECT().
-					AddMultipleMetrics(gomock.Any(), gomock.Any()).
+					AddMultipleMetrics(gomock.Any(), []entities.MetricInternal{
+						{ID: "gaugeMetric", MType: entities.Gauge, Value: "123.456"},
+						{ID: "counterMetric", MType: entities.Counter, Value: "15"},
+					}).
 					Return(nil)
+				mockRepo.EXPECT().MergeRollups(gomock.Any(), gomock.Len(len(entities.RollupResolutions))).Return(nil)
 			},
 			expectedError: nil,
 		},
+		{
+			name: "Gauges of the same series are rolled up together",
+			input: []entities.Metric{
+				{ID: "cpu", MType: entities.Gauge, Value: func(v float64) *float64 { return &v }(10)},
+				{ID: "cpu", MType: entities.Gauge, Value: func(v float64) *float64 { return &v }(90)},
+			},
+			setupMock: func() {
+				mockRepo.EXPECT().ClaimMetricTypes(gomock.Any(), map[string]string{"cpu": entities.Gauge}).Return(nil)
+				mockRepo.EXPECT().AddMultipleMetrics(gomock.Any(), gomock.Any()).Return(nil)
+				mockRepo.EXPECT().
+					MergeRollups(gomock.Any(), []entities.RollupInternal{
+						{ID: "cpu", Step: time.Minute, Bucket: time.Date(2024, 5, 1, 10, 7, 0, 0, time.UTC), Min: 10, Max: 90, Sum: 100, Count: 2},
+						{ID: "cpu", Step: 10 * time.Minute, Bucket: time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC), Min: 10, Max: 90, Sum: 100, Count: 2},
+						{ID: "cpu", Step: time.Hour, Bucket: time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC), Min: 10, Max: 90, Sum: 100, Count: 2},
+					}).
+					Return(nil)
+			},
+			expectedError: nil,
+		},
+		{
+			name: "Counters with different labels are separate series",
+			input: []entities.Metric{
+				{ID: "requests", MType: entities.Counter, Delta: func(v int64) *int64 { return &v }(1), Labels: map[string]string{"host": "a"}},
+				{ID: "requests", MType: entities.Counter, Delta: func(v int64) *int64 { return &v }(2), Labels: map[string]string{"host": "b"}},
+				{ID: "requests", MType: entities.Counter, Delta: func(v int64) *int64 { return &v }(3), Labels: map[string]string{"host": "a"}},
+			},
+			setupMock: func() {
+				mockRepo.EXPECT().ClaimMetricTypes(gomock.Any(), map[string]string{"requests": entities.Counter}).Return(nil)
+				mockRepo.EXPECT().
+					AddMultipleMetrics(gomock.Any(), []entities.MetricInternal{
+						{ID: "requests", MType: entities.Counter, Value: "4", Labels: map[string]string{"host": "a"}},
+						{ID: "requests", MType: entities.Counter, Value: "2", Labels: map[string]string{"host": "b"}},
+					}).
+					Return(nil)
+			},
+			expectedError: nil,
+		},
+		{
+			name: "Histograms of the same series are merged",
+			input: []entities.Metric{
+				{ID: "latency", MType: entities.Histogram, Histogram: &entities.HistogramValue{Bounds: []float64{1}, Counts: []uint64{1, 0}, Sum: 0.5, Count: 1}},
+				{ID: "latency", MType: entities.Histogram, Histogram: &entities.HistogramValue{Bounds: []float64{1}, Counts: []uint64{0, 2}, Sum: 5, Count: 2}},
+			},
+			setupMock: func() {
+				mockRepo.EXPECT().ClaimMetricTypes(gomock.Any(), map[string]string{"latency": entities.Histogram}).Return(nil)
+				mockRepo.EXPECT().
+					AddMultipleMetrics(gomock.Any(), []entities.MetricInternal{
+						{ID: "latency", MType: entities.Histogram, Value: `{"bounds":[1],"counts":[1,2],"sum":5.5,"count":3}`},
+					}).
+					Return(nil)
+			},
+			expectedError: nil,
+		},
+		{
+			name: "Histograms with different buckets",
+			input: []entities.Metric{
+				{ID: "latency", MType: entities.Histogram, Histogram: &entities.HistogramValue{Bounds: []float64{1}, Counts: []uint64{1, 0}, Count: 1}},
+				{ID: "latency", MType: entities.Histogram, Histogram: &entities.HistogramValue{Bounds: []float64{2}, Counts: []uint64{1, 0}, Count: 1}},
+			},
+			setupMock:     func() {},
+			expectedError: entities.ErrDistributionMismatch,
+		},
+		{
+			name: "Name with different types in one batch",
+			input: []entities.Metric{
+				{ID: "requests", MType: entities.Counter, Delta: func(v int64) *int64 { return &v }(1)},
+				{ID: "requests", MType: entities.Gauge, Value: func(v float64) *float64 { return &v }(1)},
+			},
+			setupMock:     func() {},
+			expectedError: entities.ErrMetricTypeConflict,
+		},
 		{
 			name: "Missing field in Gauge metric",
 			input: []entities.Metric{
@@ -248,6 +402,14 @@ func TestService_AddMultipleMetrics(t *testing.T) {
 			setupMock:     func() {},
 			expectedError: entities.ErrMissingField,
 		},
+		{
+			name: "Invalid label name",
+			input: []entities.Metric{
+				{ID: "gaugeMetric", MType: entities.Gauge, Value: func(v float64) *float64 { return &v }(1), Labels: map[string]string{"1host": "a"}},
+			},
+			setupMock:     func() {},
+			expectedError: entities.ErrInvalidLabel,
+		},
 	}
 
 	for _, tt := range tests {
@@ -276,3 +438,291 @@ func TestService_Ping(t *testing.T) {
 
 	assert.NoError(t, err)
 }
+
+func TestService_DeleteMetric(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockRepo := NewMockServiceRepository(ctrl)
+	s := &Service{ServiceRepo: mockRepo}
+
+	tests := []struct {
+		name          string
+		mType         string
+		mName         string
+		setupMock     func()
+		expectedError error
+	}{
+		{
+			name:  "Delete gauge",
+			mType: entities.Gauge,
+			mName: "CPUutilization3",
+			setupMock: func() {
+				mockRepo.EXPECT().DeleteMetric(gomock.Any(), entities.Gauge, "CPUutilization3", gomock.Nil()).Return(nil)
+			},
+			expectedError: nil,
+		},
+		{
+			name:  "Metric not found",
+			mType: entities.Counter,
+			mName: "missing",
+			setupMock: func() {
+				mockRepo.EXPECT().DeleteMetric(gomock.Any(), entities.Counter, "missing", gomock.Nil()).Return(entities.ErrMetricNotFound)
+			},
+			expectedError: entities.ErrMetricNotFound,
+		},
+		{
+			name:          "Unsupported metric type",
+			mType:         "nonType",
+			mName:         "metric",
+			setupMock:     func() {},
+			expectedError: entities.ErrMetricNotSupportedType,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.setupMock()
+			err := s.DeleteMetric(context.Background(), tt.mType, tt.mName, nil)
+			assert.ErrorIs(t, err, tt.expectedError)
+		})
+	}
+}
+
+func TestService_UpdateGauge(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockRepo := NewMockServiceRepository(ctrl)
+	s := &Service{ServiceRepo: mockRepo}
+
+	value := 1.5
+	expected := int64(10)
+	cond := entities.GaugeCondition{Version: &expected}
+
+	// The second update trusts the first claim
+	mockRepo.EXPECT().ClaimMetricTypes(gomock.Any(), map[string]string{"Alloc": entities.Gauge}).Return(nil)
+	mockRepo.EXPECT().
+		UpdateGauge(gomock.Any(), entities.MetricInternal{ID: "Alloc", MType: entities.Gauge, Value: "1.5"}, cond).
+		Return(int64(11), nil)
+	mockRepo.EXPECT().MergeRollups(gomock.Any(), gomock.Any()).Return(nil)
+
+	version, err := s.UpdateGauge(context.Background(), entities.Metric{ID: "Alloc", MType: entities.Gauge, Value: &value}, cond)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(11), version)
+
+	// Failed condition does not touch rollups
+	mockRepo.EXPECT().UpdateGauge(gomock.Any(), gomock.Any(), cond).Return(int64(0), entities.ErrConditionFailed)
+	_, err = s.UpdateGauge(context.Background(), entities.Metric{ID: "Alloc", MType: entities.Gauge, Value: &value}, cond)
+	assert.ErrorIs(t, err, entities.ErrConditionFailed)
+
+	delta := int64(1)
+	_, err = s.UpdateGauge(context.Background(), entities.Metric{ID: "PollCount", MType: entities.Counter, Delta: &delta}, cond)
+	assert.ErrorIs(t, err, entities.ErrMetricNotSupportedType)
+	_, err = s.UpdateGauge(context.Background(), entities.Metric{ID: "Alloc", MType: entities.Gauge}, cond)
+	assert.ErrorIs(t, err, entities.ErrMissingField)
+}
+
+func TestService_ClaimsAreCached(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockRepo := NewMockServiceRepository(ctrl)
+	now := time.Now()
+	s := &Service{ServiceRepo: mockRepo, Now: func() time.Time { return now }}
+	ctx := context.Background()
+	other := entities.ContextWithTenant(ctx, "other")
+
+	delta := int64(1)
+	counter := entities.Metric{ID: "PollCount", MType: entities.Counter, Delta: &delta}
+	mockRepo.EXPECT().IncrementCounter(gomock.Any(), "PollCount", gomock.Any(), delta).Return(nil).AnyTimes()
+	claim := func(times int) {
+		mockRepo.EXPECT().ClaimMetricTypes(gomock.Any(), map[string]string{"PollCount": entities.Counter}).Return(nil).Times(times)
+	}
+
+	// Name is claimed once for every tenant
+	claim(2)
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, s.AddMetric(ctx, counter))
+		assert.NoError(t, s.AddMetric(other, counter))
+	}
+
+	// Claim expires and is dropped with metadata
+	claim(1)
+	now = now.Add(claimTTL)
+	assert.NoError(t, s.AddMetric(ctx, counter))
+	assert.NoError(t, s.AddMetric(ctx, counter))
+
+	mockRepo.EXPECT().DeleteMetadata(gomock.Any(), "PollCount").Return(nil)
+	assert.NoError(t, s.DeleteMetadata(ctx, "PollCount"))
+	claim(1)
+	assert.NoError(t, s.AddMetric(ctx, counter))
+
+	// Another type is always checked by storage
+	value := 1.5
+	mockRepo.EXPECT().ClaimMetricTypes(gomock.Any(), map[string]string{"PollCount": entities.Gauge}).Return(entities.ErrMetricTypeConflict)
+	err := s.AddMetric(ctx, entities.Metric{ID: "PollCount", MType: entities.Gauge, Value: &value})
+	assert.ErrorIs(t, err, entities.ErrMetricTypeConflict)
+}
+
+func TestService_AddMetricsPartially(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockRepo := NewMockServiceRepository(ctrl)
+	s := &Service{ServiceRepo: mockRepo}
+	ctx := context.Background()
+
+	value, delta := 1.5, int64(2)
+	metrics := []entities.Metric{
+		{ID: "Alloc", MType: entities.Gauge, Value: &value},
+		{ID: "PollCount", MType: entities.Counter, Delta: &delta},
+	}
+	conflict := entities.TypeConflict("PollCount", entities.Gauge, entities.Counter)
+
+	// Conflicting name rejects the batch, then other metrics are written one by one
+	mockRepo.EXPECT().ClaimMetricTypes(gomock.Any(), map[string]string{"Alloc": entities.Gauge, "PollCount": entities.Counter}).Return(conflict)
+	mockRepo.EXPECT().ClaimMetricTypes(gomock.Any(), map[string]string{"Alloc": entities.Gauge}).Return(nil)
+	mockRepo.EXPECT().AddMetric(gomock.Any(), gomock.Any()).Return(nil)
+	mockRepo.EXPECT().MergeRollups(gomock.Any(), gomock.Any()).Return(nil)
+	mockRepo.EXPECT().ClaimMetricTypes(gomock.Any(), map[string]string{"PollCount": entities.Counter}).Return(conflict)
+	failed, err := s.AddMetricsPartially(ctx, metrics)
+	assert.NoError(t, err)
+	assert.Equal(t, map[int]error{1: conflict}, failed)
+
+	// Too long name is rejected by service
+	long := entities.Metric{ID: strings.Repeat("a", entities.MaxNameLength+1), MType: entities.Gauge, Value: &value}
+	mockRepo.EXPECT().AddMetric(gomock.Any(), gomock.Any()).Return(nil)
+	mockRepo.EXPECT().MergeRollups(gomock.Any(), gomock.Any()).Return(nil)
+	failed, err = s.AddMetricsPartially(ctx, []entities.Metric{long, metrics[0]})
+	assert.NoError(t, err)
+	assert.Len(t, failed, 1)
+	assert.ErrorIs(t, failed[0], entities.ErrNameTooLong)
+
+	// Other errors reject the whole batch
+	mockRepo.EXPECT().ClaimMetricTypes(gomock.Any(), gomock.Any()).Return(entities.ErrStorageDegraded)
+	failed, err = s.AddMetricsPartially(ctx, metrics)
+	assert.ErrorIs(t, err, entities.ErrStorageDegraded)
+	assert.Empty(t, failed)
+}
+
+func TestService_ResetCounter(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockRepo := NewMockServiceRepository(ctrl)
+	s := &Service{ServiceRepo: mockRepo}
+
+	mockRepo.EXPECT().
+		ResetCounter(gomock.Any(), "PollCount", gomock.Nil()).
+		Return(nil)
+
+	err := s.ResetCounter(context.Background(), "PollCount", nil)
+
+	assert.NoError(t, err)
+}
+
+func TestService_GetMetricHistory(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockRepo := NewMockServiceRepository(ctrl)
+	s := &Service{ServiceRepo: mockRepo}
+
+	from := time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)
+	to := from.Add(time.Hour)
+
+	mockPoints := []entities.MetricPointInternal{
+		{Timestamp: from.Add(10 * time.Second), Value: "1.5"},
+		{Timestamp: from.Add(50 * time.Second), Value: "2.5"},
+		{Timestamp: from.Add(70 * time.Second), Value: "3.5"},
+	}
+
+	tests := []struct {
+		name           string
+		step           time.Duration
+		from           time.Time
+		to             time.Time
+		setupMock      func()
+		expectedPoints []entities.MetricPoint
+		expectedError  error
+	}{
+		{
+			name: "Raw history",
+			from: from,
+			to:   to,
+			setupMock: func() {
+				mockRepo.EXPECT().
+					GetMetricHistory(gomock.Any(), entities.Gauge, "gaugeMetric", gomock.Nil(), from, to).
+					Return(mockPoints, nil)
+			},
+			expectedPoints: []entities.MetricPoint{
+				{Timestamp: from.Add(10 * time.Second), Value: func(v float64) *float64 { return &v }(1.5)},
+				{Timestamp: from.Add(50 * time.Second), Value: func(v float64) *float64 { return &v }(2.5)},
+				{Timestamp: from.Add(70 * time.Second), Value: func(v float64) *float64 { return &v }(3.5)},
+			},
+		},
+		{
+			name: "Downsampled history",
+			step: time.Minute,
+			from: from,
+			to:   to,
+			setupMock: func() {
+				mockRepo.EXPECT().
+					GetMetricHistory(gomock.Any(), entities.Gauge, "gaugeMetric", gomock.Nil(), from, to).
+					Return(mockPoints, nil)
+			},
+			expectedPoints: []entities.MetricPoint{
+				{Timestamp: from, Value: func(v float64) *float64 { return &v }(2.5)},
+				{Timestamp: from.Add(time.Minute), Value: func(v float64) *float64 { return &v }(3.5)},
+			},
+		},
+		{
+			name:          "Invalid time range",
+			from:          to,
+			to:            from,
+			setupMock:     func() {},
+			expectedError: entities.ErrInvalidTimeRange,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.setupMock()
+
+			history, err := s.GetMetricHistory(context.Background(), entities.Gauge, "gaugeMetric", nil, tt.from, tt.to, tt.step)
+
+			assert.ErrorIs(t, err, tt.expectedError)
+			assert.Equal(t, tt.expectedPoints, history.Points)
+		})
+	}
+}
+
+func TestService_GetGaugeRollups(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockRepo := NewMockServiceRepository(ctrl)
+	s := &Service{ServiceRepo: mockRepo}
+
+	from := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	to := from.Add(time.Hour)
+	mockRepo.EXPECT().
+		GetRollups(gomock.Any(), "cpu", gomock.Nil(), 10*time.Minute, from, to).
+		Return([]entities.RollupInternal{
+			{ID: "cpu", Step: 10 * time.Minute, Bucket: from, Min: 1, Max: 3, Sum: 6, Count: 3},
+		}, nil)
+
+	rollups, err := s.GetGaugeRollups(context.Background(), "cpu", nil, "10m", from, to)
+	assert.NoError(t, err)
+	assert.Equal(t, entities.MetricRollups{
+		ID:         "cpu",
+		Resolution: "10m",
+		Points:     []entities.Rollup{{Timestamp: from, Min: 1, Max: 3, Avg: 2, Sum: 6, Count: 3}},
+	}, rollups)
+
+	_, err = s.GetGaugeRollups(context.Background(), "cpu", nil, "5m", from, to)
+	assert.ErrorIs(t, err, entities.ErrInvalidResolution)
+	_, err = s.GetGaugeRollups(context.Background(), "cpu", nil, "1m", to, from)
+	assert.ErrorIs(t, err, entities.ErrInvalidTimeRange)
+}
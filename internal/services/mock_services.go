@@ -1,5 +1,5 @@
 // Code generated by MockGen. DO NOT EDIT.
-// Source: internal/services/services.go
+// Source: internal/services/interfaces.go
 
 // Package services is a generated GoMock package.
 package services
@@ -7,9 +7,9 @@ package services
 import (
 	context "context"
 	reflect "reflect"
+	time "time"
 
 	gomock "github.com/golang/mock/gomock"
-
 	entities "github.com/melkomukovki/go-musthave-metrics/internal/entities"
 )
 
@@ -64,34 +64,178 @@ func (mr *MockServiceRepositoryMockRecorder) AddMultipleMetrics(ctx, metrics int
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AddMultipleMetrics", reflect.TypeOf((*MockServiceRepository)(nil).AddMultipleMetrics), ctx, metrics)
 }
 
+// ClaimMetricTypes mocks base method.
+func (m *MockServiceRepository) ClaimMetricTypes(ctx context.Context, types map[string]string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ClaimMetricTypes", ctx, types)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// ClaimMetricTypes indicates an expected call of ClaimMetricTypes.
+func (mr *MockServiceRepositoryMockRecorder) ClaimMetricTypes(ctx, types interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ClaimMetricTypes", reflect.TypeOf((*MockServiceRepository)(nil).ClaimMetricTypes), ctx, types)
+}
+
+// DeleteMetadata mocks base method.
+func (m *MockServiceRepository) DeleteMetadata(ctx context.Context, name string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "DeleteMetadata", ctx, name)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// DeleteMetadata indicates an expected call of DeleteMetadata.
+func (mr *MockServiceRepositoryMockRecorder) DeleteMetadata(ctx, name interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DeleteMetadata", reflect.TypeOf((*MockServiceRepository)(nil).DeleteMetadata), ctx, name)
+}
+
+// DeleteMetric mocks base method.
+func (m *MockServiceRepository) DeleteMetric(ctx context.Context, metricType, metricName string, labels map[string]string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "DeleteMetric", ctx, metricType, metricName, labels)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// DeleteMetric indicates an expected call of DeleteMetric.
+func (mr *MockServiceRepositoryMockRecorder) DeleteMetric(ctx, metricType, metricName, labels interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DeleteMetric", reflect.TypeOf((*MockServiceRepository)(nil).DeleteMetric), ctx, metricType, metricName, labels)
+}
+
+// GetAllMetadata mocks base method.
+func (m *MockServiceRepository) GetAllMetadata(ctx context.Context) ([]entities.MetricMetadata, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetAllMetadata", ctx)
+	ret0, _ := ret[0].([]entities.MetricMetadata)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetAllMetadata indicates an expected call of GetAllMetadata.
+func (mr *MockServiceRepositoryMockRecorder) GetAllMetadata(ctx interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetAllMetadata", reflect.TypeOf((*MockServiceRepository)(nil).GetAllMetadata), ctx)
+}
+
 // GetAllMetrics mocks base method.
-func (m *MockServiceRepository) GetAllMetrics(ctx context.Context) ([]entities.MetricInternal, error) {
+func (m *MockServiceRepository) GetAllMetrics(ctx context.Context, matchers []entities.LabelMatcher) ([]entities.MetricInternal, error) {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "GetAllMetrics", ctx)
+	ret := m.ctrl.Call(m, "GetAllMetrics", ctx, matchers)
 	ret0, _ := ret[0].([]entities.MetricInternal)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
 // GetAllMetrics indicates an expected call of GetAllMetrics.
-func (mr *MockServiceRepositoryMockRecorder) GetAllMetrics(ctx interface{}) *gomock.Call {
+func (mr *MockServiceRepositoryMockRecorder) GetAllMetrics(ctx, matchers interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetAllMetrics", reflect.TypeOf((*MockServiceRepository)(nil).GetAllMetrics), ctx)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetAllMetrics", reflect.TypeOf((*MockServiceRepository)(nil).GetAllMetrics), ctx, matchers)
+}
+
+// GetMetadata mocks base method.
+func (m *MockServiceRepository) GetMetadata(ctx context.Context, name string) (entities.MetricMetadata, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetMetadata", ctx, name)
+	ret0, _ := ret[0].(entities.MetricMetadata)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetMetadata indicates an expected call of GetMetadata.
+func (mr *MockServiceRepositoryMockRecorder) GetMetadata(ctx, name interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetMetadata", reflect.TypeOf((*MockServiceRepository)(nil).GetMetadata), ctx, name)
 }
 
 // GetMetric mocks base method.
-func (m *MockServiceRepository) GetMetric(ctx context.Context, metricType, metricName string) (entities.MetricInternal, error) {
+func (m *MockServiceRepository) GetMetric(ctx context.Context, metricType, metricName string, labels map[string]string) (entities.MetricInternal, error) {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "GetMetric", ctx, metricType, metricName)
+	ret := m.ctrl.Call(m, "GetMetric", ctx, metricType, metricName, labels)
 	ret0, _ := ret[0].(entities.MetricInternal)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
 // GetMetric indicates an expected call of GetMetric.
-func (mr *MockServiceRepositoryMockRecorder) GetMetric(ctx, metricType, metricName interface{}) *gomock.Call {
+func (mr *MockServiceRepositoryMockRecorder) GetMetric(ctx, metricType, metricName, labels interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetMetric", reflect.TypeOf((*MockServiceRepository)(nil).GetMetric), ctx, metricType, metricName, labels)
+}
+
+// GetMetricHistory mocks base method.
+func (m *MockServiceRepository) GetMetricHistory(ctx context.Context, metricType, metricName string, labels map[string]string, from, to time.Time) ([]entities.MetricPointInternal, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetMetricHistory", ctx, metricType, metricName, labels, from, to)
+	ret0, _ := ret[0].([]entities.MetricPointInternal)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetMetricHistory indicates an expected call of GetMetricHistory.
+func (mr *MockServiceRepositoryMockRecorder) GetMetricHistory(ctx, metricType, metricName, labels, from, to interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetMetricHistory", reflect.TypeOf((*MockServiceRepository)(nil).GetMetricHistory), ctx, metricType, metricName, labels, from, to)
+}
+
+// GetRollups mocks base method.
+func (m *MockServiceRepository) GetRollups(ctx context.Context, metricName string, labels map[string]string, step time.Duration, from, to time.Time) ([]entities.RollupInternal, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetRollups", ctx, metricName, labels, step, from, to)
+	ret0, _ := ret[0].([]entities.RollupInternal)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetRollups indicates an expected call of GetRollups.
+func (mr *MockServiceRepositoryMockRecorder) GetRollups(ctx, metricName, labels, step, from, to interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetRollups", reflect.TypeOf((*MockServiceRepository)(nil).GetRollups), ctx, metricName, labels, step, from, to)
+}
+
+// IncrementCounter mocks base method.
+func (m *MockServiceRepository) IncrementCounter(ctx context.Context, metricName string, labels map[string]string, delta int64) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "IncrementCounter", ctx, metricName, labels, delta)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// IncrementCounter indicates an expected call of IncrementCounter.
+func (mr *MockServiceRepositoryMockRecorder) IncrementCounter(ctx, metricName, labels, delta interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "IncrementCounter", reflect.TypeOf((*MockServiceRepository)(nil).IncrementCounter), ctx, metricName, labels, delta)
+}
+
+// MergeMetric mocks base method.
+func (m *MockServiceRepository) MergeMetric(ctx context.Context, metric entities.MetricInternal) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "MergeMetric", ctx, metric)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// MergeMetric indicates an expected call of MergeMetric.
+func (mr *MockServiceRepositoryMockRecorder) MergeMetric(ctx, metric interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetMetric", reflect.TypeOf((*MockServiceRepository)(nil).GetMetric), ctx, metricType, metricName)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "MergeMetric", reflect.TypeOf((*MockServiceRepository)(nil).MergeMetric), ctx, metric)
+}
+
+// MergeRollups mocks base method.
+func (m *MockServiceRepository) MergeRollups(ctx context.Context, rollups []entities.RollupInternal) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "MergeRollups", ctx, rollups)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// MergeRollups indicates an expected call of MergeRollups.
+func (mr *MockServiceRepositoryMockRecorder) MergeRollups(ctx, rollups interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "MergeRollups", reflect.TypeOf((*MockServiceRepository)(nil).MergeRollups), ctx, rollups)
 }
 
 // Ping mocks base method.
@@ -107,3 +251,98 @@ func (mr *MockServiceRepositoryMockRecorder) Ping(ctx interface{}) *gomock.Call
 	mr.mock.ctrl.T.Helper()
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Ping", reflect.TypeOf((*MockServiceRepository)(nil).Ping), ctx)
 }
+
+// Prune mocks base method.
+func (m *MockServiceRepository) Prune(ctx context.Context, rules []entities.RetentionRule, now time.Time) (entities.PruneReport, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Prune", ctx, rules, now)
+	ret0, _ := ret[0].(entities.PruneReport)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Prune indicates an expected call of Prune.
+func (mr *MockServiceRepositoryMockRecorder) Prune(ctx, rules, now interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Prune", reflect.TypeOf((*MockServiceRepository)(nil).Prune), ctx, rules, now)
+}
+
+// ResetCounter mocks base method.
+func (m *MockServiceRepository) ResetCounter(ctx context.Context, metricName string, labels map[string]string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ResetCounter", ctx, metricName, labels)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// ResetCounter indicates an expected call of ResetCounter.
+func (mr *MockServiceRepositoryMockRecorder) ResetCounter(ctx, metricName, labels interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ResetCounter", reflect.TypeOf((*MockServiceRepository)(nil).ResetCounter), ctx, metricName, labels)
+}
+
+// SetMetadata mocks base method.
+func (m *MockServiceRepository) SetMetadata(ctx context.Context, meta entities.MetricMetadata) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SetMetadata", ctx, meta)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// SetMetadata indicates an expected call of SetMetadata.
+func (mr *MockServiceRepositoryMockRecorder) SetMetadata(ctx, meta interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetMetadata", reflect.TypeOf((*MockServiceRepository)(nil).SetMetadata), ctx, meta)
+}
+
+// UpdateGauge mocks base method.
+func (m *MockServiceRepository) UpdateGauge(ctx context.Context, metric entities.MetricInternal, cond entities.GaugeCondition) (int64, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "UpdateGauge", ctx, metric, cond)
+	ret0, _ := ret[0].(int64)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// UpdateGauge indicates an expected call of UpdateGauge.
+func (mr *MockServiceRepositoryMockRecorder) UpdateGauge(ctx, metric, cond interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UpdateGauge", reflect.TypeOf((*MockServiceRepository)(nil).UpdateGauge), ctx, metric, cond)
+}
+
+// MockJournalReporter is a mock of JournalReporter interface.
+type MockJournalReporter struct {
+	ctrl     *gomock.Controller
+	recorder *MockJournalReporterMockRecorder
+}
+
+// MockJournalReporterMockRecorder is the mock recorder for MockJournalReporter.
+type MockJournalReporterMockRecorder struct {
+	mock *MockJournalReporter
+}
+
+// NewMockJournalReporter creates a new mock instance.
+func NewMockJournalReporter(ctrl *gomock.Controller) *MockJournalReporter {
+	mock := &MockJournalReporter{ctrl: ctrl}
+	mock.recorder = &MockJournalReporterMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockJournalReporter) EXPECT() *MockJournalReporterMockRecorder {
+	return m.recorder
+}
+
+// JournalStats mocks base method.
+func (m *MockJournalReporter) JournalStats() entities.JournalStats {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "JournalStats")
+	ret0, _ := ret[0].(entities.JournalStats)
+	return ret0
+}
+
+// JournalStats indicates an expected call of JournalStats.
+func (mr *MockJournalReporterMockRecorder) JournalStats() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "JournalStats", reflect.TypeOf((*MockJournalReporter)(nil).JournalStats))
+}
@@ -0,0 +1,49 @@
+package services
+
+import (
+	"context"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/melkomukovki/go-musthave-metrics/internal/entities"
+)
+
+// Prune applies retention rules to stored metrics once
+func (s *Service) Prune(ctx context.Context, rules []entities.RetentionRule) (report entities.PruneReport, err error) {
+	if len(rules) == 0 {
+		return entities.PruneReport{}, nil
+	}
+	return s.ServiceRepo.Prune(ctx, rules, s.now())
+}
+
+// RunRetention applies retention rules every interval until ctx is done. Result of every run is logged
+func (s *Service) RunRetention(ctx context.Context, rules []entities.RetentionRule, interval time.Duration) {
+	if len(rules) == 0 || interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			start := time.Now()
+			report, err := s.Prune(ctx, rules)
+			if err != nil {
+				if ctx.Err() == nil {
+					log.Error().Err(err).Msg("failed to apply retention rules")
+				}
+				continue
+			}
+			log.Info().
+				Int("series", report.Series).
+				Int("history_points", report.HistoryPoints).
+				Dur("duration", time.Since(start)).
+				Msg("retention rules applied")
+		}
+	}
+}
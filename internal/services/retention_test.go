@@ -0,0 +1,59 @@
+package services
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/melkomukovki/go-musthave-metrics/internal/entities"
+)
+
+func TestService_Prune(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	now := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	mockRepo := NewMockServiceRepository(ctrl)
+	s := &Service{ServiceRepo: mockRepo, Now: func() time.Time { return now }}
+
+	rules := []entities.RetentionRule{{MType: entities.Gauge, TTL: time.Hour}}
+	mockRepo.EXPECT().Prune(gomock.Any(), rules, now).Return(entities.PruneReport{Series: 3}, nil)
+
+	report, err := s.Prune(context.Background(), rules)
+	assert.NoError(t, err)
+	assert.Equal(t, entities.PruneReport{Series: 3}, report)
+
+	// Without rules repository is not called
+	report, err = s.Prune(context.Background(), nil)
+	assert.NoError(t, err)
+	assert.Zero(t, report)
+}
+
+func TestService_RunRetention(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockRepo := NewMockServiceRepository(ctrl)
+	s := &Service{ServiceRepo: mockRepo}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	rules := []entities.RetentionRule{{MType: entities.Gauge, TTL: time.Hour}}
+	mockRepo.EXPECT().Prune(gomock.Any(), rules, gomock.Any()).Return(entities.PruneReport{}, nil).MinTimes(1).Do(
+		func(context.Context, []entities.RetentionRule, time.Time) { cancel() },
+	)
+
+	done := make(chan struct{})
+	go func() {
+		s.RunRetention(ctx, rules, time.Millisecond)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("retention didn't stop after context was cancelled")
+	}
+}